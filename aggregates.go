@@ -0,0 +1,149 @@
+// Functions related to aggregating the measurement into buckets of time and
+// phases, so it can be plotted without replaying the stream of events.
+package main
+
+import (
+	"slices"
+	"time"
+)
+
+// aggregateInterval is the width of the buckets of Aggregates.PerMinute.
+const aggregateInterval = time.Minute
+
+// Aggregates are the totals of the measurement in each minute and in each
+// phase.
+type Aggregates struct {
+	PerMinute []Aggregate `json:"per_minute"`
+	PerPhase  []Aggregate `json:"per_phase"`
+}
+
+// Aggregate is what happened between Start and End. The latency
+// percentiles are of the successful replies, zero without any.
+type Aggregate struct {
+	// Phase the aggregate is of, empty for the buckets of time
+	Phase         PhaseName     `json:"phase,omitempty"`
+	Start         time.Time     `json:"start"`
+	End           time.Time     `json:"end"`
+	Established   int           `json:"established"`
+	Failed        int           `json:"failed"`
+	Replies       int           `json:"replies"`
+	BytesSent     uint64        `json:"bytes_sent"`
+	BytesReceived uint64        `json:"bytes_received"`
+	LatencyP50    time.Duration `json:"latency_p50"`
+	LatencyP90    time.Duration `json:"latency_p90"`
+	LatencyP99    time.Duration `json:"latency_p99"`
+}
+
+// bucket accumulates an Aggregate until it is closed. Only the latencies
+// of the open buckets are kept.
+type bucket struct {
+	Aggregate
+	// Bytes sent and received when the bucket opened
+	sent      uint64
+	received  uint64
+	latencies []time.Duration
+}
+
+// aggregator fills the bucket of the current minute and phase, closing
+// them as the measurement moves on.
+type aggregator struct {
+	traffic *traffic
+	minute  *bucket
+	phase   *bucket
+	minutes []Aggregate
+	phases  []Aggregate
+}
+
+func newAggregator(start time.Time, t *traffic) *aggregator {
+	a := &aggregator{traffic: t}
+	a.minute = a.open("", start)
+	return a
+}
+
+func (a *aggregator) open(phase PhaseName, at time.Time) *bucket {
+	return &bucket{
+		Aggregate: Aggregate{Phase: phase, Start: at},
+		sent:      a.traffic.sent.Load(),
+		received:  a.traffic.received.Load(),
+	}
+}
+
+func (a *aggregator) close(b *bucket, at time.Time) Aggregate {
+	b.End = at
+	b.BytesSent = a.traffic.sent.Load() - b.sent
+	b.BytesReceived = a.traffic.received.Load() - b.received
+	slices.Sort(b.latencies)
+	b.LatencyP50 = percentile(b.latencies, 50)
+	b.LatencyP90 = percentile(b.latencies, 90)
+	b.LatencyP99 = percentile(b.latencies, 99)
+	return b.Aggregate
+}
+
+// percentile is the p-th percentile of the sorted latencies by nearest
+// rank.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := (p*len(sorted) + 99) / 100
+	return sorted[max(rank, 1)-1]
+}
+
+// advance closes the buckets of the minutes ended before at, the bytes of
+// a minute being those counted by the time it was closed.
+func (a *aggregator) advance(at time.Time) {
+	if a == nil || a.minute == nil {
+		return
+	}
+	for end := a.minute.Start.Add(aggregateInterval); at.After(end); end = a.minute.Start.Add(aggregateInterval) {
+		a.minutes = append(a.minutes, a.close(a.minute, end))
+		a.minute = a.open("", end)
+	}
+}
+
+// startPhase closes the bucket of the last phase and opens one for name,
+// closing every bucket at the end of the measurement.
+func (a *aggregator) startPhase(name PhaseName, at time.Time) {
+	if a == nil || a.minute == nil {
+		return
+	}
+	a.advance(at)
+	if a.phase != nil {
+		a.phases = append(a.phases, a.close(a.phase, at))
+	}
+	a.phase = a.open(name, at)
+	if name == PhaseEnd {
+		a.minutes = append(a.minutes, a.close(a.minute, at))
+		a.minute, a.phase = nil, nil
+	}
+}
+
+// reply counts a reply at replyTs, established or failed.
+func (a *aggregator) reply(requestTs, replyTs time.Time, established, failed bool) {
+	if a == nil || a.minute == nil {
+		return
+	}
+	a.advance(replyTs)
+	for _, b := range []*bucket{a.minute, a.phase} {
+		if b == nil {
+			continue
+		}
+		if established {
+			b.Established++
+		}
+		if failed {
+			b.Failed++
+			continue
+		}
+		b.Replies++
+		b.latencies = append(b.latencies, replyTs.Sub(requestTs))
+	}
+}
+
+// report is the aggregates of the closed buckets, nil without any.
+func (a *aggregator) report() *Aggregates {
+	if a == nil || len(a.minutes) == 0 {
+		return nil
+	}
+	return &Aggregates{PerMinute: a.minutes, PerPhase: a.phases}
+}
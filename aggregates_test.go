@@ -0,0 +1,96 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPercentile(t *testing.T) {
+	latencies := make([]time.Duration, 100)
+	for i := range latencies {
+		latencies[i] = time.Duration(i+1) * time.Millisecond
+	}
+	testcases := map[string]struct {
+		in     []time.Duration
+		p      int
+		expect time.Duration
+	}{
+		"Empty":  {p: 50},
+		"Single": {in: latencies[:1], p: 99, expect: time.Millisecond},
+		"P50":    {in: latencies, p: 50, expect: 50 * time.Millisecond},
+		"P90":    {in: latencies, p: 90, expect: 90 * time.Millisecond},
+		"P99":    {in: latencies, p: 99, expect: 99 * time.Millisecond},
+		"Few":    {in: latencies[:3], p: 50, expect: 2 * time.Millisecond},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			if got := percentile(tc.in, tc.p); got != tc.expect {
+				t.Errorf("expected the percentile to be %v, got %v", tc.expect, got)
+			}
+		})
+	}
+}
+
+func TestAggregator(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tr := &traffic{}
+	a := newAggregator(start, tr)
+	a.startPhase(PhaseRampStart, start)
+
+	tr.sent.Add(100)
+	a.reply(start, start.Add(10*time.Second), true, false)
+	a.reply(start, start.Add(20*time.Second), false, true)
+	a.startPhase(PhaseSustainStart, start.Add(30*time.Second))
+	// The second minute is empty
+	a.reply(start.Add(150*time.Second), start.Add(150*time.Second+time.Millisecond), false, false)
+	tr.sent.Add(50)
+	a.startPhase(PhaseEnd, start.Add(3*time.Minute))
+
+	r := a.report()
+	if len(r.PerMinute) != 3 || len(r.PerPhase) != 2 {
+		t.Fatalf("expected 3 minutes and 2 phases, got %+v", r)
+	}
+	first := r.PerMinute[0]
+	if first.Established != 1 || first.Failed != 1 || first.Replies != 1 || first.BytesSent != 100 || first.LatencyP50 != 10*time.Second {
+		t.Errorf("expected the first minute to have the first two replies, got %+v", first)
+	}
+	if empty := r.PerMinute[1]; empty.Replies != 0 || empty.BytesSent != 0 || !empty.End.Equal(start.Add(2*time.Minute)) {
+		t.Errorf("expected the second minute to be empty, got %+v", empty)
+	}
+	if last := r.PerMinute[2]; last.Replies != 1 || last.BytesSent != 50 || last.LatencyP99 != time.Millisecond {
+		t.Errorf("expected the last minute to have the last reply, got %+v", last)
+	}
+	ramp, sustain := r.PerPhase[0], r.PerPhase[1]
+	if ramp.Phase != PhaseRampStart || ramp.Established != 1 || ramp.Failed != 1 || ramp.BytesSent != 100 {
+		t.Errorf("expected the ramp to have the first two replies, got %+v", ramp)
+	}
+	if sustain.Phase != PhaseSustainStart || sustain.Replies != 1 || !sustain.End.Equal(start.Add(3*time.Minute)) {
+		t.Errorf("expected the sustain to have the last reply, got %+v", sustain)
+	}
+}
+
+func TestMeasureAggregates(t *testing.T) {
+	n := &benchNetwork{hosts: 20, fanout: 2, seeds: 2}
+	m := Measurer{network: n}
+	r, err := m.Measure(n.seedUrls())
+	if err != nil {
+		t.Fatal("Failed to measure: ", err)
+	}
+	if r.Aggregates == nil {
+		t.Fatal("expected the measurement to be aggregated")
+	}
+	for name, buckets := range map[string][]Aggregate{"minutes": r.Aggregates.PerMinute, "phases": r.Aggregates.PerPhase} {
+		established, sent := 0, uint64(0)
+		for _, b := range buckets {
+			established += b.Established
+			sent += b.BytesSent
+		}
+		if established != n.hosts || sent != r.BytesSent {
+			t.Errorf("expected the %v to total %d established and %d bytes sent, got %d and %d", name, n.hosts, r.BytesSent, established, sent)
+		}
+	}
+	if len(r.Aggregates.PerPhase) != len(r.Phases)-1 {
+		t.Errorf("expected an aggregate of each phase before the end, got %d of %d", len(r.Aggregates.PerPhase), len(r.Phases))
+	}
+}
@@ -0,0 +1,134 @@
+// Functions related to benchmarking the scheduler itself, by driving it
+// with an in-memory network of simulated hosts.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/netip"
+	"net/url"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// benchNetwork simulates a tree of hosts, each linking to fanout more
+// until there are hosts in total. Replies are instant so the scheduler is
+// the bottleneck.
+type benchNetwork struct {
+	hosts, fanout, seeds int
+
+	lookups    atomic.Uint64
+	roundtrips atomic.Uint64
+}
+
+func benchHostUrl(i int) *url.URL {
+	return &url.URL{Scheme: "http", Host: fmt.Sprintf("h%d.bench", i), Path: "/"}
+}
+
+func benchHostIndex(u *url.URL) (int, bool) {
+	name, found := strings.CutSuffix(u.Hostname(), ".bench")
+	if !found || !strings.HasPrefix(name, "h") {
+		return 0, false
+	}
+	i, err := strconv.Atoi(name[1:])
+	return i, err == nil
+}
+
+func (n *benchNetwork) seedUrls() []*url.URL {
+	urls := []*url.URL{}
+	for i := range min(n.seeds, n.hosts) {
+		urls = append(urls, benchHostUrl(i))
+	}
+	return urls
+}
+
+func (n *benchNetwork) lookupAddr(ctx context.Context, network string, h *url.URL) *resolvedUrl {
+	n.lookups.Add(1)
+	r := &resolvedUrl{url: h}
+	i, ok := benchHostIndex(h)
+	if !ok || i >= n.hosts {
+		return r
+	}
+
+	// Every host gets its own address in 10.0.0.0/8
+	ip := netip.AddrFrom4([4]byte{10, byte(i >> 16), byte(i >> 8), byte(i)})
+	r.addresses = []netip.AddrPort{netip.AddrPortFrom(ip, 80)}
+	return r
+}
+
+func (n *benchNetwork) scrapConnection(ctx context.Context, r *roundtrip) *roundtrip {
+	n.roundtrips.Add(1)
+	r.requestTs = time.Now()
+	r.replyTs = r.requestTs
+	r.crawlDelay = 0
+
+	i, ok := benchHostIndex(r.url)
+	if !ok || r.url.Path != "/" {
+		return r
+	}
+	for k := range n.fanout {
+		child := n.seeds + i*n.fanout + k
+		if child >= n.hosts {
+			break
+		}
+		r.scrapedUrls = append(r.scrapedUrls, benchHostUrl(child))
+	}
+	return r
+}
+
+// benchOptions are the flags of the simulate command.
+type benchOptions struct {
+	fs       *flag.FlagSet
+	n        *benchNetwork
+	strategy string
+	duration time.Duration
+}
+
+func newBenchFlags(name string) *benchOptions {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	o := &benchOptions{fs: fs, n: &benchNetwork{}}
+	fs.IntVar(&o.n.hosts, "hosts", 50000, "simulated hosts to measure")
+	fs.IntVar(&o.n.fanout, "fanout", 4, "links from each simulated host to others")
+	fs.IntVar(&o.n.seeds, "seeds", 10, "simulated hosts to start measuring from")
+	fs.StringVar(&o.strategy, "strategy", "linear-ramp", "strategy to benchmark, one of "+strategyNames())
+	fs.DurationVar(&o.duration, "duration", 30*time.Second, "stop benchmarking after this long, 0 runs until every host is measured")
+	return o
+}
+
+// benchScheduler measures the simulated network, reporting the
+// throughput and allocations of the scheduler.
+func benchScheduler(w io.Writer, args []string) error {
+	o := newBenchFlags("simulate")
+	o.fs.Usage = commandUsage(o.fs, "")
+	err := o.fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	n := o.n
+	m := Measurer{Strategy: o.strategy, network: n, Timeout: o.duration}
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+	r, err := m.Measure(n.seedUrls())
+	elapsed := time.Since(start)
+	runtime.ReadMemStats(&after)
+	if err != nil {
+		return fmt.Errorf("failed to measure: %w", err)
+	}
+
+	secs := elapsed.Seconds()
+	fmt.Fprintf(w, "Measured %d of %d simulated hosts in %v\n", r.MaxConnections, n.hosts, elapsed)
+	fmt.Fprintf(w, "Lookups %d (%.0f/s), requests %d (%.0f/s)\n",
+		n.lookups.Load(), float64(n.lookups.Load())/secs,
+		n.roundtrips.Load(), float64(n.roundtrips.Load())/secs)
+	fmt.Fprintf(w, "Allocated %d bytes in %d allocations, %d GCs\n",
+		after.TotalAlloc-before.TotalAlloc, after.Mallocs-before.Mallocs, after.NumGC-before.NumGC)
+	return nil
+}
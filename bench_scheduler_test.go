@@ -0,0 +1,32 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestBenchScheduler(t *testing.T) {
+	var b bytes.Buffer
+	err := benchScheduler(&b, []string{"--hosts", "200", "--duration", "0"})
+	if err != nil {
+		t.Fatal("Failed to benchmark: ", err)
+	}
+	if !strings.HasPrefix(b.String(), "Measured 200 of 200 simulated hosts") {
+		t.Errorf("expected every simulated host to be measured, got %v", b.String())
+	}
+}
+
+func BenchmarkScheduler(b *testing.B) {
+	for range b.N {
+		n := &benchNetwork{hosts: 1000, fanout: 4, seeds: 10}
+		m := Measurer{network: n}
+		r, err := m.Measure(n.seedUrls())
+		if err != nil {
+			b.Fatal("Failed to measure: ", err)
+		}
+		if r.MaxConnections != n.hosts {
+			b.Fatalf("expected to measure %d hosts, got %d", n.hosts, r.MaxConnections)
+		}
+	}
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"syscall"
+)
+
+// bindToDevice binds sockets to the interface, so they leave through it
+// whatever the routing table says.
+func bindToDevice(iface string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var err error
+		cErr := c.Control(func(fd uintptr) {
+			err = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, iface)
+		})
+		if cErr != nil {
+			return cErr
+		}
+		return err
+	}
+}
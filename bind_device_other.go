@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"syscall"
+)
+
+// bindToDevice is only supported on linux, elsewhere connections only
+// dial from the address of the interface.
+func bindToDevice(iface string) func(network, address string, c syscall.RawConn) error {
+	return nil
+}
@@ -0,0 +1,377 @@
+// Functions related to classifying the mapping and filtering behaviour of
+// the NAT with STUN, RFC 5780, as capacity is far more useful alongside
+// the type of NAT measured.
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// Servers answering the behaviour discovery of RFC 5780
+	defaultStunServers = "stun.stunprotocol.org:3478"
+	defaultStunTimeout = 3 * time.Second
+	// Time between retransmissions of an unanswered request
+	stunRetransmit = 250 * time.Millisecond
+
+	stunMagicCookie      = 0x2112a442
+	stunBindingRequest   = 0x0001
+	stunBindingResponse  = 0x0101
+	stunHeaderLen        = 20
+	stunMappedAddress    = 0x0001
+	stunChangeRequest    = 0x0003
+	stunChangedAddress   = 0x0005
+	stunXorMappedAddress = 0x0020
+	stunOtherAddress     = 0x802c
+
+	// Flags of CHANGE-REQUEST
+	stunChangeIp   = 0x04
+	stunChangePort = 0x02
+)
+
+// Mapping and filtering behaviours of RFC 5780 section 4
+const (
+	BehaviourNone                    = "none"
+	BehaviourEndpointIndependent     = "endpoint-independent"
+	BehaviourAddressDependent        = "address-dependent"
+	BehaviourAddressAndPortDependent = "address-and-port-dependent"
+)
+
+var (
+	errStunTimeout = errors.New("no STUN response")
+	errNoRfc5780   = errors.New("STUN server has no alternate address, it does not support RFC 5780")
+)
+
+// NatBehaviour is how the NAT maps and filters UDP, as discovered with
+// a STUN server.
+type NatBehaviour struct {
+	Server    string         `json:"server"`
+	Local     netip.AddrPort `json:"local"`
+	Mapped    netip.AddrPort `json:"mapped"`
+	Mapping   string         `json:"mapping"`
+	Filtering string         `json:"filtering"`
+	// Classic name of the behaviour, like full cone or symmetric
+	Type string `json:"type"`
+}
+
+// behaviourAbbreviations are the abbreviations of the mapping and the
+// filtering behaviours.
+var behaviourAbbreviations = map[string][2]string{
+	BehaviourEndpointIndependent:     {"EIM", "EIF"},
+	BehaviourAddressDependent:        {"ADM", "ADF"},
+	BehaviourAddressAndPortDependent: {"APDM", "APDF"},
+}
+
+// natType is the classic name of the mapping and filtering behaviours.
+func natType(mapping, filtering string) string {
+	switch {
+	case mapping == BehaviourNone && filtering == BehaviourEndpointIndependent:
+		return "no NAT"
+	case mapping == BehaviourNone:
+		return "no NAT, filtered by a firewall"
+	case mapping != BehaviourEndpointIndependent:
+		return "symmetric"
+	case filtering == BehaviourEndpointIndependent:
+		return "full cone"
+	case filtering == BehaviourAddressDependent:
+		return "restricted cone"
+	}
+	return "port restricted cone"
+}
+
+// stunResponse is what a binding response said of the request.
+type stunResponse struct {
+	mapped netip.AddrPort
+	// Alternate address of the server, invalid without RFC 5780
+	other netip.AddrPort
+}
+
+// stunRequest is a binding request with a random transaction ID, asking
+// the server to answer from another address or port with change.
+func stunRequest(change byte) ([]byte, [12]byte) {
+	var id [12]byte
+	rand.Read(id[:])
+	msg := make([]byte, stunHeaderLen, stunHeaderLen+8)
+	binary.BigEndian.PutUint16(msg[0:], stunBindingRequest)
+	binary.BigEndian.PutUint32(msg[4:], stunMagicCookie)
+	copy(msg[8:], id[:])
+	if change != 0 {
+		msg = binary.BigEndian.AppendUint16(msg, stunChangeRequest)
+		msg = binary.BigEndian.AppendUint16(msg, 4)
+		msg = append(msg, 0, 0, 0, change)
+	}
+	binary.BigEndian.PutUint16(msg[2:], uint16(len(msg)-stunHeaderLen))
+	return msg, id
+}
+
+// parseStunAddress parses a MAPPED-ADDRESS like attribute, xor'd with the
+// magic cookie for XOR-MAPPED-ADDRESS.
+func parseStunAddress(v []byte, xor bool) (netip.AddrPort, bool) {
+	if len(v) < 8 {
+		return netip.AddrPort{}, false
+	}
+	port := binary.BigEndian.Uint16(v[2:])
+	ip := v[4:]
+	if xor {
+		port ^= stunMagicCookie >> 16
+		cookie := binary.BigEndian.AppendUint32(nil, stunMagicCookie)
+		ip = append([]byte{}, ip...)
+		for i := range ip {
+			ip[i] ^= cookie[i%4]
+		}
+	}
+	// Only IPv4 is classified, IPv6 NATs being rare
+	if v[1] != 0x01 || len(ip) != 4 {
+		return netip.AddrPort{}, false
+	}
+	return netip.AddrPortFrom(netip.AddrFrom4([4]byte(ip)), port), true
+}
+
+// parseStunResponse parses the binding response to the transaction id.
+func parseStunResponse(msg []byte, id [12]byte) (*stunResponse, bool) {
+	if len(msg) < stunHeaderLen ||
+		binary.BigEndian.Uint16(msg[0:]) != stunBindingResponse ||
+		binary.BigEndian.Uint32(msg[4:]) != stunMagicCookie ||
+		[12]byte(msg[8:20]) != id {
+		return nil, false
+	}
+	end := min(stunHeaderLen+int(binary.BigEndian.Uint16(msg[2:])), len(msg))
+	r := &stunResponse{}
+	for attrs := msg[stunHeaderLen:end]; len(attrs) >= 4; {
+		kind, n := binary.BigEndian.Uint16(attrs[0:]), int(binary.BigEndian.Uint16(attrs[2:]))
+		if len(attrs) < 4+n {
+			break
+		}
+		v := attrs[4 : 4+n]
+		switch kind {
+		case stunXorMappedAddress:
+			r.mapped, _ = parseStunAddress(v, true)
+		case stunMappedAddress:
+			if !r.mapped.IsValid() {
+				r.mapped, _ = parseStunAddress(v, false)
+			}
+		case stunOtherAddress, stunChangedAddress:
+			r.other, _ = parseStunAddress(v, false)
+		}
+		// Attributes are padded to 4 bytes
+		attrs = attrs[min(4+(n+3)&^3, len(attrs)):]
+	}
+	return r, r.mapped.IsValid()
+}
+
+// stunTransaction sends a binding request to server from conn, resending
+// it until answered or timeout passes.
+func stunTransaction(conn net.PacketConn, server netip.AddrPort, change byte, timeout time.Duration) (*stunResponse, error) {
+	msg, id := stunRequest(change)
+	to := net.UDPAddrFromAddrPort(server)
+	deadline := time.Now().Add(timeout)
+	buf := make([]byte, 1500)
+	for time.Now().Before(deadline) {
+		_, err := conn.WriteTo(msg, to)
+		if err != nil {
+			return nil, fmt.Errorf("failed to send STUN request: %w", err)
+		}
+		readDeadline := time.Now().Add(stunRetransmit)
+		if readDeadline.After(deadline) {
+			readDeadline = deadline
+		}
+		conn.SetReadDeadline(readDeadline)
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				break
+			}
+			if r, ok := parseStunResponse(buf[:n], id); ok {
+				return r, nil
+			}
+		}
+	}
+	return nil, errStunTimeout
+}
+
+// mappingBehaviour compares the mapping of local to the server with its
+// mapping to the alternate address and port of the server, r1 being the
+// response of the server.
+func mappingBehaviour(conn net.PacketConn, local, server netip.AddrPort, r1 *stunResponse, timeout time.Duration) (string, error) {
+	if r1.mapped == local {
+		return BehaviourNone, nil
+	}
+	r2, err := stunTransaction(conn, netip.AddrPortFrom(r1.other.Addr(), server.Port()), 0, timeout)
+	if err != nil {
+		return "", fmt.Errorf("failed to reach the alternate address: %w", err)
+	}
+	if r2.mapped == r1.mapped {
+		return BehaviourEndpointIndependent, nil
+	}
+	r3, err := stunTransaction(conn, r1.other, 0, timeout)
+	if err != nil {
+		return "", fmt.Errorf("failed to reach the alternate address: %w", err)
+	}
+	if r3.mapped == r2.mapped {
+		return BehaviourAddressDependent, nil
+	}
+	return BehaviourAddressAndPortDependent, nil
+}
+
+// filteringBehaviour asks the server to answer from its alternate
+// address and port, then from its alternate port, unanswered requests
+// being taken as filtered.
+func filteringBehaviour(listen func() (net.PacketConn, netip.AddrPort, error), server netip.AddrPort, timeout time.Duration) (string, error) {
+	conn, _, err := listen()
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	_, err = stunTransaction(conn, server, stunChangeIp|stunChangePort, timeout)
+	if err == nil {
+		return BehaviourEndpointIndependent, nil
+	}
+	_, err = stunTransaction(conn, server, stunChangePort, timeout)
+	if err == nil {
+		return BehaviourAddressDependent, nil
+	}
+	return BehaviourAddressAndPortDependent, nil
+}
+
+// discoverNatBehaviour runs the mapping and filtering tests of RFC 5780
+// against server, on sockets from listen along with their address. The
+// filtering tests are from a socket of their own, as the mapping tests
+// open the filters of the NAT to the alternate address of the server.
+func discoverNatBehaviour(listen func() (net.PacketConn, netip.AddrPort, error), server netip.AddrPort, timeout time.Duration) (*NatBehaviour, error) {
+	conn, local, err := listen()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	b := &NatBehaviour{Local: local}
+	r1, err := stunTransaction(conn, server, 0, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if !r1.other.IsValid() {
+		return nil, errNoRfc5780
+	}
+	b.Mapped = r1.mapped
+
+	b.Mapping, err = mappingBehaviour(conn, local, server, r1, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	b.Filtering, err = filteringBehaviour(listen, server, timeout)
+	if err != nil {
+		return nil, err
+	}
+	b.Type = natType(b.Mapping, b.Filtering)
+	return b, nil
+}
+
+// classifyNat discovers the behaviour of the NAT with the first of the
+// comma separated servers able to.
+func classifyNat(servers string, timeout time.Duration) (*NatBehaviour, error) {
+	errs := []error{}
+	for _, s := range strings.Split(servers, ",") {
+		s = strings.TrimSpace(s)
+		b, err := classifyWith(s, timeout)
+		if err == nil {
+			return b, nil
+		}
+		errs = append(errs, fmt.Errorf("%v: %w", s, err))
+	}
+	return nil, errors.Join(errs...)
+}
+
+func classifyWith(server string, timeout time.Duration) (*NatBehaviour, error) {
+	addr, err := net.ResolveUDPAddr("udp4", server)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve STUN server: %w", err)
+	}
+	serverAddr := addr.AddrPort()
+
+	// The address routed to the server, as the socket is bound to all
+	route, err := net.DialUDP("udp4", nil, addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find route to STUN server: %w", err)
+	}
+	localIp := route.LocalAddr().(*net.UDPAddr).AddrPort().Addr()
+	route.Close()
+
+	listen := func() (net.PacketConn, netip.AddrPort, error) {
+		conn, err := net.ListenUDP("udp4", nil)
+		if err != nil {
+			return nil, netip.AddrPort{}, fmt.Errorf("failed to listen for STUN responses: %w", err)
+		}
+		return conn, netip.AddrPortFrom(localIp, conn.LocalAddr().(*net.UDPAddr).AddrPort().Port()), nil
+	}
+	b, err := discoverNatBehaviour(listen, serverAddr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	b.Server = server
+	return b, nil
+}
+
+func printNatBehaviour(w io.Writer, b *NatBehaviour) {
+	abbreviated := func(behaviour string, i int) string {
+		if a, found := behaviourAbbreviations[behaviour]; found {
+			return fmt.Sprintf("%v (%v)", behaviour, a[i])
+		}
+		return behaviour
+	}
+	fmt.Fprintf(w, "STUN server: %v\n", b.Server)
+	fmt.Fprintf(w, "Mapped %v to %v\n", b.Local, b.Mapped)
+	fmt.Fprintf(w, "Mapping: %v\n", abbreviated(b.Mapping, 0))
+	fmt.Fprintf(w, "Filtering: %v\n", abbreviated(b.Filtering, 1))
+	fmt.Fprintf(w, "NAT type: %v\n", b.Type)
+}
+
+// classifyOptions are the flags of the classify command.
+type classifyOptions struct {
+	fs      *flag.FlagSet
+	servers string
+	timeout time.Duration
+	json    bool
+}
+
+func newClassifyFlags(name string) *classifyOptions {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	o := &classifyOptions{fs: fs}
+	fs.StringVar(&o.servers, "stun-servers", defaultStunServers, "comma separated STUN servers supporting RFC 5780, tried in order until one answers")
+	fs.DurationVar(&o.timeout, "timeout", defaultStunTimeout, "how long to wait for each STUN response, unanswered filtering tests are taken as filtered")
+	fs.BoolVar(&o.json, "json", false, "print the behaviour as json, for scripts")
+	return o
+}
+
+func classifyCommand(name string, args []string) {
+	o := newClassifyFlags(name)
+	parseCommandArgs(o.fs, args, "", 0, false)
+
+	b, err := classifyNat(o.servers, o.timeout)
+	if err != nil {
+		fmt.Printf("Failed to classify the NAT: %v\n", err)
+		os.Exit(1)
+	}
+	if !o.json {
+		printNatBehaviour(os.Stdout, b)
+		return
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	err = enc.Encode(b)
+	if err != nil {
+		fmt.Printf("Failed to print behaviour: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeNat simulates the behaviour of a NAT in front of the client of a
+// fakeStunServer.
+type fakeNat struct {
+	mapping   string
+	filtering string
+	// Server addresses each client sent to, as the NAT filters by them
+	mu        sync.Mutex
+	contacted map[netip.AddrPort][]netip.AddrPort
+}
+
+func (n *fakeNat) mapped(client, dst netip.AddrPort) netip.AddrPort {
+	external := netip.MustParseAddr("203.0.113.1")
+	switch n.mapping {
+	case BehaviourEndpointIndependent:
+		return netip.AddrPortFrom(external, 40000)
+	case BehaviourAddressDependent:
+		return netip.AddrPortFrom(external, 40000+uint16(dst.Addr().As4()[3]))
+	case BehaviourAddressAndPortDependent:
+		return netip.AddrPortFrom(external, 40000+uint16(dst.Addr().As4()[3])*1000+dst.Port()%1000)
+	}
+	return client
+}
+
+func (n *fakeNat) send(client, dst netip.AddrPort) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.contacted == nil {
+		n.contacted = map[netip.AddrPort][]netip.AddrPort{}
+	}
+	n.contacted[client] = append(n.contacted[client], dst)
+}
+
+func (n *fakeNat) allows(client, from netip.AddrPort) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, c := range n.contacted[client] {
+		switch {
+		case n.filtering == BehaviourEndpointIndependent:
+			return true
+		case n.filtering == BehaviourAddressDependent && c.Addr() == from.Addr():
+			return true
+		case c == from:
+			return true
+		}
+	}
+	return false
+}
+
+// fakeStunServer answers binding requests on two addresses and two
+// ports, answering from the others when asked to change them.
+type fakeStunServer struct {
+	// conns[ip][port]
+	conns [2][2]*net.UDPConn
+	nat   *fakeNat
+	// Omit OTHER-ADDRESS, like servers without RFC 5780
+	noOther bool
+}
+
+func newFakeStunServer(t *testing.T, nat *fakeNat, noOther bool) *fakeStunServer {
+	s := &fakeStunServer{nat: nat, noOther: noOther}
+	ips := [2]string{"127.0.0.1", "127.0.0.2"}
+	for p := range 2 {
+		first, err := net.ListenUDP("udp4", net.UDPAddrFromAddrPort(netip.MustParseAddrPort(ips[0]+":0")))
+		if err != nil {
+			t.Fatal("Failed to listen: ", err)
+		}
+		s.conns[0][p] = first
+		port := first.LocalAddr().(*net.UDPAddr).AddrPort().Port()
+		second, err := net.ListenUDP("udp4", net.UDPAddrFromAddrPort(netip.AddrPortFrom(netip.MustParseAddr(ips[1]), port)))
+		if err != nil {
+			t.Skip("Cannot listen on a second loopback address: ", err)
+		}
+		s.conns[1][p] = second
+	}
+	t.Cleanup(func() {
+		for _, row := range s.conns {
+			for _, c := range row {
+				c.Close()
+			}
+		}
+	})
+	for i := range 2 {
+		for p := range 2 {
+			go s.serve(i, p)
+		}
+	}
+	return s
+}
+
+func (s *fakeStunServer) addr(i, p int) netip.AddrPort {
+	return s.conns[i][p].LocalAddr().(*net.UDPAddr).AddrPort()
+}
+
+func (s *fakeStunServer) serve(i, p int) {
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := s.conns[i][p].ReadFromUDPAddrPort(buf)
+		if err != nil {
+			return
+		}
+		msg := buf[:n]
+		if n < stunHeaderLen || binary.BigEndian.Uint16(msg) != stunBindingRequest {
+			continue
+		}
+		var change byte
+		if n >= stunHeaderLen+8 && binary.BigEndian.Uint16(msg[stunHeaderLen:]) == stunChangeRequest {
+			change = msg[stunHeaderLen+7]
+		}
+		ri, rp := i, p
+		if change&stunChangeIp != 0 {
+			ri = 1 - i
+		}
+		if change&stunChangePort != 0 {
+			rp = 1 - p
+		}
+
+		s.nat.send(from, s.addr(i, p))
+		if !s.nat.allows(from, s.addr(ri, rp)) {
+			continue
+		}
+		mapped := s.nat.mapped(from, s.addr(i, p))
+		res := s.response([12]byte(msg[8:20]), mapped)
+		s.conns[ri][rp].WriteToUDPAddrPort(res, from)
+	}
+}
+
+func (s *fakeStunServer) response(id [12]byte, mapped netip.AddrPort) []byte {
+	attr := func(msg []byte, kind uint16, addr netip.AddrPort, xor bool) []byte {
+		port, ip := addr.Port(), addr.Addr().As4()
+		if xor {
+			port ^= stunMagicCookie >> 16
+			binary.BigEndian.PutUint32(ip[:], binary.BigEndian.Uint32(ip[:])^stunMagicCookie)
+		}
+		msg = binary.BigEndian.AppendUint16(msg, kind)
+		msg = binary.BigEndian.AppendUint16(msg, 8)
+		msg = append(msg, 0, 0x01)
+		msg = binary.BigEndian.AppendUint16(msg, port)
+		return append(msg, ip[:]...)
+	}
+	msg := make([]byte, stunHeaderLen)
+	binary.BigEndian.PutUint16(msg, stunBindingResponse)
+	binary.BigEndian.PutUint32(msg[4:], stunMagicCookie)
+	copy(msg[8:], id[:])
+	msg = attr(msg, stunXorMappedAddress, mapped, true)
+	if !s.noOther {
+		msg = attr(msg, stunOtherAddress, s.addr(1, 1), false)
+	}
+	binary.BigEndian.PutUint16(msg[2:], uint16(len(msg)-stunHeaderLen))
+	return msg
+}
+
+func listenLoopback() (net.PacketConn, netip.AddrPort, error) {
+	conn, err := net.ListenUDP("udp4", net.UDPAddrFromAddrPort(netip.MustParseAddrPort("127.0.0.1:0")))
+	if err != nil {
+		return nil, netip.AddrPort{}, err
+	}
+	return conn, conn.LocalAddr().(*net.UDPAddr).AddrPort(), nil
+}
+
+func TestDiscoverNatBehaviour(t *testing.T) {
+	testcases := map[string]struct {
+		inMapping   string
+		inFiltering string
+		outType     string
+	}{
+		"No NAT": {
+			inMapping:   BehaviourNone,
+			inFiltering: BehaviourEndpointIndependent,
+			outType:     "no NAT",
+		},
+		"Full cone": {
+			inMapping:   BehaviourEndpointIndependent,
+			inFiltering: BehaviourEndpointIndependent,
+			outType:     "full cone",
+		},
+		"Restricted cone": {
+			inMapping:   BehaviourEndpointIndependent,
+			inFiltering: BehaviourAddressDependent,
+			outType:     "restricted cone",
+		},
+		"Port restricted cone": {
+			inMapping:   BehaviourEndpointIndependent,
+			inFiltering: BehaviourAddressAndPortDependent,
+			outType:     "port restricted cone",
+		},
+		"Address dependent mapping": {
+			inMapping:   BehaviourAddressDependent,
+			inFiltering: BehaviourAddressAndPortDependent,
+			outType:     "symmetric",
+		},
+		"Address and port dependent mapping": {
+			inMapping:   BehaviourAddressAndPortDependent,
+			inFiltering: BehaviourAddressAndPortDependent,
+			outType:     "symmetric",
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			srv := newFakeStunServer(t, &fakeNat{mapping: tc.inMapping, filtering: tc.inFiltering}, false)
+			b, err := discoverNatBehaviour(listenLoopback, srv.addr(0, 0), 200*time.Millisecond)
+			if err != nil {
+				t.Fatal("Failed to discover behaviour: ", err)
+			}
+			if b.Mapping != tc.inMapping {
+				t.Errorf("expected mapping %v, got %v", tc.inMapping, b.Mapping)
+			}
+			if b.Filtering != tc.inFiltering {
+				t.Errorf("expected filtering %v, got %v", tc.inFiltering, b.Filtering)
+			}
+			if b.Type != tc.outType {
+				t.Errorf("expected type %v, got %v", tc.outType, b.Type)
+			}
+		})
+	}
+}
+
+func TestDiscoverNatBehaviourWithoutRfc5780(t *testing.T) {
+	srv := newFakeStunServer(t, &fakeNat{mapping: BehaviourNone, filtering: BehaviourEndpointIndependent}, true)
+	_, err := discoverNatBehaviour(listenLoopback, srv.addr(0, 0), 200*time.Millisecond)
+	if !errors.Is(err, errNoRfc5780) {
+		t.Errorf("expected %v, got %v", errNoRfc5780, err)
+	}
+}
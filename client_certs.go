@@ -0,0 +1,81 @@
+// Functions related to presenting client certificates, for measurements
+// against mTLS protected internal servers rather than anonymous test
+// servers.
+package main
+
+import (
+	"cmp"
+	"crypto/tls"
+	"fmt"
+	"strings"
+)
+
+// ClientCertificates are presented to servers asking for a certificate,
+// the zero value presents none.
+type ClientCertificates struct {
+	// Presented to hosts without a certificate of their own
+	Default *tls.Certificate
+	// Certificate of each domain and its subdomains. The longest domain
+	// matching a hostname wins.
+	Hosts map[string]*tls.Certificate
+}
+
+// hostCertificate is the certificate of host's own, nil if host is
+// presented the default.
+func (cc *ClientCertificates) hostCertificate(host string) *tls.Certificate {
+	if cc == nil {
+		return nil
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	var cert *tls.Certificate
+	longest := -1
+	for domain, c := range cc.Hosts {
+		domain = strings.ToLower(strings.Trim(domain, "."))
+		if (host == domain || strings.HasSuffix(host, "."+domain)) && len(domain) > longest {
+			cert, longest = c, len(domain)
+		}
+	}
+	return cert
+}
+
+// certificates are those tls.Config.Certificates presents to host.
+func (cc *ClientCertificates) certificates(host string) []tls.Certificate {
+	if c := cc.hostCertificate(host); c != nil {
+		return []tls.Certificate{*c}
+	}
+	if cc == nil || cc.Default == nil {
+		return nil
+	}
+	return []tls.Certificate{*cc.Default}
+}
+
+// loadClientCertificate loads a PEM certificate and its key, which may be
+// in the same file.
+func loadClientCertificate(certFile, keyFile string) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, cmp.Or(keyFile, certFile))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load client certificate: %w", err)
+	}
+	return &cert, nil
+}
+
+// parseClientCertHosts parses comma separated domain=cert[:key]
+// certificates, like "lab.example=lab.pem,corp.example=corp.crt:corp.key",
+// loading each.
+func parseClientCertHosts(s string) (map[string]*tls.Certificate, error) {
+	certs := map[string]*tls.Certificate{}
+	for _, field := range strings.Split(s, ",") {
+		domain, files, found := strings.Cut(strings.TrimSpace(field), "=")
+		domain, files = strings.TrimSpace(domain), strings.TrimSpace(files)
+		if !found || domain == "" || files == "" {
+			return nil, fmt.Errorf("invalid client certificate %q, expected like lab.example=lab.crt:lab.key", field)
+		}
+		certFile, keyFile, _ := strings.Cut(files, ":")
+		cert, err := loadClientCertificate(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		certs[domain] = cert
+	}
+	return certs, nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeClientCertificate writes a self-signed client certificate and its
+// key to a single PEM file.
+func writeClientCertificate(t *testing.T, name string) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("Failed to generate key: ", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal("Failed to create certificate: ", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal("Failed to marshal key: ", err)
+	}
+	path := filepath.Join(t.TempDir(), name+".pem")
+	contents := append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})...)
+	if err := os.WriteFile(path, contents, 0o600); err != nil {
+		t.Fatal("Failed to write certificate: ", err)
+	}
+	return path
+}
+
+func TestClientCertificate(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	srv.StartTLS()
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal("Failed to parse server url: ", err)
+	}
+	cert, err := loadClientCertificate(writeClientCertificate(t, "client"), "")
+	if err != nil {
+		t.Fatal("Failed to load client certificate: ", err)
+	}
+
+	testcases := map[string]struct {
+		in          ClientCertificates
+		expectError bool
+	}{
+		"No certificate":      {expectError: true},
+		"Default certificate": {in: ClientCertificates{Default: cert}},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			m := Measurer{InsecureSkipVerify: true, ClientCerts: tc.in}
+			client, _ := makeClient(&traffic{}, m.tlsConfig(), nil)
+			defer client.CloseIdleConnections()
+
+			ctx := context.WithValue(context.Background(), ctxAddrKey{}, netip.MustParseAddrPort(u.Host))
+			resp, err := getUrl(ctx, client, http.MethodGet, u)
+			if err == nil {
+				resp.Body.Close()
+			}
+			if (err != nil) != tc.expectError {
+				t.Errorf("expected error %v, got %v", tc.expectError, err)
+			}
+		})
+	}
+}
+
+func TestClientCertificateHosts(t *testing.T) {
+	lab, corp, fallback := &tls.Certificate{}, &tls.Certificate{}, &tls.Certificate{}
+	cc := &ClientCertificates{
+		Default: fallback,
+		Hosts:   map[string]*tls.Certificate{"lab.example": lab, "corp.lab.example": corp},
+	}
+
+	testcases := map[string]struct {
+		inHost  string
+		outCert *tls.Certificate
+	}{
+		"domain":            {inHost: "lab.example", outCert: lab},
+		"subdomain":         {inHost: "www.lab.example", outCert: lab},
+		"longest domain":    {inHost: "www.corp.lab.example", outCert: corp},
+		"case insensitive":  {inHost: "WWW.Lab.Example.", outCert: lab},
+		"only whole labels": {inHost: "otherlab.example", outCert: nil},
+		"other host":        {inHost: "example.com", outCert: nil},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			if got := cc.hostCertificate(tc.inHost); got != tc.outCert {
+				t.Errorf("expected certificate %p, got %p", tc.outCert, got)
+			}
+			if got := cc.certificates(tc.inHost); len(got) != 1 {
+				t.Errorf("expected one certificate, got %v", len(got))
+			}
+		})
+	}
+
+	var none *ClientCertificates
+	if got := none.certificates("lab.example"); got != nil {
+		t.Errorf("expected no certificates, got %v", got)
+	}
+}
+
+func TestParseClientCertHosts(t *testing.T) {
+	path := writeClientCertificate(t, "lab")
+	certs, err := parseClientCertHosts("lab.example=" + path + ":" + path)
+	if err != nil {
+		t.Fatal("Failed to parse client certificates: ", err)
+	}
+	if certs["lab.example"] == nil {
+		t.Errorf("expected a certificate for lab.example, got %v", certs)
+	}
+
+	for _, in := range []string{"lab.example", "=" + path, "lab.example=" + filepath.Join(t.TempDir(), "missing.pem")} {
+		if _, err := parseClientCertHosts(in); err == nil {
+			t.Errorf("expected %q to be rejected", in)
+		}
+	}
+}
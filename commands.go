@@ -0,0 +1,502 @@
+// Functions related to the subcommands of natck, dispatching to each and
+// the commands small enough to not need a file of their own.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/netip"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+)
+
+// command is a subcommand of natck, like natck measure.
+type command struct {
+	name    string
+	summary string
+	// Positional arguments, like [url-file]
+	args string
+	// Paragraphs of the long help and man page
+	description []string
+	examples    []example
+	// Defines the flags of the command, for completion and help
+	flags func() *flag.FlagSet
+	// Words to complete the arguments with, otherwise files
+	completeArgs []string
+	run          func(name string, args []string)
+}
+
+// example is a command line and what it does.
+type example struct {
+	line        string
+	description string
+}
+
+func allCommands() []command {
+	return []command{
+		{
+			name:    "measure",
+			summary: "measure the connections the NAT allows, crawling from a url list",
+			args:    "[url-file]",
+			description: []string{
+				"Crawls outwards from the urls of the url list, or stdin, opening one connection per server and keeping each alive, until the NAT refuses more connections. Prints the connections verified alive, along with the caveats of the result.",
+				"Without a command, natck runs measure.",
+			},
+			examples: []example{
+				{"cat url-list.txt | natck --yes", "measure from the urls piped to natck, without confirming the estimated cost"},
+				{"natck measure --max-total-bytes 50000000 url-list.txt", "stop once 50MB have been sent and received"},
+				{"natck measure --report json --report-file result.json url-list.txt", "write the result as json, to compare later"},
+			},
+			flags: func() *flag.FlagSet { return newMeasureFlags("measure").fs },
+			run:   measureCommand,
+		},
+		{
+			name:    "validate",
+			summary: "check a url list, reporting the lines that cannot be measured",
+			args:    "[url-file]",
+			description: []string{
+				"Reports each line of the url list, or stdin, that cannot be measured, like urls without a scheme. Exits with 1 if any line is invalid.",
+			},
+			examples: []example{
+				{"natck validate url-list.txt", "check a url list before measuring"},
+			},
+			flags: func() *flag.FlagSet { return flag.NewFlagSet("validate", flag.ExitOnError) },
+			run:   validateCommand,
+		},
+		{
+			name:    "seeds",
+			summary: "print the urls of a url list a measurement starts from",
+			args:    "[url-file]",
+			description: []string{
+				"Prints the urls a measurement of the url list, or stdin, would start from, one per host and port.",
+			},
+			examples: []example{
+				{"natck seeds url-list.txt | wc -l", "count the hosts a measurement starts from"},
+			},
+			flags: func() *flag.FlagSet { return flag.NewFlagSet("seeds", flag.ExitOnError) },
+			run:   seedsCommand,
+		},
+		{
+			name:    "server",
+			summary: "measure repeatedly as a daemon, serving the latest result",
+			args:    "[url-file]",
+			description: []string{
+				"Measures every interval, serving the latest result as Prometheus metrics on /metrics, along with /healthz and /readyz. Takes the flags of measure.",
+			},
+			examples: []example{
+				{"natck server --yes --interval 6h --listen :9090 url-list.txt", "measure every 6 hours, serving the metrics on port 9090"},
+			},
+			flags: func() *flag.FlagSet { return newMeasureFlags("server").fs },
+			run:   measureCommand,
+		},
+		{
+			name:    "simulate",
+			summary: "benchmark the scheduler against a simulated network",
+			description: []string{
+				"Measures a simulated network of hosts without touching the real network, reporting the lookups and requests per second and the memory used.",
+			},
+			examples: []example{
+				{"natck simulate --hosts 10000", "benchmark the scheduler against 10000 simulated hosts"},
+			},
+			flags: func() *flag.FlagSet { return newBenchFlags("simulate").fs },
+			run:   simulateCommand,
+		},
+		{
+			name:    "compare",
+			summary: "compare two results reported with --report json",
+			args:    "<old.json> <new.json>",
+			description: []string{
+				"Prints each figure that changed between two results reported with --report json.",
+			},
+			examples: []example{
+				{"natck compare before.json after.json", "show what changed after a router upgrade"},
+			},
+			flags: func() *flag.FlagSet { return flag.NewFlagSet("compare", flag.ExitOnError) },
+			run:   compareCommand,
+		},
+		{
+			name:    "reflector",
+			summary: "reply to each request with the address it came from",
+			description: []string{
+				"Serves the address each request came from as plain text, for measurements with --reflector to record the external IP of the NAT. Run it outside the NAT, like on a VPS. With --ports it also replies on a range of ports, for measurements with --single-target.",
+			},
+			examples: []example{
+				{"natck reflector --listen :8080", "serve the addresses of clients on port 8080"},
+				{"natck reflector --ports 8000-8999", "also serve on ports 8000 to 8999, for natck measure --single-target"},
+			},
+			flags: func() *flag.FlagSet { return newReflectorFlags("reflector").fs },
+			run:   reflectorCommand,
+		},
+		{
+			name:    "classify",
+			summary: "classify the mapping and filtering behaviour of the NAT with STUN",
+			description: []string{
+				"Runs the behaviour discovery of RFC 5780 against a STUN server, reporting whether the NAT maps endpoint independently (EIM), address dependently (ADM) or address and port dependently (APDM), how it filters likewise, and the classic cone or symmetric type. The STUN servers must support RFC 5780, answering from an alternate address.",
+			},
+			examples: []example{
+				{"natck classify", "classify the NAT with the default STUN server"},
+				{"natck classify --json --stun-servers stun.example.com:3478", "classify the NAT with another STUN server, for scripts"},
+			},
+			flags: func() *flag.FlagSet { return newClassifyFlags("classify").fs },
+			run:   classifyCommand,
+		},
+		{
+			name:    "udp",
+			summary: "measure the UDP mappings the NAT sustains",
+			description: []string{
+				"Opens UDP sockets in batches, each a mapping of the NAT kept alive with STUN binding requests or DNS queries, until a batch goes unanswered. The mappings are then refreshed for a while, reporting the most alive at once and those lost, as measuring TCP alone misses half the conntrack table.",
+			},
+			examples: []example{
+				{"natck udp --max-mappings 5000", "open up to 5000 UDP mappings to the default STUN server"},
+				{"natck udp --probe dns --servers 192.0.2.53:53", "keep the mappings alive with DNS queries to a lab resolver"},
+			},
+			flags: func() *flag.FlagSet { return newUdpFlags("udp").fs },
+			run:   udpCommand,
+		},
+		{
+			name:    "idle-timeout",
+			summary: "measure how long the NAT keeps idle TCP and UDP mappings",
+			description: []string{
+				"Probes a handful of TCP connections to --url, and as many UDP mappings of a STUN server, after idle gaps doubling from --start, reporting the longest gap the mappings survived and the shortest they were dropped after. The TCP server must keep idle connections open for longer than the NAT, like natck reflector, as connections it closes tell nothing of the NAT.",
+				"The keep-alive interval suggested is half the longest TCP gap survived, to measure with --keep-alive-interval rather than the fixed default.",
+			},
+			examples: []example{
+				{"natck idle-timeout --url http://192.0.2.1:8080/", "probe TCP mappings to a reflector, and UDP mappings to the default STUN server"},
+				{"natck idle-timeout --stun-server '' --url http://192.0.2.1:8080/ --max-idle 1h", "probe only TCP mappings, idle for up to an hour"},
+			},
+			flags: func() *flag.FlagSet { return newIdleTimeoutFlags("idle-timeout").fs },
+			run:   idleTimeoutCommand,
+		},
+		{
+			name:    "history",
+			summary: "list the results kept in a result store",
+			description: []string{
+				"Lists the most recent results that natck measure or natck server kept with --store, oldest first. Stores that results are only posted to, over http:// or https://, cannot be listed.",
+			},
+			examples: []example{
+				{"natck history --store file:history.jsonl", "list the last 20 results kept in history.jsonl"},
+				{"natck history --store sqlite:history.db --limit 0 --json", "print every result kept in a SQLite database, for scripts"},
+			},
+			flags: func() *flag.FlagSet { return newHistoryFlags("history").fs },
+			run:   historyCommand,
+		},
+		{
+			name:    "query",
+			summary: "run a canned query on a database of measurements",
+			description: []string{
+				"Runs a canned query on the connections, requests and results natck measure stored with --db, of the latest run unless --run is given. The queries are: " + crawlDbQuerySummaries() + ".",
+				"The database is SQLite, so natck must be built with -tags sqlite, and any SQLite client can query the runs, connections and requests tables further.",
+			},
+			examples: []example{
+				{"natck query slowest-hosts", "list the hosts of the latest run in natck.db with the highest latency"},
+				{"natck query --db lab.db --run 3 --limit 0 failure-timeline", "list every failed request of the third run in lab.db"},
+			},
+			flags: func() *flag.FlagSet { return newQueryFlags("query").fs },
+			run:   queryCommand,
+		},
+		{
+			name:    "version",
+			summary: "print the version of natck and the features compiled in",
+			description: []string{
+				"Prints the version and commit natck was built from, the Go version and platform, and which optional features were compiled in.",
+			},
+			examples: []example{
+				{"natck version --json", "print the version for scripts"},
+			},
+			flags: func() *flag.FlagSet { return newVersionFlags("version").fs },
+			run:   versionCommand,
+		},
+		{
+			name:    "self-update",
+			summary: "replace natck with the latest signed release",
+			description: []string{
+				"Verifies the ed25519 signature of the manifest at the release url, downloads its binary if the release is newer than the running version, checks its SHA-256 and atomically replaces the running binary.",
+			},
+			examples: []example{
+				{"natck self-update --check", "report whether a newer release is available"},
+			},
+			flags: func() *flag.FlagSet { return newSelfUpdateFlags("self-update").fs },
+			run:   selfUpdateCommand,
+		},
+		{
+			name:    "completion",
+			summary: "print a completion script for " + strings.Join(completionShells, ", "),
+			args:    "<" + strings.Join(completionShells, "|") + ">",
+			description: []string{
+				"Prints a script completing the commands and flags of natck for the shell.",
+			},
+			examples: []example{
+				{"source <(natck completion bash)", "complete natck in the current bash shell"},
+			},
+			flags:        func() *flag.FlagSet { return flag.NewFlagSet("completion", flag.ExitOnError) },
+			completeArgs: completionShells,
+			run:          completionCommand,
+		},
+		{
+			name:    "man",
+			summary: "print the natck(1) man page",
+			description: []string{
+				"Prints the man page of natck, generated from its commands and flags.",
+			},
+			examples: []example{
+				{"natck man > /usr/local/share/man/man1/natck.1", "install the man page"},
+			},
+			flags: func() *flag.FlagSet { return flag.NewFlagSet("man", flag.ExitOnError) },
+			run:   manCommand,
+		},
+	}
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: natck <command> [flags]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
+	for _, c := range allCommands() {
+		fmt.Fprintf(w, "  %-12v %v\n", c.name, c.summary)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Without a command, natck measures the urls read from stdin.")
+	fmt.Fprintln(w, "Run natck <command> -h for the flags of each command, or")
+	fmt.Fprintln(w, "--help-long for its description and examples too.")
+}
+
+// commandUsage prints the flags of a command, after its positional
+// arguments.
+func commandUsage(fs *flag.FlagSet, positional string) func() {
+	return func() {
+		fmt.Fprintln(fs.Output(), strings.TrimSpace("Usage: natck "+fs.Name()+" [flags] "+positional))
+		fs.PrintDefaults()
+	}
+}
+
+// parseCommandArgs parses the flags of a command that takes exactly n
+// positional arguments, or up to n when optional.
+func parseCommandArgs(fs *flag.FlagSet, args []string, positional string, n int, optional bool) {
+	fs.Usage = commandUsage(fs, positional)
+	fs.Parse(args)
+	if fs.NArg() > n || (!optional && fs.NArg() < n) {
+		fs.Usage()
+		os.Exit(2)
+	}
+}
+
+// readUrlFile reads the url list in path, or stdin when path is empty
+// or -.
+func readUrlFile(path string) ([]*url.URL, map[string]netip.Addr, error) {
+	if path == "" || path == "-" {
+		return readUrls(os.Stdin)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open url list: %w", err)
+	}
+	defer f.Close()
+	return readUrls(f)
+}
+
+// checkTargetUrl reports why a url cannot be measured.
+func checkTargetUrl(u *url.URL) error {
+	if u.Host == "" {
+		return errors.New("no host, missing a scheme like https://?")
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	return nil
+}
+
+// validateUrls writes each line of the url list that cannot be measured
+// to w, returning the number of valid and invalid lines.
+func validateUrls(input io.Reader, w io.Writer) (int, int, error) {
+	valid, invalid := 0, 0
+	sc := bufio.NewScanner(input)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+
+		u, _, err := parseSeedLine(line)
+		if err == nil {
+			err = checkTargetUrl(u)
+		}
+		if err != nil {
+			fmt.Fprintf(w, "Line %d %q: %v\n", n, line, err)
+			invalid++
+			continue
+		}
+		valid++
+	}
+	if err := sc.Err(); err != nil {
+		return valid, invalid, fmt.Errorf("failed to read url line: %w", err)
+	}
+	return valid, invalid, nil
+}
+
+func validateCommand(name string, args []string) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	parseCommandArgs(fs, args, "[url-file]", 1, true)
+
+	input := os.Stdin
+	if path := fs.Arg(0); path != "" && path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			fmt.Printf("Failed to open url list: %v\n", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		input = f
+	}
+
+	valid, invalid, err := validateUrls(input, os.Stdout)
+	if err != nil {
+		fmt.Printf("Failed to validate urls: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("%d valid urls, %d invalid\n", valid, invalid)
+	if invalid > 0 || valid == 0 {
+		os.Exit(1)
+	}
+}
+
+// writeSeeds writes the urls a measurement starts from, one per host and
+// port, with their pinned addresses.
+func writeSeeds(w io.Writer, urls []*url.URL, pins map[string]netip.Addr) {
+	for _, u := range deleteDuplicateUrlsByHostPort(urls) {
+		if checkTargetUrl(u) != nil {
+			continue
+		}
+		if pin, found := pins[canonicalHost(u)]; found {
+			fmt.Fprintf(w, "%v @%v\n", u, pin)
+			continue
+		}
+		fmt.Fprintln(w, u)
+	}
+}
+
+func seedsCommand(name string, args []string) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	parseCommandArgs(fs, args, "[url-file]", 1, true)
+
+	urls, pins, err := readUrlFile(fs.Arg(0))
+	if err != nil {
+		fmt.Printf("Failed to read urls: %v\n", err)
+		os.Exit(1)
+	}
+	writeSeeds(os.Stdout, urls, pins)
+}
+
+func simulateCommand(name string, args []string) {
+	err := benchScheduler(os.Stdout, args)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fmt.Printf("Failed to simulate: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func readJsonResult(path string) (*Result, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open result: %w", err)
+	}
+	defer f.Close()
+
+	r := &Result{}
+	err = json.NewDecoder(f).Decode(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode result %v: %w", path, err)
+	}
+	return r, nil
+}
+
+// compareResults writes the figures that differ between two results, in
+// the kind and name of their csv report rows. Phases and notices always
+// differ, and warnings follow from the figures compared, so are left
+// out.
+func compareResults(w io.Writer, a, b *Result) int {
+	keys := []string{}
+	values := func(r *Result) map[string]string {
+		v := map[string]string{}
+		for _, row := range reportRows(r) {
+			if row[0] == "phase" || row[0] == "notice" || row[0] == "warning" {
+				continue
+			}
+			k := row[0] + " " + row[1]
+			if !slices.Contains(keys, k) {
+				keys = append(keys, k)
+			}
+			v[k] = row[2]
+		}
+		return v
+	}
+	aValues, bValues := values(a), values(b)
+
+	differences := 0
+	for _, k := range keys {
+		if aValues[k] == bValues[k] {
+			continue
+		}
+		fmt.Fprintf(w, "%v: %q -> %q\n", k, aValues[k], bValues[k])
+		differences++
+	}
+	return differences
+}
+
+func compareCommand(name string, args []string) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	parseCommandArgs(fs, args, "<old.json> <new.json>", 2, false)
+
+	a, err := readJsonResult(fs.Arg(0))
+	if err != nil {
+		fmt.Printf("Failed to read result: %v\n", err)
+		os.Exit(1)
+	}
+	b, err := readJsonResult(fs.Arg(1))
+	if err != nil {
+		fmt.Printf("Failed to read result: %v\n", err)
+		os.Exit(1)
+	}
+	if compareResults(os.Stdout, a, b) == 0 {
+		fmt.Println("The results are the same")
+	}
+}
+
+func main() {
+	name, args := "measure", os.Args[1:]
+	if len(args) > 0 {
+		switch {
+		case args[0] == "help" || args[0] == "-h" || args[0] == "--help":
+			printUsage(os.Stdout)
+			return
+		case args[0] == "--help-long" || args[0] == "-help-long":
+			writeLongHelp(os.Stdout, allCommands())
+			return
+		case !strings.HasPrefix(args[0], "-"):
+			name, args = args[0], args[1:]
+		}
+	}
+
+	for _, c := range allCommands() {
+		if c.name == name {
+			if wantsLongHelp(args) {
+				writeCommandHelp(os.Stdout, c)
+				return
+			}
+			c.run(name, args)
+			return
+		}
+	}
+	fmt.Printf("Unknown command %q\n\n", name)
+	printUsage(os.Stdout)
+	os.Exit(2)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestValidateUrls(t *testing.T) {
+	testcases := map[string]struct {
+		in         string
+		outValid   int
+		outInvalid int
+		outLines   []string
+	}{
+		"Valid":     {in: "https://example.com\nhttp://example.org/path\n", outValid: 2},
+		"No scheme": {in: "example.com\nhttps://example.org\n", outValid: 1, outInvalid: 1, outLines: []string{"Line 1"}},
+		"Scheme":    {in: "https://example.org\n\nftp://example.com\n", outValid: 1, outInvalid: 1, outLines: []string{"Line 3"}},
+		"Unparsable": {
+			in:         "https://example.org\nhttp://[::1\n",
+			outValid:   1,
+			outInvalid: 1,
+			outLines:   []string{"Line 2"},
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			var b bytes.Buffer
+			valid, invalid, err := validateUrls(strings.NewReader(tc.in), &b)
+			if err != nil {
+				t.Fatal("Failed to validate: ", err)
+			}
+			if valid != tc.outValid || invalid != tc.outInvalid {
+				t.Errorf("expected %d valid and %d invalid, got %d and %d", tc.outValid, tc.outInvalid, valid, invalid)
+			}
+			for _, l := range tc.outLines {
+				if !strings.Contains(b.String(), l) {
+					t.Errorf("expected %q to be reported, got %q", l, b.String())
+				}
+			}
+		})
+	}
+}
+
+func TestWriteSeeds(t *testing.T) {
+	urls, pins, err := readUrls(strings.NewReader("https://a.example\nhttps://a.example/other\nb.example\nhttp://a.example @203.0.113.9\n"))
+	if err != nil {
+		t.Fatal("Failed to read urls: ", err)
+	}
+
+	var b bytes.Buffer
+	writeSeeds(&b, urls, pins)
+	expected := "https://a.example\nhttp://a.example @203.0.113.9\n"
+	if b.String() != expected {
+		t.Errorf("expected seeds %q, got %q", expected, b.String())
+	}
+}
+
+func TestCompareResults(t *testing.T) {
+	a := &Result{MaxConnections: 10, CountedAfter: CountAfterConnect, Notices: []string{"a"}}
+	b := &Result{MaxConnections: 12, CountedAfter: CountAfterConnect, DualStack: &DualStackReport{Hosts: 3}}
+
+	var out bytes.Buffer
+	differences := compareResults(&out, a, b)
+	if differences != 4 {
+		t.Errorf("expected 4 differences, got %d: %q", differences, out.String())
+	}
+	if !strings.Contains(out.String(), `result max_connections: "10" -> "12"`) {
+		t.Errorf("expected max connections to differ, got %q", out.String())
+	}
+	if strings.Contains(out.String(), "notice") {
+		t.Errorf("expected notices to be left out, got %q", out.String())
+	}
+}
@@ -0,0 +1,172 @@
+// Functions related to generating shell completion scripts from the
+// commands and flags of natck.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+var completionShells = []string{"bash", "zsh", "fish"}
+
+var completionWriters = map[string]func(io.Writer, []command){
+	"bash": writeBashCompletion,
+	"zsh":  writeZshCompletion,
+	"fish": writeFishCompletion,
+}
+
+// completionFlag is a flag as completion scripts need it.
+type completionFlag struct {
+	name  string
+	usage string
+	// Whether the flag takes a value from the next argument
+	value bool
+}
+
+func completionFlags(c command) []completionFlag {
+	flags := []completionFlag{}
+	c.flags().VisitAll(func(f *flag.Flag) {
+		b, isBool := f.Value.(interface{ IsBoolFlag() bool })
+		flags = append(flags, completionFlag{
+			name:  f.Name,
+			usage: f.Usage,
+			value: !isBool || !b.IsBoolFlag(),
+		})
+	})
+	return flags
+}
+
+func writeBashCompletion(w io.Writer, cmds []command) {
+	names := []string{}
+	for _, c := range cmds {
+		names = append(names, c.name)
+	}
+
+	fmt.Fprintln(w, "# bash completion for natck, load with")
+	fmt.Fprintln(w, "#     source <(natck completion bash)")
+	fmt.Fprintln(w, "_natck() {")
+	fmt.Fprintln(w, "\tlocal cur=${COMP_WORDS[COMP_CWORD]}")
+	fmt.Fprintln(w, "\tif [ \"$COMP_CWORD\" -eq 1 ] && [[ $cur != -* ]]; then")
+	fmt.Fprintf(w, "\t\tCOMPREPLY=($(compgen -W %q -- \"$cur\"))\n", strings.Join(names, " "))
+	fmt.Fprintln(w, "\t\treturn")
+	fmt.Fprintln(w, "\tfi")
+	fmt.Fprintln(w, "\tlocal cmd=${COMP_WORDS[1]}")
+	fmt.Fprintln(w, "\t[[ $cmd == -* ]] && cmd=measure")
+	fmt.Fprintln(w, "\tcase $cmd in")
+	for _, c := range cmds {
+		flags := []string{}
+		for _, f := range completionFlags(c) {
+			flags = append(flags, "--"+f.name)
+		}
+		fmt.Fprintf(w, "\t%v)\n", c.name)
+		fmt.Fprintln(w, "\t\tif [[ $cur == -* ]]; then")
+		fmt.Fprintf(w, "\t\t\tCOMPREPLY=($(compgen -W %q -- \"$cur\"))\n", strings.Join(flags, " "))
+		if len(c.completeArgs) > 0 {
+			fmt.Fprintln(w, "\t\telse")
+			fmt.Fprintf(w, "\t\t\tCOMPREPLY=($(compgen -W %q -- \"$cur\"))\n", strings.Join(c.completeArgs, " "))
+		}
+		fmt.Fprintln(w, "\t\tfi")
+		fmt.Fprintln(w, "\t\t;;")
+	}
+	fmt.Fprintln(w, "\tesac")
+	fmt.Fprintln(w, "}")
+	fmt.Fprintln(w, "complete -o default -F _natck natck")
+}
+
+// zshQuote quotes s to be inside single quotes and, if brackets, the
+// brackets of an _arguments spec.
+func zshQuote(s string, brackets bool) string {
+	s = strings.ReplaceAll(s, "'", `'\''`)
+	if brackets {
+		s = strings.NewReplacer("[", `\[`, "]", `\]`).Replace(s)
+	}
+	return s
+}
+
+func writeZshCompletion(w io.Writer, cmds []command) {
+	fmt.Fprintln(w, "#compdef natck")
+	fmt.Fprintln(w, "# zsh completion for natck, save as _natck in a directory of $fpath")
+	fmt.Fprintln(w, "_natck() {")
+	fmt.Fprintln(w, "\tlocal -a commands")
+	fmt.Fprintln(w, "\tcommands=(")
+	for _, c := range cmds {
+		fmt.Fprintf(w, "\t\t'%v:%v'\n", c.name, zshQuote(c.summary, false))
+	}
+	fmt.Fprintln(w, "\t)")
+	fmt.Fprintln(w, "\tif (( CURRENT == 2 )); then")
+	fmt.Fprintln(w, "\t\t_describe 'command' commands")
+	fmt.Fprintln(w, "\t\treturn")
+	fmt.Fprintln(w, "\tfi")
+	fmt.Fprintln(w, "\tcase $words[2] in")
+	for _, c := range cmds {
+		fmt.Fprintf(w, "\t%v)\n", c.name)
+		fmt.Fprintln(w, "\t\t_arguments \\")
+		for _, f := range completionFlags(c) {
+			spec := fmt.Sprintf("--%v[%v]", f.name, zshQuote(f.usage, true))
+			if f.value {
+				spec += ":" + f.name + ":"
+			}
+			fmt.Fprintf(w, "\t\t\t'%v' \\\n", spec)
+		}
+		if len(c.completeArgs) > 0 {
+			fmt.Fprintf(w, "\t\t\t'*:argument:(%v)'\n", strings.Join(c.completeArgs, " "))
+		} else {
+			fmt.Fprintln(w, "\t\t\t'*:file:_files'")
+		}
+		fmt.Fprintln(w, "\t\t;;")
+	}
+	fmt.Fprintln(w, "\tesac")
+	fmt.Fprintln(w, "}")
+	fmt.Fprintln(w, "_natck \"$@\"")
+}
+
+func fishQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(s) + "'"
+}
+
+func writeFishCompletion(w io.Writer, cmds []command) {
+	fmt.Fprintln(w, "# fish completion for natck, load with")
+	fmt.Fprintln(w, "#     natck completion fish | source")
+	fmt.Fprintln(w, "complete -c natck -f")
+	for _, c := range cmds {
+		fmt.Fprintf(w, "complete -c natck -n __fish_use_subcommand -a %v -d %v\n", c.name, fishQuote(c.summary))
+	}
+	for _, c := range cmds {
+		seen := "'__fish_seen_subcommand_from " + c.name + "'"
+		for _, f := range completionFlags(c) {
+			fmt.Fprintf(w, "complete -c natck -n %v -l %v -d %v", seen, f.name, fishQuote(f.usage))
+			if f.value {
+				fmt.Fprint(w, " -r -F")
+			}
+			fmt.Fprintln(w)
+		}
+		if len(c.completeArgs) > 0 {
+			fmt.Fprintf(w, "complete -c natck -n %v -a %v\n", seen, fishQuote(strings.Join(c.completeArgs, " ")))
+		} else {
+			fmt.Fprintf(w, "complete -c natck -n %v -F\n", seen)
+		}
+	}
+}
+
+func writeCompletion(w io.Writer, shell string) error {
+	write, found := completionWriters[shell]
+	if !found {
+		return fmt.Errorf("unsupported shell %q, one of %v", shell, strings.Join(completionShells, ", "))
+	}
+	write(w, allCommands())
+	return nil
+}
+
+func completionCommand(name string, args []string) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	parseCommandArgs(fs, args, "<"+strings.Join(completionShells, "|")+">", 1, false)
+
+	err := writeCompletion(os.Stdout, fs.Arg(0))
+	if err != nil {
+		fmt.Printf("Failed to complete: %v\n", err)
+		os.Exit(1)
+	}
+}
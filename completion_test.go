@@ -0,0 +1,29 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWriteCompletion(t *testing.T) {
+	for _, shell := range completionShells {
+		t.Run(shell, func(t *testing.T) {
+			var b bytes.Buffer
+			err := writeCompletion(&b, shell)
+			if err != nil {
+				t.Fatal("Failed to write completion: ", err)
+			}
+			for _, expected := range []string{"measure", "server", "compare", "strict-politeness", "listen", "hosts"} {
+				if !strings.Contains(b.String(), expected) {
+					t.Errorf("expected %q to be completed", expected)
+				}
+			}
+		})
+	}
+
+	err := writeCompletion(&bytes.Buffer{}, "csh")
+	if err == nil {
+		t.Error("expected an unsupported shell to fail")
+	}
+}
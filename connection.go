@@ -3,7 +3,9 @@
 package main
 
 import (
+	"cmp"
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
@@ -15,8 +17,6 @@ import (
 	"time"
 )
 
-const reRequestInterval = 3500 * time.Millisecond
-
 type ctxAddrKey struct{}
 
 type crawlError struct {
@@ -35,49 +35,69 @@ type connection struct {
 	host          *host
 	url           *url.URL
 	client        *http.Client
+	pinger        *h2Pinger
 	uncrawledUrls map[relativeUrl]bool
 	crawlingUrls  map[relativeUrl]bool
 	crawledUrls   map[relativeUrl]bool
-	robots        robotstxt
-	crawlDelay    time.Duration
-	lastRequest   time.Time
-	lastReply     time.Time
-}
-
-// Rotates lookups from each connection response to avoid
-// spending ages resolving one connection whilst others
-// are already.
-type lookupQueue struct {
-	urls [][]*url.URL
+	robots        RobotsTxt
+	// robots.txt failed to be fetched and is being retried
+	robotsRetry bool
+	// Time idle before keeping the connection alive, zero is
+	// reRequestInterval
+	keepAliveInterval time.Duration
+	// How far the connection got, see usableConnections
+	robotsFetched  bool
+	contentFetched bool
+	crawlDelay     time.Duration
+	lastRequest    time.Time
+	lastReply      time.Time
+	// Intervals between requests
+	pacing pacing
+	// First successful reply, zero until established
+	established time.Time
+	// A request is outstanding. Only one request is made at a time,
+	// otherwise the transport would dial a second connection.
+	inFlight bool
+	// Negotiated on the first TLS reply, nil until then or without TLS.
+	tls *tlsState
+	// The TCP connection once dialed, to check whether it is half-open.
+	conn atomic.Pointer[countingConn]
+	// Keeps the connection alive once there is nothing new to crawl,
+	// nil re-requests pages or sends HTTP/2 PINGs.
+	keepAliver KeepAliver
+	// Only keep-alives are sent, keepAliver may have taken over the
+	// connection.
+	keepingAlive bool
+	// The first url crawled with each content hash, and the patterns of
+	// urls found to duplicate another's content, see duplicateContent.
+	bodyHashes   map[uint64]relativeUrl
+	trapPatterns map[string]bool
+	// Queries crawled of each path, see TrapLimits.MaxQueryVariants
+	queryVariants map[string]map[string]bool
+	// Sent with every request, empty is Go's default
+	userAgent string
+	// Response headers captured, see Measurer.CaptureHeaders
+	headers map[string]string
+	// How far through its lifecycle the connection is
+	state connectionState
+	// Socket of the last successful reply, and whether a successful
+	// reply came over the same socket as the one before
+	lastSocket   *countingConn
+	socketReused bool
+	// One of the first connections, established as Measurer.Preload
+	preload bool
+	// HTTP status of the last response, zero before any
+	lastStatus int
+	// Least crawlDelay, as overridden for the host
+	minCrawlDelay time.Duration
+	// Hostnames resolved to the address, that of url first
+	hostnames []string
 }
 
 func (e *crawlError) Error() string {
 	return fmt.Sprintf("crawling error during %v: %v", e.opErr, e.err)
 }
 
-func (q lookupQueue) peek() *url.URL {
-	if len(q.urls) == 0 {
-		return nil
-	}
-	return q.urls[0][0]
-}
-
-func (q *lookupQueue) put(u ...*url.URL) {
-	q.urls = append(q.urls, u)
-}
-
-func (q *lookupQueue) pop() *url.URL {
-	u := q.urls[0][0]
-
-	if len(q.urls[0]) == 1 {
-		q.urls = q.urls[1:]
-		return u
-	}
-
-	q.urls = append(q.urls[1:], q.urls[0][1:])
-	return u
-}
-
 func urlPort(u *url.URL) string {
 	if port := u.Port(); port != "" {
 		return port
@@ -133,12 +153,17 @@ func isDialError(err error) bool {
 }
 
 func canonicalHost(u *url.URL) string {
-	return net.JoinHostPort(u.Hostname(), urlPort(u))
+	host := u.Hostname()
+	if addr, err := netip.ParseAddr(host); err == nil {
+		// The same address may be written many ways, especially IPv6
+		host = addr.String()
+	}
+	return net.JoinHostPort(host, urlPort(u))
 }
 
-func indexKeepAliveConnection(conns []*connection) int {
+func indexKeepAliveConnection(conns []*connection, now time.Time) int {
 	return slices.IndexFunc(conns, func(c *connection) bool {
-		return time.Since(c.lastReply) > reRequestInterval && time.Since(c.lastRequest) > c.crawlDelay
+		return keepAliveDue(c, now)
 	})
 }
 
@@ -185,8 +210,10 @@ func deleteDuplicateUrlsByHostPort(urls []*url.URL) []*url.URL {
 	return uniqueUrls
 }
 
-func makeClient() *http.Client {
-	var dialed atomic.Bool
+// makeClient makes the client of one connection, storing the connection
+// in dialedConn once dialed, if not nil.
+func makeClient(t *traffic, tlsConf *tls.Config, dialedConn *atomic.Pointer[countingConn]) (*http.Client, *h2Pinger) {
+	var dialed, proxied atomic.Bool
 
 	// Need a unique transport per http.Client to avoid re-using the same
 	// connections, otherwise the NAT count will be wrong.
@@ -195,6 +222,19 @@ func makeClient() *http.Client {
 	transport.IdleConnTimeout = 0
 	transport.MaxIdleConns = 1
 	transport.MaxConnsPerHost = 1
+	applyTlsConfig(transport, tlsConf)
+	pinger := configureH2Pinger(transport)
+	transport.Proxy = func(req *http.Request) (*url.URL, error) {
+		if t.proxy == nil {
+			return nil, nil
+		}
+		u, err := t.proxy(req)
+		if u != nil {
+			proxied.Store(true)
+			t.proxies.add(u)
+		}
+		return u, err
+	}
 	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
 		isFirstDial := dialed.CompareAndSwap(false, true)
 		if !isFirstDial {
@@ -210,9 +250,31 @@ func makeClient() *http.Client {
 		}
 
 		// Http clients should not resolve the address. Overriding the dial avoids having to
-		// override URL and TLS ServerName.
-		addrShouldUse := ctx.Value(ctxAddrKey{}).(netip.AddrPort)
-		return http.DefaultTransport.(*http.Transport).DialContext(ctx, network, addrShouldUse.String())
+		// override URL and TLS ServerName. Proxies are dialed as given.
+		if !proxied.Load() {
+			addr = ctx.Value(ctxAddrKey{}).(netip.AddrPort).String()
+		}
+		dial := http.DefaultTransport.(*http.Transport).DialContext
+		if t.dialer != nil {
+			dial = t.dialer.DialContext
+		}
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		err = t.socket.apply(conn)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		cConn := &countingConn{Conn: conn, traffic: t}
+		if t.open != nil {
+			t.open.add(cConn)
+		}
+		if dialedConn != nil {
+			dialedConn.Store(cConn)
+		}
+		return cConn, nil
 	}
 
 	client := http.Client{
@@ -222,13 +284,12 @@ func makeClient() *http.Client {
 		},
 		Transport: transport,
 	}
-	return &client
+	return &client, pinger
 }
 
-func makeConnection(addr netip.AddrPort, target *url.URL) *connection {
+func makeConnection(addr netip.AddrPort, target *url.URL, t *traffic, tlsConf *tls.Config) *connection {
 	c := &connection{
-		client: makeClient(),
-		url:    target,
+		url: target,
 		uncrawledUrls: map[relativeUrl]bool{
 			pathToRelativeUrl("/robots.txt"): true,
 			urlToRelativeUrl(target):         true,
@@ -240,12 +301,19 @@ func makeConnection(addr netip.AddrPort, target *url.URL) *connection {
 			hostPort: canonicalHost(target),
 		},
 		crawlDelay: reRequestInterval,
+		hostnames:  []string{urlHostname(target)},
 	}
+	c.client, c.pinger = makeClient(t, tlsConf, &c.conn)
 	return c
 }
 
-func getNextConnection(pendingConns, activeConns []*connection, freeWorkers int) *connection {
-	if i := indexKeepAliveConnection(activeConns); i != -1 {
+// nextConnection picks the connection to request next, of the pending
+// connections and the active connections of s, using at most freeWorkers
+// to crawl for new hosts. Nil if none should be requested yet.
+func (s *scheduler) nextConnection(pendingConns []*connection, freeWorkers int) *connection {
+	activeConns := s.activeConns
+	now := s.now()
+	if i := indexKeepAliveConnection(activeConns, now); i != -1 {
 		// Prioritise existing connections to avoid http keep-alive
 		// or NAT mapping expires
 		return activeConns[i]
@@ -258,7 +326,7 @@ func getNextConnection(pendingConns, activeConns []*connection, freeWorkers int)
 		// frequency to try to find new hosts
 		availableToCrawl := []*connection{}
 		for _, c := range activeConns {
-			if len(c.uncrawledUrls) == 0 || time.Since(c.lastRequest) < c.crawlDelay {
+			if c.inFlight || len(c.uncrawledUrls) == 0 || now.Sub(c.lastRequest) < c.crawlDelay {
 				continue
 			}
 			availableToCrawl = append(availableToCrawl, c)
@@ -298,16 +366,18 @@ func getNextUrlToCrawl(c *connection) *url.URL {
 		}
 		return target
 	}
+	return getCrawledUrl(c)
+}
 
-	// Randomise re-used crawled urls
+// getCrawledUrl picks a crawled url allowed by robots.txt, at random, or
+// the url the connection was made for.
+func getCrawledUrl(c *connection) *url.URL {
 	for r := range c.crawledUrls {
-		var err error
-
 		if !c.robots.pathAllowed(r.getRawPath()) {
 			continue
 		}
 
-		target, err = resolveRelativeUrl(c.url, r)
+		target, err := resolveRelativeUrl(c.url, r)
 		if err != nil {
 			// Shouldn't be possible, try again next time
 			continue
@@ -326,7 +396,7 @@ func stealUrlsForConnections(connections []*connection, urls []*url.URL) []*url.
 			r := urlToRelativeUrl(u)
 			_, inCrawling := c.crawlingUrls[r]
 			_, inCrawled := c.crawledUrls[r]
-			if !inCrawling && !inCrawled && c.robots.pathAllowed(u.Path) {
+			if !inCrawling && !inCrawled && c.robots.pathAllowed(u.Path) && !c.trapPatterns[r.pattern()] {
 				c.uncrawledUrls[r] = true
 			}
 			continue
@@ -337,185 +407,79 @@ func stealUrlsForConnections(connections []*connection, urls []*url.URL) []*url.
 }
 
 func makeCrawlRequest(c *connection) *roundtrip {
+	if c.keepAliver != nil && len(c.uncrawledUrls) == 0 {
+		c.keepingAlive = true
+	}
+	if c.keepingAlive {
+		return makeKeepAliveRequest(c)
+	}
+
 	target := getNextUrlToCrawl(c)
+	return &roundtrip{
+		connId: c.id,
+		client: c.client,
+		// Once there is nothing new to crawl, requests only keep the
+		// connection alive, which a PING does for far fewer bytes.
+		ping:       len(c.uncrawledUrls) == 0 && c.pinger.ready(),
+		pinger:     c.pinger,
+		url:        target,
+		host:       c.host,
+		robots:     c.robots,
+		crawlDelay: c.crawlDelay,
+	}
+}
+
+// makeKeepAliveRequest makes a request only keeping c alive, with its
+// keepAliver.
+func makeKeepAliveRequest(c *connection) *roundtrip {
+	target := getCrawledUrl(c)
+	k := &KeepAliveConn{
+		Client:   c.client,
+		Url:      target,
+		Interval: cmp.Or(c.keepAliveInterval, reRequestInterval),
+		pinger:   c.pinger,
+	}
+	if conn := c.conn.Load(); conn != nil {
+		k.Conn = conn
+	}
 	return &roundtrip{
 		connId:     c.id,
 		client:     c.client,
+		pinger:     c.pinger,
 		url:        target,
 		host:       c.host,
 		robots:     c.robots,
 		crawlDelay: c.crawlDelay,
+		keepAliver: c.keepAliver,
+		keepAlive:  k,
 	}
 }
 
-func lookupv4AddrRequest(h *url.URL, resolvedAddr chan<- *resolvedUrl, cancel <-chan struct{}) {
-	select {
-	case resolvedAddr <- lookupAddr("ip4", h):
-	case <-cancel:
+// ipNetwork is the network to lookup addresses on.
+func ipNetwork(ipv6 bool) string {
+	if ipv6 {
+		return "ip6"
 	}
+	return "ip4"
 }
 
-func scrapConnectionRequest(r *roundtrip, scraped chan<- *roundtrip, cancel <-chan struct{}) {
-	ctx := context.WithValue(context.Background(), ctxAddrKey{}, r.host.ip)
+func lookupAddrRequest(ctx context.Context, n network, h *url.URL, ipNetwork string, dualStack bool, resolvedAddr chan<- *resolvedUrl, cancel <-chan struct{}) {
+	var r *resolvedUrl
+	if dualStack && ipNetwork == "ip4" {
+		r = lookupDualStack(ctx, n, h)
+	} else {
+		r = n.lookupAddr(ctx, ipNetwork, h)
+	}
 	select {
-	case scraped <- scrapConnection(ctx, r):
+	case resolvedAddr <- r:
 	case <-cancel:
 	}
 }
 
-func MeasureMaxConnections(urls []*url.URL) int {
-	lookupAddrReply := make(chan *resolvedUrl)
-	scrapedReply := make(chan *roundtrip)
-	stopC := make(chan struct{})
-
-	workerLimit := 10000
-	semC := make(chan struct{}, workerLimit)
-
-	urls = deleteDuplicateUrlsByHostPort(urls)
-	pendingResolutions := lookupQueue{}
-	for _, u := range urls {
-		pendingResolutions.put(u)
-	}
-
-	connectionIdCtr := uint(0)
-	repeatedDialFails := 0
-	pendingConns := []*connection{}
-	activeConns := []*connection{}
-	failedConns := []*connection{}
-	for {
-		var lookupAddrSemC chan<- struct{} = nil
-		var scrapRequestSemC chan<- struct{} = nil
-
-		if pendingResolutions.peek() != nil {
-			lookupAddrSemC = semC
-		}
-
-		crawlConnection := getNextConnection(pendingConns, activeConns, workerLimit-len(semC))
-		if crawlConnection != nil {
-			scrapRequestSemC = semC
-		}
-
-		select {
-		case <-time.After(50 * time.Millisecond):
-		case lookupAddrSemC <- struct{}{}:
-			hUrl := pendingResolutions.pop()
-			go func() {
-				// Only lookup IPv4 addresses. IPv6 addresses are
-				// not running out so no need for CGNAT.
-				lookupv4AddrRequest(hUrl, lookupAddrReply, stopC)
-				<-semC
-			}()
-		case h, ok := <-lookupAddrReply:
-			if !ok {
-				return -1
-			}
-
-			i := slices.IndexFunc(h.addresses, func(a netip.AddrPort) bool {
-				return indexConnectionByAddr(pendingConns, a) == -1 &&
-					indexConnectionByAddr(activeConns, a) == -1
-			})
-			if i == -1 {
-				break
-			}
-			c := makeConnection(h.addresses[i], h.url)
-			c.id = connectionIdCtr
-			pendingConns = append(pendingConns, c)
-			connectionIdCtr++
-		case scrapRequestSemC <- struct{}{}:
-			request := makeCrawlRequest(crawlConnection)
-			crawlConnection.lastRequest = time.Now()
-			go func() {
-				scrapConnectionRequest(request, scrapedReply, stopC)
-				<-semC
-			}()
-
-			rUrl := urlToRelativeUrl(request.url)
-			delete(crawlConnection.uncrawledUrls, rUrl)
-			crawlConnection.crawlingUrls[rUrl] = true
-
-			if len(pendingConns) > 0 && pendingConns[0] == crawlConnection {
-				pendingConns = pendingConns[1:]
-				activeConns = append(activeConns, crawlConnection)
-			}
-		case reply, ok := <-scrapedReply:
-			if !ok {
-				return -1
-			}
-
-			i := indexConnectionById(activeConns, reply.connId)
-			if i == -1 {
-				break
-			}
-
-			c := activeConns[i]
-
-			// Dial errors may signify the middleware NAT device has run out
-			// of ports for this client
-			if isDialError(reply.err) {
-				var err *crawlError
-				if !errors.As(reply.err, &err) {
-					repeatedDialFails++
-				}
-			} else if reply.err == nil && len(c.crawledUrls) == 0 {
-				repeatedDialFails = 0
-			}
-
-			// Add new connections
-			rUrl := urlToRelativeUrl(reply.url)
-			delete(c.crawlingUrls, rUrl)
-			c.crawledUrls[rUrl] = true
-			c.robots = reply.robots
-			c.crawlDelay = reply.crawlDelay
-			c.lastRequest = reply.requestTs
-			c.lastReply = reply.replyTs
-
-			if reply.err != nil {
-				failedConns = append(failedConns, activeConns[i])
-				activeConns = slices.Delete(activeConns, i, i+1)
-			}
-
-			// Determine where to put the newly scraped urls
-			newUrls := stealUrlsForConnections(activeConns, reply.scrapedUrls)
-			urlsToResolve := []*url.URL{}
-			for _, u := range newUrls {
-				if indexUrlByHostPort(urlsToResolve, u) != -1 {
-					continue
-				}
-				if indexConnectionByHostPort(pendingConns, u) != -1 {
-					continue
-				}
-				if indexConnectionByHostPort(failedConns, u) != -1 {
-					// Avoid consuming extra NAT translations on a bad server
-					continue
-				}
-				urlsToResolve = append(urlsToResolve, u)
-			}
-			if len(urlsToResolve) > 0 {
-				pendingResolutions.put(urlsToResolve...)
-			}
-		}
-
-		if repeatedDialFails >= 5 {
-			// Assume the NAT has exceeded the allowed connections
-			// after repeated dail failures.
-			break
-		}
-		if len(pendingConns) == 0 && len(pendingResolutions.urls) == 0 && len(semC) == 0 {
-			haveMoreUrls := slices.ContainsFunc(activeConns, func(c *connection) bool {
-				return len(c.uncrawledUrls)+len(c.crawlingUrls) > 0
-			})
-			if !haveMoreUrls {
-				break
-			}
-		}
-	}
-
-	close(stopC)
-	for i := workerLimit; i > 0; i-- {
-		semC <- struct{}{}
+func scrapConnectionRequest(ctx context.Context, n network, r *roundtrip, scraped chan<- *roundtrip, cancel <-chan struct{}) {
+	ctx = context.WithValue(ctx, ctxAddrKey{}, r.host.ip)
+	select {
+	case scraped <- n.scrapConnection(ctx, r):
+	case <-cancel:
 	}
-	close(semC)
-	close(lookupAddrReply)
-	close(scrapedReply)
-	return len(activeConns)
 }
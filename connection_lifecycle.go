@@ -0,0 +1,64 @@
+// Functions related to the lifecycle of connections, so every connection
+// is released once the measurement no longer needs it, rather than
+// leaking descriptors over the many measurements of a daemon.
+package main
+
+// connectionState is how far a connection got, each moving from created
+// through dialing and active to failed or closed.
+type connectionState int
+
+const (
+	// Resolved and pending, not yet dialed
+	stateCreated connectionState = iota
+	// The first request was made, without a reply yet
+	stateDialing
+	// Established by a successful reply
+	stateActive
+	stateFailed
+	stateClosed
+)
+
+func (st connectionState) String() string {
+	switch st {
+	case stateCreated:
+		return "created"
+	case stateDialing:
+		return "dialing"
+	case stateActive:
+		return "active"
+	case stateFailed:
+		return "failed"
+	case stateClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+// finish moves c to the failed or closed state, closing the idle
+// connections of its transport. The client may already have been dropped
+// to shed memory.
+func (c *connection) finish(st connectionState) {
+	c.state = st
+	if c.client != nil {
+		c.client.CloseIdleConnections()
+	}
+}
+
+// releaseConnections closes the connections the measurement is over
+// with. The pending connections never dialed are abandoned and the failed
+// connections have their transports closed once more, for replies that
+// returned a connection to the pool after failing. The active connections
+// are kept when held.
+func (s *scheduler) releaseConnections(hold bool) {
+	for _, c := range s.pendingConns {
+		c.finish(stateClosed)
+	}
+	s.closedConns = append(s.closedConns, s.pendingConns...)
+	s.pendingConns = nil
+	for _, c := range s.failedConns {
+		c.finish(stateFailed)
+	}
+	if !hold {
+		s.closeActiveConnections()
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReleaseConnections(t *testing.T) {
+	testcases := map[string]struct {
+		inHold      bool
+		expectState connectionState
+		expectClose int32
+	}{
+		"closed": {expectState: stateClosed, expectClose: 2},
+		"held":   {inHold: true, expectState: stateActive, expectClose: 1},
+	}
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			// A server of its own, so closes left over from another
+			// case are not counted
+			var closed atomic.Int32
+			srv := httptest.NewUnstartedServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {}))
+			srv.Config.ConnState = func(_ net.Conn, st http.ConnState) {
+				if st == http.StateClosed {
+					closed.Add(1)
+				}
+			}
+			srv.Start()
+			defer srv.Close()
+			u, err := url.Parse(srv.URL)
+			if err != nil {
+				t.Fatal("Failed to parse server url: ", err)
+			}
+			addr := netip.MustParseAddrPort(u.Host)
+
+			ctx := context.WithValue(context.Background(), ctxAddrKey{}, addr)
+			// Both are left idle in the pool of their transport
+			failed := makeConnection(addr, u, &traffic{}, nil)
+			active := makeConnection(addr, u, &traffic{}, nil)
+			for _, c := range []*connection{failed, active} {
+				if r := scrapConnection(ctx, makeCrawlRequest(c)); r.err != nil {
+					t.Fatal("Failed to scrap: ", r.err)
+				}
+			}
+			failed.state = stateFailed
+			active.state = stateActive
+			defer active.client.CloseIdleConnections()
+			pending := makeConnection(addr, u, &traffic{}, nil)
+
+			s := scheduler{
+				pendingConns: []*connection{pending},
+				activeConns:  []*connection{active},
+				failedConns:  []*connection{failed},
+			}
+			s.releaseConnections(tc.inHold)
+
+			if len(s.pendingConns) != 0 || len(s.closedConns) != 1 || pending.state != stateClosed {
+				t.Errorf("expected the pending connection to be abandoned, got %d pending in state %v", len(s.pendingConns), pending.state)
+			}
+			if active.state != tc.expectState {
+				t.Errorf("expected the active connection to be %v, got %v", tc.expectState, active.state)
+			}
+			deadline := time.Now().Add(5 * time.Second)
+			for closed.Load() < tc.expectClose && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			if n := closed.Load(); n != tc.expectClose {
+				t.Errorf("expected %d connections to be closed, got %d", tc.expectClose, n)
+			}
+		})
+	}
+}
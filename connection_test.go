@@ -1,11 +1,13 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"html/template"
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/netip"
 	"net/url"
 	"os"
@@ -272,7 +274,10 @@ func startHttpServer(t *testing.T, tSrv *httpTestServer) {
 }
 
 func checkMaxConnections(t *testing.T, urls []*url.URL, nConns int, srvs []*httpTestServer) {
-	measured := MeasureMaxConnections(urls)
+	measured, err := MeasureMaxConnections(context.Background(), urls)
+	if err != nil {
+		t.Fatal("Failed to measure max connections: ", err)
+	}
 	if measured != nConns {
 		t.Errorf("expected to measure %d connections, got %d", nConns, measured)
 	}
@@ -365,6 +370,77 @@ func TestSmallTopologyConvergence(t *testing.T) {
 	}
 }
 
+func TestMeasureMaxConnectionsDeadline(t *testing.T) {
+	// Never replies until the request is cancelled
+	srv := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		<-req.Context().Done()
+	}))
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal("Failed to parse server url: ", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	started := time.Now()
+	if _, err := MeasureMaxConnections(ctx, []*url.URL{u}); err != nil {
+		t.Error("expected the connections so far once the deadline passed, got: ", err)
+	}
+	if time.Since(started) > 10*time.Second {
+		t.Errorf("expected the deadline to stop the measurement, took %v", time.Since(started))
+	}
+}
+
+func TestMeasureLimits(t *testing.T) {
+	testcases := map[string]struct {
+		inMeasurer    Measurer
+		expectConns   int
+		expectWarning bool
+		expectNotice  bool
+	}{
+		"Timeout": {
+			inMeasurer:    Measurer{Strategy: "sustain-only", SustainDuration: time.Hour, Timeout: 500 * time.Millisecond},
+			expectConns:   2,
+			expectWarning: true,
+		},
+		"Connection limit": {
+			inMeasurer:   Measurer{ConnectionLimit: 5},
+			expectConns:  5,
+			expectNotice: true,
+		},
+		"Workers": {
+			inMeasurer:  Measurer{Policy: Policy{WorkerLimit: 1, PollInterval: time.Millisecond}},
+			expectConns: 20,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			n := &benchNetwork{hosts: 20, fanout: 2, seeds: 2}
+			m := tc.inMeasurer
+			m.network = n
+			started := time.Now()
+			r, err := m.Measure(n.seedUrls())
+			if err != nil {
+				t.Fatal("Failed to measure: ", err)
+			}
+			if time.Since(started) > 10*time.Second {
+				t.Errorf("expected the measurement to stop, took %v", time.Since(started))
+			}
+			if r.MaxConnections != tc.expectConns {
+				t.Errorf("expected to measure %d connections, got %d", tc.expectConns, r.MaxConnections)
+			}
+			if warned := len(r.Warnings) > 0; warned != tc.expectWarning {
+				t.Errorf("expected a warning %v, got %v", tc.expectWarning, r.Warnings)
+			}
+			if noticed := len(r.Notices) > 0; noticed != tc.expectNotice {
+				t.Errorf("expected a notice %v, got %v", tc.expectNotice, r.Notices)
+			}
+		})
+	}
+}
+
 func TestBigTopologyConvergence(t *testing.T) {
 	if testing.Short() {
 		t.Skip("skipping TestMeasureMaxConnections in short mode due to re-request timeouts.")
@@ -449,6 +525,192 @@ func TestRequestCrawlDelay(t *testing.T) {
 	}
 }
 
+// inFlightNetwork tracks the most requests made at once on a connection.
+type inFlightNetwork struct {
+	liveNetwork
+	m           sync.Mutex
+	inFlight    map[uint]int
+	maxInFlight int
+}
+
+func (n *inFlightNetwork) scrapConnection(ctx context.Context, r *roundtrip) *roundtrip {
+	n.m.Lock()
+	n.inFlight[r.connId]++
+	n.maxInFlight = max(n.maxInFlight, n.inFlight[r.connId])
+	n.m.Unlock()
+	defer func() {
+		n.m.Lock()
+		n.inFlight[r.connId]--
+		n.m.Unlock()
+	}()
+	return n.liveNetwork.scrapConnection(ctx, r)
+}
+
+func TestOneRequestInFlight(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping due to slow responses.")
+	}
+
+	srv := &httpTestServer{name: "server"}
+	startHttpServer(t, srv)
+
+	root := makeServerRoot(t)
+	pages := []*url.URL{}
+	for i := range 4 {
+		pages = append(pages, srv.tUrl(t, fmt.Sprintf("page%d.html", i)))
+	}
+	makeHtmlDocWithLinks(t, pages, path.Join(root, "index.html"))
+	for i := range pages {
+		cpFile(t, tPath("no_links.html"), path.Join(root, fmt.Sprintf("page%d.html", i)))
+	}
+	robotsTxt := *defaultRobotsTxtRecord.Clone()
+	robotsTxt.Rules = []rule{
+		{Token: "Crawl-delay", Value: "0.1"},
+	}
+	makeRobotsTxt(t, []record{robotsTxt}, path.Join(root, "robots.txt"))
+
+	// Replies are much slower than the crawl delay, so a second
+	// request would overlap the first.
+	srv.server.Handler = HandlerChain{
+		makeLatencyHandler(500 * time.Millisecond),
+		makeFileHandler(root),
+	}
+
+	n := &inFlightNetwork{inFlight: map[uint]int{}}
+	m := Measurer{network: n}
+	r, err := m.Measure([]*url.URL{srv.tUrl(t, "")})
+	if err != nil {
+		t.Fatal("Failed to measure: ", err)
+	}
+	if r.MaxConnections != 1 {
+		t.Errorf("expected to measure 1 connection, got %d", r.MaxConnections)
+	}
+
+	n.m.Lock()
+	defer n.m.Unlock()
+	if n.maxInFlight != 1 {
+		t.Errorf("expected one request in flight per connection, got %d", n.maxInFlight)
+	}
+}
+
+func TestNextConnectionSkipsInFlight(t *testing.T) {
+	makeConn := func(inFlight bool) *connection {
+		u, _ := url.Parse("http://127.0.0.1/")
+		c := makeConnection(netip.MustParseAddrPort("127.0.0.1:80"), u, &traffic{}, nil)
+		c.inFlight = inFlight
+		return c
+	}
+
+	testcases := map[string]struct {
+		conns []*connection
+		want  int
+	}{
+		"Idle":      {conns: []*connection{makeConn(false)}, want: 0},
+		"In flight": {conns: []*connection{makeConn(true)}, want: -1},
+		"Mixed":     {conns: []*connection{makeConn(true), makeConn(false)}, want: 1},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			s := scheduler{activeConns: tc.conns}
+			c := s.nextConnection(nil, workerLimit)
+			got := slices.Index(tc.conns, c)
+			if c == nil {
+				got = -1
+			}
+			if got != tc.want {
+				t.Errorf("expected connection %d to be next, got %d", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestNextConnection(t *testing.T) {
+	now := time.Now()
+	// A connection last requested and replied to the durations ago
+	makeConn := func(requested, replied time.Duration, uncrawled bool) *connection {
+		u, _ := url.Parse("http://127.0.0.1/")
+		c := makeConnection(netip.MustParseAddrPort("127.0.0.1:80"), u, &traffic{}, nil)
+		c.lastRequest = now.Add(-requested)
+		c.lastReply = now.Add(-replied)
+		c.keepAliveInterval = reRequestInterval
+		if !uncrawled {
+			c.uncrawledUrls = map[relativeUrl]bool{}
+		}
+		return c
+	}
+
+	testcases := map[string]struct {
+		inActive      []time.Duration
+		inUncrawled   bool
+		inPending     bool
+		inFreeWorkers int
+		expectNext    int
+	}{
+		"Keep-alive before pending": {
+			inActive:      []time.Duration{10 * time.Second},
+			inPending:     true,
+			inFreeWorkers: 1,
+			expectNext:    0,
+		},
+		"Pending before crawling": {
+			inActive:      []time.Duration{time.Second},
+			inUncrawled:   true,
+			inPending:     true,
+			inFreeWorkers: 1,
+			expectNext:    -2,
+		},
+		"Crawls with free workers": {
+			inActive:      []time.Duration{time.Second},
+			inUncrawled:   true,
+			inFreeWorkers: 1,
+			expectNext:    0,
+		},
+		"No free workers": {
+			inActive:    []time.Duration{time.Second},
+			inUncrawled: true,
+			expectNext:  -1,
+		},
+		"Nothing to crawl": {
+			inActive:      []time.Duration{time.Second},
+			inFreeWorkers: 1,
+			expectNext:    -1,
+		},
+		"Latest reply crawled first": {
+			inActive:      []time.Duration{2 * time.Second, time.Second, 3 * time.Second},
+			inUncrawled:   true,
+			inFreeWorkers: 1,
+			expectNext:    1,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			s := scheduler{clock: func() time.Time { return now }}
+			for _, replied := range tc.inActive {
+				// Past the crawl delay, but not the keep-alive interval
+				// unless replied to before it
+				s.activeConns = append(s.activeConns, makeConn(replied+reRequestInterval, replied, tc.inUncrawled))
+			}
+			var pending []*connection
+			if tc.inPending {
+				pending = []*connection{makeConn(0, 0, true)}
+			}
+
+			c := s.nextConnection(pending, tc.inFreeWorkers)
+			got := slices.Index(s.activeConns, c)
+			if c == nil {
+				got = -1
+			} else if got == -1 {
+				got = -2
+			}
+			if got != tc.expectNext {
+				t.Errorf("expected connection %d to be next, got %d", tc.expectNext, got)
+			}
+		})
+	}
+}
+
 func TestRequestRateLimiting(t *testing.T) {
 	if testing.Short() {
 		t.Skip("skipping due to re-request timeouts.")
@@ -796,3 +1058,192 @@ func TestCrawlingBehaviour(t *testing.T) {
 		})
 	}
 }
+
+func TestMaxTotalBytes(t *testing.T) {
+	urls := []*url.URL{}
+	for i := range 3 {
+		root := makeServerRoot(t, tPath("wildcard_robots.txt"), tPath("no_links.html"))
+		srv := &httpTestServer{
+			name:     fmt.Sprintf("http.%v", i),
+			handlers: HandlerChain{makeFileHandler(root)},
+		}
+		startHttpServer(t, srv)
+		urls = append(urls, srv.tUrl(t, "index.html"))
+	}
+
+	m := Measurer{MaxTotalBytes: 1}
+	r, err := m.Measure(urls)
+	if err != nil {
+		t.Fatal("Failed to measure: ", err)
+	}
+	if !r.OverBudget {
+		t.Error("expected the measurement to stop after exceeding the data budget")
+	}
+	if r.BytesSent == 0 || r.BytesReceived == 0 {
+		t.Errorf("expected traffic to be counted, got %d sent and %d received", r.BytesSent, r.BytesReceived)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	root := makeServerRoot(t, tPath("wildcard_robots.txt"), tPath("no_links.html"))
+	srv := &httpTestServer{
+		name:     "http",
+		handlers: HandlerChain{makeFileHandler(root)},
+	}
+	startHttpServer(t, srv)
+
+	// Nothing listens on port 1 of localhost
+	refused, err := url.Parse("http://127.0.0.1:1/index.html")
+	if err != nil {
+		t.Fatal("Failed to parse test url: ", err)
+	}
+
+	var m sync.Mutex
+	events := []Event{}
+	measurer := Measurer{
+		OnEvent: func(e Event) {
+			m.Lock()
+			defer m.Unlock()
+			events = append(events, e)
+		},
+	}
+	_, err = measurer.Measure([]*url.URL{srv.tUrl(t, "index.html"), refused})
+	if err != nil {
+		t.Fatal("Failed to measure: ", err)
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	count := map[EventType]int{}
+	for _, e := range events {
+		count[e.Type]++
+	}
+	if count[EventConnectionEstablished] != 1 {
+		t.Errorf("expected 1 %v event, got %d", EventConnectionEstablished, count[EventConnectionEstablished])
+	}
+	if count[EventConnectionFailed] != 1 {
+		t.Errorf("expected 1 %v event, got %d", EventConnectionFailed, count[EventConnectionFailed])
+	}
+}
+
+func TestPhases(t *testing.T) {
+	root := makeServerRoot(t, tPath("wildcard_robots.txt"), tPath("no_links.html"))
+	srv := &httpTestServer{
+		name:     "http",
+		handlers: HandlerChain{makeFileHandler(root)},
+	}
+	startHttpServer(t, srv)
+
+	measurer := Measurer{}
+	r, err := measurer.Measure([]*url.URL{srv.tUrl(t, "no_links.html")})
+	if err != nil {
+		t.Fatal("Failed to measure: ", err)
+	}
+
+	names := []PhaseName{}
+	for i, p := range r.Phases {
+		names = append(names, p.Name)
+		if i > 0 && p.Time.Before(r.Phases[i-1].Time) {
+			t.Errorf("phase %v is before phase %v", p.Name, r.Phases[i-1].Name)
+		}
+	}
+	expected := []PhaseName{PhaseResolutionStart, PhaseRampStart, PhaseDrainStart, PhaseEnd}
+	if !slices.Equal(names, expected) {
+		t.Errorf("expected phases %v, got %v", expected, names)
+	}
+}
+
+func TestCountBySchemePort(t *testing.T) {
+	makeConn := func(s string) *connection {
+		u, err := url.Parse(s)
+		if err != nil {
+			t.Fatal("Failed to parse test url: ", err)
+		}
+		return makeConnection(netip.MustParseAddrPort("127.0.0.1:80"), u, &traffic{}, nil)
+	}
+
+	conns := []*connection{
+		makeConn("https://a.example/"),
+		makeConn("http://b.example/"),
+		makeConn("https://c.example:8443/"),
+		makeConn("https://d.example/index.html"),
+		makeConn("http://e.example:80/"),
+	}
+	expected := []SchemePortConnections{
+		{Scheme: "http", Port: "80", MaxConnections: 2},
+		{Scheme: "https", Port: "443", MaxConnections: 2},
+		{Scheme: "https", Port: "8443", MaxConnections: 1},
+	}
+	if got := countBySchemePort(conns); !slices.Equal(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
+
+func TestStrategies(t *testing.T) {
+	testcases := map[string]struct {
+		inMeasurer Measurer
+		outNConns  int
+	}{
+		"linear-ramp": {
+			inMeasurer: Measurer{Strategy: "linear-ramp"},
+			outNConns:  3,
+		},
+		"linear-ramp with ramp interval": {
+			inMeasurer: Measurer{Strategy: "linear-ramp", RampInterval: 100 * time.Millisecond},
+			outNConns:  3,
+		},
+		"binary-search runs out of servers": {
+			inMeasurer: Measurer{Strategy: "binary-search"},
+			outNConns:  3,
+		},
+		"sustain-only": {
+			inMeasurer: Measurer{Strategy: "sustain-only", SustainDuration: time.Second},
+			outNConns:  3,
+		},
+		"sustain-only fewer connections": {
+			inMeasurer: Measurer{Strategy: "sustain-only", SustainConnections: 1, SustainDuration: time.Second},
+			outNConns:  1,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			srvs := []*httpTestServer{}
+			urls := []*url.URL{}
+			for i := range 3 {
+				root := makeServerRoot(t, tPath("wildcard_robots.txt"), tPath("no_links.html"))
+				srv := &httpTestServer{
+					name:     fmt.Sprintf("http.%v", i),
+					handlers: HandlerChain{makeFileHandler(root)},
+				}
+				startHttpServer(t, srv)
+				srvs = append(srvs, srv)
+			}
+			// Only link the servers from the first to give sustain-only
+			// something to ignore
+			root := makeServerRoot(t, tPath("wildcard_robots.txt"))
+			makeHtmlDocWithLinks(t, []*url.URL{srvs[1].tUrl(t, ""), srvs[2].tUrl(t, "")}, path.Join(root, "index.html"))
+			srvs[0].server.Handler = HandlerChain{makeFileHandler(root)}
+			urls = append(urls, srvs[0].tUrl(t, ""))
+			if tc.inMeasurer.Strategy == "sustain-only" && tc.inMeasurer.SustainConnections == 0 {
+				urls = append(urls, srvs[1].tUrl(t, ""), srvs[2].tUrl(t, ""))
+			}
+
+			r, err := tc.inMeasurer.Measure(urls)
+			if err != nil {
+				t.Fatal("Failed to measure: ", err)
+			}
+			if r.MaxConnections != tc.outNConns {
+				t.Errorf("expected to measure %d connections, got %d", tc.outNConns, r.MaxConnections)
+			}
+		})
+	}
+}
+
+func TestUnknownStrategy(t *testing.T) {
+	m := Measurer{Strategy: "guess"}
+	_, err := m.Measure([]*url.URL{})
+	if err == nil {
+		t.Error("expected an error for an unknown strategy")
+	}
+}
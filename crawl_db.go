@@ -0,0 +1,361 @@
+// Functions related to keeping the connections, requests and results of
+// measurements in a SQLite database, so they can be analysed afterwards
+// with natck query or any SQLite client.
+package main
+
+import (
+	"cmp"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	// Requests buffered before they are inserted in one transaction
+	crawlDbBatch = 1000
+	// Rows natck query prints by default
+	defaultQueryLimit = 20
+)
+
+const crawlDbSchema = `
+CREATE TABLE IF NOT EXISTS runs (
+	id INTEGER PRIMARY KEY,
+	started TEXT NOT NULL,
+	finished TEXT,
+	max_connections INTEGER,
+	result TEXT
+);
+CREATE TABLE IF NOT EXISTS connections (
+	run INTEGER NOT NULL REFERENCES runs (id),
+	id INTEGER NOT NULL,
+	scheme TEXT NOT NULL,
+	host TEXT NOT NULL,
+	address TEXT NOT NULL,
+	state TEXT NOT NULL,
+	established TEXT,
+	PRIMARY KEY (run, id)
+);
+CREATE TABLE IF NOT EXISTS requests (
+	run INTEGER NOT NULL REFERENCES runs (id),
+	connection INTEGER NOT NULL,
+	host TEXT NOT NULL,
+	url TEXT NOT NULL,
+	requested TEXT NOT NULL,
+	replied TEXT NOT NULL,
+	latency_ms REAL NOT NULL,
+	status INTEGER NOT NULL,
+	error TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS requests_run ON requests (run, host);
+`
+
+// crawlDb is a SQLite database of measurements.
+type crawlDb struct {
+	db *sql.DB
+}
+
+// crawlDbRun stores one measurement, buffering its requests. A nil run
+// stores nothing.
+type crawlDbRun struct {
+	db       *sql.DB
+	id       int64
+	requests []crawlDbRequest
+	// The first error storing the run, which stops storing it
+	err error
+}
+
+type crawlDbRequest struct {
+	connection uint
+	host       string
+	url        string
+	requested  time.Time
+	replied    time.Time
+	status     int
+	err        string
+}
+
+// dbTime formats times to sort as text.
+func dbTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+func openCrawlDb(path string) (*crawlDb, error) {
+	if !sqliteSupported() {
+		return nil, errors.New("the database needs natck built with -tags sqlite")
+	}
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	_, err = db.Exec(crawlDbSchema)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create database tables: %w", err)
+	}
+	return &crawlDb{db: db}, nil
+}
+
+func (d *crawlDb) Close() error {
+	return d.db.Close()
+}
+
+// startRun stores the start of a measurement, nil without a database.
+func (d *crawlDb) startRun(started time.Time) *crawlDbRun {
+	if d == nil {
+		return nil
+	}
+	run := &crawlDbRun{db: d.db}
+	res, err := d.db.Exec("INSERT INTO runs (started) VALUES (?)", dbTime(started))
+	if err == nil {
+		run.id, err = res.LastInsertId()
+	}
+	if err != nil {
+		run.err = fmt.Errorf("failed to insert run: %w", err)
+	}
+	return run
+}
+
+func (run *crawlDbRun) request(r *roundtrip) {
+	if run == nil || run.err != nil {
+		return
+	}
+	errMsg := ""
+	if r.err != nil {
+		errMsg = r.err.Error()
+	}
+	run.requests = append(run.requests, crawlDbRequest{
+		connection: r.connId,
+		host:       r.host.hostPort,
+		url:        r.url.String(),
+		requested:  r.requestTs,
+		replied:    r.replyTs,
+		status:     r.status,
+		err:        errMsg,
+	})
+	if len(run.requests) >= crawlDbBatch {
+		run.flush()
+	}
+}
+
+// flush inserts the buffered requests in one transaction.
+func (run *crawlDbRun) flush() {
+	if len(run.requests) == 0 || run.err != nil {
+		return
+	}
+	requests := run.requests
+	run.requests = nil
+	run.err = run.transaction("INSERT INTO requests (run, connection, host, url, requested, replied, latency_ms, status, error) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		len(requests), func(i int) []any {
+			r := requests[i]
+			latency := float64(r.replied.Sub(r.requested)) / float64(time.Millisecond)
+			return []any{run.id, r.connection, r.host, r.url, dbTime(r.requested), dbTime(r.replied), latency, r.status, r.err}
+		})
+}
+
+// transaction runs query n times with the arguments of args, in one
+// transaction.
+func (run *crawlDbRun) transaction(query string, n int, args func(i int) []any) error {
+	tx, err := run.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	stmt, err := tx.Prepare(query)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to prepare insert: %w", err)
+	}
+	defer stmt.Close()
+	for i := range n {
+		_, err := stmt.Exec(args(i)...)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to insert: %w", err)
+		}
+	}
+	return tx.Commit()
+}
+
+// finish stores the remaining requests, the connections and the result
+// of the measurement. The first error storing the run, if any.
+func (run *crawlDbRun) finish(r *Result, conns []*connection, finished time.Time) error {
+	if run == nil {
+		return nil
+	}
+	run.flush()
+	if run.err != nil {
+		return run.err
+	}
+
+	err := run.transaction("INSERT INTO connections (run, id, scheme, host, address, state, established) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		len(conns), func(i int) []any {
+			c := conns[i]
+			var established any
+			if !c.established.IsZero() {
+				established = dbTime(c.established)
+			}
+			return []any{run.id, c.id, c.url.Scheme, c.host.hostPort, c.host.ip.String(), c.state.String(), established}
+		})
+	if err != nil {
+		return err
+	}
+
+	result, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("failed to encode result: %w", err)
+	}
+	_, err = run.db.Exec("UPDATE runs SET finished = ?, max_connections = ?, result = ? WHERE id = ?",
+		dbTime(finished), r.MaxConnections, string(result), run.id)
+	if err != nil {
+		return fmt.Errorf("failed to update run: %w", err)
+	}
+	return nil
+}
+
+// crawlDbQuery is a canned query of natck query, of the run given as
+// its first argument and limited to the rows given as its second.
+type crawlDbQuery struct {
+	summary string
+	query   string
+}
+
+var crawlDbQueries = map[string]crawlDbQuery{
+	"runs": {
+		summary: "the measurements stored, newest first",
+		query: `SELECT id, started, finished, max_connections FROM runs
+			WHERE ?1 = 0 OR id = ?1 ORDER BY id DESC LIMIT ?2`,
+	},
+	"slowest-hosts": {
+		summary: "the hosts with the highest mean latency of successful requests",
+		query: `SELECT host, COUNT(*) AS requests, ROUND(AVG(latency_ms), 1) AS mean_ms, ROUND(MAX(latency_ms), 1) AS max_ms
+			FROM requests WHERE run = ?1 AND error = ''
+			GROUP BY host ORDER BY mean_ms DESC LIMIT ?2`,
+	},
+	"failure-timeline": {
+		summary: "the failed requests in the order they failed",
+		query: `SELECT replied, connection, host, error FROM requests
+			WHERE run = ?1 AND error != '' ORDER BY replied LIMIT ?2`,
+	},
+	"failures-by-host": {
+		summary: "the hosts with the most failed requests",
+		query: `SELECT host, COUNT(*) AS failures, MIN(replied) AS first, MAX(replied) AS last
+			FROM requests WHERE run = ?1 AND error != ''
+			GROUP BY host ORDER BY failures DESC LIMIT ?2`,
+	},
+	"connection-states": {
+		summary: "how many connections ended in each state",
+		query: `SELECT state, COUNT(*) AS connections FROM connections
+			WHERE run = ?1 GROUP BY state ORDER BY connections DESC LIMIT ?2`,
+	},
+}
+
+// crawlDbQuerySummaries describes each canned query, for the help.
+func crawlDbQuerySummaries() string {
+	summaries := []string{}
+	for _, name := range strings.Split(crawlDbQueryNames(), ", ") {
+		summaries = append(summaries, name+" lists "+crawlDbQueries[name].summary)
+	}
+	return strings.Join(summaries, ", ")
+}
+
+func crawlDbQueryNames() string {
+	names := []string{}
+	for name := range crawlDbQueries {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return strings.Join(names, ", ")
+}
+
+// query runs the canned query name on run, zero being the latest run,
+// printing at most limit rows to w.
+func (d *crawlDb) query(w io.Writer, name string, run int64, limit int) error {
+	q, found := crawlDbQueries[name]
+	if !found {
+		return fmt.Errorf("unknown query %q, one of %v", name, crawlDbQueryNames())
+	}
+	if run == 0 && name != "runs" {
+		err := d.db.QueryRow("SELECT COALESCE(MAX(id), 0) FROM runs").Scan(&run)
+		if err != nil {
+			return fmt.Errorf("failed to find the latest run: %w", err)
+		}
+	}
+	// A negative limit is no limit to SQLite
+	rows, err := d.db.Query(q.query, run, cmp.Or(limit, -1))
+	if err != nil {
+		return fmt.Errorf("failed to query %v: %w", name, err)
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return fmt.Errorf("failed to query %v: %w", name, err)
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(columns, "\t"))
+	values := make([]sql.NullString, len(columns))
+	dest := make([]any, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	for rows.Next() {
+		err := rows.Scan(dest...)
+		if err != nil {
+			return fmt.Errorf("failed to read %v: %w", name, err)
+		}
+		fields := make([]string, len(values))
+		for i, v := range values {
+			fields[i] = v.String
+		}
+		fmt.Fprintln(tw, strings.Join(fields, "\t"))
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read %v: %w", name, err)
+	}
+	return tw.Flush()
+}
+
+// queryOptions are the flags of the query command.
+type queryOptions struct {
+	fs    *flag.FlagSet
+	db    string
+	run   int64
+	limit int
+}
+
+func newQueryFlags(name string) *queryOptions {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	o := &queryOptions{fs: fs}
+	fs.StringVar(&o.db, "db", "natck.db", "database measured into with natck measure --db")
+	fs.Int64Var(&o.run, "run", 0, "id of the run to query, 0 is the latest")
+	fs.IntVar(&o.limit, "limit", defaultQueryLimit, "most rows to print, 0 prints all")
+	return o
+}
+
+func queryCommand(name string, args []string) {
+	o := newQueryFlags(name)
+	parseCommandArgs(o.fs, args, "<query>", 1, false)
+
+	if _, err := os.Stat(o.db); err != nil {
+		fmt.Printf("Failed to open database: %v\n", err)
+		os.Exit(1)
+	}
+	d, err := openCrawlDb(o.db)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	defer d.Close()
+	err = d.query(os.Stdout, o.fs.Arg(0), o.run, max(o.limit, 0))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
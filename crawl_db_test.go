@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/netip"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOpenCrawlDbWithoutSqlite(t *testing.T) {
+	if sqliteSupported() {
+		t.Skip("natck was built with -tags sqlite")
+	}
+	if _, err := openCrawlDb(filepath.Join(t.TempDir(), "natck.db")); err == nil {
+		t.Error("expected the database to need sqlite")
+	}
+}
+
+func TestCrawlDb(t *testing.T) {
+	if !sqliteSupported() {
+		t.Skip("natck was built without -tags sqlite")
+	}
+	d, err := openCrawlDb(filepath.Join(t.TempDir(), "natck.db"))
+	if err != nil {
+		t.Fatal("Failed to open database: ", err)
+	}
+	defer d.Close()
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	run := d.startRun(start)
+	requests := []struct {
+		host    string
+		latency time.Duration
+		err     error
+	}{
+		{"fast.example.com:443", 10 * time.Millisecond, nil},
+		{"slow.example.com:443", 900 * time.Millisecond, nil},
+		{"broken.example.com:443", 0, errors.New("connection reset by peer")},
+	}
+	conns := []*connection{}
+	for i, req := range requests {
+		u := &url.URL{Scheme: "https", Host: req.host, Path: "/"}
+		c := makeConnection(netip.MustParseAddrPort("192.0.2.1:443"), u, &traffic{}, nil)
+		c.id = uint(i)
+		c.host.hostPort = req.host
+		conns = append(conns, c)
+		run.request(&roundtrip{
+			connId:    c.id,
+			host:      c.host,
+			url:       u,
+			requestTs: start,
+			replyTs:   start.Add(req.latency),
+			status:    200,
+			err:       req.err,
+		})
+	}
+	err = run.finish(&Result{MaxConnections: 2}, conns, start.Add(time.Minute))
+	if err != nil {
+		t.Fatal("Failed to store run: ", err)
+	}
+
+	testcases := map[string]struct {
+		in       string
+		outFirst string
+		outLines int
+	}{
+		"runs":              {in: "runs", outFirst: "1", outLines: 2},
+		"slowest hosts":     {in: "slowest-hosts", outFirst: "slow.example.com:443", outLines: 3},
+		"failure timeline":  {in: "failure-timeline", outLines: 2},
+		"connection states": {in: "connection-states", outFirst: "created", outLines: 2},
+	}
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			var b bytes.Buffer
+			err := d.query(&b, tc.in, 0, defaultQueryLimit)
+			if err != nil {
+				t.Fatal("Failed to query: ", err)
+			}
+			lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+			if len(lines) != tc.outLines {
+				t.Fatalf("expected %v lines, got %q", tc.outLines, b.String())
+			}
+			if tc.outFirst != "" && !strings.HasPrefix(lines[1], tc.outFirst) {
+				t.Errorf("expected the first row to start with %v, got %q", tc.outFirst, lines[1])
+			}
+		})
+	}
+	if err := d.query(&bytes.Buffer{}, "carrier-pigeons", 0, 0); err == nil {
+		t.Error("expected an unknown query to be rejected")
+	}
+}
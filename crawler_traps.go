@@ -0,0 +1,103 @@
+// Functions related to skipping the urls of crawler traps by their shape,
+// before they are crawled, so pathological sites do not take over long
+// measurements.
+package main
+
+import (
+	"cmp"
+	"net/url"
+	"strings"
+)
+
+// Defaults of TrapLimits
+const (
+	// Longer urls are rarely real pages, most browsers and servers cap
+	// urls near here
+	defaultMaxUrlLength = 2000
+	// Relative links resolved against the wrong base repeat segments,
+	// like /a/b/a/b/a/b
+	defaultMaxRepeatedSegments = 3
+	// Faceted search and sorting links multiply queries of a path
+	defaultMaxQueryVariants = 50
+)
+
+// TrapLimits are the heuristics skipping the urls of crawler traps. Zero
+// limits are the defaults and negative ones disable the heuristic.
+type TrapLimits struct {
+	// Longest url crawled, in bytes.
+	MaxUrlLength int
+	// Times a segment may appear in the path of a url.
+	MaxRepeatedSegments int
+	// Distinct queries of a path crawled on one server.
+	MaxQueryVariants int
+}
+
+// hasRepeatedSegments reports whether a segment of the path appears more
+// than limit times.
+func hasRepeatedSegments(path string, limit int) bool {
+	seen := map[string]int{}
+	for _, s := range strings.Split(path, "/") {
+		if s == "" {
+			continue
+		}
+		seen[s]++
+		if seen[s] > limit {
+			return true
+		}
+	}
+	return false
+}
+
+// newQueryVariant reports whether u is a query of its path beyond the
+// limit of the connection, recording the query otherwise.
+func newQueryVariant(c *connection, u *url.URL, limit int) bool {
+	if u.RawQuery == "" {
+		return false
+	}
+	if c.queryVariants == nil {
+		c.queryVariants = map[string]map[string]bool{}
+	}
+	queries := c.queryVariants[u.Path]
+	if queries[u.RawQuery] {
+		return false
+	}
+	if len(queries) >= limit {
+		return true
+	}
+	if queries == nil {
+		queries = map[string]bool{}
+		c.queryVariants[u.Path] = queries
+	}
+	queries[u.RawQuery] = true
+	return false
+}
+
+// isTrapUrl reports whether the scraped url looks like a crawler trap.
+func (s *scheduler) isTrapUrl(u *url.URL) bool {
+	limits := s.m.TrapLimits
+	if limit := cmp.Or(limits.MaxUrlLength, defaultMaxUrlLength); limit > 0 && len(u.String()) > limit {
+		return true
+	}
+	if limit := cmp.Or(limits.MaxRepeatedSegments, defaultMaxRepeatedSegments); limit > 0 && hasRepeatedSegments(u.Path, limit) {
+		return true
+	}
+	limit := cmp.Or(limits.MaxQueryVariants, defaultMaxQueryVariants)
+	if i := indexConnectionByHostPort(s.activeConns, u); limit > 0 && i != -1 {
+		return newQueryVariant(s.activeConns[i], u, limit)
+	}
+	return false
+}
+
+// skipTrapUrls drops the scraped urls that look like crawler traps,
+// counting them.
+func (s *scheduler) skipTrapUrls(urls []*url.URL) []*url.URL {
+	kept := []*url.URL{}
+	for _, u := range urls {
+		if s.isTrapUrl(u) {
+			s.trapUrls++
+			continue
+		}
+		kept = append(kept, u)
+	}
+	return kept
+}
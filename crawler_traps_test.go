@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestIsTrapUrl(t *testing.T) {
+	testcases := map[string]struct {
+		inLimits TrapLimits
+		inUrl    string
+		expTrap  bool
+	}{
+		"Plain": {
+			inUrl:   "http://example.com/about/team",
+			expTrap: false,
+		},
+		"Long": {
+			inUrl:   "http://example.com/" + strings.Repeat("a", defaultMaxUrlLength),
+			expTrap: true,
+		},
+		"Long allowed": {
+			inLimits: TrapLimits{MaxUrlLength: -1},
+			inUrl:    "http://example.com/" + strings.Repeat("a", defaultMaxUrlLength),
+			expTrap:  false,
+		},
+		"Repeated segments": {
+			inUrl:   "http://example.com/a/b/a/b/a/b/a/b",
+			expTrap: true,
+		},
+		"Few repeated segments": {
+			inUrl:   "http://example.com/a/b/a/b",
+			expTrap: false,
+		},
+		"Repeated segments limited": {
+			inLimits: TrapLimits{MaxRepeatedSegments: 1},
+			inUrl:    "http://example.com/a/b/a/b",
+			expTrap:  true,
+		},
+		"Query variants exploded": {
+			inLimits: TrapLimits{MaxQueryVariants: 2},
+			inUrl:    "http://example.com/search?q=3",
+			expTrap:  true,
+		},
+		"Query variant already crawled": {
+			inLimits: TrapLimits{MaxQueryVariants: 2},
+			inUrl:    "http://example.com/search?q=1",
+			expTrap:  false,
+		},
+		"Query variant of another path": {
+			inLimits: TrapLimits{MaxQueryVariants: 2},
+			inUrl:    "http://example.com/shop?q=3",
+			expTrap:  false,
+		},
+		"Query variant of another server": {
+			inLimits: TrapLimits{MaxQueryVariants: 2},
+			inUrl:    "http://example.org/search?q=3",
+			expTrap:  false,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			root, _ := url.Parse("http://example.com/")
+			c := makeConnection(netip.MustParseAddrPort("192.0.2.1:80"), root, &traffic{}, nil)
+			s := scheduler{
+				m:           &Measurer{TrapLimits: tc.inLimits},
+				activeConns: []*connection{c},
+			}
+			for i := range 2 {
+				u, _ := url.Parse(fmt.Sprintf("http://example.com/search?q=%d", i))
+				if s.isTrapUrl(u) {
+					t.Fatalf("expected %v not to be a trap", u)
+				}
+			}
+
+			u, err := url.Parse(tc.inUrl)
+			if err != nil {
+				t.Fatal("Failed to parse url: ", err)
+			}
+			if trap := s.isTrapUrl(u); trap != tc.expTrap {
+				t.Errorf("expected trap to be %v, got %v", tc.expTrap, trap)
+			}
+		})
+	}
+}
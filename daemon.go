@@ -0,0 +1,227 @@
+// Functions related to running measurements repeatedly as a long-running
+// service, exposing the latest result over HTTP.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	daemonShutdownTimeout = 5 * time.Second
+	// Longest to wait for a cancelled measurement to release its
+	// connections, within the 30s grace period Kubernetes gives pods
+	daemonDrainTimeout = 20 * time.Second
+)
+
+type daemon struct {
+	measure  func(ctx context.Context) (*Result, error)
+	interval time.Duration
+	onResult func(*Result)
+	// Re-measures results differing greatly from the last
+	variance varianceCheck
+
+	m            sync.Mutex
+	last         *Result
+	lastFinished time.Time
+	measurements uint64
+	// Why the last measurement failed, nil if it did not
+	lastErr  error
+	failures uint64
+
+	draining atomic.Bool
+}
+
+func (d *daemon) lastResult() (*Result, time.Time, uint64) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	return d.last, d.lastFinished, d.measurements
+}
+
+func (d *daemon) lastError() (error, uint64) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	return d.lastErr, d.failures
+}
+
+func (d *daemon) healthz(res http.ResponseWriter, req *http.Request) {
+	fmt.Fprintln(res, "ok")
+}
+
+// readyz reports ready once there is a result to serve, and not ready
+// once draining so traffic is routed elsewhere before exiting, or whilst
+// the result served is stale as the last measurement failed.
+func (d *daemon) readyz(res http.ResponseWriter, req *http.Request) {
+	r, _, _ := d.lastResult()
+	if d.draining.Load() {
+		http.Error(res, "draining", http.StatusServiceUnavailable)
+		return
+	}
+	if err, _ := d.lastError(); err != nil {
+		http.Error(res, fmt.Sprintf("last measurement failed: %v", err), http.StatusServiceUnavailable)
+		return
+	}
+	if r == nil {
+		http.Error(res, "no measurement yet", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(res, "ok")
+}
+
+// metrics serves the latest result in the Prometheus text format.
+func (d *daemon) metrics(res http.ResponseWriter, req *http.Request) {
+	r, finished, n := d.lastResult()
+	res.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	fmt.Fprintln(res, "# HELP natck_measurements_total Completed measurements.")
+	fmt.Fprintln(res, "# TYPE natck_measurements_total counter")
+	fmt.Fprintln(res, "natck_measurements_total", n)
+	_, failures := d.lastError()
+	fmt.Fprintln(res, "# HELP natck_measurement_failures_total Failed measurements.")
+	fmt.Fprintln(res, "# TYPE natck_measurement_failures_total counter")
+	fmt.Fprintln(res, "natck_measurement_failures_total", failures)
+	if r == nil {
+		return
+	}
+
+	overBudget := 0
+	if r.OverBudget {
+		overBudget = 1
+	}
+	unstable := 0
+	if r.Unstable {
+		unstable = 1
+	}
+	gauges := []struct {
+		name, help string
+		value      any
+	}{
+		{"natck_max_connections", "Max connections measured by the last measurement.", r.MaxConnections},
+		{"natck_last_bytes_sent", "Bytes sent by the last measurement.", r.BytesSent},
+		{"natck_last_bytes_received", "Bytes received by the last measurement.", r.BytesReceived},
+		{"natck_last_over_budget", "Whether the last measurement exceeded its data budget.", overBudget},
+		{"natck_last_refused_redials", "Times the last measurement refused a second dial to the same server.", r.RefusedRedials},
+		{"natck_last_unstable", "Whether the confirmation runs of the last measurement disagreed.", unstable},
+		{"natck_last_measurement_timestamp_seconds", "When the last measurement finished.", finished.Unix()},
+	}
+	for _, g := range gauges {
+		fmt.Fprintf(res, "# HELP %v %v\n", g.name, g.help)
+		fmt.Fprintf(res, "# TYPE %v gauge\n", g.name)
+		fmt.Fprintln(res, g.name, g.value)
+	}
+
+	fmt.Fprintln(res, "# HELP natck_max_connections_by_scheme_port Max connections measured by the last measurement, by scheme and port.")
+	fmt.Fprintln(res, "# TYPE natck_max_connections_by_scheme_port gauge")
+	for _, s := range r.BySchemePort {
+		fmt.Fprintf(res, "natck_max_connections_by_scheme_port{scheme=%q,port=%q} %d\n", s.Scheme, s.Port, s.MaxConnections)
+	}
+}
+
+func (d *daemon) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", d.healthz)
+	mux.HandleFunc("/readyz", d.readyz)
+	mux.HandleFunc("/metrics", d.metrics)
+	return mux
+}
+
+// run repeats the measurement every interval until ctx is done, which
+// stops the measurement in progress early, its connections released
+// normally and its result discarded. Failed measurements are logged and
+// tried again the next interval.
+func (d *daemon) run(ctx context.Context) {
+	for {
+		r, err := d.measure(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			slog.Error("Failed to measure", "err", err)
+			d.m.Lock()
+			d.lastErr = err
+			d.failures++
+			d.m.Unlock()
+		} else {
+			last, _, _ := d.lastResult()
+			r = d.variance.check(ctx, last, r, d.measure)
+
+			d.m.Lock()
+			d.last = r
+			d.lastFinished = time.Now()
+			d.lastErr = nil
+			d.measurements++
+			d.m.Unlock()
+			if d.onResult != nil {
+				d.onResult(r)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(d.interval):
+		}
+	}
+}
+
+// runDaemon measures every interval, serving the latest result on addr,
+// until SIGTERM or SIGINT is received.
+func runDaemon(addr string, d *daemon) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %v: %w", addr, err)
+	}
+
+	srv := http.Server{Handler: d.handler()}
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.Serve(listener)
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	measured := make(chan struct{})
+	go func() {
+		d.run(ctx)
+		close(measured)
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	defer signal.Stop(signals)
+
+	select {
+	case err := <-served:
+		cancel()
+		return fmt.Errorf("failed to serve on %v: %w", addr, err)
+	case <-signals:
+	}
+
+	// Drain, stop being ready then stop the current measurement, waiting
+	// a while for it to release its connections
+	d.draining.Store(true)
+	cancel()
+	select {
+	case <-measured:
+	case <-time.After(daemonDrainTimeout):
+		slog.Warn("Measurement did not stop in time", "timeout", daemonDrainTimeout)
+	}
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), daemonShutdownTimeout)
+	defer shutdownCancel()
+	err = srv.Shutdown(shutdownCtx)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("failed to shutdown server: %w", err)
+	}
+	return nil
+}
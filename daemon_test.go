@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDaemonEndpoints(t *testing.T) {
+	get := func(h http.Handler, path string) *httptest.ResponseRecorder {
+		res := httptest.NewRecorder()
+		h.ServeHTTP(res, httptest.NewRequest(http.MethodGet, path, nil))
+		return res
+	}
+
+	d := daemon{}
+	h := d.handler()
+	if res := get(h, "/healthz"); res.Code != http.StatusOK {
+		t.Errorf("expected /healthz to be ok, got %v", res.Code)
+	}
+	if res := get(h, "/readyz"); res.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected /readyz to be unavailable before measuring, got %v", res.Code)
+	}
+
+	d.last = &Result{
+		MaxConnections: 7,
+		BySchemePort:   []SchemePortConnections{{Scheme: "https", Port: "443", MaxConnections: 7}},
+	}
+	d.lastFinished = time.Now()
+	d.measurements = 1
+	if res := get(h, "/readyz"); res.Code != http.StatusOK {
+		t.Errorf("expected /readyz to be ok after measuring, got %v", res.Code)
+	}
+	res := get(h, "/metrics")
+	if !strings.Contains(res.Body.String(), "natck_max_connections 7\n") {
+		t.Errorf("expected /metrics to report the max connections, got %v", res.Body.String())
+	}
+	if !strings.Contains(res.Body.String(), `natck_max_connections_by_scheme_port{scheme="https",port="443"} 7`+"\n") {
+		t.Errorf("expected /metrics to report the max connections by scheme, got %v", res.Body.String())
+	}
+
+	d.draining.Store(true)
+	if res := get(h, "/readyz"); res.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected /readyz to be unavailable when draining, got %v", res.Code)
+	}
+	if res := get(h, "/healthz"); res.Code != http.StatusOK {
+		t.Errorf("expected /healthz to be ok when draining, got %v", res.Code)
+	}
+}
+
+func TestDaemonRun(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	calls := 0
+	d := daemon{
+		interval: time.Millisecond,
+		measure: func(ctx context.Context) (*Result, error) {
+			calls++
+			switch calls {
+			case 1:
+				return nil, errors.New("no route to host")
+			case 2:
+				return &Result{MaxConnections: 7}, nil
+			}
+			// Measuring until cancelled, as on SIGTERM
+			cancel()
+			<-ctx.Done()
+			return &Result{MaxConnections: 1}, nil
+		},
+	}
+
+	ran := make(chan struct{})
+	go func() {
+		d.run(ctx)
+		close(ran)
+	}()
+	select {
+	case <-ran:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the daemon to stop once cancelled")
+	}
+
+	r, _, n := d.lastResult()
+	err, failures := d.lastError()
+	if calls != 3 || n != 1 || failures != 1 {
+		t.Errorf("expected 3 measurements, 1 published and 1 failed, got %d, %d and %d", calls, n, failures)
+	}
+	if r == nil || r.MaxConnections != 7 || err != nil {
+		t.Errorf("expected the last finished measurement to be served, got %v and %v", r, err)
+	}
+}
+
+func TestDaemonFailedReadyz(t *testing.T) {
+	d := daemon{last: &Result{MaxConnections: 7}, lastErr: errors.New("no route to host"), failures: 1}
+	res := httptest.NewRecorder()
+	d.handler().ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if res.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected /readyz to be unavailable after a failure, got %v", res.Code)
+	}
+	res = httptest.NewRecorder()
+	d.handler().ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if !strings.Contains(res.Body.String(), "natck_measurement_failures_total 1\n") {
+		t.Errorf("expected /metrics to count the failure, got %v", res.Body.String())
+	}
+}
@@ -0,0 +1,30 @@
+// Functions related to detecting the NAT mappings dropped silently. Data
+// sent into a dropped mapping is never acknowledged, so TCP_USER_TIMEOUT
+// bounds how long until the connection fails rather than retransmitting
+// for the system's default of around 15 minutes.
+package main
+
+import (
+	"errors"
+	"syscall"
+	"time"
+)
+
+// Time sent data may go unacknowledged, by default, before the mapping
+// is considered lost
+const defaultUserTimeout = 20 * time.Second
+
+// userTimeout is the TCP_USER_TIMEOUT to set, zero keeps the system
+// default.
+func (o SocketOptions) userTimeout() time.Duration {
+	if o.UserTimeout == 0 && userTimeoutSupported {
+		return defaultUserTimeout
+	}
+	return max(o.UserTimeout, 0)
+}
+
+// isMappingLost is whether err is an established connection timing out,
+// rather than an HTTP error or failing to connect.
+func isMappingLost(err error) bool {
+	return !isDialError(err) && errors.Is(err, syscall.ETIMEDOUT)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// deadMappingNetwork simulates a NAT in front of a benchNetwork that
+// silently drops each mapping after its first requests, so the next
+// request times out.
+type deadMappingNetwork struct {
+	benchNetwork
+	requests int
+
+	m    sync.Mutex
+	sent map[uint]int
+}
+
+func (n *deadMappingNetwork) scrapConnection(ctx context.Context, r *roundtrip) *roundtrip {
+	n.m.Lock()
+	n.sent[r.connId]++
+	sent := n.sent[r.connId]
+	n.m.Unlock()
+
+	if sent > n.requests {
+		r.requestTs = time.Now()
+		r.replyTs = r.requestTs
+		r.err = &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ETIMEDOUT)}
+		return r
+	}
+	return n.benchNetwork.scrapConnection(ctx, r)
+}
+
+func TestIsMappingLost(t *testing.T) {
+	timedOut := &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ETIMEDOUT)}
+	testcases := map[string]struct {
+		err  error
+		lost bool
+	}{
+		"Read timed out":    {err: fmt.Errorf("failed get uri: %w", timedOut), lost: true},
+		"Dial timed out":    {err: &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ETIMEDOUT)}},
+		"Reset":             {err: &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}},
+		"Deadline exceeded": {err: os.ErrDeadlineExceeded},
+		"HTTP error":        {err: errors.New("unexpected status 503")},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			if got := isMappingLost(tc.err); got != tc.lost {
+				t.Errorf("expected %v to be a lost mapping %v, got %v", tc.err, tc.lost, got)
+			}
+		})
+	}
+}
+
+func TestMappingLost(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping due to sustaining connections.")
+	}
+
+	n := &deadMappingNetwork{
+		benchNetwork: benchNetwork{hosts: 4, seeds: 4},
+		requests:     2,
+		sent:         map[uint]int{},
+	}
+	var m sync.Mutex
+	events := map[EventType]int{}
+	measurer := Measurer{
+		network:           n,
+		Strategy:          "sustain-only",
+		SustainDuration:   time.Second,
+		KeepAliveInterval: 200 * time.Millisecond,
+		OnEvent: func(e Event) {
+			m.Lock()
+			events[e.Type]++
+			m.Unlock()
+		},
+	}
+	r, err := measurer.Measure(n.seedUrls())
+	if err != nil {
+		t.Fatal("Failed to measure: ", err)
+	}
+
+	if r.MappingsLost != n.hosts {
+		t.Errorf("expected %d mappings lost, got %d", n.hosts, r.MappingsLost)
+	}
+	m.Lock()
+	defer m.Unlock()
+	if events[EventMappingLost] != n.hosts || events[EventConnectionFailed] != 0 {
+		t.Errorf("expected %d mapping-lost and no connection-failed events, got %v", n.hosts, events)
+	}
+}
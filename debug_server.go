@@ -0,0 +1,76 @@
+// Functions related to serving the Go runtime profiles and counters of
+// the scheduler, to profile memory and goroutine growth in large runs.
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"time"
+)
+
+// schedulerVars are the counters of the scheduler published with expvar,
+// under scheduler on /debug/vars. Only updated when serving them.
+var schedulerVars struct {
+	iterations         expvar.Int
+	decisions          expvar.Map
+	activeConns        expvar.Int
+	pendingConns       expvar.Int
+	pendingResolutions expvar.Int
+	pendingBatches     expvar.Int
+	oldestResolution   expvar.Float
+	bytes              expvar.Int
+}
+
+func init() {
+	m := expvar.NewMap("scheduler")
+	m.Set("iterations", &schedulerVars.iterations)
+	m.Set("decisions", &schedulerVars.decisions)
+	m.Set("active_connections", &schedulerVars.activeConns)
+	m.Set("pending_connections", &schedulerVars.pendingConns)
+	m.Set("pending_resolutions", &schedulerVars.pendingResolutions)
+	m.Set("pending_resolution_batches", &schedulerVars.pendingBatches)
+	m.Set("oldest_resolution_seconds", &schedulerVars.oldestResolution)
+	m.Set("bytes", &schedulerVars.bytes)
+}
+
+// publishVars updates the expvar counters after an iteration of the
+// scheduler.
+func (s *scheduler) publishVars(decision string) {
+	schedulerVars.iterations.Add(1)
+	if decision != "" {
+		schedulerVars.decisions.Add(decision, 1)
+	}
+	schedulerVars.activeConns.Set(int64(len(s.activeConns)))
+	schedulerVars.pendingConns.Set(int64(len(s.pendingConns)))
+	schedulerVars.pendingResolutions.Set(int64(s.pendingResolutions.len()))
+	schedulerVars.pendingBatches.Set(int64(len(s.pendingResolutions.batches)))
+	schedulerVars.oldestResolution.Set(s.pendingResolutions.oldest(time.Now()).Seconds())
+	schedulerVars.bytes.Set(int64(s.traffic.total()))
+}
+
+func debugHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	return mux
+}
+
+// serveDebug serves the pprof profiles and expvar counters on addr, which
+// should be a loopback address as profiles reveal the urls measured.
+func serveDebug(addr string) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %v: %w", addr, err)
+	}
+
+	srv := &http.Server{Handler: debugHandler()}
+	go srv.Serve(l)
+	return l, nil
+}
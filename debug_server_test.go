@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDebugEndpoints(t *testing.T) {
+	n := &benchNetwork{hosts: 20, fanout: 2, seeds: 2}
+	m := Measurer{network: n, publishVars: true}
+	_, err := m.Measure(n.seedUrls())
+	if err != nil {
+		t.Fatal("Failed to measure: ", err)
+	}
+
+	h := debugHandler()
+	res := httptest.NewRecorder()
+	h.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/debug/vars", nil))
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected /debug/vars to be ok, got %v", res.Code)
+	}
+	vars := struct {
+		Scheduler struct {
+			Iterations int            `json:"iterations"`
+			Decisions  map[string]int `json:"decisions"`
+		} `json:"scheduler"`
+	}{}
+	err = json.NewDecoder(res.Body).Decode(&vars)
+	if err != nil {
+		t.Fatal("Failed to decode /debug/vars: ", err)
+	}
+	if vars.Scheduler.Iterations == 0 || vars.Scheduler.Decisions["crawl"] == 0 {
+		t.Errorf("expected the scheduler iterations and crawls to be counted, got %+v", vars.Scheduler)
+	}
+
+	res = httptest.NewRecorder()
+	h.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/debug/pprof/goroutine?debug=1", nil))
+	if res.Code != http.StatusOK {
+		t.Errorf("expected the goroutine profile to be ok, got %v", res.Code)
+	}
+}
@@ -0,0 +1,100 @@
+// Functions related to resolving hosts with search domains and resolvers
+// of their own, for labs with split-horizon DNS that the system resolver
+// does not know of.
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// DnsConfig adds to the system resolver, the zero value only uses the
+// system resolver.
+type DnsConfig struct {
+	// Domains appended in order to hostnames without a dot, before the
+	// hostname is looked up as is.
+	SearchDomains []string
+	// Nameserver, as host:port, of each domain and its subdomains. The
+	// longest domain matching a hostname wins.
+	Resolvers map[string]string
+	// Resolve .local hostnames with multicast DNS, off to avoid
+	// surprising multicast traffic.
+	Mdns bool
+}
+
+// nameserver is the nameserver routed to for host, empty for the system
+// resolver.
+func (d *DnsConfig) nameserver(host string) string {
+	if d == nil {
+		return ""
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	server, longest := "", -1
+	for domain, s := range d.Resolvers {
+		domain = strings.ToLower(strings.Trim(domain, "."))
+		if (host == domain || strings.HasSuffix(host, "."+domain)) && len(domain) > longest {
+			server, longest = s, len(domain)
+		}
+	}
+	return server
+}
+
+// resolver looks up host with its routed nameserver, if any.
+func (d *DnsConfig) resolver(host string) *net.Resolver {
+	server := d.nameserver(host)
+	if server == "" {
+		return net.DefaultResolver
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, server)
+		},
+	}
+}
+
+// candidates are the names host is looked up as, in order.
+func (d *DnsConfig) candidates(host string) []string {
+	if d == nil || strings.Contains(host, ".") {
+		return []string{host}
+	}
+	names := make([]string, 0, len(d.SearchDomains)+1)
+	for _, domain := range d.SearchDomains {
+		names = append(names, host+"."+strings.Trim(domain, "."))
+	}
+	return append(names, host)
+}
+
+// parseSearchDomains parses comma separated search domains.
+func parseSearchDomains(s string) []string {
+	domains := []string{}
+	for _, d := range strings.Split(s, ",") {
+		d = strings.Trim(strings.TrimSpace(d), ".")
+		if d != "" {
+			domains = append(domains, d)
+		}
+	}
+	return domains
+}
+
+// parseDnsRoutes parses comma separated domain=nameserver routes, like
+// "lab.example=10.0.0.53,corp.example=10.1.0.53:5353", the port being
+// 53 if not given.
+func parseDnsRoutes(s string) (map[string]string, error) {
+	routes := map[string]string{}
+	for _, field := range strings.Split(s, ",") {
+		domain, server, found := strings.Cut(strings.TrimSpace(field), "=")
+		domain, server = strings.TrimSpace(domain), strings.TrimSpace(server)
+		if !found || domain == "" || server == "" {
+			return nil, fmt.Errorf("invalid dns route %q, expected like lab.example=10.0.0.53", field)
+		}
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		routes[domain] = server
+	}
+	return routes, nil
+}
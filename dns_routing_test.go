@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestDnsNameserver(t *testing.T) {
+	d := &DnsConfig{Resolvers: map[string]string{
+		"lab.example":     "10.0.0.53:53",
+		"dmz.lab.example": "10.0.1.53:53",
+	}}
+	testcases := map[string]struct {
+		in     string
+		expect string
+	}{
+		"Domain":            {in: "lab.example", expect: "10.0.0.53:53"},
+		"Subdomain":         {in: "web.lab.example", expect: "10.0.0.53:53"},
+		"Longest wins":      {in: "web.dmz.lab.example", expect: "10.0.1.53:53"},
+		"Case and root dot": {in: "WEB.Lab.Example.", expect: "10.0.0.53:53"},
+		"Other domain":      {in: "example.com", expect: ""},
+		"Suffix not label":  {in: "otherlab.example", expect: ""},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			if got := d.nameserver(tc.in); got != tc.expect {
+				t.Errorf("expected nameserver %q, got %q", tc.expect, got)
+			}
+		})
+	}
+}
+
+func TestDnsCandidates(t *testing.T) {
+	d := &DnsConfig{SearchDomains: []string{"lab.example", ".corp.example."}}
+	if got := d.candidates("web"); !reflect.DeepEqual(got, []string{"web.lab.example", "web.corp.example", "web"}) {
+		t.Errorf("expected the search domains to be tried first, got %v", got)
+	}
+	if got := d.candidates("web.other"); !reflect.DeepEqual(got, []string{"web.other"}) {
+		t.Errorf("expected a name with a dot to be looked up as is, got %v", got)
+	}
+}
+
+func TestParseDnsRoutes(t *testing.T) {
+	routes, err := parseDnsRoutes("lab.example=10.0.0.53, corp.example = [fd00::53]:5353")
+	if err != nil {
+		t.Fatal("Failed to parse routes: ", err)
+	}
+	expect := map[string]string{"lab.example": "10.0.0.53:53", "corp.example": "[fd00::53]:5353"}
+	if !reflect.DeepEqual(routes, expect) {
+		t.Errorf("expected routes %v, got %v", expect, routes)
+	}
+	for _, in := range []string{"lab.example", "=10.0.0.53", "lab.example="} {
+		if _, err := parseDnsRoutes(in); err == nil {
+			t.Errorf("expected %q to be invalid", in)
+		}
+	}
+}
+
+// serveLabDns answers A queries for web.lab.example with addr, and every
+// other query with NXDOMAIN.
+func serveLabDns(t *testing.T, addr netip.Addr) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Failed to listen: ", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var p dnsmessage.Parser
+			h, err := p.Start(buf[:n])
+			if err != nil {
+				continue
+			}
+			q, err := p.Question()
+			if err != nil {
+				continue
+			}
+
+			found := q.Name.String() == "web.lab.example." && q.Type == dnsmessage.TypeA
+			rcode := dnsmessage.RCodeSuccess
+			if q.Name.String() != "web.lab.example." {
+				rcode = dnsmessage.RCodeNameError
+			}
+			b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: h.ID, Response: true, Authoritative: true, RCode: rcode})
+			b.StartQuestions()
+			b.Question(q)
+			b.StartAnswers()
+			if found {
+				b.AResource(
+					dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+					dnsmessage.AResource{A: addr.As4()},
+				)
+			}
+			reply, err := b.Finish()
+			if err != nil {
+				continue
+			}
+			conn.WriteTo(reply, from)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestLookupAddrDnsConfig(t *testing.T) {
+	want := netip.MustParseAddr("192.0.2.10")
+	d := &DnsConfig{
+		SearchDomains: []string{"lab.example"},
+		Resolvers:     map[string]string{"lab.example": serveLabDns(t, want)},
+	}
+
+	for _, host := range []string{"web", "web.lab.example"} {
+		r := lookupAddr(context.Background(), "ip4", &url.URL{Scheme: "http", Host: host}, d)
+		if len(r.addresses) != 1 || r.addresses[0] != netip.AddrPortFrom(want, 80) {
+			t.Errorf("expected %v to resolve to %v, got %v", host, want, r.addresses)
+		}
+	}
+}
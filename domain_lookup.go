@@ -3,18 +3,24 @@ package main
 
 import (
 	"context"
-	"net"
 	"net/netip"
 	"net/url"
 	"strconv"
+	"strings"
 )
 
 type resolvedUrl struct {
 	url       *url.URL
 	addresses []netip.AddrPort
+	// Published by the server for Encrypted ClientHello, if looked up.
+	echConfigList []byte
+	// The host also has IPv6 addresses, if looked up.
+	hasIpv6 bool
 }
 
-func lookupAddr(network string, h *url.URL) *resolvedUrl {
+// lookupAddr resolves h with the search domains and nameservers of dns,
+// nil only using the system resolver.
+func lookupAddr(ctx context.Context, network string, h *url.URL, dns *DnsConfig) *resolvedUrl {
 	r := resolvedUrl{url: h}
 
 	portString := urlPort(h)
@@ -24,8 +30,26 @@ func lookupAddr(network string, h *url.URL) *resolvedUrl {
 	}
 	p := uint16(p64)
 
-	resolver := net.DefaultResolver
-	addrs, err := resolver.LookupNetIP(context.Background(), network, r.url.Hostname())
+	// The resolver drops the zone of IPv6 literals, like fe80::1%eth0
+	if addr, err := netip.ParseAddr(r.url.Hostname()); err == nil {
+		addr = addr.Unmap()
+		if addr.Is4() == (network == "ip4") {
+			r.addresses = append(r.addresses, netip.AddrPortFrom(addr, p))
+		}
+		return &r
+	}
+
+	var addrs []netip.Addr
+	for _, name := range dns.candidates(r.url.Hostname()) {
+		if dns.isMdnsHost(name) {
+			addrs, err = lookupMdns(ctx, mdnsGroup(network), network, name)
+		} else {
+			addrs, err = dns.resolver(name).LookupNetIP(ctx, network, name)
+		}
+		if err == nil && len(addrs) > 0 {
+			break
+		}
+	}
 	if err != nil {
 		return &r
 	}
@@ -36,3 +60,20 @@ func lookupAddr(network string, h *url.URL) *resolvedUrl {
 	}
 	return &r
 }
+
+// parseTargetUrl parses a url, accepting the zone of a link-local IPv6
+// address without the %25 escape RFC 6874 requires, like
+// http://[fe80::1%eth0]/.
+func parseTargetUrl(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err == nil {
+		return u, nil
+	}
+
+	start, end := strings.Index(s, "["), strings.Index(s, "]")
+	zone := strings.Index(s, "%")
+	if start == -1 || zone < start || zone > end || strings.HasPrefix(s[zone:], "%25") {
+		return nil, err
+	}
+	return url.Parse(s[:zone] + "%25" + s[zone+1:])
+}
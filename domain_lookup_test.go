@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"testing"
+)
+
+func TestParseTargetUrl(t *testing.T) {
+	testcases := map[string]struct {
+		in       string
+		outHost  string
+		outError bool
+	}{
+		"Host":            {in: "http://example.com/", outHost: "example.com"},
+		"IPv6":            {in: "http://[2001:db8::1]:8080/", outHost: "2001:db8::1"},
+		"Escaped zone":    {in: "http://[fe80::1%25eth0]/", outHost: "fe80::1%eth0"},
+		"Unescaped zone":  {in: "http://[fe80::1%eth0]:8080/a", outHost: "fe80::1%eth0"},
+		"Bad escape":      {in: "http://example.com/%zz", outError: true},
+		"Percent in path": {in: "http://[fe80::1]/%zz", outError: true},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			u, err := parseTargetUrl(tc.in)
+			if (err != nil) != tc.outError {
+				t.Fatalf("expected error %v, got %v", tc.outError, err)
+			}
+			if err == nil && u.Hostname() != tc.outHost {
+				t.Errorf("expected host %v, got %v", tc.outHost, u.Hostname())
+			}
+		})
+	}
+}
+
+func TestCanonicalHost(t *testing.T) {
+	testcases := map[string]struct {
+		in  string
+		out string
+	}{
+		"Name":       {in: "http://example.com/", out: "example.com:80"},
+		"IPv4":       {in: "https://192.0.2.1/", out: "192.0.2.1:443"},
+		"IPv6":       {in: "http://[2001:DB8:0::1]:8080/", out: "[2001:db8::1]:8080"},
+		"Zoned IPv6": {in: "http://[FE80::0001%25eth0]/", out: "[fe80::1%eth0]:80"},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			u, err := parseTargetUrl(tc.in)
+			if err != nil {
+				t.Fatal("Failed to parse url: ", err)
+			}
+			if got := canonicalHost(u); got != tc.out {
+				t.Errorf("expected canonical host %v, got %v", tc.out, got)
+			}
+		})
+	}
+}
+
+func TestLookupAddrLiteral(t *testing.T) {
+	u, err := parseTargetUrl("http://[fe80::1%eth0]:8080/")
+	if err != nil {
+		t.Fatal("Failed to parse url: ", err)
+	}
+
+	r := lookupAddr(context.Background(), "ip6", u, nil)
+	want := netip.MustParseAddrPort("[fe80::1%eth0]:8080")
+	if len(r.addresses) != 1 || r.addresses[0] != want {
+		t.Errorf("expected addresses [%v], got %v", want, r.addresses)
+	}
+	if r := lookupAddr(context.Background(), "ip4", u, nil); len(r.addresses) != 0 {
+		t.Errorf("expected no IPv4 addresses, got %v", r.addresses)
+	}
+}
+
+func TestLookupAddrCancelled(t *testing.T) {
+	u, err := parseTargetUrl("http://localhost/")
+	if err != nil {
+		t.Fatal("Failed to parse url: ", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if r := lookupAddr(ctx, "ip4", u, nil); len(r.addresses) != 0 {
+		t.Errorf("expected a cancelled lookup to find no addresses, got %v", r.addresses)
+	}
+}
+
+// linkLocalAddr finds a link-local IPv6 address of this host, with its
+// zone.
+func linkLocalAddr(t *testing.T) netip.Addr {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Skip("skipping as interfaces are unavailable: ", err)
+	}
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			prefix, err := netip.ParsePrefix(a.String())
+			if err == nil && prefix.Addr().Is6() && prefix.Addr().IsLinkLocalUnicast() {
+				return prefix.Addr().WithZone(iface.Name)
+			}
+		}
+	}
+	t.Skip("skipping as there are no link-local IPv6 addresses")
+	return netip.Addr{}
+}
+
+func TestMeasureIpv6(t *testing.T) {
+	testcases := map[string]struct {
+		addr func(t *testing.T) netip.Addr
+	}{
+		"Loopback": {
+			addr: func(t *testing.T) netip.Addr { return netip.IPv6Loopback() },
+		},
+		"Link-local": {
+			addr: linkLocalAddr,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			addr := tc.addr(t)
+			l, err := net.Listen("tcp", netip.AddrPortFrom(addr, 0).String())
+			if err != nil {
+				t.Skip("skipping as IPv6 is unavailable: ", err)
+			}
+			l.Close()
+
+			srv := &httpTestServer{name: "server", server: &http.Server{Addr: addr.String()}}
+			startHttpServer(t, srv)
+			root := makeServerRoot(t, tPath("wildcard_robots.txt"), tPath("no_links.html"))
+			srv.server.Handler = HandlerChain{
+				makeFileHandler(root),
+			}
+
+			u, err := parseTargetUrl("http://" + srv.server.Addr + "/")
+			if err != nil {
+				t.Fatal("Failed to parse url: ", err)
+			}
+			for _, ipv6 := range []bool{false, true} {
+				m := Measurer{Ipv6: ipv6}
+				r, err := m.Measure([]*url.URL{u})
+				if err != nil {
+					t.Fatal("Failed to measure: ", err)
+				}
+				want := 0
+				if ipv6 {
+					want = 1
+				}
+				if r.MaxConnections != want {
+					t.Errorf("expected to measure %d connections with IPv6 %v, got %d", want, ipv6, r.MaxConnections)
+				}
+			}
+		})
+	}
+}
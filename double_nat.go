@@ -0,0 +1,194 @@
+// Functions related to detecting double NATs from the first hops of the
+// path, as the capacity measured behind them is that of the most
+// restrictive device rather than the nearest.
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+const (
+	defaultHopTarget = "1.1.1.1"
+	defaultMaxHops   = 5
+	hopTimeout       = time.Second
+)
+
+// Ranges of addresses behind NATs, RFC 1918 private networks and the RFC
+// 6598 shared address space of carrier-grade NATs
+var (
+	privateRanges = []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("172.16.0.0/12"),
+		netip.MustParsePrefix("192.168.0.0/16"),
+	}
+	sharedRange = netip.MustParsePrefix("100.64.0.0/10")
+)
+
+// DoubleNatReport is what the first hops of the path tell of the NATs
+// on it.
+type DoubleNatReport struct {
+	// Addresses of the first hops in order, empty for those that did not
+	// answer
+	Hops []string `json:"hops"`
+	// Private and shared networks of the hops, as /24s, each likely
+	// behind a NAT of its own
+	Networks []string `json:"networks"`
+	// A hop was in the shared address space of carrier-grade NATs
+	CarrierGrade bool `json:"carrier_grade"`
+	DoubleNat    bool `json:"double_nat"`
+}
+
+// analyseHops finds the private and shared networks the hops are in. A
+// path crossing more than one, or the shared address space, likely
+// crosses more than one NAT. Routers of an ISP numbered privately look
+// alike, so this is only a likely double NAT.
+func analyseHops(hops []netip.Addr) *DoubleNatReport {
+	report := &DoubleNatReport{Hops: []string{}, Networks: []string{}}
+	seen := map[netip.Prefix]bool{}
+	for _, h := range hops {
+		if !h.IsValid() {
+			report.Hops = append(report.Hops, "")
+			continue
+		}
+		h = h.Unmap()
+		report.Hops = append(report.Hops, h.String())
+
+		shared := sharedRange.Contains(h)
+		private := shared
+		for _, p := range privateRanges {
+			private = private || p.Contains(h)
+		}
+		if !private {
+			continue
+		}
+		report.CarrierGrade = report.CarrierGrade || shared
+		network := netip.PrefixFrom(h, 24).Masked()
+		if !seen[network] {
+			seen[network] = true
+			report.Networks = append(report.Networks, network.String())
+		}
+	}
+	report.DoubleNat = len(report.Networks) > 1 || report.CarrierGrade
+	return report
+}
+
+// probedSeq is the sequence of the echo request a time exceeded message
+// is about, from the IPv4 header and first 8 bytes of the request it
+// carries.
+func probedSeq(body icmp.MessageBody, id int) (int, bool) {
+	te, ok := body.(*icmp.TimeExceeded)
+	if !ok || len(te.Data) < ipv4.HeaderLen {
+		return 0, false
+	}
+	ihl := int(te.Data[0]&0x0f) * 4
+	if len(te.Data) < ihl+8 || te.Data[ihl] != byte(ipv4.ICMPTypeEcho) {
+		return 0, false
+	}
+	if int(binary.BigEndian.Uint16(te.Data[ihl+4:])) != id {
+		return 0, false
+	}
+	return int(binary.BigEndian.Uint16(te.Data[ihl+6:])), true
+}
+
+// traceHops sends echo requests to target with TTLs from 1 to maxHops,
+// returning the address of each hop that answered, invalid for those
+// that did not, until target answers.
+func traceHops(conn *icmp.PacketConn, target netip.Addr, maxHops int, timeout time.Duration) ([]netip.Addr, error) {
+	id := os.Getpid() & 0xffff
+	hops := []netip.Addr{}
+	buf := make([]byte, 1500)
+	for ttl := 1; ttl <= maxHops; ttl++ {
+		err := conn.IPv4PacketConn().SetTTL(ttl)
+		if err != nil {
+			return nil, fmt.Errorf("failed to set the TTL: %w", err)
+		}
+		msg := icmp.Message{
+			Type: ipv4.ICMPTypeEcho,
+			Body: &icmp.Echo{ID: id, Seq: ttl, Data: []byte("natck")},
+		}
+		b, err := msg.Marshal(nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode echo request: %w", err)
+		}
+		_, err = conn.WriteTo(b, &net.IPAddr{IP: target.AsSlice()})
+		if err != nil {
+			return nil, fmt.Errorf("failed to send echo request: %w", err)
+		}
+
+		hop := netip.Addr{}
+		reached := false
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		for !hop.IsValid() {
+			n, peer, err := conn.ReadFrom(buf)
+			if err != nil {
+				break
+			}
+			reply, err := icmp.ParseMessage(1, buf[:n])
+			if err != nil {
+				continue
+			}
+			from, ok := netip.AddrFromSlice(peer.(*net.IPAddr).IP)
+			if !ok {
+				continue
+			}
+			if echo, ok := reply.Body.(*icmp.Echo); ok && reply.Type == ipv4.ICMPTypeEchoReply && echo.ID == id && echo.Seq == ttl {
+				hop, reached = from, true
+			} else if seq, ok := probedSeq(reply.Body, id); ok && seq == ttl {
+				hop = from
+			}
+		}
+		hops = append(hops, hop.Unmap())
+		if reached {
+			break
+		}
+	}
+	return hops, nil
+}
+
+// listenRawIcmp opens a raw ICMP socket, as the ping sockets of
+// listenIcmp are not given time exceeded messages.
+func listenRawIcmp() (*icmp.PacketConn, error) {
+	conn, err := icmp.ListenPacket("ip4:icmp", "0.0.0.0")
+	if err != nil {
+		return nil, errNoRawSockets
+	}
+	return conn, nil
+}
+
+// detectDoubleNat traces the first hops towards target.
+func detectDoubleNat(target netip.Addr, maxHops int) (*DoubleNatReport, error) {
+	conn, err := listenRawIcmp()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	hops, err := traceHops(conn, target, maxHops, hopTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.ContainsFunc(hops, netip.Addr.IsValid) {
+		return nil, errors.New("no hops answered")
+	}
+	return analyseHops(hops), nil
+}
+
+// doubleNatWarning explains what a double NAT means for the result.
+func doubleNatWarning(d *DoubleNatReport) string {
+	if d == nil || !d.DoubleNat {
+		return ""
+	}
+	if d.CarrierGrade {
+		return "the path crosses a carrier-grade NAT, the max connections are of the most restrictive NAT on the path"
+	}
+	return fmt.Sprintf("the path crosses %d private networks, likely a double NAT, the max connections are of the most restrictive NAT on the path", len(d.Networks))
+}
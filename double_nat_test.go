@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"slices"
+	"testing"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+func TestAnalyseHops(t *testing.T) {
+	testcases := map[string]struct {
+		in              []string
+		outNetworks     []string
+		outCarrierGrade bool
+		outDoubleNat    bool
+	}{
+		"single NAT": {
+			in:          []string{"192.168.1.1", "203.0.113.1", "198.51.100.1"},
+			outNetworks: []string{"192.168.1.0/24"},
+		},
+		"double NAT": {
+			in:           []string{"192.168.1.1", "", "10.0.0.1", "203.0.113.1"},
+			outNetworks:  []string{"192.168.1.0/24", "10.0.0.0/24"},
+			outDoubleNat: true,
+		},
+		"carrier-grade NAT": {
+			in:              []string{"192.168.1.1", "100.64.12.1", "203.0.113.1"},
+			outNetworks:     []string{"192.168.1.0/24", "100.64.12.0/24"},
+			outCarrierGrade: true,
+			outDoubleNat:    true,
+		},
+		"same network twice": {
+			in:          []string{"172.16.0.1", "172.16.0.254"},
+			outNetworks: []string{"172.16.0.0/24"},
+		},
+		"no answers": {
+			in:          []string{"", ""},
+			outNetworks: []string{},
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			hops := []netip.Addr{}
+			for _, h := range tc.in {
+				a, _ := netip.ParseAddr(h)
+				hops = append(hops, a)
+			}
+			got := analyseHops(hops)
+			if !slices.Equal(got.Hops, tc.in) {
+				t.Errorf("expected hops %v, got %v", tc.in, got.Hops)
+			}
+			if !slices.Equal(got.Networks, tc.outNetworks) || got.CarrierGrade != tc.outCarrierGrade || got.DoubleNat != tc.outDoubleNat {
+				t.Errorf("expected networks %v, carrier-grade %v and double NAT %v, got %+v",
+					tc.outNetworks, tc.outCarrierGrade, tc.outDoubleNat, got)
+			}
+			if (doubleNatWarning(got) != "") != tc.outDoubleNat {
+				t.Errorf("expected a warning only for double NATs, got %q", doubleNatWarning(got))
+			}
+		})
+	}
+}
+
+func TestProbedSeq(t *testing.T) {
+	probe := func(typ byte, id, seq uint16) *icmp.TimeExceeded {
+		data := make([]byte, ipv4.HeaderLen, ipv4.HeaderLen+8)
+		data[0] = 0x45
+		data = append(data, typ, 0, 0, 0)
+		data = binary.BigEndian.AppendUint16(data, id)
+		data = binary.BigEndian.AppendUint16(data, seq)
+		return &icmp.TimeExceeded{Data: data}
+	}
+
+	if seq, ok := probedSeq(probe(byte(ipv4.ICMPTypeEcho), 42, 3), 42); !ok || seq != 3 {
+		t.Errorf("expected sequence 3, got %v and %v", seq, ok)
+	}
+	if _, ok := probedSeq(probe(byte(ipv4.ICMPTypeEcho), 7, 3), 42); ok {
+		t.Error("expected the echo of another process to be ignored")
+	}
+	if _, ok := probedSeq(probe(17, 42, 3), 42); ok {
+		t.Error("expected another ICMP type to be ignored")
+	}
+	if _, ok := probedSeq(&icmp.Echo{ID: 42, Seq: 3}, 42); ok {
+		t.Error("expected a message other than time exceeded to be ignored")
+	}
+}
@@ -0,0 +1,44 @@
+// Functions related to reporting how many hosts could also be reached
+// over IPv6, bypassing the NAT entirely.
+package main
+
+import (
+	"context"
+	"net/url"
+)
+
+// DualStackReport counts the hosts looked up whilst measuring that also,
+// or only, have IPv6 addresses.
+type DualStackReport struct {
+	Hosts       int `json:"hosts"`
+	DualStacked int `json:"dual_stacked"`
+	// Skipped by the measurement, which only connects over IPv4
+	Ipv6Only int `json:"ipv6_only"`
+}
+
+func (d *DualStackReport) add(r *resolvedUrl) {
+	if d == nil || (len(r.addresses) == 0 && !r.hasIpv6) {
+		return
+	}
+	d.Hosts++
+	if !r.hasIpv6 {
+		return
+	}
+	if len(r.addresses) > 0 {
+		d.DualStacked++
+	} else {
+		d.Ipv6Only++
+	}
+}
+
+// lookupDualStack looks up the IPv4 addresses of a host and, in
+// parallel, whether it has IPv6 addresses.
+func lookupDualStack(ctx context.Context, n network, h *url.URL) *resolvedUrl {
+	hasIpv6 := make(chan bool, 1)
+	go func() {
+		hasIpv6 <- len(n.lookupAddr(ctx, "ip6", h).addresses) > 0
+	}()
+	r := n.lookupAddr(ctx, "ip4", h)
+	r.hasIpv6 = <-hasIpv6
+	return r
+}
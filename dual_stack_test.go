@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"net/netip"
+	"net/url"
+	"testing"
+)
+
+// dualStackNetwork gives the even hosts of a benchNetwork IPv6 addresses,
+// and takes the IPv4 addresses of the hosts in ipv6Only.
+type dualStackNetwork struct {
+	benchNetwork
+	ipv6Only map[int]bool
+}
+
+func (n *dualStackNetwork) lookupAddr(ctx context.Context, network string, h *url.URL) *resolvedUrl {
+	i, _ := benchHostIndex(h)
+	if network == "ip6" {
+		r := &resolvedUrl{url: h}
+		if i%2 == 0 || n.ipv6Only[i] {
+			r.addresses = []netip.AddrPort{netip.MustParseAddrPort("[2001:db8::1]:80")}
+		}
+		return r
+	}
+	if n.ipv6Only[i] {
+		return &resolvedUrl{url: h}
+	}
+	return n.benchNetwork.lookupAddr(ctx, network, h)
+}
+
+func TestCompareDualStack(t *testing.T) {
+	n := &dualStackNetwork{
+		benchNetwork: benchNetwork{hosts: 10, fanout: 3, seeds: 1},
+		ipv6Only:     map[int]bool{9: true},
+	}
+
+	testcases := map[string]struct {
+		compare bool
+		out     *DualStackReport
+	}{
+		"IPv4 only": {},
+		"Compare": {
+			compare: true,
+			out:     &DualStackReport{Hosts: 10, DualStacked: 5, Ipv6Only: 1},
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			m := Measurer{network: n, CompareDualStack: tc.compare}
+			r, err := m.Measure(n.seedUrls())
+			if err != nil {
+				t.Fatal("Failed to measure: ", err)
+			}
+			if r.MaxConnections != 9 {
+				t.Errorf("expected to measure 9 connections, got %d", r.MaxConnections)
+			}
+			if (r.DualStack == nil) != (tc.out == nil) || (tc.out != nil && *r.DualStack != *tc.out) {
+				t.Errorf("expected dual-stack report %+v, got %+v", tc.out, r.DualStack)
+			}
+		})
+	}
+}
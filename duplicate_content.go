@@ -0,0 +1,71 @@
+// Functions related to detecting pages with the same content as another
+// page of the server, like the endless pages of a calendar or urls varying
+// only by a session id, so crawler traps do not monopolise a connection.
+package main
+
+import (
+	"net/url"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// pattern is the shape of the url, segments of the path with digits and
+// the values of the query are wildcards. Urls of crawler traps usually
+// share a pattern.
+func (r relativeUrl) pattern() string {
+	segments := strings.Split(r.path, "/")
+	for i, s := range segments {
+		if strings.ContainsFunc(s, unicode.IsDigit) {
+			segments[i] = "*"
+		}
+	}
+	p := strings.Join(segments, "/")
+
+	query, err := url.ParseQuery(r.rawQuery)
+	if err != nil || len(query) == 0 {
+		return p
+	}
+	keys := []string{}
+	for k := range query {
+		keys = append(keys, k+"=*")
+	}
+	slices.Sort(keys)
+	return p + "?" + strings.Join(keys, "&")
+}
+
+// duplicateContent reports whether the page of the reply has the same
+// content as another page of the connection. The pattern of its url is
+// then a trap, the uncrawled urls sharing it are dropped and no more are
+// added. Pages crawled again, to keep the connection alive, are not
+// duplicates.
+func (s *scheduler) duplicateContent(c *connection, reply *roundtrip, recrawled bool) bool {
+	if reply.bodyHash == 0 || recrawled {
+		return false
+	}
+	rUrl := urlToRelativeUrl(reply.url)
+	if c.bodyHashes == nil {
+		c.bodyHashes = map[uint64]relativeUrl{}
+	}
+	first, found := c.bodyHashes[reply.bodyHash]
+	if !found {
+		c.bodyHashes[reply.bodyHash] = rUrl
+		return false
+	}
+	if first == rUrl {
+		return false
+	}
+
+	s.duplicatePages++
+	if c.trapPatterns == nil {
+		c.trapPatterns = map[string]bool{}
+	}
+	p := rUrl.pattern()
+	c.trapPatterns[p] = true
+	for r := range c.uncrawledUrls {
+		if r.pattern() == p {
+			delete(c.uncrawledUrls, r)
+		}
+	}
+	return true
+}
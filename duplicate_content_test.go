@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUrlPattern(t *testing.T) {
+	testcases := map[string]struct {
+		inUrl      string
+		expPattern string
+	}{
+		"Root":          {inUrl: "http://example.com/", expPattern: "/"},
+		"Plain path":    {inUrl: "http://example.com/about/team", expPattern: "/about/team"},
+		"Calendar":      {inUrl: "http://example.com/calendar/2024/05", expPattern: "/calendar/*/*"},
+		"Session id":    {inUrl: "http://example.com/page?sid=a1b2&lang=en", expPattern: "/page?lang=*&sid=*"},
+		"Id in segment": {inUrl: "http://example.com/post-42/comments", expPattern: "/*/comments"},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			u, err := url.Parse(tc.inUrl)
+			if err != nil {
+				t.Fatal("Failed to parse url: ", err)
+			}
+			if p := urlToRelativeUrl(u).pattern(); p != tc.expPattern {
+				t.Errorf("expected %v, got %v", tc.expPattern, p)
+			}
+		})
+	}
+}
+
+// calendarNetwork gives the only host of a benchNetwork an endless
+// calendar, each month linking to the next with the same content.
+type calendarNetwork struct {
+	benchNetwork
+	months atomic.Int32
+}
+
+func (n *calendarNetwork) scrapConnection(ctx context.Context, r *roundtrip) *roundtrip {
+	r = n.benchNetwork.scrapConnection(ctx, r)
+	switch r.url.Path {
+	case "/":
+		r.bodyHash = 1
+		r.scrapedUrls = append(r.scrapedUrls, r.url.JoinPath("calendar", "1"))
+	case "/robots.txt":
+	default:
+		month := n.months.Add(1)
+		r.bodyHash = 2
+		r.scrapedUrls = append(r.scrapedUrls, r.url.JoinPath("..", fmt.Sprint(month+1)))
+	}
+	return r
+}
+
+func TestDuplicateContent(t *testing.T) {
+	n := &calendarNetwork{benchNetwork: benchNetwork{hosts: 1, seeds: 1}}
+	m := Measurer{network: n, Timeout: 10 * time.Second}
+	r, err := m.Measure(n.seedUrls())
+	if err != nil {
+		t.Fatal("Failed to measure: ", err)
+	}
+
+	if r.DuplicatePages != 1 {
+		t.Errorf("expected 1 duplicate page, got %d", r.DuplicatePages)
+	}
+	if months := n.months.Load(); months != 2 {
+		t.Errorf("expected to stop crawling the calendar after 2 months, crawled %d", months)
+	}
+}
@@ -0,0 +1,146 @@
+// Functions related to Encrypted ClientHello, where the servers publish
+// the configs to encrypt the ClientHello with in their DNS HTTPS records.
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	echLookupTimeout = 5 * time.Second
+	// HTTPS resource record type, RFC 9460
+	dnsTypeHttps dnsmessage.Type = 65
+	// SvcParamKey of the ECHConfigList in HTTPS records
+	svcParamEch = 5
+)
+
+var errNoEchConfig = errors.New("no ECH config published")
+
+// systemNameserver is the first nameserver in resolv.conf.
+func systemNameserver() (string, error) {
+	f, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return "", fmt.Errorf("failed to open resolv.conf: %w", err)
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			return net.JoinHostPort(fields[1], "53"), nil
+		}
+	}
+	return "", errors.New("no nameserver in resolv.conf")
+}
+
+// parseHttpsEch returns the ECHConfigList from the RDATA of an HTTPS
+// record, if it has one.
+func parseHttpsEch(rdata []byte) ([]byte, bool) {
+	if len(rdata) < 2 {
+		return nil, false
+	}
+	// Alias mode records have no parameters
+	if binary.BigEndian.Uint16(rdata) == 0 {
+		return nil, false
+	}
+	rdata = rdata[2:]
+
+	// Skip the uncompressed target name
+	for {
+		if len(rdata) == 0 {
+			return nil, false
+		}
+		n := int(rdata[0])
+		if len(rdata) < 1+n {
+			return nil, false
+		}
+		rdata = rdata[1+n:]
+		if n == 0 {
+			break
+		}
+	}
+
+	for len(rdata) >= 4 {
+		key := binary.BigEndian.Uint16(rdata)
+		n := int(binary.BigEndian.Uint16(rdata[2:]))
+		if len(rdata) < 4+n {
+			return nil, false
+		}
+		if key == svcParamEch {
+			return rdata[4 : 4+n], true
+		}
+		rdata = rdata[4+n:]
+	}
+	return nil, false
+}
+
+// lookupEchConfigList asks nameserver for the ECHConfigList published by
+// host.
+func lookupEchConfigList(nameserver, host string) ([]byte, error) {
+	name, err := dnsmessage.NewName(strings.TrimSuffix(host, ".") + ".")
+	if err != nil {
+		return nil, fmt.Errorf("failed to make dns name: %w", err)
+	}
+
+	id := uint16(time.Now().UnixNano())
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: true})
+	b.EnableCompression()
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{Name: name, Type: dnsTypeHttps, Class: dnsmessage.ClassINET})
+	query, err := b.Finish()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build dns query: %w", err)
+	}
+
+	conn, err := net.DialTimeout("udp", nameserver, echLookupTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial nameserver: %w", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(echLookupTimeout))
+
+	_, err = conn.Write(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send dns query: %w", err)
+	}
+
+	buf := make([]byte, 4096)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read dns reply: %w", err)
+		}
+
+		var p dnsmessage.Parser
+		h, err := p.Start(buf[:n])
+		if err != nil || h.ID != id || !h.Response {
+			// Not a reply to this query
+			continue
+		}
+		p.SkipAllQuestions()
+		answers, err := p.AllAnswers()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse dns reply: %w", err)
+		}
+		for _, a := range answers {
+			r, ok := a.Body.(*dnsmessage.UnknownResource)
+			if !ok || r.Type != dnsTypeHttps {
+				continue
+			}
+			if ech, found := parseHttpsEch(r.Data); found {
+				return ech, nil
+			}
+		}
+		return nil, errNoEchConfig
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// httpsRdata builds the RDATA of an HTTPS record with the given params.
+func httpsRdata(priority uint16, params map[uint16][]byte) []byte {
+	b := []byte{byte(priority >> 8), byte(priority), 0}
+	for k, v := range params {
+		b = append(b, byte(k>>8), byte(k), byte(len(v)>>8), byte(len(v)))
+		b = append(b, v...)
+	}
+	return b
+}
+
+func TestParseHttpsEch(t *testing.T) {
+	ech := []byte{0x00, 0x04, 0xfe, 0x0d, 0x00, 0x00}
+	alpn := []byte{2, 'h', '2'}
+
+	testcases := map[string]struct {
+		rdata []byte
+		ech   []byte
+		found bool
+	}{
+		"ECH": {
+			rdata: httpsRdata(1, map[uint16][]byte{svcParamEch: ech}),
+			ech:   ech,
+			found: true,
+		},
+		"No ECH": {
+			rdata: httpsRdata(1, map[uint16][]byte{1: alpn}),
+		},
+		"Alias mode": {
+			rdata: httpsRdata(0, map[uint16][]byte{svcParamEch: ech}),
+		},
+		"Truncated": {
+			rdata: httpsRdata(1, map[uint16][]byte{svcParamEch: ech})[:8],
+		},
+		"Empty": {
+			rdata: []byte{},
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			ech, found := parseHttpsEch(tc.rdata)
+			if found != tc.found || !bytes.Equal(ech, tc.ech) {
+				t.Errorf("expected %v %v, got %v %v", tc.ech, tc.found, ech, found)
+			}
+		})
+	}
+}
+
+func TestLookupEchConfigList(t *testing.T) {
+	ech := []byte{0x00, 0x04, 0xfe, 0x0d, 0x00, 0x00}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Failed to listen: ", err)
+	}
+	defer conn.Close()
+
+	// Answer every query with an HTTPS record carrying ech
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var p dnsmessage.Parser
+			h, err := p.Start(buf[:n])
+			if err != nil {
+				continue
+			}
+			q, err := p.Question()
+			if err != nil {
+				continue
+			}
+
+			b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: h.ID, Response: true})
+			b.StartQuestions()
+			b.Question(q)
+			b.StartAnswers()
+			b.UnknownResource(
+				dnsmessage.ResourceHeader{Name: q.Name, Type: dnsTypeHttps, Class: dnsmessage.ClassINET},
+				dnsmessage.UnknownResource{Type: dnsTypeHttps, Data: httpsRdata(1, map[uint16][]byte{svcParamEch: ech})},
+			)
+			reply, err := b.Finish()
+			if err != nil {
+				continue
+			}
+			conn.WriteTo(reply, addr)
+		}
+	}()
+
+	got, err := lookupEchConfigList(conn.LocalAddr().String(), "example.com")
+	if err != nil {
+		t.Fatal("Failed to lookup ECH config: ", err)
+	}
+	if !bytes.Equal(got, ech) {
+		t.Errorf("expected ECH config %v, got %v", ech, got)
+	}
+}
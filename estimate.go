@@ -0,0 +1,36 @@
+// Functions related to estimating the cost of a measurement before starting it.
+package main
+
+import (
+	"time"
+)
+
+// Rough sizes of what is fetched from each server, including headers,
+// taken from a typical crawl of popular sites.
+const (
+	avgRobotsTxtBytes = 4 * 1024
+	avgPageBytes      = 64 * 1024
+	avgPagesPerHost   = 4
+)
+
+type runEstimate struct {
+	duration time.Duration
+	bytes    uint64
+}
+
+// estimateRun guesses the duration and data usage of measuring from
+// nSeeds servers. Hosts discovered whilst crawling are not known ahead of
+// time, so this is only a lower bound unless the data usage is capped.
+func estimateRun(m *Measurer, nSeeds int) runEstimate {
+	perHost := uint64(avgRobotsTxtBytes + avgPagesPerHost*avgPageBytes)
+	e := runEstimate{
+		// Servers are crawled in parallel, each limited to one request
+		// per re-request interval.
+		duration: (avgPagesPerHost + 1) * m.policy().ReRequestInterval,
+		bytes:    uint64(nSeeds) * perHost,
+	}
+	if m.MaxTotalBytes > 0 {
+		e.bytes = min(e.bytes, m.MaxTotalBytes)
+	}
+	return e
+}
@@ -0,0 +1,80 @@
+// Functions related to reporting significant events whilst measuring.
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+type EventType string
+
+const (
+	EventConnectionEstablished EventType = "connection-established"
+	EventConnectionFailed      EventType = "connection-failed"
+	// An established connection timed out, its NAT mapping was dropped
+	EventMappingLost         EventType = "mapping-lost"
+	EventRampPaused          EventType = "ramp-paused"
+	EventExhaustionSuspected EventType = "exhaustion-suspected"
+	// The NAT moved the client to another external IP
+	EventExternalIpChanged EventType = "external-ip-changed"
+	// Last of the events streamed by Measurer.Run
+	EventMeasurementFinished EventType = "measurement-finished"
+	EventMeasurementFailed   EventType = "measurement-failed"
+)
+
+// Event is a point in a measurement that external tooling may want to
+// react to as it happens.
+type Event struct {
+	Type EventType `json:"type"`
+	Time time.Time `json:"time"`
+	// Server the event relates to, if any.
+	Scheme string `json:"scheme,omitempty"`
+	Host   string `json:"host,omitempty"`
+	Addr   string `json:"addr,omitempty"`
+	// Why the event happened, e.g. the connection error.
+	Reason string `json:"reason,omitempty"`
+	// Connections that were active when the event happened.
+	ActiveConnections int `json:"active_connections"`
+	// Result of the measurement, only when finished.
+	Result *Result `json:"result,omitempty"`
+}
+
+func (m *Measurer) emit(e Event) {
+	if m.OnEvent == nil {
+		return
+	}
+	e.Time = time.Now()
+	m.OnEvent(e)
+}
+
+func connectionEvent(t EventType, c *connection, nActive int) Event {
+	return Event{
+		Type:              t,
+		Scheme:            c.url.Scheme,
+		Host:              c.host.hostPort,
+		Addr:              c.host.ip.String(),
+		ActiveConnections: nActive,
+	}
+}
+
+// multiEventHandler calls each of the handlers in order.
+func multiEventHandler(handlers ...func(Event)) func(Event) {
+	return func(e Event) {
+		for _, h := range handlers {
+			h(e)
+		}
+	}
+}
+
+// ndjsonEventWriter writes each event as one line of JSON.
+func ndjsonEventWriter(w io.Writer) func(Event) {
+	var m sync.Mutex
+	enc := json.NewEncoder(w)
+	return func(e Event) {
+		m.Lock()
+		defer m.Unlock()
+		enc.Encode(e)
+	}
+}
@@ -0,0 +1,161 @@
+// Functions related to watching what happens to established connections
+// once the NAT is suspected to be exhausted. Some NATs evict existing
+// mappings to make room for new ones, others hard-block new mappings.
+package main
+
+import (
+	"slices"
+	"time"
+)
+
+const (
+	EvictionPolicyNone   = "none"
+	EvictionPolicyLru    = "lru"
+	EvictionPolicyRandom = "random"
+)
+
+// ExhaustionReport is what the NAT did to the established connections
+// after it was first suspected to be exhausted.
+type ExhaustionReport struct {
+	// How the NAT picks existing mappings to evict when exhausted. lru
+	// when it evicted the oldest or least recently used mappings first,
+	// random when it evicted others and none when it hard-blocks new
+	// mappings instead.
+	Policy string `json:"policy"`
+	// Rank correlation between the order the evicted connections were
+	// established and the order they failed, 1 when the oldest failed
+	// first. Zero with fewer than two evictions.
+	OrderCorrelation float64    `json:"order_correlation"`
+	Evicted          []Eviction `json:"evicted,omitempty"`
+}
+
+// Eviction is an established connection that failed its keep-alive
+// after exhaustion was suspected.
+type Eviction struct {
+	Host string `json:"host"`
+	// Time from exhaustion being suspected to the keep-alive failing
+	AfterExhaustion time.Duration `json:"after_exhaustion"`
+}
+
+// watchedConnection is the state of an established connection when
+// exhaustion was suspected.
+type watchedConnection struct {
+	established time.Time
+	lastUsed    time.Time
+}
+
+// exhaustionWatch tracks the connections established when exhaustion
+// was first suspected.
+type exhaustionWatch struct {
+	start time.Time
+	// Long enough for every established connection to be kept alive at
+	// least once
+	duration time.Duration
+	watched  map[uint]watchedConnection
+	// In the order they failed
+	evicted []*connection
+	after   []time.Duration
+}
+
+func newExhaustionWatch(conns []*connection, keepAliveInterval time.Duration) *exhaustionWatch {
+	w := &exhaustionWatch{
+		start:    time.Now(),
+		duration: 2 * keepAliveInterval,
+		watched:  map[uint]watchedConnection{},
+	}
+	for _, c := range conns {
+		if c.established.IsZero() {
+			continue
+		}
+		w.watched[c.id] = watchedConnection{established: c.established, lastUsed: c.lastReply}
+	}
+	return w
+}
+
+// watching reports whether there are established connections to watch,
+// and the watch is not over.
+func (w *exhaustionWatch) watching() bool {
+	return w != nil && len(w.watched) > len(w.evicted) && time.Since(w.start) < w.duration
+}
+
+func (w *exhaustionWatch) failed(c *connection, at time.Time) {
+	if w == nil {
+		return
+	}
+	if _, found := w.watched[c.id]; !found {
+		return
+	}
+	w.evicted = append(w.evicted, c)
+	w.after = append(w.after, at.Sub(w.start))
+}
+
+// evictedFirst reports whether every evicted connection is before every
+// surviving connection, by the given time.
+func (w *exhaustionWatch) evictedFirst(by func(watchedConnection) time.Time) bool {
+	for id, survivor := range w.watched {
+		if slices.ContainsFunc(w.evicted, func(c *connection) bool { return c.id == id }) {
+			continue
+		}
+		for _, c := range w.evicted {
+			if by(w.watched[c.id]).After(by(survivor)) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// orderCorrelation is the Kendall rank correlation between the order the
+// evicted connections were established and the order they failed.
+func (w *exhaustionWatch) orderCorrelation() float64 {
+	n := len(w.evicted)
+	if n < 2 {
+		return 0
+	}
+
+	concordant := 0
+	for i := range n {
+		for j := i + 1; j < n; j++ {
+			a := w.watched[w.evicted[i].id].established
+			b := w.watched[w.evicted[j].id].established
+			if a.Before(b) {
+				concordant++
+			} else if a.After(b) {
+				concordant--
+			}
+		}
+	}
+	return float64(concordant) / float64(n*(n-1)/2)
+}
+
+// classify correlates the order connections were established and used
+// with the order they were evicted, to tell LRU eviction from random
+// eviction.
+func (w *exhaustionWatch) classify() (string, float64) {
+	if len(w.evicted) == 0 {
+		return EvictionPolicyNone, 0
+	}
+
+	correlation := w.orderCorrelation()
+	oldest := w.evictedFirst(func(c watchedConnection) time.Time { return c.established })
+	leastUsed := w.evictedFirst(func(c watchedConnection) time.Time { return c.lastUsed })
+	// Failing out of order may just be the order of keep-alives, so
+	// only a reversed order rules out LRU
+	if (oldest || leastUsed) && correlation >= 0 {
+		return EvictionPolicyLru, correlation
+	}
+	return EvictionPolicyRandom, correlation
+}
+
+func (w *exhaustionWatch) report() *ExhaustionReport {
+	if w == nil || len(w.watched) == 0 {
+		return nil
+	}
+
+	r := &ExhaustionReport{}
+	r.Policy, r.OrderCorrelation = w.classify()
+	for i, c := range w.evicted {
+		r.Evicted = append(r.Evicted, Eviction{Host: c.host.hostPort, AfterExhaustion: w.after[i]})
+	}
+	return r
+}
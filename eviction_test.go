@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// natNetwork simulates a NAT in front of a benchNetwork, with room for
+// a limited number of mappings. If evict is set, refused dials evict the
+// oldest mapping once there have been enough to suspect exhaustion.
+type natNetwork struct {
+	benchNetwork
+	limit int
+	evict bool
+
+	m       sync.Mutex
+	mapped  []uint
+	refused map[uint]bool
+	evicted map[uint]bool
+}
+
+func (n *natNetwork) scrapConnection(ctx context.Context, r *roundtrip) *roundtrip {
+	n.m.Lock()
+	refused := n.refused[r.connId]
+	if !refused && !slices.Contains(n.mapped, r.connId) && !n.evicted[r.connId] {
+		if len(n.mapped) < n.limit {
+			n.mapped = append(n.mapped, r.connId)
+		} else {
+			refused = true
+			n.refused[r.connId] = true
+			if n.evict && len(n.refused) >= maxRepeatedDialFails {
+				n.evicted[n.mapped[0]] = true
+				n.mapped = n.mapped[1:]
+			}
+		}
+	}
+	evicted := n.evicted[r.connId]
+	n.m.Unlock()
+
+	if refused {
+		r.requestTs = time.Now()
+		r.replyTs = r.requestTs
+		r.err = &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("no free mappings")}
+		return r
+	}
+	if evicted {
+		r.requestTs = time.Now()
+		r.replyTs = r.requestTs
+		r.err = errors.New("connection reset by peer")
+		return r
+	}
+	return n.benchNetwork.scrapConnection(ctx, r)
+}
+
+func TestExhaustionEvictions(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping due to waiting for keep-alives.")
+	}
+
+	testcases := map[string]struct {
+		evict    bool
+		policies []string
+	}{
+		"Hard-block": {
+			policies: []string{EvictionPolicyNone},
+		},
+		"Evicting": {
+			evict:    true,
+			policies: []string{EvictionPolicyLru},
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			n := &natNetwork{
+				benchNetwork: benchNetwork{hosts: 40, fanout: 4, seeds: 2},
+				limit:        8,
+				evict:        tc.evict,
+				refused:      map[uint]bool{},
+				evicted:      map[uint]bool{},
+			}
+			m := Measurer{network: n}
+			r, err := m.Measure(n.seedUrls())
+			if err != nil {
+				t.Fatal("Failed to measure: ", err)
+			}
+
+			e := r.Exhaustion
+			if e == nil {
+				t.Fatal("expected the NAT to be exhausted")
+			}
+			if !slices.Contains(tc.policies, e.Policy) {
+				t.Errorf("expected eviction policy to be one of %v, got %v", tc.policies, e.Policy)
+			}
+			if tc.evict != (len(e.Evicted) > 0) {
+				t.Errorf("expected evictions %v, got %v", tc.evict, e.Evicted)
+			}
+			if r.MaxConnections+len(e.Evicted) != n.limit {
+				t.Errorf("expected %d connections and evictions, got %d and %d", n.limit, r.MaxConnections, len(e.Evicted))
+			}
+		})
+	}
+}
+
+func TestExhaustionReportPolicy(t *testing.T) {
+	start := time.Now()
+	// Established in order, with the keep-alives of the first two
+	// reversed
+	makeConns := func() []*connection {
+		lastUsed := []int{1, 0, 2, 3}
+		conns := []*connection{}
+		for i := range lastUsed {
+			c := &connection{
+				id:          uint(i),
+				host:        &host{hostPort: fmt.Sprintf("h%d:80", i)},
+				established: start.Add(time.Duration(i) * time.Second),
+				lastReply:   start.Add(time.Duration(10+lastUsed[i]) * time.Second),
+			}
+			conns = append(conns, c)
+		}
+		return conns
+	}
+
+	testcases := map[string]struct {
+		evicted     []int
+		policy      string
+		correlation float64
+	}{
+		"None evicted":          {policy: EvictionPolicyNone},
+		"Oldest in order":       {evicted: []int{0, 1, 2}, policy: EvictionPolicyLru, correlation: 1},
+		"Least recently used":   {evicted: []int{1}, policy: EvictionPolicyLru},
+		"Every connection":      {evicted: []int{0, 1, 2, 3}, policy: EvictionPolicyLru, correlation: 1},
+		"Newest":                {evicted: []int{3}, policy: EvictionPolicyRandom},
+		"Skipping a connection": {evicted: []int{0, 2}, policy: EvictionPolicyRandom, correlation: 1},
+		"Oldest reversed":       {evicted: []int{1, 0}, policy: EvictionPolicyRandom, correlation: -1},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			conns := makeConns()
+			w := newExhaustionWatch(conns, reRequestInterval)
+			for _, i := range tc.evicted {
+				w.failed(conns[i], time.Now())
+			}
+
+			r := w.report()
+			if r.Policy != tc.policy {
+				t.Errorf("expected policy %v, got %v", tc.policy, r.Policy)
+			}
+			if r.OrderCorrelation != tc.correlation {
+				t.Errorf("expected order correlation %v, got %v", tc.correlation, r.OrderCorrelation)
+			}
+			if len(r.Evicted) != len(tc.evicted) {
+				t.Errorf("expected %d evictions, got %d", len(tc.evicted), len(r.Evicted))
+			}
+		})
+	}
+}
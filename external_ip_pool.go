@@ -0,0 +1,71 @@
+// Functions related to finding the pool of external IPs a NAT spreads one
+// subscriber across, as carrier NATs may map each connection to any of
+// several public IPs.
+package main
+
+import (
+	"cmp"
+	"net/netip"
+	"slices"
+)
+
+// Connections made to the reflector before measuring, to find the
+// external IPs of a pool
+const externalIpSamples = 8
+
+// ExternalIpUse is an external IP the NAT mapped connections to the
+// reflector to.
+type ExternalIpUse struct {
+	Ip          string `json:"ip"`
+	Connections int    `json:"connections"`
+}
+
+// externalIpPool counts the connections to the reflector seen from each
+// external IP.
+type externalIpPool struct {
+	counts map[netip.Addr]int
+}
+
+func newExternalIpPool() *externalIpPool {
+	return &externalIpPool{counts: map[netip.Addr]int{}}
+}
+
+func (p *externalIpPool) add(addr netip.Addr) {
+	if p == nil {
+		return
+	}
+	p.counts[addr]++
+}
+
+// seen reports whether a connection to the reflector came from addr.
+func (p *externalIpPool) seen(addr netip.Addr) bool {
+	return p != nil && p.counts[addr] > 0
+}
+
+// report is the external IPs used, most used first.
+func (p *externalIpPool) report() []ExternalIpUse {
+	if p == nil {
+		return nil
+	}
+	uses := []ExternalIpUse{}
+	for addr, n := range p.counts {
+		uses = append(uses, ExternalIpUse{Ip: addr.String(), Connections: n})
+	}
+	slices.SortFunc(uses, func(a, b ExternalIpUse) int {
+		return cmp.Or(cmp.Compare(b.Connections, a.Connections), cmp.Compare(a.Ip, b.Ip))
+	})
+	return uses
+}
+
+// sampleExternalIps asks the reflector for the external IP over n new
+// connections, each of which the NAT may map to another IP of its pool.
+func (s *scheduler) sampleExternalIps(n int) {
+	client := s.reflectorClient()
+	for range n {
+		addr, err := lookupExternalIp(s.m.context(), client, s.m.Reflector)
+		if err != nil {
+			continue
+		}
+		s.externalIps.add(addr)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSampleExternalIps(t *testing.T) {
+	testcases := map[string]struct {
+		inPool  []string
+		expUses []ExternalIpUse
+	}{
+		"Paired": {
+			inPool:  []string{"203.0.113.5"},
+			expUses: []ExternalIpUse{{Ip: "203.0.113.5", Connections: externalIpSamples}},
+		},
+		"Pooled": {
+			inPool: []string{"203.0.113.5", "203.0.113.6", "203.0.113.7", "203.0.113.5"},
+			expUses: []ExternalIpUse{
+				{Ip: "203.0.113.5", Connections: externalIpSamples / 2},
+				{Ip: "203.0.113.6", Connections: externalIpSamples / 4},
+				{Ip: "203.0.113.7", Connections: externalIpSamples / 4},
+			},
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			var requests atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+				n := requests.Add(1) - 1
+				fmt.Fprintln(res, tc.inPool[int(n)%len(tc.inPool)])
+			}))
+			defer srv.Close()
+
+			s := scheduler{
+				m:           &Measurer{Reflector: srv.URL},
+				traffic:     &traffic{},
+				externalIps: newExternalIpPool(),
+			}
+			s.sampleExternalIps(externalIpSamples)
+			if uses := s.externalIps.report(); !slices.Equal(uses, tc.expUses) {
+				t.Errorf("expected %+v, got %+v", tc.expUses, uses)
+			}
+		})
+	}
+}
+
+func TestPooledExternalIpNotChange(t *testing.T) {
+	s := scheduler{
+		m:           &Measurer{},
+		externalIp:  newExternalIpWatch(nil, "", time.Hour, netip.MustParseAddr("203.0.113.5")),
+		externalIps: newExternalIpPool(),
+	}
+	s.externalIps.add(netip.MustParseAddr("203.0.113.5"))
+	s.externalIps.add(netip.MustParseAddr("203.0.113.6"))
+
+	s.externalIpSeen(netip.MustParseAddr("203.0.113.6"), time.Now())
+	if changes := s.externalIp.report(); len(changes) != 0 {
+		t.Errorf("expected moving within the pool not to be a change, got %+v", changes)
+	}
+	s.externalIpSeen(netip.MustParseAddr("198.51.100.1"), time.Now())
+	if changes := s.externalIp.report(); len(changes) != 1 {
+		t.Errorf("expected moving out of the pool to be a change, got %+v", changes)
+	}
+	if n := len(s.externalIps.report()); n != 3 {
+		t.Errorf("expected 3 external IPs, got %d", n)
+	}
+}
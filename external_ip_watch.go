@@ -0,0 +1,142 @@
+// Functions related to watching the external IP whilst measuring, as
+// CGNATs may move a subscriber to another external IP mid-measurement,
+// taking the established connections with them.
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"time"
+)
+
+// Time between asking the reflector for the external IP, by default
+const defaultReflectorInterval = 30 * time.Second
+
+// ExternalIpChange is the external IP changing whilst measuring.
+type ExternalIpChange struct {
+	Time time.Time `json:"time"`
+	From string    `json:"from"`
+	To   string    `json:"to"`
+	// Connections established when the change was seen, and how many of
+	// them failed afterwards.
+	EstablishedConnections int `json:"established_connections"`
+	LostConnections        int `json:"lost_connections"`
+}
+
+// externalIpWatch polls the reflector for the external IP, recording each
+// change and the established connections lost after it.
+type externalIpWatch struct {
+	client   *http.Client
+	target   string
+	interval time.Duration
+	polled   time.Time
+	// A poll is outstanding, its address is sent to replies, invalid if
+	// it failed
+	polling bool
+	replies chan netip.Addr
+	current netip.Addr
+	changes []ExternalIpChange
+	// Connections established at the last change that have not failed
+	held map[uint]bool
+}
+
+// reflectorInterval is the time between polls of the reflector, zero
+// never polls.
+func (m *Measurer) reflectorInterval() time.Duration {
+	if m.ReflectorInterval == 0 {
+		return defaultReflectorInterval
+	}
+	return max(m.ReflectorInterval, 0)
+}
+
+func newExternalIpWatch(client *http.Client, target string, interval time.Duration, current netip.Addr) *externalIpWatch {
+	return &externalIpWatch{
+		client:   client,
+		target:   target,
+		interval: interval,
+		polled:   time.Now(),
+		replies:  make(chan netip.Addr, 1),
+		current:  current,
+	}
+}
+
+// checkExternalIp handles the reply of the last poll of the reflector,
+// polling again at most every reflectorInterval.
+func (s *scheduler) checkExternalIp() {
+	w := s.externalIp
+	if w == nil {
+		return
+	}
+	select {
+	case addr := <-w.replies:
+		w.polling = false
+		if addr.IsValid() {
+			s.externalIpSeen(addr, time.Now())
+		}
+	default:
+	}
+	if w.polling || time.Since(w.polled) < w.interval {
+		return
+	}
+
+	w.polled = time.Now()
+	w.polling = true
+	go func() {
+		addr, _ := lookupExternalIp(s.m.context(), w.client, w.target)
+		w.replies <- addr
+	}()
+}
+
+// externalIpSeen records a change of the external IP, watching the
+// connections established at the time for being lost. Moving to an
+// address already seen, of a pool the NAT spreads connections over, is
+// not a change.
+func (s *scheduler) externalIpSeen(addr netip.Addr, at time.Time) {
+	w := s.externalIp
+	pooled := s.externalIps.seen(addr)
+	s.externalIps.add(addr)
+	if !w.current.IsValid() || pooled {
+		w.current = addr
+		return
+	}
+	if addr == w.current {
+		return
+	}
+
+	w.held = map[uint]bool{}
+	for _, c := range s.activeConns {
+		if !c.established.IsZero() {
+			w.held[c.id] = true
+		}
+	}
+	w.changes = append(w.changes, ExternalIpChange{
+		Time:                   at,
+		From:                   w.current.String(),
+		To:                     addr.String(),
+		EstablishedConnections: len(w.held),
+	})
+	s.m.emit(Event{
+		Type:              EventExternalIpChanged,
+		Addr:              addr.String(),
+		Reason:            fmt.Sprintf("external IP changed from %v to %v", w.current, addr),
+		ActiveConnections: len(s.activeConns),
+	})
+	w.current = addr
+}
+
+// failed counts c as lost to the last change, if it was established then.
+func (w *externalIpWatch) failed(c *connection) {
+	if w == nil || !w.held[c.id] {
+		return
+	}
+	delete(w.held, c.id)
+	w.changes[len(w.changes)-1].LostConnections++
+}
+
+func (w *externalIpWatch) report() []ExternalIpChange {
+	if w == nil {
+		return nil
+	}
+	return w.changes
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestExternalIpChange(t *testing.T) {
+	u, _ := url.Parse("http://example.com/")
+	established := makeConnection(netip.MustParseAddrPort("192.0.2.1:80"), u, &traffic{}, nil)
+	established.id, established.established = 1, time.Now()
+	pending := makeConnection(netip.MustParseAddrPort("192.0.2.2:80"), u, &traffic{}, nil)
+	pending.id = 2
+
+	events := []Event{}
+	s := scheduler{
+		m:           &Measurer{OnEvent: func(e Event) { events = append(events, e) }},
+		activeConns: []*connection{established, pending},
+		externalIp:  newExternalIpWatch(nil, "", time.Hour, netip.MustParseAddr("203.0.113.5")),
+	}
+
+	s.externalIpSeen(netip.MustParseAddr("203.0.113.5"), time.Now())
+	if changes := s.externalIp.report(); len(changes) != 0 {
+		t.Fatalf("expected no change, got %+v", changes)
+	}
+
+	s.externalIpSeen(netip.MustParseAddr("203.0.113.9"), time.Now())
+	s.externalIp.failed(established)
+	s.externalIp.failed(established)
+	s.externalIp.failed(pending)
+	changes := s.externalIp.report()
+	if len(changes) != 1 {
+		t.Fatalf("expected one change, got %+v", changes)
+	}
+	c := changes[0]
+	if c.From != "203.0.113.5" || c.To != "203.0.113.9" {
+		t.Errorf("expected a change from 203.0.113.5 to 203.0.113.9, got %v to %v", c.From, c.To)
+	}
+	if c.EstablishedConnections != 1 || c.LostConnections != 1 {
+		t.Errorf("expected 1 of 1 established connections lost, got %d of %d", c.LostConnections, c.EstablishedConnections)
+	}
+	if len(events) != 1 || events[0].Type != EventExternalIpChanged {
+		t.Errorf("expected an %v event, got %+v", EventExternalIpChanged, events)
+	}
+}
+
+func TestCheckExternalIp(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Write([]byte("203.0.113.9\n"))
+	}))
+	defer srv.Close()
+
+	s := scheduler{
+		m:          &Measurer{},
+		externalIp: newExternalIpWatch(srv.Client(), srv.URL, time.Millisecond, netip.MustParseAddr("203.0.113.5")),
+	}
+	for deadline := time.Now().Add(5 * time.Second); len(s.externalIp.changes) == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the change to be found by polling the reflector")
+		}
+		s.checkExternalIp()
+		time.Sleep(time.Millisecond)
+	}
+	if to := s.externalIp.changes[0].To; to != "203.0.113.9" {
+		t.Errorf("expected a change to 203.0.113.9, got %v", to)
+	}
+}
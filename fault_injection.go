@@ -0,0 +1,79 @@
+// Functions related to injecting faults into the client, to check how
+// measurements cope with failing dials, responses and slow servers.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+var (
+	errInjectedDial     = errors.New("injected dial failure")
+	errInjectedResponse = errors.New("injected response failure")
+)
+
+// Faults are injected into the client during a measurement, for testing
+// rather than measuring. Rates are fractions between 0 and 1.
+type Faults struct {
+	// Rate of connections that fail to dial
+	DialFailureRate float64
+	// Rate of requests on dialed connections that fail
+	ResponseFailureRate float64
+	// Added to every request
+	Latency time.Duration
+}
+
+// faultyNetwork injects faults into the requests made over another
+// network. The first request on a connection is its dial.
+type faultyNetwork struct {
+	inner  network
+	faults Faults
+
+	m      sync.Mutex
+	dialed map[uint]bool
+}
+
+func newFaultyNetwork(inner network, f Faults) *faultyNetwork {
+	return &faultyNetwork{
+		inner:  inner,
+		faults: f,
+		dialed: map[uint]bool{},
+	}
+}
+
+func (f Faults) notice() string {
+	return fmt.Sprintf("Faults were injected, %v%% of dials and %v%% of responses failed with %v added latency",
+		f.DialFailureRate*100, f.ResponseFailureRate*100, f.Latency)
+}
+
+func (n *faultyNetwork) lookupAddr(ctx context.Context, network string, h *url.URL) *resolvedUrl {
+	return n.inner.lookupAddr(ctx, network, h)
+}
+
+func (n *faultyNetwork) scrapConnection(ctx context.Context, r *roundtrip) *roundtrip {
+	n.m.Lock()
+	isDial := !n.dialed[r.connId]
+	n.dialed[r.connId] = true
+	n.m.Unlock()
+
+	time.Sleep(n.faults.Latency)
+	if isDial && rand.Float64() < n.faults.DialFailureRate {
+		r.requestTs = time.Now()
+		r.replyTs = r.requestTs
+		r.err = &net.OpError{Op: "dial", Net: "tcp", Err: errInjectedDial}
+		return r
+	}
+	if !isDial && rand.Float64() < n.faults.ResponseFailureRate {
+		r.requestTs = time.Now()
+		r.replyTs = r.requestTs
+		r.err = fmt.Errorf("failed get uri %v: %w", r.url, errInjectedResponse)
+		return r
+	}
+	return n.inner.scrapConnection(ctx, r)
+}
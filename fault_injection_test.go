@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestInjectedFaults(t *testing.T) {
+	seeds := []*url.URL{}
+	for i := range maxRepeatedDialFails + 1 {
+		root := makeServerRoot(t, tPath("wildcard_robots.txt"), tPath("no_links.html"))
+		srv := &httpTestServer{
+			name:     fmt.Sprintf("http.%v", i),
+			handlers: HandlerChain{makeFileHandler(root)},
+		}
+		startHttpServer(t, srv)
+		seeds = append(seeds, srv.tUrl(t, "index.html"))
+	}
+
+	testcases := map[string]struct {
+		faults      Faults
+		connections int
+		events      map[EventType]int
+		minDuration time.Duration
+	}{
+		"Dial failures": {
+			faults:      Faults{DialFailureRate: 1},
+			connections: 0,
+			events:      map[EventType]int{EventExhaustionSuspected: 1},
+		},
+		"Response failures": {
+			faults:      Faults{ResponseFailureRate: 1},
+			connections: 0,
+			events:      map[EventType]int{EventConnectionFailed: len(seeds)},
+		},
+		"Latency": {
+			faults:      Faults{Latency: 200 * time.Millisecond},
+			connections: len(seeds),
+			events:      map[EventType]int{EventConnectionEstablished: len(seeds)},
+			minDuration: 200 * time.Millisecond,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			var m sync.Mutex
+			events := map[EventType]int{}
+			measurer := Measurer{
+				Faults: tc.faults,
+				OnEvent: func(e Event) {
+					m.Lock()
+					defer m.Unlock()
+					events[e.Type]++
+				},
+			}
+
+			start := time.Now()
+			r, err := measurer.Measure(seeds)
+			if err != nil {
+				t.Fatal("Failed to measure: ", err)
+			}
+			if d := time.Since(start); d < tc.minDuration {
+				t.Errorf("expected measuring to take at least %v, took %v", tc.minDuration, d)
+			}
+			if r.MaxConnections != tc.connections {
+				t.Errorf("expected to measure %d connections, got %d", tc.connections, r.MaxConnections)
+			}
+			if len(r.Notices) != 1 {
+				t.Errorf("expected a notice of the injected faults, got %v", r.Notices)
+			}
+
+			m.Lock()
+			defer m.Unlock()
+			for e, n := range tc.events {
+				if events[e] != n {
+					t.Errorf("expected %d %v events, got %d", n, e, events[e])
+				}
+			}
+		})
+	}
+}
+
+func TestInjectedDialFailureIsDialError(t *testing.T) {
+	n := newFaultyNetwork(nil, Faults{DialFailureRate: 1})
+	u, _ := url.Parse("http://127.0.0.1/")
+	r := n.scrapConnection(context.Background(), &roundtrip{url: u})
+	if !isDialError(r.err) || !errors.Is(r.err, errInjectedDial) {
+		t.Errorf("expected an injected dial error, got %v", r.err)
+	}
+}
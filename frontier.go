@@ -0,0 +1,120 @@
+// Functions related to the frontier, the urls of hosts waiting to be
+// looked up, kept fair between the pages they were found on.
+package main
+
+import (
+	"cmp"
+	"net/url"
+	"slices"
+	"time"
+)
+
+// Most urls the frontier holds by default, puts past it are dropped
+const defaultFrontierLimit = 1 << 20
+
+// frontierBatch is the urls found on one page, in the order found.
+type frontierBatch struct {
+	urls []*url.URL
+	put  time.Time
+}
+
+// frontier holds the urls waiting to be looked up in batches, one per
+// page they were found on, and rotates lookups over the batches, so one
+// page yielding a huge batch cannot starve the hosts found on others.
+//
+// The frontier guarantees that
+//   - urls are popped in the order of their batch,
+//   - between two pops of a batch, every other batch is popped at most
+//     once, so a url waits at most one pop of every other batch for each
+//     url ahead of it in its own batch,
+//   - at most limit urls are held, the urls of a put past it are dropped
+//     from the back of its batch.
+//
+// The zero value is an empty frontier of defaultFrontierLimit urls.
+type frontier struct {
+	batches []frontierBatch
+	n       int
+	// Most urls held, zero is defaultFrontierLimit
+	limit int
+	// Urls dropped by puts past the limit
+	dropped int
+}
+
+func (f *frontier) peek() *url.URL {
+	if len(f.batches) == 0 {
+		return nil
+	}
+	return f.batches[0].urls[0]
+}
+
+// len is the number of urls held.
+func (f *frontier) len() int {
+	return f.n
+}
+
+// oldest is how long the oldest batch held has waited, zero if empty.
+func (f *frontier) oldest(now time.Time) time.Duration {
+	if len(f.batches) == 0 {
+		return 0
+	}
+	oldest := slices.MinFunc(f.batches, func(a, b frontierBatch) int {
+		return a.put.Compare(b.put)
+	})
+	return now.Sub(oldest.put)
+}
+
+// put adds the urls found on one page as a batch, behind every batch
+// already held, dropping those past the limit. Returns the number
+// dropped.
+func (f *frontier) put(u ...*url.URL) int {
+	room := max(cmp.Or(f.limit, defaultFrontierLimit)-f.n, 0)
+	dropped := max(len(u)-room, 0)
+	u = u[:len(u)-dropped]
+	f.dropped += dropped
+	if len(u) == 0 {
+		return dropped
+	}
+	f.batches = append(f.batches, frontierBatch{urls: u, put: time.Now()})
+	f.n += len(u)
+	return dropped
+}
+
+// pop removes the first url of the front batch, moving the rest of the
+// batch behind every other.
+func (f *frontier) pop() *url.URL {
+	b := f.batches[0]
+	u := b.urls[0]
+	f.n--
+
+	f.batches = f.batches[1:]
+	if len(b.urls) > 1 {
+		b.urls = b.urls[1:]
+		f.batches = append(f.batches, b)
+	}
+	return u
+}
+
+// halve drops the back half of the urls in the order they would be
+// popped, the backs of the largest batches, so shedding does not starve
+// the smaller batches either. Returns the number of urls dropped.
+func (f *frontier) halve() int {
+	keep := (f.n + 1) / 2
+	kept := make([]int, len(f.batches))
+	for round := 0; keep > 0; round++ {
+		for i, b := range f.batches {
+			if keep > 0 && len(b.urls) > round {
+				kept[i]++
+				keep--
+			}
+		}
+	}
+
+	shed := 0
+	for i, b := range f.batches {
+		shed += len(b.urls) - kept[i]
+		f.batches[i].urls = b.urls[:kept[i]]
+	}
+	f.batches = slices.DeleteFunc(f.batches, func(b frontierBatch) bool { return len(b.urls) == 0 })
+	f.n -= shed
+	return shed
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net/url"
+	"testing"
+	"testing/quick"
+	"time"
+)
+
+// batchUrls are n urls of batch b, http://b<b>/<i>.
+func batchUrls(b, n int) []*url.URL {
+	urls := make([]*url.URL, n)
+	for i := range urls {
+		urls[i] = &url.URL{Scheme: "http", Host: fmt.Sprintf("b%d", b), Path: fmt.Sprintf("/%d", i)}
+	}
+	return urls
+}
+
+func parseBatchUrl(u *url.URL) (int, int) {
+	var b, i int
+	fmt.Sscanf(u.Host, "b%d", &b)
+	fmt.Sscanf(u.Path, "/%d", &i)
+	return b, i
+}
+
+func TestFrontierProperties(t *testing.T) {
+	property := func(seed uint64) bool {
+		rng := rand.New(rand.NewPCG(seed, seed))
+		f := frontier{limit: 1 + rng.IntN(100)}
+		put, dropped := 0, 0
+		// Batch of each pop, and the next url expected of each batch
+		popped := []int{}
+		next := map[int]int{}
+
+		for op := range 500 {
+			if f.len() == 0 || rng.IntN(3) == 0 {
+				urls := batchUrls(op, rng.IntN(20))
+				d := f.put(urls...)
+				put += len(urls)
+				dropped += d
+				if f.len() > f.limit {
+					t.Logf("holds %d urls past the limit %d", f.len(), f.limit)
+					return false
+				}
+				continue
+			}
+
+			b, i := parseBatchUrl(f.pop())
+			if i != next[b] {
+				t.Logf("popped url %d of batch %d, expected %d", i, b, next[b])
+				return false
+			}
+			next[b]++
+			// Every other batch is popped at most once since b was last
+			seen := map[int]bool{}
+			for j := len(popped) - 1; j >= 0 && popped[j] != b && next[b] > 1; j-- {
+				if seen[popped[j]] {
+					t.Logf("batch %d popped twice between pops of batch %d", popped[j], b)
+					return false
+				}
+				seen[popped[j]] = true
+			}
+			popped = append(popped, b)
+		}
+
+		if f.dropped != dropped || f.len() != put-dropped-len(popped) {
+			t.Logf("holds %d urls with %d dropped, expected %d with %d dropped", f.len(), f.dropped, put-dropped-len(popped), dropped)
+			return false
+		}
+		return true
+	}
+	if err := quick.Check(property, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFrontierHalve(t *testing.T) {
+	property := func(seed uint64) bool {
+		rng := rand.New(rand.NewPCG(seed, seed))
+		f := frontier{}
+		for b := range 1 + rng.IntN(10) {
+			f.put(batchUrls(b, 1+rng.IntN(20))...)
+		}
+		// The urls popped first are kept
+		order := f
+		order.batches = append([]frontierBatch(nil), f.batches...)
+		n := f.len()
+
+		shed := f.halve()
+		if shed != n/2 || f.len() != n-shed {
+			t.Logf("shed %d of %d urls leaving %d", shed, n, f.len())
+			return false
+		}
+		for f.len() > 0 {
+			if f.pop().String() != order.pop().String() {
+				t.Log("expected the urls popped first to be kept")
+				return false
+			}
+		}
+		return true
+	}
+	if err := quick.Check(property, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFrontierHalveSmallBatches(t *testing.T) {
+	f := frontier{}
+	f.put(batchUrls(0, 10)...)
+	f.put(batchUrls(1, 2)...)
+
+	shed := f.halve()
+	if shed != 6 || f.len() != 6 {
+		t.Fatalf("expected 6 urls to be shed leaving 6, got %d leaving %d", shed, f.len())
+	}
+	if f.batches[1].urls[1].Host != "b1" {
+		t.Error("expected the small batch to be kept whole")
+	}
+}
+
+func TestFrontierOldest(t *testing.T) {
+	f := frontier{}
+	now := time.Now()
+	if f.oldest(now) != 0 {
+		t.Error("expected an empty frontier to have no oldest url")
+	}
+
+	f.put(batchUrls(0, 2)...)
+	f.put(batchUrls(1, 1)...)
+	f.batches[0].put = now.Add(-time.Minute)
+	f.batches[1].put = now.Add(-time.Second)
+	// Rotating the oldest batch behind the other keeps its age
+	f.pop()
+	if age := f.oldest(now); age != time.Minute {
+		t.Errorf("expected the oldest url to have waited %v, got %v", time.Minute, age)
+	}
+	f.pop()
+	f.pop()
+	if f.oldest(now) != 0 || f.peek() != nil {
+		t.Error("expected the frontier to be empty")
+	}
+}
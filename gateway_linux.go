@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+)
+
+// Whether the default gateway can be read from the kernel on this
+// platform
+const gatewaySupported = true
+
+// defaultGateway is the default IPv4 gateway of iface and its MAC address,
+// from the kernel's routing and neighbour tables.
+func defaultGateway(iface string) (netip.Addr, string, error) {
+	routes, err := os.Open("/proc/net/route")
+	if err != nil {
+		return netip.Addr{}, "", fmt.Errorf("failed to open routes: %w", err)
+	}
+	defer routes.Close()
+	gateway, err := parseRouteGateway(routes, iface)
+	if err != nil {
+		return netip.Addr{}, "", err
+	}
+
+	neighbours, err := os.Open("/proc/net/arp")
+	if err != nil {
+		return gateway, "", fmt.Errorf("failed to open neighbours: %w", err)
+	}
+	defer neighbours.Close()
+	mac, err := parseArpMac(neighbours, gateway)
+	return gateway, mac, err
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net/netip"
+)
+
+// Whether the default gateway can be read from the kernel on this
+// platform
+const gatewaySupported = false
+
+func defaultGateway(iface string) (netip.Addr, string, error) {
+	return netip.Addr{}, "", errors.New("the default gateway is only found on linux")
+}
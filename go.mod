@@ -1,5 +1,12 @@
 module natck
 
-go 1.22
+go 1.23
 
-require golang.org/x/net v0.24.0
+require (
+	go.starlark.net v0.0.0-20231121155337-90ade8b19d09
+	golang.org/x/net v0.24.0
+	golang.org/x/sys v0.19.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require golang.org/x/text v0.14.0 // indirect
@@ -0,0 +1,63 @@
+// Functions related to keeping HTTP/2 connections alive with PING frames,
+// which cost a few bytes rather than a full request.
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"golang.org/x/net/http2"
+)
+
+// h2Pinger captures the HTTP/2 connection of a client as requests are
+// made on it, to later send PING frames on it.
+type h2Pinger struct {
+	http2.ClientConnPool
+
+	m  sync.Mutex
+	cc *http2.ClientConn
+}
+
+// configureH2Pinger has the transport negotiate HTTP/2 itself, to capture
+// its connection. Transports that do not attempt HTTP/2 are left alone.
+func configureH2Pinger(transport *http.Transport) *h2Pinger {
+	if transport.TLSNextProto != nil && transport.TLSNextProto["h2"] == nil {
+		return nil
+	}
+
+	t2, err := http2.ConfigureTransports(transport)
+	if err != nil {
+		return nil
+	}
+	p := &h2Pinger{ClientConnPool: t2.ConnPool}
+	t2.ConnPool = p
+	return p
+}
+
+func (p *h2Pinger) GetClientConn(req *http.Request, addr string) (*http2.ClientConn, error) {
+	cc, err := p.ClientConnPool.GetClientConn(req, addr)
+	if err == nil {
+		p.m.Lock()
+		p.cc = cc
+		p.m.Unlock()
+	}
+	return cc, err
+}
+
+// ready reports whether there is an open HTTP/2 connection to ping.
+func (p *h2Pinger) ready() bool {
+	if p == nil {
+		return false
+	}
+	p.m.Lock()
+	defer p.m.Unlock()
+	return p.cc != nil && !p.cc.State().Closed
+}
+
+func (p *h2Pinger) ping(ctx context.Context) error {
+	p.m.Lock()
+	cc := p.cc
+	p.m.Unlock()
+	return cc.Ping(ctx)
+}
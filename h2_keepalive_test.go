@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"sync/atomic"
+	"testing"
+)
+
+func TestH2PingKeepAlive(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		requests.Add(1)
+	}))
+	srv.EnableHTTP2 = true
+	srv.TLS = &tls.Config{NextProtos: []string{"h2", "http/1.1"}}
+	srv.StartTLS()
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal("Failed to parse server url: ", err)
+	}
+	addr := netip.MustParseAddrPort(u.Host)
+	ctx := context.WithValue(context.Background(), ctxAddrKey{}, addr)
+
+	testcases := map[string]struct {
+		alpn []string
+		ping bool
+	}{
+		"HTTP/2":   {alpn: nil, ping: true},
+		"HTTP/1.1": {alpn: []string{"http/1.1"}, ping: false},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			m := Measurer{Alpn: tc.alpn}
+			conf := m.tlsConfig()
+			conf.RootCAs = srv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+			c := makeConnection(addr, u, &traffic{}, conf)
+			defer c.client.CloseIdleConnections()
+
+			r := makeCrawlRequest(c)
+			if r.ping {
+				t.Fatal("expected the first request to be a GET")
+			}
+			if r = scrapConnection(ctx, r); r.err != nil {
+				t.Fatal("Failed to get: ", r.err)
+			}
+
+			// Nothing left to crawl, so only keep-alives remain
+			clear(c.uncrawledUrls)
+			before := requests.Load()
+			r = makeCrawlRequest(c)
+			if r.ping != tc.ping {
+				t.Fatalf("expected ping to be %v, got %v", tc.ping, r.ping)
+			}
+			if r = scrapConnection(ctx, r); r.err != nil {
+				t.Fatal("Failed to keep alive: ", r.err)
+			}
+
+			sent := requests.Load() - before
+			if tc.ping && sent != 0 {
+				t.Errorf("expected a ping instead of a request, server got %d requests", sent)
+			}
+			if !tc.ping && sent != 1 {
+				t.Errorf("expected a request to keep alive, server got %d requests", sent)
+			}
+		})
+	}
+}
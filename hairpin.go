@@ -0,0 +1,134 @@
+// Functions related to detecting whether the NAT hairpins, forwarding
+// packets sent from behind it to its own external address back inside,
+// which hosts behind the same NAT need to reach each other by their
+// public addresses.
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// Longest to wait for the STUN server, and for the packet sent to the
+// external address to come back
+const hairpinTimeout = 2 * time.Second
+
+// Methods of learning the external address of the mapping
+const (
+	HairpinMethodStun      = "stun"
+	HairpinMethodReflector = "reflector"
+)
+
+// HairpinReport is whether the NAT hairpinned a UDP packet sent to the
+// external address of a mapping from another socket behind it.
+type HairpinReport struct {
+	Supported bool `json:"supported"`
+	// How the external address was learnt, see HairpinMethodStun
+	Method string `json:"method"`
+	// The external address of the mapping sent to
+	ExternalAddress string `json:"external_address"`
+}
+
+// hairpinTo reports whether a token sent from from to external arrives
+// at inside, resending it until timeout.
+func hairpinTo(inside, from net.PacketConn, external netip.AddrPort, timeout time.Duration) (bool, error) {
+	token := make([]byte, 16)
+	rand.Read(token)
+
+	to := net.UDPAddrFromAddrPort(external)
+	deadline := time.Now().Add(timeout)
+	buf := make([]byte, 1500)
+	for time.Now().Before(deadline) {
+		_, err := from.WriteTo(token, to)
+		if err != nil {
+			return false, fmt.Errorf("failed to send to %v: %w", external, err)
+		}
+		readDeadline := time.Now().Add(stunRetransmit)
+		if readDeadline.After(deadline) {
+			readDeadline = deadline
+		}
+		inside.SetReadDeadline(readDeadline)
+		for {
+			n, _, err := inside.ReadFrom(buf)
+			if err != nil {
+				break
+			}
+			if bytes.Equal(buf[:n], token) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// discoverHairpin learns the external address of a mapping from the STUN
+// server, or failing that from the externalIp the reflector saw with the
+// port of the socket, which holds for NATs preserving ports. Then sends
+// to it from a second socket.
+func discoverHairpin(listen func() (net.PacketConn, error), server string, externalIp netip.Addr, timeout time.Duration) (*HairpinReport, error) {
+	inside, err := listen()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open UDP socket: %w", err)
+	}
+	defer inside.Close()
+	from, err := listen()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open UDP socket: %w", err)
+	}
+	defer from.Close()
+
+	report := &HairpinReport{Method: HairpinMethodStun}
+	var external netip.AddrPort
+	stunErr := errors.New("no STUN server")
+	if server != "" {
+		var addr *net.UDPAddr
+		addr, stunErr = net.ResolveUDPAddr("udp4", server)
+		if stunErr == nil {
+			var r *stunResponse
+			r, stunErr = stunTransaction(inside, addr.AddrPort(), 0, timeout)
+			if stunErr == nil {
+				external = r.mapped
+			}
+		}
+	}
+	if stunErr != nil {
+		if !externalIp.IsValid() {
+			return nil, fmt.Errorf("failed to learn the external address: %w", stunErr)
+		}
+		report.Method = HairpinMethodReflector
+		port := inside.LocalAddr().(*net.UDPAddr).AddrPort().Port()
+		external = netip.AddrPortFrom(externalIp, port)
+	}
+
+	report.ExternalAddress = external.String()
+	report.Supported, err = hairpinTo(inside, from, external, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// checkHairpin checks whether the NAT hairpins from the address the
+// connections are dialed from.
+func (s *scheduler) checkHairpin(metadata *RunMetadata) (*HairpinReport, error) {
+	if s.m.Ipv6 {
+		return nil, errors.New("hairpinning is only checked over IPv4")
+	}
+	laddr := &net.UDPAddr{}
+	if s.traffic.dialer != nil {
+		if a, ok := s.traffic.dialer.LocalAddr.(*net.TCPAddr); ok {
+			laddr.IP = a.IP
+		}
+	}
+	listen := func() (net.PacketConn, error) {
+		return net.ListenUDP("udp4", laddr)
+	}
+	externalIp, _ := netip.ParseAddr(metadata.ExternalIp)
+	return discoverHairpin(listen, cmp.Or(s.m.HairpinStunServer, defaultStunServers), externalIp, hairpinTimeout)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestDiscoverHairpin(t *testing.T) {
+	stun := serveUdpProbes(t, &fakeUdpNat{})
+	silent, err := net.ListenUDP("udp4", net.UDPAddrFromAddrPort(netip.MustParseAddrPort("127.0.0.1:0")))
+	if err != nil {
+		t.Fatal("Failed to listen: ", err)
+	}
+	defer silent.Close()
+	listen := func() (net.PacketConn, error) {
+		return net.ListenUDP("udp4", net.UDPAddrFromAddrPort(netip.MustParseAddrPort("127.0.0.1:0")))
+	}
+
+	testcases := map[string]struct {
+		inServer     string
+		inExternalIp netip.Addr
+		outErr       bool
+		outSupported bool
+		outMethod    string
+	}{
+		"stun": {
+			inServer:     stun.String(),
+			outSupported: true,
+			outMethod:    HairpinMethodStun,
+		},
+		"reflector": {
+			inServer:     silent.LocalAddr().String(),
+			inExternalIp: netip.MustParseAddr("127.0.0.1"),
+			outSupported: true,
+			outMethod:    HairpinMethodReflector,
+		},
+		"not hairpinned": {
+			inExternalIp: netip.MustParseAddr("127.0.0.2"),
+			outSupported: false,
+			outMethod:    HairpinMethodReflector,
+		},
+		"no external address": {
+			inServer: silent.LocalAddr().String(),
+			outErr:   true,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			r, err := discoverHairpin(listen, tc.inServer, tc.inExternalIp, 300*time.Millisecond)
+			if tc.outErr {
+				if err == nil {
+					t.Errorf("expected an error, got %+v", r)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal("Failed to discover hairpinning: ", err)
+			}
+			if r.Supported != tc.outSupported || r.Method != tc.outMethod {
+				t.Errorf("expected supported %v by %v, got %+v", tc.outSupported, tc.outMethod, r)
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+// Functions related to finding half-open connections, those the NAT has
+// dropped but the client still believes are established. Their sockets
+// are checked without sending anything, so the checks cost no traffic
+// and do not refresh the mappings being measured.
+package main
+
+import (
+	"fmt"
+	"slices"
+	"time"
+)
+
+// Time between checking for half-open connections, by default
+const defaultHalfOpenInterval = 5 * time.Second
+
+// halfOpenInterval is the time between checks, zero never checks.
+func (m *Measurer) halfOpenInterval() time.Duration {
+	if m.HalfOpenInterval == 0 && tcpInfoSupported {
+		return defaultHalfOpenInterval
+	}
+	return max(m.HalfOpenInterval, 0)
+}
+
+// checkHalfOpen closes the half-open connections, checking at most every
+// halfOpenInterval.
+func (s *scheduler) checkHalfOpen() {
+	interval := s.m.halfOpenInterval()
+	if interval == 0 || time.Since(s.halfOpenChecked) < interval {
+		return
+	}
+	s.halfOpenChecked = time.Now()
+	s.sweepHalfOpen()
+}
+
+// sweepHalfOpen fails the active connections whose sockets show they are
+// half-open, so they are not counted as active.
+func (s *scheduler) sweepHalfOpen() {
+	halfOpen := []*connection{}
+	for _, c := range s.activeConns {
+		conn := c.conn.Load()
+		if conn == nil {
+			continue
+		}
+		reason, err := probeHalfOpen(conn.Conn)
+		if err != nil || reason == "" {
+			continue
+		}
+		halfOpen = append(halfOpen, c)
+
+		conn.Close()
+		c.finish(stateFailed)
+		s.evictions.failed(c, time.Now())
+		s.externalIp.failed(c)
+		s.failedConns = append(s.failedConns, c)
+		s.halfOpen++
+		e := connectionEvent(EventMappingLost, c, len(s.activeConns)-len(halfOpen))
+		e.Reason = fmt.Sprintf("half-open, %v", reason)
+		s.m.emit(e)
+	}
+	s.activeConns = slices.DeleteFunc(s.activeConns, func(c *connection) bool {
+		return slices.Contains(halfOpen, c)
+	})
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// Whether sockets can be checked for half-open connections with TCP_INFO
+// on this platform
+const tcpInfoSupported = true
+
+// TCP_ESTABLISHED of the kernel's socket states
+const tcpEstablished = 1
+
+// Retransmissions of sent data before a connection is considered
+// half-open, fewer may just be loss
+const halfOpenRetransmits = 3
+
+// probeHalfOpen reads the TCP_INFO of the socket, returning why it is
+// half-open or empty if it looks established.
+func probeHalfOpen(c net.Conn) (string, error) {
+	tcp, ok := c.(*net.TCPConn)
+	if !ok {
+		return "", errors.New("not a TCP connection")
+	}
+	raw, err := tcp.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+	var info *unix.TCPInfo
+	var sErr error
+	err = raw.Control(func(fd uintptr) {
+		info, sErr = unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+	})
+	if err == nil {
+		err = sErr
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read TCP_INFO: %w", err)
+	}
+
+	switch {
+	case info.State != tcpEstablished:
+		return fmt.Sprintf("socket left the established state for %d", info.State), nil
+	case info.Probes > 0:
+		return fmt.Sprintf("%d keep-alive probes unanswered", info.Probes), nil
+	case info.Retransmits >= halfOpenRetransmits:
+		return fmt.Sprintf("%d retransmissions unacknowledged", info.Retransmits), nil
+	}
+	return "", nil
+}
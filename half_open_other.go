@@ -0,0 +1,16 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// Whether sockets can be checked for half-open connections with TCP_INFO
+// on this platform
+const tcpInfoSupported = false
+
+func probeHalfOpen(c net.Conn) (string, error) {
+	return "", errors.New("half-open connections are only detected on linux")
+}
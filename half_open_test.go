@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// tcpPair dials a loopback connection, returning both ends.
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Failed to listen: ", err)
+	}
+	defer l.Close()
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal("Failed to dial: ", err)
+	}
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatal("Failed to accept: ", err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func TestProbeHalfOpen(t *testing.T) {
+	if !tcpInfoSupported {
+		t.Skip("TCP_INFO is not supported")
+	}
+
+	client, server := tcpPair(t)
+	reason, err := probeHalfOpen(client)
+	if err != nil {
+		t.Fatal("Failed to probe: ", err)
+	}
+	if reason != "" {
+		t.Errorf("expected an established connection, got %v", reason)
+	}
+
+	server.Close()
+	time.Sleep(50 * time.Millisecond)
+	reason, err = probeHalfOpen(client)
+	if err != nil {
+		t.Fatal("Failed to probe: ", err)
+	}
+	if reason == "" {
+		t.Error("expected a connection closed by the peer to not be established")
+	}
+}
+
+func TestSweepHalfOpen(t *testing.T) {
+	if !tcpInfoSupported {
+		t.Skip("TCP_INFO is not supported")
+	}
+
+	events := []Event{}
+	s := scheduler{m: &Measurer{OnEvent: func(e Event) { events = append(events, e) }}}
+	for i, closed := range []bool{false, true} {
+		u := &url.URL{Scheme: "http", Host: "example.com", Path: "/"}
+		c := makeConnection(netip.MustParseAddrPort("127.0.0.1:80"), u, &traffic{}, nil)
+		c.id = uint(i)
+		client, server := tcpPair(t)
+		c.conn.Store(&countingConn{Conn: client, traffic: &traffic{}})
+		if closed {
+			server.Close()
+		}
+		s.activeConns = append(s.activeConns, c)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	s.sweepHalfOpen()
+	if len(s.activeConns) != 1 || s.activeConns[0].id != 0 {
+		t.Errorf("expected only the established connection to remain active, got %d", len(s.activeConns))
+	}
+	if s.halfOpen != 1 || len(s.failedConns) != 1 {
+		t.Errorf("expected 1 half-open connection to fail, got %d and %d failed", s.halfOpen, len(s.failedConns))
+	}
+	if len(events) != 1 || events[0].Type != EventMappingLost || events[0].ActiveConnections != 1 {
+		t.Errorf("expected a mapping-lost event with 1 active connection, got %+v", events)
+	}
+}
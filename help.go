@@ -0,0 +1,191 @@
+// Functions related to generating the long help and man page from the
+// commands and flags of natck, so neither drifts from the flags parsed.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// Width long help is wrapped to
+const helpWidth = 78
+
+// helpFlag is a flag as help needs it.
+type helpFlag struct {
+	name string
+	// Kind of value the flag takes, empty for boolean flags
+	value string
+	usage string
+	// Empty if the zero value of the flag
+	defValue string
+}
+
+func helpFlags(c command) []helpFlag {
+	flags := []helpFlag{}
+	c.flags().VisitAll(func(f *flag.Flag) {
+		value, usage := flag.UnquoteUsage(f)
+		h := helpFlag{name: f.Name, value: value, usage: usage}
+		switch f.DefValue {
+		case "", "0", "false", "0s", "[]":
+		default:
+			h.defValue = f.DefValue
+		}
+		flags = append(flags, h)
+	})
+	return flags
+}
+
+func commandSynopsis(c command) string {
+	return strings.TrimSpace("natck " + c.name + " [flags] " + c.args)
+}
+
+// wrapText wraps the words of s to width, indenting each line.
+func wrapText(s string, width int, indent string) string {
+	var b strings.Builder
+	line := indent
+	for _, word := range strings.Fields(s) {
+		if len(line) > len(indent) && len(line)+1+len(word) > width {
+			b.WriteString(line + "\n")
+			line = indent
+		}
+		if len(line) > len(indent) {
+			line += " "
+		}
+		line += word
+	}
+	b.WriteString(line + "\n")
+	return b.String()
+}
+
+func writeCommandHelp(w io.Writer, c command) {
+	fmt.Fprintf(w, "natck %v - %v\n\n", c.name, c.summary)
+	fmt.Fprintf(w, "Usage: %v\n\n", commandSynopsis(c))
+	for _, p := range c.description {
+		fmt.Fprint(w, wrapText(p, helpWidth, ""))
+		fmt.Fprintln(w)
+	}
+
+	flags := helpFlags(c)
+	if len(flags) > 0 {
+		fmt.Fprintln(w, "Flags:")
+		for _, f := range flags {
+			fmt.Fprintln(w, "  "+strings.TrimSpace("--"+f.name+" "+f.value))
+			usage := f.usage
+			if f.defValue != "" {
+				usage += fmt.Sprintf(" (default %v)", f.defValue)
+			}
+			fmt.Fprint(w, wrapText(usage, helpWidth, "      "))
+		}
+		fmt.Fprintln(w)
+	}
+
+	if len(c.examples) > 0 {
+		fmt.Fprintln(w, "Examples:")
+		for _, e := range c.examples {
+			fmt.Fprint(w, wrapText(e.description+":", helpWidth, "  "))
+			fmt.Fprintf(w, "    %v\n", e.line)
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+// writeLongHelp writes the help of each command.
+func writeLongHelp(w io.Writer, cmds []command) {
+	printUsage(w)
+	fmt.Fprintln(w)
+	for _, c := range cmds {
+		writeCommandHelp(w, c)
+	}
+}
+
+// wantsLongHelp is whether the flags in args ask for the long help.
+func wantsLongHelp(args []string) bool {
+	for _, a := range args {
+		if a == "--" {
+			return false
+		}
+		if a == "--help-long" || a == "-help-long" {
+			return true
+		}
+	}
+	return false
+}
+
+// roffEscape escapes s to be text in a man page.
+func roffEscape(s string) string {
+	s = strings.NewReplacer(`\`, `\e`, "-", `\-`).Replace(s)
+	if strings.HasPrefix(s, ".") || strings.HasPrefix(s, "'") {
+		s = `\&` + s
+	}
+	return s
+}
+
+// writeManPage writes the natck(1) man page in roff.
+func writeManPage(w io.Writer, cmds []command, v VersionInfo, date time.Time) {
+	fmt.Fprintf(w, ".TH NATCK 1 %q %q \"natck manual\"\n", date.Format("2006-01-02"), "natck "+v.Version)
+	fmt.Fprintln(w, ".SH NAME")
+	fmt.Fprintln(w, `natck \- measure the connections a NAT allows`)
+	fmt.Fprintln(w, ".SH SYNOPSIS")
+	fmt.Fprintln(w, `.B natck`)
+	fmt.Fprintln(w, `.I command`)
+	fmt.Fprintln(w, `[\fIflags\fR] [\fIarguments\fR]`)
+	fmt.Fprintln(w, ".SH DESCRIPTION")
+	fmt.Fprintln(w, roffEscape("natck measures how many concurrent connections a NAT, like a CGNAT or home router, allows by crawling outwards from a list of urls and keeping one connection per server alive. Run natck <command> --help-long for the help of a command."))
+
+	fmt.Fprintln(w, ".SH COMMANDS")
+	for _, c := range cmds {
+		fmt.Fprintf(w, ".SS %v\n", roffEscape(c.name))
+		fmt.Fprintf(w, ".B %v\n", roffEscape(commandSynopsis(c)))
+		fmt.Fprintln(w, ".PP")
+		fmt.Fprintln(w, roffEscape(c.summary)+".")
+		for _, p := range c.description {
+			fmt.Fprintln(w, ".PP")
+			fmt.Fprintln(w, roffEscape(p))
+		}
+		for _, f := range helpFlags(c) {
+			fmt.Fprintln(w, ".TP")
+			fmt.Fprintf(w, `\fB\-\-%v\fR`, roffEscape(f.name))
+			if f.value != "" {
+				fmt.Fprintf(w, ` \fI%v\fR`, roffEscape(f.value))
+			}
+			fmt.Fprintln(w)
+			usage := f.usage
+			if f.defValue != "" {
+				usage += fmt.Sprintf(" (default %v)", f.defValue)
+			}
+			fmt.Fprintln(w, roffEscape(usage))
+		}
+	}
+
+	fmt.Fprintln(w, ".SH EXAMPLES")
+	for _, c := range cmds {
+		for _, e := range c.examples {
+			fmt.Fprintln(w, ".PP")
+			fmt.Fprintln(w, roffEscape(strings.ToUpper(e.description[:1])+e.description[1:]+":"))
+			fmt.Fprintln(w, ".RS")
+			fmt.Fprintln(w, ".nf")
+			fmt.Fprintln(w, roffEscape(e.line))
+			fmt.Fprintln(w, ".fi")
+			fmt.Fprintln(w, ".RE")
+		}
+	}
+}
+
+func manCommand(name string, args []string) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	parseCommandArgs(fs, args, "", 0, false)
+
+	info, _ := debug.ReadBuildInfo()
+	v := readVersionInfo(info)
+	// Dated by the commit so the page is reproducible
+	date, err := time.Parse(time.RFC3339, v.CommitTime)
+	if err != nil {
+		date = time.Now()
+	}
+	writeManPage(os.Stdout, allCommands(), v, date)
+}
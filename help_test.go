@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWantsLongHelp(t *testing.T) {
+	testcases := map[string]struct {
+		args []string
+		want bool
+	}{
+		"None":        {args: []string{"url-list.txt"}},
+		"Long help":   {args: []string{"--yes", "--help-long"}, want: true},
+		"Single dash": {args: []string{"-help-long"}, want: true},
+		"After --":    {args: []string{"--", "--help-long"}},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			if got := wantsLongHelp(tc.args); got != tc.want {
+				t.Errorf("expected %v to want long help %v, got %v", tc.args, tc.want, got)
+			}
+		})
+	}
+}
+
+func TestWrapText(t *testing.T) {
+	got := wrapText("one two three four", 10, "  ")
+	expected := "  one two\n  three\n  four\n"
+	if got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
+
+func TestWriteLongHelp(t *testing.T) {
+	var b bytes.Buffer
+	writeLongHelp(&b, allCommands())
+	for _, c := range allCommands() {
+		if !strings.Contains(b.String(), "Usage: "+commandSynopsis(c)) {
+			t.Errorf("expected the help of %v", c.name)
+		}
+		if len(c.description) == 0 || len(c.examples) == 0 {
+			t.Errorf("expected %v to be described with examples", c.name)
+		}
+	}
+	for _, expected := range []string{"  --max-total-bytes uint\n", "(default linear-ramp)", "    natck compare before.json after.json\n"} {
+		if !strings.Contains(b.String(), expected) {
+			t.Errorf("expected %q in the long help", expected)
+		}
+	}
+}
+
+func TestWriteManPage(t *testing.T) {
+	var b bytes.Buffer
+	v := VersionInfo{Version: "v1.2.3"}
+	writeManPage(&b, allCommands(), v, time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC))
+	page := b.String()
+
+	if !strings.HasPrefix(page, `.TH NATCK 1 "2024-05-01" "natck v1.2.3"`) {
+		t.Errorf("expected the man page title first, got %q", strings.SplitN(page, "\n", 2)[0])
+	}
+	for _, c := range allCommands() {
+		if !strings.Contains(page, ".SS "+roffEscape(c.name)+"\n") {
+			t.Errorf("expected a section for %v", c.name)
+		}
+	}
+	for _, expected := range []string{`\fB\-\-max\-total\-bytes\fR \fIuint\fR`, ".SH EXAMPLES"} {
+		if !strings.Contains(page, expected) {
+			t.Errorf("expected %q in the man page", expected)
+		}
+	}
+}
+
+func TestRoffEscape(t *testing.T) {
+	testcases := map[string]struct {
+		in  string
+		out string
+	}{
+		"Plain":     {in: "measure", out: "measure"},
+		"Dashes":    {in: "--max-total-bytes", out: `\-\-max\-total\-bytes`},
+		"Backslash": {in: `a\b`, out: `a\eb`},
+		"Request":   {in: ".SH", out: `\&.SH`},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			if got := roffEscape(tc.in); got != tc.out {
+				t.Errorf("expected %q, got %q", tc.out, got)
+			}
+		})
+	}
+}
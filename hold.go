@@ -0,0 +1,74 @@
+// Functions related to holding the connections open once measured, so
+// router and conntrack state can be inspected whilst the NAT mappings
+// still exist.
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"time"
+)
+
+// holdConnections only keeps the established connections alive, until
+// released.
+type holdConnections struct {
+	release <-chan struct{}
+}
+
+func (h *holdConnections) next(s *scheduler) action {
+	select {
+	case <-h.release:
+		return action{kind: actionStop}
+	default:
+	}
+	if len(s.activeConns) == 0 {
+		return action{kind: actionStop}
+	}
+	return crawlAction(s.nextConnection(nil, 0))
+}
+
+// KeepAliveHeld keeps the connections of the last measurement alive, if
+// it was held, until release is closed or the data budget is exceeded.
+// The connections are then closed. It reports how many connections were
+// still alive.
+func (m *Measurer) KeepAliveHeld(release <-chan struct{}) int {
+	s := m.held
+	if s == nil {
+		return 0
+	}
+	m.held = nil
+
+	s.strategy = &holdConnections{release: release}
+	s.semC = make(chan struct{}, m.workers())
+	// The measurement is over, only keep-alives are needed
+	s.tracer = nil
+	s.pendingResolutions = frontier{}
+	s.pendingConns = nil
+	s.run()
+
+	s.closeActiveConnections()
+	return len(s.activeConns)
+}
+
+// releaseOnEnter returns a channel closed once Enter is pressed on the
+// terminal, or the timeout elapses.
+func releaseOnEnter(timeout time.Duration) (<-chan struct{}, error) {
+	tty, err := os.Open("/dev/tty")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open terminal: %w", err)
+	}
+
+	release := make(chan struct{})
+	go func() {
+		defer tty.Close()
+		bufio.NewReader(tty).ReadString('\n')
+		close(release)
+	}()
+	go func() {
+		<-time.After(timeout)
+		// Unblocks the read
+		tty.Close()
+	}()
+	return release, nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestKeepAliveHeld(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping due to waiting for keep-alives.")
+	}
+
+	n := &benchNetwork{hosts: 20, fanout: 4, seeds: 2}
+	m := Measurer{network: n, Hold: true}
+	r, err := m.Measure(n.seedUrls())
+	if err != nil {
+		t.Fatal("Failed to measure: ", err)
+	}
+	measured := n.roundtrips.Load()
+
+	release := make(chan struct{})
+	time.AfterFunc(reRequestInterval+time.Second, func() { close(release) })
+	alive := m.KeepAliveHeld(release)
+	if alive != r.MaxConnections {
+		t.Errorf("expected %d held connections to be alive, got %d", r.MaxConnections, alive)
+	}
+	if kept := n.roundtrips.Load() - measured; kept < uint64(alive) {
+		t.Errorf("expected a keep-alive on each of %d held connections, got %d", alive, kept)
+	}
+
+	// Already released
+	if alive := m.KeepAliveHeld(release); alive != 0 {
+		t.Errorf("expected no connections to be held after release, got %d", alive)
+	}
+}
@@ -0,0 +1,83 @@
+// Functions related to recording the hostnames resolved to the address of
+// each connection, as hostnames sharing an address, like the sites of a
+// CDN or shared host, share one connection through the NAT.
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// ConnectionHostnames are the hostnames resolved to the address of a
+// connection, in the order they were resolved, the one it was opened
+// for first.
+type ConnectionHostnames struct {
+	Address   string   `json:"address"`
+	Hostnames []string `json:"hostnames"`
+	// Hostnames other than the one the connection was opened for
+	Aliases int `json:"aliases"`
+}
+
+// urlHostname is the hostname of a url, as it is compared.
+func urlHostname(u *url.URL) string {
+	return strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+}
+
+// recordHostname adds the hostname of h to the pending or active
+// connection to one of its addresses as an alias, the lookup finding no
+// address left to connect to. The connection, nil if there is none.
+func (s *scheduler) recordHostname(h *resolvedUrl) *connection {
+	if override := hostOverride(s.m.Overrides, h); override != nil {
+		h = override.rewrite(h)
+	}
+	for _, conns := range [][]*connection{s.activeConns, s.pendingConns} {
+		i := slices.IndexFunc(conns, func(c *connection) bool {
+			return slices.Contains(h.addresses, c.host.ip)
+		})
+		if i == -1 {
+			continue
+		}
+		c := conns[i]
+		if name := urlHostname(h.url); !slices.Contains(c.hostnames, name) {
+			c.hostnames = append(c.hostnames, name)
+			s.aliases++
+		}
+		return c
+	}
+	return nil
+}
+
+func connectionHostnames(conns []*connection) []ConnectionHostnames {
+	hostnames := []ConnectionHostnames{}
+	for _, c := range conns {
+		hostnames = append(hostnames, ConnectionHostnames{
+			Address:   c.host.ip.String(),
+			Hostnames: slices.Clone(c.hostnames),
+			Aliases:   len(c.hostnames) - 1,
+		})
+	}
+	return hostnames
+}
+
+// sharedConnections counts the connections several hostnames were
+// resolved to.
+func sharedConnections(hostnames []ConnectionHostnames) int {
+	shared := 0
+	for _, h := range hostnames {
+		if h.Aliases > 0 {
+			shared++
+		}
+	}
+	return shared
+}
+
+// aliasesWarning explains why fewer connections were measured than
+// hostnames crawled.
+func aliasesWarning(aliases int) string {
+	if aliases == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d hostnames crawled were aliases of connections already open to their address, the max connections count addresses rather than hostnames", aliases)
+}
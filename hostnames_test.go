@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/netip"
+	"net/url"
+	"slices"
+	"testing"
+)
+
+func TestRecordHostname(t *testing.T) {
+	testcases := map[string]struct {
+		inUrl        string
+		inAddresses  []netip.AddrPort
+		expRecorded  bool
+		expHostnames []string
+		expAliases   int
+	}{
+		"Alias": {
+			inUrl:        "http://cdn.example.net/a",
+			inAddresses:  []netip.AddrPort{netip.MustParseAddrPort("192.0.2.1:80")},
+			expRecorded:  true,
+			expHostnames: []string{"www.example.com", "cdn.example.net"},
+			expAliases:   1,
+		},
+		"Alias among addresses": {
+			inUrl: "http://cdn.example.net/a",
+			inAddresses: []netip.AddrPort{
+				netip.MustParseAddrPort("198.51.100.1:80"),
+				netip.MustParseAddrPort("192.0.2.1:80"),
+			},
+			expRecorded:  true,
+			expHostnames: []string{"www.example.com", "cdn.example.net"},
+			expAliases:   1,
+		},
+		"Same hostname": {
+			inUrl:        "http://WWW.example.com./b",
+			inAddresses:  []netip.AddrPort{netip.MustParseAddrPort("192.0.2.1:80")},
+			expRecorded:  true,
+			expHostnames: []string{"www.example.com"},
+		},
+		"Other address": {
+			inUrl:        "http://other.example.org/",
+			inAddresses:  []netip.AddrPort{netip.MustParseAddrPort("198.51.100.1:80")},
+			expRecorded:  false,
+			expHostnames: []string{"www.example.com"},
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			addr := netip.MustParseAddrPort("192.0.2.1:80")
+			c := makeConnection(addr, &url.URL{Scheme: "http", Host: "www.example.com"}, &traffic{}, nil)
+			s := scheduler{m: &Measurer{}, activeConns: []*connection{c}}
+			u, err := url.Parse(tc.inUrl)
+			if err != nil {
+				t.Fatal("Failed to parse url: ", err)
+			}
+
+			recorded := s.recordHostname(&resolvedUrl{url: u, addresses: tc.inAddresses})
+			if (recorded != nil) != tc.expRecorded {
+				t.Errorf("expected recorded to be %v, got %v", tc.expRecorded, recorded != nil)
+			}
+			hostnames := connectionHostnames(s.activeConns)
+			if len(hostnames) != 1 || hostnames[0].Address != "192.0.2.1:80" {
+				t.Fatalf("expected the hostnames of 192.0.2.1:80, got %v", hostnames)
+			}
+			if !slices.Equal(hostnames[0].Hostnames, tc.expHostnames) {
+				t.Errorf("expected hostnames %v, got %v", tc.expHostnames, hostnames[0].Hostnames)
+			}
+			if hostnames[0].Aliases != tc.expAliases || s.aliases != tc.expAliases {
+				t.Errorf("expected %d aliases, got %d of the connection and %d counted", tc.expAliases, hostnames[0].Aliases, s.aliases)
+			}
+			if shared := sharedConnections(hostnames); shared != tc.expAliases {
+				t.Errorf("expected %d shared connections, got %d", tc.expAliases, shared)
+			}
+		})
+	}
+}
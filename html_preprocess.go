@@ -0,0 +1,64 @@
+// Functions related to pre-processing the body of html pages before their
+// links are scraped, so programs embedding natck can protect their memory
+// from hostile pages or only follow the links they care about.
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// HtmlPreprocessor rewrites the body of an html page before its links
+// are scraped. The links of the reader returned are scraped, which may
+// stop reading it early, as at maxHtmlBytes. Whatever of body is left
+// unread is discarded afterwards, so it need not be read to EOF.
+type HtmlPreprocessor interface {
+	Preprocess(page *url.URL, body io.Reader) io.Reader
+}
+
+// HtmlPreprocessorFunc adapts a function to an HtmlPreprocessor.
+type HtmlPreprocessorFunc func(page *url.URL, body io.Reader) io.Reader
+
+func (f HtmlPreprocessorFunc) Preprocess(page *url.URL, body io.Reader) io.Reader {
+	return f(page, body)
+}
+
+// StripHtmlElements removes the elements with the given tag names, and
+// everything within them, like inline svg whose many nodes hold no
+// links worth crawling.
+func StripHtmlElements(tags ...string) HtmlPreprocessor {
+	strip := map[string]bool{}
+	for _, t := range tags {
+		strip[strings.ToLower(t)] = true
+	}
+	return HtmlPreprocessorFunc(func(page *url.URL, body io.Reader) io.Reader {
+		stripped := &bytes.Buffer{}
+		depth := 0
+		z := html.NewTokenizer(io.LimitReader(body, maxHtmlBytes))
+		for {
+			tt := z.Next()
+			if tt == html.ErrorToken {
+				return stripped
+			}
+			if tt == html.StartTagToken || tt == html.EndTagToken || tt == html.SelfClosingTagToken {
+				name, _ := z.TagName()
+				if strip[string(name)] {
+					switch tt {
+					case html.StartTagToken:
+						depth++
+					case html.EndTagToken:
+						depth = max(depth-1, 0)
+					}
+					continue
+				}
+			}
+			if depth == 0 {
+				stripped.Write(z.Raw())
+			}
+		}
+	})
+}
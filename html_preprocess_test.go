@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestStripHtmlElements(t *testing.T) {
+	testcases := map[string]struct {
+		in     string
+		tags   []string
+		expect []string
+	}{
+		"Nothing to strip": {
+			in:     `<html><body><a href="/a.html">a</a></body></html>`,
+			tags:   []string{"svg"},
+			expect: []string{"http://example.com/a.html"},
+		},
+		"Inline svg": {
+			in:     `<html><body><svg><a href="/icon.html"><circle r="1"/></a></svg><a href="/a.html">a</a></body></html>`,
+			tags:   []string{"svg"},
+			expect: []string{"http://example.com/a.html"},
+		},
+		"Nested": {
+			in:     `<html><body><svg><svg><a href="/inner.html"></a></svg><a href="/outer.html"></a></svg><a href="/a.html">a</a></body></html>`,
+			tags:   []string{"SVG"},
+			expect: []string{"http://example.com/a.html"},
+		},
+		"Several tags": {
+			in:     `<html><body><nav><a href="/nav.html"></a></nav><footer><a href="/footer.html"></a></footer><a href="/a.html">a</a></body></html>`,
+			tags:   []string{"nav", "footer"},
+			expect: []string{"http://example.com/a.html"},
+		},
+		"Unclosed": {
+			in:     `<html><body><a href="/a.html">a</a><svg><a href="/icon.html"></a>`,
+			tags:   []string{"svg"},
+			expect: []string{"http://example.com/a.html"},
+		},
+	}
+
+	page, _ := url.Parse("http://example.com/index.html")
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			body := StripHtmlElements(tc.tags...).Preprocess(page, strings.NewReader(tc.in))
+			got := urlsToStrings(ScrapHtml(page, body))
+			if !slices.Equal(got, tc.expect) {
+				t.Errorf("expected %v, got %v", tc.expect, got)
+			}
+		})
+	}
+}
+
+func TestHtmlPreprocessorKeepsConnection(t *testing.T) {
+	// Larger than the transport drains itself on close
+	filler := strings.Repeat("<p>filler</p>", 40000)
+	var dialed atomic.Int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(res, `<html><body><a href="/a.html">a</a>`+filler+`</body></html>`)
+	}))
+	srv.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			dialed.Add(1)
+		}
+	}
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	u, _ := url.Parse(srv.URL + "/index.html")
+	addr := netip.MustParseAddrPort(u.Host)
+	ctx := context.WithValue(context.Background(), ctxAddrKey{}, addr)
+	c := makeConnection(addr, u, &traffic{}, nil)
+	pages := 0
+	for range 2 {
+		r := makeCrawlRequest(c)
+		r.url = u
+		// Only reads the start of the page, leaving the rest unread
+		r.preprocessor = HtmlPreprocessorFunc(func(page *url.URL, body io.Reader) io.Reader {
+			pages++
+			return io.LimitReader(body, 64)
+		})
+		r = scrapConnection(ctx, r)
+		if r.err != nil {
+			t.Fatal("Failed to scrape page: ", r.err)
+		}
+		if got := urlsToStrings(r.scrapedUrls); !slices.Equal(got, []string{srv.URL + "/a.html"}) {
+			t.Errorf("expected the link of the start of the page, got %v", got)
+		}
+	}
+	if pages != 2 {
+		t.Errorf("expected the preprocessor to be called for each page, got %d", pages)
+	}
+	if n := dialed.Load(); n != 1 {
+		t.Errorf("expected the connection to be reused, got %d dialed", n)
+	}
+}
@@ -2,8 +2,10 @@
 package main
 
 import (
+	"cmp"
 	"context"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"net/http"
 	"net/netip"
@@ -22,14 +24,38 @@ type host struct {
 type roundtrip struct {
 	connId      uint
 	client      *http.Client
+	pinger      *h2Pinger
+	ping        bool
 	host        *host
 	url         *url.URL
 	err         error
 	requestTs   time.Time
 	replyTs     time.Time
-	robots      robotstxt
+	robots      RobotsTxt
 	scrapedUrls []*url.URL
 	crawlDelay  time.Duration
+	tls         *tlsState
+	// Added to crawlDelay on HTTP 429 without Retry-After, zero is
+	// defaultBackoffIncrement
+	backoffIncrement time.Duration
+	// HTTP status of the response, zero without one
+	status int
+	// The response asked for the host to be requested over https
+	asksForHttps bool
+	// FNV-1a hash of the html read, zero if none was
+	bodyHash uint64
+	// Response headers to capture, and those captured
+	captureHeaders []string
+	headers        map[string]string
+	// Only keep the connection alive with a HEAD request
+	head bool
+	// Tokenize html instead of parsing the document tree
+	streamHtml bool
+	// Rewrites html before it is scraped, if not nil
+	preprocessor HtmlPreprocessor
+	// Only keep the connection alive with keepAliver, if not nil
+	keepAliver KeepAliver
+	keepAlive  *KeepAliveConn
 }
 
 func sliceContainsUrl(urls []*url.URL, needle *url.URL) bool {
@@ -38,10 +64,10 @@ func sliceContainsUrl(urls []*url.URL, needle *url.URL) bool {
 	})
 }
 
-func getUrl(ctx context.Context, client *http.Client, target *url.URL) (*http.Response, error) {
+func getUrl(ctx context.Context, client *http.Client, method string, target *url.URL) (*http.Response, error) {
 	targetUrl := target.String()
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, targetUrl, nil)
+	req, err := http.NewRequestWithContext(ctx, method, targetUrl, nil)
 	if err != nil {
 		err = fmt.Errorf("failed to make request: %w", err)
 		return nil, err
@@ -98,12 +124,43 @@ func scrapConnection(ctx context.Context, r *roundtrip) *roundtrip {
 	var resp *http.Response
 
 	r.requestTs = time.Now()
-	resp, r.err = getUrl(ctx, r.client, r.url)
+	if r.ping {
+		r.err = r.pinger.ping(ctx)
+		r.replyTs = time.Now()
+		if r.err != nil {
+			r.err = fmt.Errorf("failed to ping %v: %w", r.host.hostPort, r.err)
+		}
+		return r
+	}
+	if r.keepAliver != nil {
+		r.err = r.keepAliver.KeepAlive(ctx, r.keepAlive)
+		r.replyTs = time.Now()
+		if r.err != nil {
+			r.err = fmt.Errorf("failed to keep %v alive: %w", r.host.hostPort, r.err)
+		}
+		return r
+	}
+	method := http.MethodGet
+	if r.head {
+		method = http.MethodHead
+	}
+	resp, r.err = getUrl(ctx, r.client, method, r.url)
 	r.replyTs = time.Now()
 	if r.err != nil {
 		return r
 	}
 	defer resp.Body.Close()
+	r.status = resp.StatusCode
+	r.asksForHttps = asksForHttps(resp)
+	r.headers = captureHeaders(resp.Header, r.captureHeaders)
+
+	if resp.TLS != nil {
+		r.tls = &tlsState{
+			alpn:        resp.TLS.NegotiatedProtocol,
+			resumed:     resp.TLS.DidResume,
+			echAccepted: resp.TLS.ECHAccepted,
+		}
+	}
 
 	urls := []*url.URL{}
 
@@ -112,7 +169,7 @@ func scrapConnection(ctx context.Context, r *roundtrip) *roundtrip {
 		if retry, ok := parseHttp429Headers(resp.Header); ok {
 			r.crawlDelay = max(retry, r.crawlDelay)
 		} else {
-			r.crawlDelay += time.Second
+			r.crawlDelay += cmp.Or(r.backoffIncrement, defaultBackoffIncrement)
 		}
 	}
 
@@ -122,14 +179,34 @@ func scrapConnection(ctx context.Context, r *roundtrip) *roundtrip {
 		urls = append(urls, location)
 	}
 
+	if r.head {
+		// HEAD responses have no body to scrape
+		r.scrapedUrls = urls
+		return r
+	}
 	if isReponseRobotstxt(resp) {
-		r.robots = scrapRobotsTxt(resp.Body)
+		r.robots = ScrapRobotsTxt(resp.Body)
 		if d, found := r.robots.crawlDelay(); found {
 			r.crawlDelay = d
 		}
 	} else if isResponseHtml(resp) {
-		sUrls := ScrapHtml(r.url, resp.Body)
+		h := fnv.New64a()
+		body := io.TeeReader(resp.Body, h)
+		doc := body
+		if r.preprocessor != nil {
+			doc = r.preprocessor.Preprocess(r.url, body)
+		}
+		var sUrls []*url.URL
+		if r.streamHtml {
+			sUrls = ScrapHtmlStream(r.url, doc)
+		} else {
+			sUrls = ScrapHtml(r.url, doc)
+		}
+		// The preprocessor may leave the body unread, which would close
+		// the connection
+		io.Copy(io.Discard, io.LimitReader(body, maxHtmlBytes))
 		urls = append(sUrls, urls...)
+		r.bodyHash = h.Sum64()
 	} else {
 		// Persistent connections need to have the body read
 		io.ReadAll(resp.Body)
@@ -0,0 +1,161 @@
+// Functions related to monitoring the uplink latency with ICMP echoes
+// whilst measuring, as NATs running out of resources often slow down.
+package main
+
+import (
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+const (
+	icmpMonitorInterval = time.Second
+	icmpEchoTimeout     = 2 * time.Second
+)
+
+// RttSummary summarises the round-trip times of ICMP echoes.
+type RttSummary struct {
+	Min    time.Duration `json:"min"`
+	Median time.Duration `json:"median"`
+	Max    time.Duration `json:"max"`
+	Sent   int           `json:"sent"`
+	Lost   int           `json:"lost"`
+}
+
+type icmpMonitor struct {
+	conn   *icmp.PacketConn
+	target netip.Addr
+	stop   chan struct{}
+	done   chan struct{}
+
+	m    sync.Mutex
+	rtts []time.Duration
+	sent int
+}
+
+func startIcmpMonitor(target netip.Addr) (*icmpMonitor, error) {
+	conn, err := listenIcmp()
+	if err != nil {
+		return nil, err
+	}
+
+	mon := &icmpMonitor{
+		conn:   conn,
+		target: target,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go mon.run()
+	return mon, nil
+}
+
+func (mon *icmpMonitor) targetAddr() net.Addr {
+	ip := net.IP(mon.target.AsSlice())
+	// Unprivileged ping sockets are datagram sockets
+	if _, ok := mon.conn.LocalAddr().(*net.UDPAddr); ok {
+		return &net.UDPAddr{IP: ip}
+	}
+	return &net.IPAddr{IP: ip}
+}
+
+// echoId is the ID echo requests are sent with and replies come back
+// with. Ping sockets rewrite the ID to their local port.
+func (mon *icmpMonitor) echoId() int {
+	if a, ok := mon.conn.LocalAddr().(*net.UDPAddr); ok {
+		return a.Port
+	}
+	return os.Getpid() & 0xffff
+}
+
+// isEchoReply reports whether b is the reply to the echo request with
+// id and seq.
+func isEchoReply(b []byte, id int, seq int) bool {
+	reply, err := icmp.ParseMessage(1, b)
+	if err != nil || reply.Type != ipv4.ICMPTypeEchoReply {
+		return false
+	}
+	echo, ok := reply.Body.(*icmp.Echo)
+	return ok && echo.ID == id && echo.Seq == seq
+}
+
+// echo sends one echo request and waits for its reply.
+func (mon *icmpMonitor) echo(seq int) (time.Duration, bool) {
+	id := mon.echoId()
+	msg := icmp.Message{
+		Type: ipv4.ICMPTypeEcho,
+		Body: &icmp.Echo{
+			ID:   id,
+			Seq:  seq,
+			Data: []byte("natck"),
+		},
+	}
+	b, err := msg.Marshal(nil)
+	if err != nil {
+		return 0, false
+	}
+
+	sent := time.Now()
+	if _, err := mon.conn.WriteTo(b, mon.targetAddr()); err != nil {
+		return 0, false
+	}
+
+	buf := make([]byte, 1500)
+	mon.conn.SetReadDeadline(sent.Add(icmpEchoTimeout))
+	for {
+		n, _, err := mon.conn.ReadFrom(buf)
+		if err != nil {
+			return 0, false
+		}
+		if isEchoReply(buf[:n], id, seq) {
+			return time.Since(sent), true
+		}
+	}
+}
+
+func (mon *icmpMonitor) run() {
+	defer close(mon.done)
+	for seq := 0; ; seq++ {
+		rtt, ok := mon.echo(seq & 0xffff)
+
+		mon.m.Lock()
+		mon.sent++
+		if ok {
+			mon.rtts = append(mon.rtts, rtt)
+		}
+		mon.m.Unlock()
+
+		select {
+		case <-mon.stop:
+			return
+		case <-time.After(icmpMonitorInterval):
+		}
+	}
+}
+
+// close stops monitoring and summarises the echoes sent.
+func (mon *icmpMonitor) close() *RttSummary {
+	close(mon.stop)
+	<-mon.done
+	mon.conn.Close()
+
+	mon.m.Lock()
+	defer mon.m.Unlock()
+	s := &RttSummary{
+		Sent: mon.sent,
+		Lost: mon.sent - len(mon.rtts),
+	}
+	if len(mon.rtts) > 0 {
+		rtts := slices.Clone(mon.rtts)
+		slices.Sort(rtts)
+		s.Min = rtts[0]
+		s.Median = rtts[len(rtts)/2]
+		s.Max = rtts[len(rtts)-1]
+	}
+	return s
+}
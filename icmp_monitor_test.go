@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+func TestIsEchoReply(t *testing.T) {
+	marshal := func(typ ipv4.ICMPType, id, seq int) []byte {
+		msg := icmp.Message{Type: typ, Body: &icmp.Echo{ID: id, Seq: seq, Data: []byte("natck")}}
+		b, err := msg.Marshal(nil)
+		if err != nil {
+			t.Fatal("Failed to marshal echo: ", err)
+		}
+		return b
+	}
+
+	testcases := map[string]struct {
+		in     []byte
+		expect bool
+	}{
+		"Reply":          {in: marshal(ipv4.ICMPTypeEchoReply, 7, 3), expect: true},
+		"Other id":       {in: marshal(ipv4.ICMPTypeEchoReply, 8, 3)},
+		"Other sequence": {in: marshal(ipv4.ICMPTypeEchoReply, 7, 4)},
+		"Request":        {in: marshal(ipv4.ICMPTypeEcho, 7, 3)},
+		"Truncated":      {in: []byte{0}},
+	}
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			if got := isEchoReply(tc.in, 7, 3); got != tc.expect {
+				t.Errorf("expected %v, got %v", tc.expect, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,359 @@
+// Functions related to measuring how long the NAT keeps an idle mapping,
+// by probing a handful of connections after progressively longer idle
+// gaps, so the keep-alive interval can be tuned to the NAT rather than
+// fixed.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+)
+
+const (
+	defaultIdleConnections = 4
+	defaultIdleStart       = 15 * time.Second
+	defaultIdleMax         = 10 * time.Minute
+	defaultIdleTimeout     = 10 * time.Second
+)
+
+// IdleTimeoutMeasurer probes Connections TCP connections to Url, and as
+// many UDP mappings of StunServer, after idle gaps doubling from Start up
+// to Max.
+type IdleTimeoutMeasurer struct {
+	// Url of a server keeping idle connections open, like the reflector,
+	// nil skips TCP
+	Url *url.URL
+	// Invalid skips UDP
+	StunServer  netip.AddrPort
+	Connections int
+	Start       time.Duration
+	Max         time.Duration
+	// Longest to wait for each probe
+	Timeout time.Duration
+}
+
+// IdleTimeout is how long the mappings of a protocol survived idle.
+type IdleTimeout struct {
+	// Longest idle gap a mapping survived, zero if none did
+	Survived time.Duration `json:"survived"`
+	// Shortest idle gap a mapping was dropped after, zero if none were
+	Dropped time.Duration `json:"dropped"`
+	// Connections lost to something other than the NAT, like the
+	// server closing them, telling nothing of the timeout
+	Inconclusive int `json:"inconclusive"`
+}
+
+// IdleTimeoutResult is the idle timeouts of the NAT.
+type IdleTimeoutResult struct {
+	Tcp *IdleTimeout `json:"tcp,omitempty"`
+	Udp *IdleTimeout `json:"udp,omitempty"`
+	// Keep-alive interval suiting the TCP idle timeout, zero if unknown
+	KeepAliveInterval time.Duration `json:"keep_alive_interval"`
+}
+
+// errInconclusive is a probe failing for something other than the NAT.
+var errInconclusive = errors.New("inconclusive probe")
+
+// idleGaps doubles from start until max.
+func idleGaps(start, max time.Duration) []time.Duration {
+	gaps := []time.Duration{}
+	for gap := start; gap <= max; gap *= 2 {
+		gaps = append(gaps, gap)
+	}
+	return gaps
+}
+
+// idleProbe reports whether a mapping survived being idle, or
+// errInconclusive.
+type idleProbe func(ctx context.Context) (bool, error)
+
+// probeIdle waits each gap then probes, until the mapping is dropped.
+// The longest gap survived and the gap dropped after, if any.
+func probeIdle(ctx context.Context, gaps []time.Duration, probe idleProbe) (time.Duration, time.Duration, error) {
+	var survived time.Duration
+	for _, gap := range gaps {
+		select {
+		case <-ctx.Done():
+			return survived, 0, ctx.Err()
+		case <-time.After(gap):
+		}
+		alive, err := probe(ctx)
+		if err != nil {
+			return survived, 0, err
+		}
+		if !alive {
+			return survived, gap, nil
+		}
+		survived = gap
+	}
+	return survived, 0, nil
+}
+
+// measureIdle opens n mappings with open, then probes them concurrently.
+func measureIdle(ctx context.Context, n int, gaps []time.Duration, open func(ctx context.Context) (idleProbe, func(), error)) (*IdleTimeout, error) {
+	probes := []idleProbe{}
+	closers := []func(){}
+	defer func() {
+		for _, c := range closers {
+			c()
+		}
+	}()
+	for range n {
+		probe, closeProbe, err := open(ctx)
+		if err != nil {
+			return nil, err
+		}
+		probes = append(probes, probe)
+		closers = append(closers, closeProbe)
+	}
+
+	t := &IdleTimeout{}
+	var m sync.Mutex
+	var wg sync.WaitGroup
+	for _, probe := range probes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			survived, dropped, err := probeIdle(ctx, gaps, probe)
+
+			m.Lock()
+			defer m.Unlock()
+			t.Survived = max(t.Survived, survived)
+			if dropped != 0 && (t.Dropped == 0 || dropped < t.Dropped) {
+				t.Dropped = dropped
+			}
+			if err != nil {
+				t.Inconclusive++
+			}
+		}()
+	}
+	wg.Wait()
+	return t, nil
+}
+
+// openTcpProbe establishes a connection to the url, probed by requesting
+// it again. Failing to dial again is the transport finding the
+// connection closed whilst idle, by the server rather than a dropped
+// mapping.
+func (im *IdleTimeoutMeasurer) openTcpProbe(addr netip.AddrPort) func(ctx context.Context) (idleProbe, func(), error) {
+	return func(ctx context.Context) (idleProbe, func(), error) {
+		client, _ := makeClient(&traffic{}, nil, nil)
+		get := func(ctx context.Context) error {
+			ctx, cancel := context.WithTimeout(context.WithValue(ctx, ctxAddrKey{}, addr), im.Timeout)
+			defer cancel()
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, im.Url.String(), nil)
+			if err != nil {
+				return err
+			}
+			res, err := client.Do(req)
+			if err != nil {
+				return err
+			}
+			defer res.Body.Close()
+			_, err = io.Copy(io.Discard, res.Body)
+			return err
+		}
+		err := get(ctx)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to connect to %v: %w", im.Url, err)
+		}
+
+		probe := func(ctx context.Context) (bool, error) {
+			err := get(ctx)
+			switch {
+			case err == nil:
+				return true, nil
+			case ctx.Err() != nil:
+				return false, ctx.Err()
+			case isDialError(err):
+				return false, errInconclusive
+			}
+			return false, nil
+		}
+		return probe, client.CloseIdleConnections, nil
+	}
+}
+
+// openUdpProbe opens a mapping to the STUN server, probed by a binding
+// request. The request arrives from another port once the mapping was
+// dropped, which misses NATs reusing the port of the dropped mapping.
+func (im *IdleTimeoutMeasurer) openUdpProbe(ctx context.Context) (idleProbe, func(), error) {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open UDP socket: %w", err)
+	}
+	first, err := stunTransaction(conn, im.StunServer, 0, im.Timeout)
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("failed to open mapping to %v: %w", im.StunServer, err)
+	}
+
+	probe := func(ctx context.Context) (bool, error) {
+		r, err := stunTransaction(conn, im.StunServer, 0, im.Timeout)
+		if err != nil {
+			return false, errInconclusive
+		}
+		return r.mapped == first.mapped, nil
+	}
+	return probe, func() { conn.Close() }, nil
+}
+
+// Measure measures the idle timeouts of TCP and UDP concurrently.
+func (im *IdleTimeoutMeasurer) Measure(ctx context.Context) (*IdleTimeoutResult, error) {
+	if im.Url == nil && !im.StunServer.IsValid() {
+		return nil, errors.New("neither a url nor a STUN server to probe")
+	}
+	if im.Connections <= 0 || im.Start <= 0 || im.Max < im.Start {
+		return nil, errors.New("the connections and start must be positive, and the start at most the max")
+	}
+	gaps := idleGaps(im.Start, im.Max)
+	r := &IdleTimeoutResult{}
+
+	var tcpErr, udpErr error
+	var wg sync.WaitGroup
+	if im.Url != nil {
+		addr, err := lookupIdleTarget(ctx, im.Url)
+		if err != nil {
+			return nil, err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.Tcp, tcpErr = measureIdle(ctx, im.Connections, gaps, im.openTcpProbe(addr))
+		}()
+	}
+	if im.StunServer.IsValid() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.Udp, udpErr = measureIdle(ctx, im.Connections, gaps, im.openUdpProbe)
+		}()
+	}
+	wg.Wait()
+	if tcpErr != nil {
+		return nil, tcpErr
+	}
+	if udpErr != nil {
+		return nil, udpErr
+	}
+	if r.Tcp != nil {
+		r.KeepAliveInterval = r.Tcp.Survived / 2
+	}
+	return r, nil
+}
+
+// lookupIdleTarget is the IPv4 address and port of u.
+func lookupIdleTarget(ctx context.Context, u *url.URL) (netip.AddrPort, error) {
+	port, err := net.LookupPort("tcp", urlPort(u))
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("invalid port of %v: %w", u, err)
+	}
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip4", u.Hostname())
+	if err != nil || len(addrs) == 0 {
+		return netip.AddrPort{}, fmt.Errorf("failed to lookup %v: %w", u.Hostname(), err)
+	}
+	return netip.AddrPortFrom(addrs[0], uint16(port)), nil
+}
+
+func printIdleTimeout(w io.Writer, protocol string, t *IdleTimeout) {
+	if t == nil {
+		return
+	}
+	switch {
+	case t.Survived == 0 && t.Dropped == 0:
+		fmt.Fprintf(w, "%v: inconclusive, %d connections lost to something other than the NAT\n", protocol, t.Inconclusive)
+	case t.Dropped == 0:
+		fmt.Fprintf(w, "%v: mappings survived every idle gap, up to %v\n", protocol, t.Survived)
+	default:
+		fmt.Fprintf(w, "%v: mappings survived %v idle, dropped after %v\n", protocol, t.Survived, t.Dropped)
+	}
+}
+
+func printIdleTimeoutResult(w io.Writer, r *IdleTimeoutResult) {
+	printIdleTimeout(w, "TCP", r.Tcp)
+	printIdleTimeout(w, "UDP", r.Udp)
+	if r.KeepAliveInterval > 0 {
+		fmt.Fprintf(w, "Measure with --keep-alive-interval %v to keep the mappings alive\n", r.KeepAliveInterval)
+	} else if r.Tcp != nil && r.Tcp.Dropped != 0 {
+		fmt.Fprintln(w, "No TCP mapping survived the shortest gap, probe again with a shorter --start")
+	}
+}
+
+// idleTimeoutOptions are the flags of the idle-timeout command.
+type idleTimeoutOptions struct {
+	fs     *flag.FlagSet
+	m      IdleTimeoutMeasurer
+	url    string
+	server string
+	json   bool
+}
+
+func newIdleTimeoutFlags(name string) *idleTimeoutOptions {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	o := &idleTimeoutOptions{fs: fs}
+	fs.StringVar(&o.url, "url", "", "url of a server keeping idle connections open, like natck reflector, to probe TCP mappings, none skips TCP")
+	fs.StringVar(&o.server, "stun-server", defaultStunServers, "STUN server to probe UDP mappings, none skips UDP")
+	fs.IntVar(&o.m.Connections, "connections", defaultIdleConnections, "connections of each protocol to probe")
+	fs.DurationVar(&o.m.Start, "start", defaultIdleStart, "shortest idle gap, doubled after each probe")
+	fs.DurationVar(&o.m.Max, "max-idle", defaultIdleMax, "longest idle gap")
+	fs.DurationVar(&o.m.Timeout, "timeout", defaultIdleTimeout, "how long to wait for each probe")
+	fs.BoolVar(&o.json, "json", false, "print the result as json, for scripts")
+	return o
+}
+
+func idleTimeoutCommand(name string, args []string) {
+	o := newIdleTimeoutFlags(name)
+	parseCommandArgs(o.fs, args, "", 0, false)
+
+	if o.url != "" {
+		u, err := url.Parse(o.url)
+		if err == nil {
+			err = checkTargetUrl(u)
+		}
+		if err != nil {
+			fmt.Printf("Invalid url %v: %v\n", o.url, err)
+			os.Exit(1)
+		}
+		o.m.Url = u
+	}
+	if o.server != "" {
+		addr, err := net.ResolveUDPAddr("udp4", o.server)
+		if err != nil {
+			fmt.Printf("Failed to resolve STUN server: %v\n", err)
+			os.Exit(1)
+		}
+		o.m.StunServer = addr.AddrPort()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	r, err := o.m.Measure(ctx)
+	if err != nil {
+		fmt.Printf("Failed to measure idle timeouts: %v\n", err)
+		os.Exit(1)
+	}
+	if !o.json {
+		printIdleTimeoutResult(os.Stdout, r)
+		return
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	err = enc.Encode(r)
+	if err != nil {
+		fmt.Printf("Failed to print result: %v\n", err)
+		os.Exit(1)
+	}
+}
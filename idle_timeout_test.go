@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// idleNatProxy forwards connections to a server like a NAT, silently
+// dropping those idle for longer than idle.
+func idleNatProxy(t *testing.T, server string, idle time.Duration) netip.AddrPort {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Failed to listen: ", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			client, err := l.Accept()
+			if err != nil {
+				return
+			}
+			backend, err := net.Dial("tcp4", server)
+			if err != nil {
+				client.Close()
+				continue
+			}
+			t.Cleanup(func() {
+				client.Close()
+				backend.Close()
+			})
+
+			var m sync.Mutex
+			last := time.Now()
+			dropped := false
+			forward := func(dst, src net.Conn, checkIdle bool) {
+				defer dst.Close()
+				buf := make([]byte, 4096)
+				for {
+					n, err := src.Read(buf)
+					if err != nil {
+						return
+					}
+					m.Lock()
+					if checkIdle && time.Since(last) > idle {
+						dropped = true
+					}
+					last = time.Now()
+					drop := dropped
+					m.Unlock()
+					if !drop {
+						dst.Write(buf[:n])
+					}
+				}
+			}
+			go forward(backend, client, true)
+			go forward(client, backend, false)
+		}
+	}()
+	return l.Addr().(*net.TCPAddr).AddrPort()
+}
+
+// serveIdleStun answers binding requests with a new mapped port for
+// clients idle for longer than idle.
+func serveIdleStun(t *testing.T, idle time.Duration) netip.AddrPort {
+	conn, err := net.ListenUDP("udp4", net.UDPAddrFromAddrPort(netip.MustParseAddrPort("127.0.0.1:0")))
+	if err != nil {
+		t.Fatal("Failed to listen: ", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		s := &fakeStunServer{noOther: true}
+		last := map[netip.AddrPort]time.Time{}
+		mapped := map[netip.AddrPort]netip.AddrPort{}
+		next := uint16(40000)
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := conn.ReadFromUDPAddrPort(buf)
+			if err != nil {
+				return
+			}
+			msg := buf[:n]
+			if n < stunHeaderLen || binary.BigEndian.Uint16(msg) != stunBindingRequest {
+				continue
+			}
+			if seen, found := last[from]; !found || time.Since(seen) > idle {
+				mapped[from] = netip.AddrPortFrom(netip.MustParseAddr("203.0.113.1"), next)
+				next++
+			}
+			last[from] = time.Now()
+			conn.WriteToUDPAddrPort(s.response([12]byte(msg[8:20]), mapped[from]), from)
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr).AddrPort()
+}
+
+func TestIdleGaps(t *testing.T) {
+	got := idleGaps(15*time.Second, 2*time.Minute)
+	expected := []time.Duration{15 * time.Second, 30 * time.Second, time.Minute, 2 * time.Minute}
+	if !slices.Equal(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
+
+func TestIdleTimeoutMeasure(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		io.WriteString(res, "idle")
+	}))
+	defer srv.Close()
+	closing := httptest.NewUnstartedServer(srv.Config.Handler)
+	closing.Config.IdleTimeout = 10 * time.Millisecond
+	closing.Start()
+	defer closing.Close()
+
+	testcases := map[string]struct {
+		inTcp        bool
+		inUdp        bool
+		inServer     *httptest.Server
+		outTcp       *IdleTimeout
+		outUdp       *IdleTimeout
+		outKeepAlive time.Duration
+	}{
+		"tcp dropped": {
+			inTcp:        true,
+			inServer:     srv,
+			outTcp:       &IdleTimeout{Survived: 100 * time.Millisecond, Dropped: 200 * time.Millisecond},
+			outKeepAlive: 50 * time.Millisecond,
+		},
+		"tcp closed by the server": {
+			inTcp:    true,
+			inServer: closing,
+			outTcp:   &IdleTimeout{Inconclusive: 2},
+		},
+		"udp dropped": {
+			inUdp:  true,
+			outUdp: &IdleTimeout{Survived: 100 * time.Millisecond, Dropped: 200 * time.Millisecond},
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			im := IdleTimeoutMeasurer{
+				Connections: 2,
+				Start:       50 * time.Millisecond,
+				Max:         400 * time.Millisecond,
+				Timeout:     200 * time.Millisecond,
+			}
+			if tc.inTcp {
+				proxy := idleNatProxy(t, tc.inServer.Listener.Addr().String(), 150*time.Millisecond)
+				im.Url = &url.URL{Scheme: "http", Host: proxy.String(), Path: "/"}
+			}
+			if tc.inUdp {
+				im.StunServer = serveIdleStun(t, 150*time.Millisecond)
+			}
+			r, err := im.Measure(context.Background())
+			if err != nil {
+				t.Fatal("Failed to measure: ", err)
+			}
+			for _, p := range []struct {
+				name          string
+				got, expected *IdleTimeout
+			}{{"tcp", r.Tcp, tc.outTcp}, {"udp", r.Udp, tc.outUdp}} {
+				if (p.got == nil) != (p.expected == nil) || (p.got != nil && *p.got != *p.expected) {
+					t.Errorf("expected %v %+v, got %+v", p.name, p.expected, p.got)
+				}
+			}
+			if r.KeepAliveInterval != tc.outKeepAlive {
+				t.Errorf("expected a keep-alive interval of %v, got %v", tc.outKeepAlive, r.KeepAliveInterval)
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+// Functions related to measuring over several local interfaces at once,
+// like the VLANs of a CPE that NATs several internal networks through
+// one WAN pool.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// InterfacesResult is the outcome of measuring over several interfaces at
+// once.
+type InterfacesResult struct {
+	// Sum of the max connections of each interface, those the shared
+	// pool held at once
+	MaxConnections int               `json:"max_connections"`
+	Interfaces     []InterfaceResult `json:"interfaces"`
+}
+
+type InterfaceResult struct {
+	Interface string  `json:"interface"`
+	Result    *Result `json:"result"`
+}
+
+// interfaceDialer dials from the address of the interface, and binds to
+// the interface where supported, so connections leave through it rather
+// than the default route.
+func interfaceDialer(name string, ipv6 bool) (*net.Dialer, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find interface: %w", err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list addresses of %v: %w", name, err)
+	}
+
+	var local net.IP
+	for _, a := range addrs {
+		ipNet, ok := a.(*net.IPNet)
+		if !ok || (ipNet.IP.To4() == nil) != ipv6 || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		local = ipNet.IP
+		break
+	}
+	if local == nil {
+		return nil, fmt.Errorf("interface %v has no %v address", name, ipNetwork(ipv6))
+	}
+
+	d := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		LocalAddr: &net.TCPAddr{IP: local},
+		Control:   bindToDevice(name),
+	}
+	// Check up-front, binding to an interface may need privileges the
+	// dials would otherwise fail for, looking like exhaustion
+	lc := net.ListenConfig{Control: d.Control}
+	conn, err := lc.ListenPacket(context.Background(), "udp", net.JoinHostPort(local.String(), "0"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to bind to interface %v: %w", name, err)
+	}
+	conn.Close()
+	return d, nil
+}
+
+// measureInterfaces measures over each interface at the same time, with
+// the options of m.
+func measureInterfaces(m *Measurer, urls []*url.URL, ifaces []string) (*InterfacesResult, error) {
+	results := make([]InterfaceResult, len(ifaces))
+	errs := make([]error, len(ifaces))
+	var wg sync.WaitGroup
+	for i, iface := range ifaces {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			im := *m
+			im.Interface = iface
+			r, err := im.Measure(urls)
+			if err != nil {
+				errs[i] = fmt.Errorf("failed to measure over %v: %w", iface, err)
+				return
+			}
+			results[i] = InterfaceResult{Interface: iface, Result: r}
+		}()
+	}
+	wg.Wait()
+
+	r := &InterfacesResult{Interfaces: results}
+	for i := range ifaces {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		r.MaxConnections += results[i].Result.MaxConnections
+	}
+	return r, nil
+}
+
+func parseInterfaces(s string) []string {
+	ifaces := []string{}
+	for _, field := range strings.Split(s, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			ifaces = append(ifaces, field)
+		}
+	}
+	return ifaces
+}
+
+func printInterfaces(w io.Writer, m *Measurer, r *InterfacesResult) {
+	for _, ir := range r.Interfaces {
+		fmt.Fprintf(w, "Over %v:\n", ir.Interface)
+		printSummary(w, m, ir.Result)
+		fmt.Fprintln(w)
+	}
+	fmt.Fprintf(w, "Max connections across %d interfaces are %d\n", len(r.Interfaces), r.MaxConnections)
+}
+
+func writeInterfaces(w io.Writer, format string, m *Measurer, r *InterfacesResult) error {
+	switch format {
+	case "text":
+		printInterfaces(w, m, r)
+		return nil
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(r)
+	default:
+		return fmt.Errorf("unsupported interfaces report format %q, expected text or json", format)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// loopbackDialer dials from the loopback interface, skipping the test if
+// binding to interfaces is not permitted.
+func loopbackDialer(t *testing.T) (string, *net.Dialer) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal("Failed to list interfaces: ", err)
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback == 0 {
+			continue
+		}
+		d, err := interfaceDialer(iface.Name, false)
+		if err != nil {
+			t.Skip("cannot bind to the loopback interface: ", err)
+		}
+		return iface.Name, d
+	}
+	t.Skip("no loopback interface")
+	return "", nil
+}
+
+func TestInterfaceDialer(t *testing.T) {
+	_, err := interfaceDialer("natck-missing0", false)
+	if err == nil {
+		t.Error("expected an unknown interface to fail")
+	}
+
+	_, d := loopbackDialer(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	conn, err := d.DialContext(context.Background(), "tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal("Failed to dial from the loopback interface: ", err)
+	}
+	defer conn.Close()
+	local := conn.LocalAddr().(*net.TCPAddr)
+	if !local.IP.IsLoopback() {
+		t.Errorf("expected to dial from a loopback address, got %v", local)
+	}
+}
+
+func TestMeasureInterfaces(t *testing.T) {
+	lo, _ := loopbackDialer(t)
+	n := &benchNetwork{hosts: 10, fanout: 2, seeds: 2}
+	m := Measurer{network: n}
+	r, err := measureInterfaces(&m, n.seedUrls(), []string{lo, lo})
+	if err != nil {
+		t.Fatal("Failed to measure: ", err)
+	}
+
+	if len(r.Interfaces) != 2 {
+		t.Fatalf("expected a result for each interface, got %d", len(r.Interfaces))
+	}
+	for _, ir := range r.Interfaces {
+		if ir.Interface != lo || ir.Result.MaxConnections != n.hosts {
+			t.Errorf("expected %v to hold %d connections, got %v with %d", lo, n.hosts, ir.Interface, ir.Result.MaxConnections)
+		}
+	}
+	if r.MaxConnections != 2*n.hosts {
+		t.Errorf("expected %d connections across interfaces, got %d", 2*n.hosts, r.MaxConnections)
+	}
+}
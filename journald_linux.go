@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+)
+
+const journaldSocket = "/run/systemd/journal/socket"
+
+// Priorities from syslog(3)
+const (
+	journaldPriorityWarning = "4"
+	journaldPriorityInfo    = "6"
+)
+
+// journaldLogger speaks the journald native protocol so fields are
+// stored separately rather than flattened into the message.
+type journaldLogger struct {
+	conn *net.UnixConn
+}
+
+// Whether journald can be logged to on this platform
+const journaldSupported = true
+
+func openJournald() (systemLogger, error) {
+	addr := &net.UnixAddr{Name: journaldSocket, Net: "unixgram"}
+	conn, err := net.DialUnix("unixgram", nil, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &journaldLogger{conn: conn}, nil
+}
+
+// journaldFieldName turns key into a field name journald accepts, of
+// at most 64 uppercase letters, digits and underscores, not starting
+// with an underscore, which journald reserves for trusted fields.
+func journaldFieldName(key string) string {
+	name := "NATCK_" + strings.Map(func(r rune) rune {
+		if 'a' <= r && r <= 'z' {
+			return r - 'a' + 'A'
+		}
+		if ('A' <= r && r <= 'Z') || ('0' <= r && r <= '9') {
+			return r
+		}
+		return '_'
+	}, key)
+	return name[:min(len(name), 64)]
+}
+
+func appendJournaldField(b *bytes.Buffer, key, value string) {
+	if !strings.Contains(value, "\n") {
+		b.WriteString(key + "=" + value + "\n")
+		return
+	}
+
+	// Multi-line values must be length prefixed
+	b.WriteString(key + "\n")
+	binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	b.WriteString(value + "\n")
+}
+
+func (l *journaldLogger) send(priority, msg string, fields []logField) error {
+	b := bytes.Buffer{}
+	appendJournaldField(&b, "PRIORITY", priority)
+	appendJournaldField(&b, "SYSLOG_IDENTIFIER", "natck")
+	appendJournaldField(&b, "MESSAGE", msg)
+	for _, f := range fields {
+		appendJournaldField(&b, journaldFieldName(f.key), f.value)
+	}
+	_, err := l.conn.Write(b.Bytes())
+	return err
+}
+
+func (l *journaldLogger) info(msg string, fields ...logField) error {
+	return l.send(journaldPriorityInfo, msg, fields)
+}
+
+func (l *journaldLogger) warning(msg string, fields ...logField) error {
+	return l.send(journaldPriorityWarning, msg, fields)
+}
+
+func (l *journaldLogger) Close() error {
+	return l.conn.Close()
+}
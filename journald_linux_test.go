@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestJournaldFieldName(t *testing.T) {
+	testcases := map[string]struct {
+		in     string
+		expect string
+	}{
+		"Upper":              {in: "MAX_CONNECTIONS", expect: "NATCK_MAX_CONNECTIONS"},
+		"Lower":              {in: "event", expect: "NATCK_EVENT"},
+		"Digits":             {in: "ipv4", expect: "NATCK_IPV4"},
+		"Invalid characters": {in: "bytes-sent.total", expect: "NATCK_BYTES_SENT_TOTAL"},
+		"Leading underscore": {in: "_PID", expect: "NATCK__PID"},
+		"Non-ASCII":          {in: "débit", expect: "NATCK_D_BIT"},
+		"Too long":           {in: strings.Repeat("A", 100), expect: "NATCK_" + strings.Repeat("A", 58)},
+	}
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			got := journaldFieldName(tc.in)
+			if got != tc.expect {
+				t.Errorf("expected %q, got %q", tc.expect, got)
+			}
+			if strings.HasPrefix(got, "_") || len(got) > 64 {
+				t.Errorf("expected a field name journald accepts, got %q", got)
+			}
+		})
+	}
+}
+
+func TestAppendJournaldField(t *testing.T) {
+	testcases := map[string]struct {
+		in     string
+		expect string
+	}{
+		"Single line": {in: "42", expect: "KEY=42\n"},
+		"Multi-line":  {in: "a\nb", expect: "KEY\n\x03\x00\x00\x00\x00\x00\x00\x00a\nb\n"},
+	}
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			b := bytes.Buffer{}
+			appendJournaldField(&b, "KEY", tc.in)
+			if b.String() != tc.expect {
+				t.Errorf("expected %q, got %q", tc.expect, b.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+)
+
+// Whether journald can be logged to on this platform
+const journaldSupported = false
+
+func openJournald() (systemLogger, error) {
+	return nil, errors.New("journald is only supported on linux")
+}
@@ -0,0 +1,46 @@
+// Functions related to reserving workers for keep-alives, so a burst of
+// crawling for new hosts cannot delay the refreshes of established
+// connections past the NAT's idle timeout.
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// Fraction of the workers reserved for keep-alives, by default
+const defaultKeepAliveReserve = 0.1
+
+func checkKeepAliveReserve(reserve float64) error {
+	if reserve >= 1 {
+		return fmt.Errorf("the keep-alive reserve %v leaves no workers to crawl, expected a fraction below 1", reserve)
+	}
+	return nil
+}
+
+// reservedWorkers is how many of the workers only keep-alives may use,
+// at least one unless none are reserved.
+func (m *Measurer) reservedWorkers(workers int) int {
+	reserve := m.KeepAliveReserve
+	if reserve == 0 {
+		reserve = defaultKeepAliveReserve
+	}
+	if reserve < 0 {
+		return 0
+	}
+	return min(int(math.Ceil(reserve*float64(workers))), max(workers-1, 0))
+}
+
+// keepAliveDue reports whether c has been idle long enough to be kept
+// alive.
+func keepAliveDue(c *connection, now time.Time) bool {
+	return !c.inFlight && now.Sub(c.lastReply) > c.keepAliveInterval && now.Sub(c.lastRequest) > c.crawlDelay
+}
+
+// mayRequest reports whether a request may be made on c now. Keep-alives
+// that are due may use the reserved workers, anything else only the
+// free workers.
+func (s *scheduler) mayRequest(c *connection) bool {
+	return s.freeWorkers() > 0 || keepAliveDue(c, s.now())
+}
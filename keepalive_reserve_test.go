@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/netip"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestReservedWorkers(t *testing.T) {
+	testcases := map[string]struct {
+		inReserve float64
+		inWorkers int
+		expect    int
+	}{
+		"Default":       {inWorkers: workerLimit, expect: workerLimit / 10},
+		"Rounds up":     {inReserve: 0.1, inWorkers: 5, expect: 1},
+		"Leaves one":    {inReserve: 0.99, inWorkers: 5, expect: 4},
+		"None reserved": {inReserve: -1, inWorkers: 5, expect: 0},
+		"No workers":    {inWorkers: 0, expect: 0},
+	}
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			m := Measurer{KeepAliveReserve: tc.inReserve}
+			if got := m.reservedWorkers(tc.inWorkers); got != tc.expect {
+				t.Errorf("expected %d reserved workers, got %d", tc.expect, got)
+			}
+		})
+	}
+}
+
+func TestMayRequest(t *testing.T) {
+	now := time.Now()
+	u, _ := url.Parse("http://127.0.0.1/")
+	makeConn := func(replied time.Duration) *connection {
+		c := makeConnection(netip.MustParseAddrPort("127.0.0.1:80"), u, &traffic{}, nil)
+		c.lastRequest = now.Add(-replied - reRequestInterval)
+		c.lastReply = now.Add(-replied)
+		c.keepAliveInterval = reRequestInterval
+		return c
+	}
+	idle, recent := makeConn(time.Minute), makeConn(time.Second)
+
+	// 2 of the 10 workers are reserved, and 8 are busy
+	s := scheduler{
+		m:     &Measurer{KeepAliveReserve: 0.2},
+		clock: func() time.Time { return now },
+		semC:  make(chan struct{}, 10),
+	}
+	for range 8 {
+		s.semC <- struct{}{}
+	}
+	if s.freeWorkers() != 0 {
+		t.Errorf("expected no free workers besides the reserve, got %d", s.freeWorkers())
+	}
+	if !s.mayRequest(idle) {
+		t.Error("expected a keep-alive due to use the reserve")
+	}
+	if s.mayRequest(recent) {
+		t.Error("expected crawling not to use the reserve")
+	}
+
+	<-s.semC
+	if !s.mayRequest(recent) {
+		t.Error("expected crawling to use a free worker")
+	}
+}
+
+func TestCheckKeepAliveReserve(t *testing.T) {
+	m := Measurer{KeepAliveReserve: 1}
+	if err := m.check(); err == nil {
+		t.Error("expected reserving every worker to be refused")
+	}
+}
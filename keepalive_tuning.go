@@ -0,0 +1,95 @@
+// Functions related to tuning the keep-alive interval from the
+// connections the NAT drops, converging on the longest interval that
+// keeps the mappings alive.
+package main
+
+import (
+	"slices"
+	"time"
+)
+
+// The keep-alive interval tuning starts from, when not given
+const defaultTuneKeepAliveStart = 2 * time.Minute
+
+// KeepAliveTuning is what tuning the keep-alive interval learnt about
+// the NAT's idle tolerance.
+type KeepAliveTuning struct {
+	// The keep-alive interval tuned to, the NAT's practical idle
+	// tolerance.
+	Interval time.Duration `json:"interval"`
+	// Longest idle time a connection survived
+	SafeIdle time.Duration `json:"safe_idle"`
+	// Shortest idle time a connection was dropped after, zero if none
+	// were dropped.
+	DroppedIdle time.Duration `json:"dropped_idle"`
+}
+
+// keepAliveTuner bisects between the longest idle time connections
+// survived and the shortest they were dropped after.
+type keepAliveTuner struct {
+	interval time.Duration
+	safe     time.Duration
+	dropped  time.Duration
+}
+
+func newKeepAliveTuner(start time.Duration) *keepAliveTuner {
+	return &keepAliveTuner{interval: start}
+}
+
+// converged reports whether the safe and dropped idle times are close
+// enough that bisecting further is not worth the dropped connections.
+func (k *keepAliveTuner) converged() bool {
+	return k.safe > 0 && k.dropped-k.safe <= max(time.Second, k.dropped/10)
+}
+
+// observe records a request after a connection was idle, reporting
+// whether the interval changed.
+func (k *keepAliveTuner) observe(idle time.Duration, dropped bool) bool {
+	if dropped {
+		if k.dropped != 0 && idle >= k.dropped {
+			return false
+		}
+		k.dropped = idle
+		if k.safe >= k.dropped {
+			// Something other than the NAT dropped the connection
+			// before, distrust it
+			k.safe = 0
+		}
+	} else {
+		k.safe = max(k.safe, idle)
+		if k.safe >= k.dropped {
+			// The NAT kept a connection idle for longer than the drop,
+			// so the drop was not the NAT's doing
+			k.dropped = 0
+		}
+	}
+	if k.dropped == 0 {
+		return false
+	}
+
+	last := k.interval
+	if k.converged() {
+		k.interval = k.safe
+	} else {
+		k.interval = (k.safe + k.dropped) / 2
+	}
+	return k.interval != last
+}
+
+func (k *keepAliveTuner) report() *KeepAliveTuning {
+	if k == nil {
+		return nil
+	}
+	return &KeepAliveTuning{Interval: k.interval, SafeIdle: k.safe, DroppedIdle: k.dropped}
+}
+
+// tuneKeepAlive observes a request after a connection was idle, applying
+// any change of interval to every connection.
+func (s *scheduler) tuneKeepAlive(idle time.Duration, dropped bool) {
+	if !s.tuner.observe(idle, dropped) {
+		return
+	}
+	for _, c := range slices.Concat(s.pendingConns, s.activeConns) {
+		c.keepAliveInterval = s.tuner.interval
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestKeepAliveTuner(t *testing.T) {
+	type observation struct {
+		idle    time.Duration
+		dropped bool
+	}
+	testcases := map[string]struct {
+		in  []observation
+		out KeepAliveTuning
+	}{
+		"Never dropped": {
+			in:  []observation{{idle: time.Minute}, {idle: 2 * time.Minute}},
+			out: KeepAliveTuning{Interval: 2 * time.Minute, SafeIdle: 2 * time.Minute},
+		},
+		"Bisects": {
+			in:  []observation{{idle: 20 * time.Second}, {idle: 2 * time.Minute, dropped: true}},
+			out: KeepAliveTuning{Interval: 70 * time.Second, SafeIdle: 20 * time.Second, DroppedIdle: 2 * time.Minute},
+		},
+		"Converges": {
+			in: []observation{
+				{idle: 2 * time.Minute, dropped: true},
+				{idle: 60 * time.Second, dropped: true},
+				{idle: 30 * time.Second},
+				{idle: 45 * time.Second},
+				{idle: 52 * time.Second, dropped: true},
+				{idle: 48 * time.Second},
+			},
+			out: KeepAliveTuning{Interval: 48 * time.Second, SafeIdle: 48 * time.Second, DroppedIdle: 52 * time.Second},
+		},
+		"Longer drop ignored": {
+			in:  []observation{{idle: time.Minute, dropped: true}, {idle: 2 * time.Minute, dropped: true}},
+			out: KeepAliveTuning{Interval: 30 * time.Second, DroppedIdle: time.Minute},
+		},
+		"Drop below safe": {
+			in:  []observation{{idle: time.Minute}, {idle: 30 * time.Second, dropped: true}},
+			out: KeepAliveTuning{Interval: 15 * time.Second, DroppedIdle: 30 * time.Second},
+		},
+		"Survived past drop": {
+			in:  []observation{{idle: 30 * time.Second, dropped: true}, {idle: time.Minute}},
+			out: KeepAliveTuning{Interval: 15 * time.Second, SafeIdle: time.Minute},
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			k := newKeepAliveTuner(2 * time.Minute)
+			for _, o := range tc.in {
+				k.observe(o.idle, o.dropped)
+			}
+			if got := *k.report(); got != tc.out {
+				t.Errorf("expected tuning %+v, got %+v", tc.out, got)
+			}
+		})
+	}
+}
+
+func TestTuneKeepAlive(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping due to sustaining connections.")
+	}
+
+	n := &idleNatNetwork{
+		benchNetwork: benchNetwork{hosts: 4, seeds: 4},
+		timeout:      time.Second,
+		lastSeen:     map[uint]time.Time{},
+	}
+	m := Measurer{
+		network:           n,
+		Strategy:          "sustain-only",
+		SustainDuration:   8 * time.Second,
+		KeepAliveInterval: 4 * time.Second,
+		TuneKeepAlive:     true,
+	}
+
+	r, err := m.Measure(n.seedUrls())
+	if err != nil {
+		t.Fatal("Failed to measure: ", err)
+	}
+	k := r.KeepAliveTuning
+	if k == nil {
+		t.Fatal("expected the keep-alive tuning to be reported")
+	}
+	if k.DroppedIdle <= n.timeout {
+		t.Errorf("expected connections to be dropped after idling over %v, got %v", n.timeout, k.DroppedIdle)
+	}
+	if k.Interval >= m.KeepAliveInterval {
+		t.Errorf("expected the interval to shorten from %v, got %v", m.KeepAliveInterval, k.Interval)
+	}
+}
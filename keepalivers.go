@@ -0,0 +1,293 @@
+// Functions related to the ways connections are kept alive once there is
+// nothing new to crawl on them. Measurer.KeepAlive chooses one for each
+// connection, so different servers can be kept alive differently.
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// KeepAliver keeps an idle connection, and so its NAT mapping, alive.
+// Each connection is given its own, which may keep state about it.
+type KeepAliver interface {
+	// KeepAlive sends one keep-alive on c, failing if the connection
+	// was lost. Requests on c.Client must be made with ctx.
+	KeepAlive(ctx context.Context, c *KeepAliveConn) error
+}
+
+// KeepAliveConn is the connection a KeepAliver keeps alive.
+type KeepAliveConn struct {
+	// Client with the single connection to the server, requests that
+	// need another connection fail.
+	Client *http.Client
+	// A url already crawled on the connection, allowed by robots.txt.
+	Url *url.URL
+	// The TCP connection, nil if the server was never reached. Bytes
+	// written to it directly are not counted.
+	Conn net.Conn
+	// Time between keep-alives.
+	Interval time.Duration
+
+	pinger *h2Pinger
+}
+
+// Ping sends an HTTP/2 PING frame, if the connection negotiated HTTP/2.
+func (c *KeepAliveConn) Ping(ctx context.Context) error {
+	if !c.pinger.ready() {
+		return errors.New("no HTTP/2 connection to ping")
+	}
+	return c.pinger.ping(ctx)
+}
+
+// keepAlivers are the KeepAlivers selectable by name.
+var keepAlivers = map[string]func() KeepAliver{
+	"get":       func() KeepAliver { return &GetKeepAlive{} },
+	"head":      func() KeepAliver { return &HeadKeepAlive{} },
+	"h2-ping":   func() KeepAliver { return &H2PingKeepAlive{} },
+	"tcp":       func() KeepAliver { return &TcpKeepAlive{} },
+	"websocket": func() KeepAliver { return &WebSocketKeepAlive{} },
+}
+
+func keepAliverNames() string {
+	names := []string{}
+	for name := range keepAlivers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return strings.Join(names, ", ")
+}
+
+// namedKeepAlive keeps every connection alive with the named KeepAliver,
+// empty is the default of re-requesting pages or sending HTTP/2 PINGs.
+func namedKeepAlive(name string) (func(*url.URL) KeepAliver, error) {
+	if name == "" {
+		return nil, nil
+	}
+	newKeepAliver, found := keepAlivers[name]
+	if !found {
+		return nil, fmt.Errorf("unknown keep-alive %q, one of %v", name, keepAliverNames())
+	}
+	return func(*url.URL) KeepAliver { return newKeepAliver() }, nil
+}
+
+// requestKeepAlive requests u, reading the whole response so the
+// connection is reused.
+func requestKeepAlive(ctx context.Context, c *KeepAliveConn, method string) error {
+	resp, err := getUrl(ctx, c.Client, method, c.Url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(io.Discard, resp.Body)
+	return err
+}
+
+// GetKeepAlive re-requests a crawled page.
+type GetKeepAlive struct{}
+
+func (*GetKeepAlive) KeepAlive(ctx context.Context, c *KeepAliveConn) error {
+	return requestKeepAlive(ctx, c, http.MethodGet)
+}
+
+// HeadKeepAlive requests the headers of a crawled page, without its body.
+type HeadKeepAlive struct{}
+
+func (*HeadKeepAlive) KeepAlive(ctx context.Context, c *KeepAliveConn) error {
+	return requestKeepAlive(ctx, c, http.MethodHead)
+}
+
+// H2PingKeepAlive sends HTTP/2 PING frames, requesting the headers of a
+// crawled page on connections without HTTP/2.
+type H2PingKeepAlive struct{}
+
+func (*H2PingKeepAlive) KeepAlive(ctx context.Context, c *KeepAliveConn) error {
+	if !c.pinger.ready() {
+		return requestKeepAlive(ctx, c, http.MethodHead)
+	}
+	return c.Ping(ctx)
+}
+
+// TcpKeepAlive has the kernel send TCP keep-alive probes every interval,
+// which cost no HTTP traffic. Each keep-alive only checks the probes
+// are answered, where the platform can tell.
+type TcpKeepAlive struct {
+	enabled bool
+}
+
+func (k *TcpKeepAlive) KeepAlive(ctx context.Context, c *KeepAliveConn) error {
+	cConn, ok := c.Conn.(*countingConn)
+	if !ok {
+		return errors.New("no TCP connection to keep alive")
+	}
+	tcp, ok := cConn.Conn.(*net.TCPConn)
+	if !ok {
+		return errors.New("no TCP connection to keep alive")
+	}
+
+	if !k.enabled {
+		err := tcp.SetKeepAliveConfig(net.KeepAliveConfig{
+			Enable:   true,
+			Idle:     c.Interval,
+			Interval: c.Interval,
+			Count:    3,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to enable TCP keep-alives: %w", err)
+		}
+		k.enabled = true
+		return nil
+	}
+
+	reason, err := probeHalfOpen(tcp)
+	if err == nil && reason != "" {
+		return fmt.Errorf("TCP keep-alives failed, %v", reason)
+	}
+	return nil
+}
+
+// GUID servers append to the key of a WebSocket handshake, RFC 6455
+const webSocketGuid = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket opcodes, RFC 6455
+const (
+	webSocketClose = 0x8
+	webSocketPing  = 0x9
+	webSocketPong  = 0xa
+)
+
+// WebSocketKeepAlive upgrades the connection to a WebSocket, then sends
+// WebSocket pings on it. The upgrade takes over the connection, so the
+// server must accept WebSockets over HTTP/1.1.
+type WebSocketKeepAlive struct {
+	// Path of the WebSocket, empty upgrades the crawled page.
+	Path string
+
+	ws io.ReadWriteCloser
+}
+
+func webSocketAccept(key string) string {
+	h := sha1.Sum([]byte(key + webSocketGuid))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// upgrade opens the WebSocket.
+func (k *WebSocketKeepAlive) upgrade(ctx context.Context, c *KeepAliveConn) error {
+	u := c.Url
+	if k.Path != "" {
+		u = u.ResolveReference(&url.URL{Path: k.Path})
+	}
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return fmt.Errorf("failed to make request: %w", err)
+	}
+	// The transport dials a separate HTTP/1.1 connection for requests
+	// whose first Connection header is upgrade, the upgrade must take
+	// over the connection being kept alive instead
+	req.Header["Connection"] = []string{"keep-alive", "Upgrade"}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to upgrade %v: %w", u, err)
+	}
+
+	ws, ok := resp.Body.(io.ReadWriteCloser)
+	if resp.StatusCode != http.StatusSwitchingProtocols || !ok {
+		resp.Body.Close()
+		return fmt.Errorf("failed to upgrade %v: %v", u, resp.Status)
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != webSocketAccept(key) {
+		ws.Close()
+		return fmt.Errorf("failed to upgrade %v: handshake not accepted", u)
+	}
+	k.ws = ws
+	return nil
+}
+
+// writePing writes a masked ping frame, as clients must mask frames.
+func (k *WebSocketKeepAlive) writePing() error {
+	payload := []byte("natck")
+	frame := []byte{0x80 | webSocketPing, 0x80 | byte(len(payload))}
+	mask := make([]byte, 4)
+	rand.Read(mask)
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	_, err := k.ws.Write(frame)
+	return err
+}
+
+// readPong reads frames until the pong, skipping any others.
+func (k *WebSocketKeepAlive) readPong() error {
+	for {
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(k.ws, header); err != nil {
+			return err
+		}
+		opcode := header[0] & 0xf
+		n := uint64(header[1] & 0x7f)
+		switch n {
+		case 126:
+			b := make([]byte, 2)
+			if _, err := io.ReadFull(k.ws, b); err != nil {
+				return err
+			}
+			n = uint64(binary.BigEndian.Uint16(b))
+		case 127:
+			b := make([]byte, 8)
+			if _, err := io.ReadFull(k.ws, b); err != nil {
+				return err
+			}
+			n = binary.BigEndian.Uint64(b)
+		}
+		if header[1]&0x80 != 0 {
+			// Servers should not mask frames, the key is skipped
+			n += 4
+		}
+		if _, err := io.CopyN(io.Discard, k.ws, int64(n)); err != nil {
+			return err
+		}
+
+		switch opcode {
+		case webSocketPong:
+			return nil
+		case webSocketClose:
+			return errors.New("server closed the WebSocket")
+		}
+	}
+}
+
+func (k *WebSocketKeepAlive) KeepAlive(ctx context.Context, c *KeepAliveConn) error {
+	if k.ws == nil {
+		return k.upgrade(ctx, c)
+	}
+
+	err := k.writePing()
+	if err == nil {
+		err = k.readPong()
+	}
+	if err != nil {
+		k.ws.Close()
+		return fmt.Errorf("failed to ping WebSocket: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"sync"
+	"testing"
+)
+
+// keepAliveServer counts the requests of each method, and the WebSocket
+// pings, it was sent.
+type keepAliveServer struct {
+	m        sync.Mutex
+	requests map[string]int
+	pings    int
+}
+
+func (s *keepAliveServer) count(key string) int {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.requests[key]
+}
+
+func (s *keepAliveServer) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	s.m.Lock()
+	s.requests[req.Method]++
+	s.m.Unlock()
+	if req.Header.Get("Upgrade") != "websocket" {
+		return
+	}
+
+	conn, rw, err := http.NewResponseController(res).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	rw.WriteString("Upgrade: websocket\r\nConnection: Upgrade\r\n")
+	rw.WriteString("Sec-WebSocket-Accept: " + webSocketAccept(req.Header.Get("Sec-WebSocket-Key")) + "\r\n\r\n")
+	rw.Flush()
+
+	for {
+		// Pings from the client are short and masked
+		header := make([]byte, 6)
+		if _, err := io.ReadFull(rw, header); err != nil {
+			return
+		}
+		payload := make([]byte, header[1]&0x7f)
+		if _, err := io.ReadFull(rw, payload); err != nil {
+			return
+		}
+		if header[0]&0xf != webSocketPing {
+			continue
+		}
+		s.m.Lock()
+		s.pings++
+		s.m.Unlock()
+		rw.Write(append([]byte{0x80 | webSocketPong, byte(len(payload))}, payload...))
+		rw.Flush()
+	}
+}
+
+func TestKeepAlivers(t *testing.T) {
+	testcases := map[string]struct {
+		expGets  int
+		expHeads int
+		expPings int
+	}{
+		"get":       {expGets: 2},
+		"head":      {expHeads: 2},
+		"h2-ping":   {expHeads: 2},
+		"tcp":       {},
+		"websocket": {expGets: 1, expPings: 1},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			s := &keepAliveServer{requests: map[string]int{}}
+			srv := httptest.NewServer(s)
+			defer srv.Close()
+			u, err := url.Parse(srv.URL)
+			if err != nil {
+				t.Fatal("Failed to parse server url: ", err)
+			}
+			addr := netip.MustParseAddrPort(u.Host)
+			ctx := context.WithValue(context.Background(), ctxAddrKey{}, addr)
+
+			c := makeConnection(addr, u, &traffic{}, nil)
+			defer c.client.CloseIdleConnections()
+			c.keepAliver = keepAlivers[name]()
+			r := makeCrawlRequest(c)
+			if r.keepAliver != nil {
+				t.Fatal("expected the first request to crawl")
+			}
+			if r = scrapConnection(ctx, r); r.err != nil {
+				t.Fatal("Failed to get: ", r.err)
+			}
+
+			// Nothing left to crawl, so only keep-alives remain
+			clear(c.uncrawledUrls)
+			s.requests = map[string]int{}
+			for range 2 {
+				r = makeCrawlRequest(c)
+				if r.keepAliver == nil {
+					t.Fatal("expected a keep-alive")
+				}
+				if r = scrapConnection(ctx, r); r.err != nil {
+					t.Fatal("Failed to keep alive: ", r.err)
+				}
+			}
+
+			gets, heads := s.count(http.MethodGet), s.count(http.MethodHead)
+			s.m.Lock()
+			pings := s.pings
+			s.m.Unlock()
+			if gets != tc.expGets || heads != tc.expHeads || pings != tc.expPings {
+				t.Errorf("expected %d GETs, %d HEADs and %d pings, got %d, %d and %d",
+					tc.expGets, tc.expHeads, tc.expPings, gets, heads, pings)
+			}
+		})
+	}
+}
+
+func TestNamedKeepAlive(t *testing.T) {
+	keepAlive, err := namedKeepAlive("")
+	if err != nil || keepAlive != nil {
+		t.Errorf("expected no keep-alive by default, got %v", err)
+	}
+	keepAlive, err = namedKeepAlive("tcp")
+	if err != nil {
+		t.Fatal("Failed to find keep-alive: ", err)
+	}
+	if a, b := keepAlive(nil), keepAlive(nil); a == b {
+		t.Error("expected each connection to get its own keep-alive")
+	}
+	if _, err := namedKeepAlive("carrier-pigeon"); err == nil {
+		t.Error("expected an unknown keep-alive to fail")
+	}
+}
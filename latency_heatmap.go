@@ -0,0 +1,149 @@
+// Functions related to recording the latency of each host over time, for
+// the heatmap of the HTML report showing when the NAT or uplink started
+// degrading relative to the connection count.
+package main
+
+import (
+	"fmt"
+	"slices"
+	"time"
+)
+
+const (
+	// Most intervals of the heatmap, further replies widen the intervals
+	heatmapColumns = 60
+	// Width of the intervals until the measurement outgrows the columns
+	heatmapInterval = time.Second
+)
+
+// LatencyHeatmap is the mean latency of replies from each host over
+// consecutive intervals of the measurement.
+type LatencyHeatmap struct {
+	Start    time.Time     `json:"start"`
+	Interval time.Duration `json:"interval"`
+	// Most connections active during each interval
+	Connections []int `json:"connections"`
+	// Slowest latency of any host and interval, the top of the scale
+	Max   time.Duration   `json:"max"`
+	Hosts []HostLatencies `json:"hosts"`
+}
+
+// HostLatencies is the mean latency of the replies from a host in each
+// interval of the heatmap, zero without any.
+type HostLatencies struct {
+	Host      string          `json:"host"`
+	Latencies []time.Duration `json:"latencies"`
+}
+
+type latencyCell struct {
+	total time.Duration
+	count int
+}
+
+// latencyHeatmap accumulates the latencies of replies by host and
+// interval, doubling the intervals whenever the measurement runs past
+// heatmapColumns of them, so long runs take no more memory than short.
+type latencyHeatmap struct {
+	start       time.Time
+	interval    time.Duration
+	connections []int
+	hosts       map[string][]latencyCell
+	// Order hosts first replied in, so the rows of the heatmap follow
+	// the ramp of connections
+	order []string
+}
+
+func newLatencyHeatmap(start time.Time) *latencyHeatmap {
+	return &latencyHeatmap{
+		start:    start,
+		interval: heatmapInterval,
+		hosts:    map[string][]latencyCell{},
+	}
+}
+
+// column is the interval at is in, widening the intervals until it fits.
+func (h *latencyHeatmap) column(at time.Time) int {
+	for at.Sub(h.start) >= h.interval*heatmapColumns {
+		h.widen()
+	}
+	return max(int(at.Sub(h.start)/h.interval), 0)
+}
+
+// widen doubles the intervals, merging each pair of them.
+func (h *latencyHeatmap) widen() {
+	h.interval *= 2
+	for i := range (len(h.connections) + 1) / 2 {
+		h.connections[i] = slices.Max(h.connections[2*i : min(2*i+2, len(h.connections))])
+	}
+	h.connections = h.connections[:(len(h.connections)+1)/2]
+	for host, cells := range h.hosts {
+		for i := range (len(cells) + 1) / 2 {
+			merged := cells[2*i]
+			if 2*i+1 < len(cells) {
+				merged.total += cells[2*i+1].total
+				merged.count += cells[2*i+1].count
+			}
+			cells[i] = merged
+		}
+		h.hosts[host] = cells[:(len(cells)+1)/2]
+	}
+}
+
+// add records the latency of a reply from host, with conns connections
+// active.
+func (h *latencyHeatmap) add(host string, requestTs, replyTs time.Time, conns int) {
+	if h == nil {
+		return
+	}
+	i := h.column(replyTs)
+	for len(h.connections) <= i {
+		h.connections = append(h.connections, 0)
+	}
+	h.connections[i] = max(h.connections[i], conns)
+
+	cells, found := h.hosts[host]
+	if !found {
+		h.order = append(h.order, host)
+	}
+	for len(cells) <= i {
+		cells = append(cells, latencyCell{})
+	}
+	cells[i].total += replyTs.Sub(requestTs)
+	cells[i].count++
+	h.hosts[host] = cells
+}
+
+// report is the heatmap of the replies, nil if there were none.
+func (h *latencyHeatmap) report() *LatencyHeatmap {
+	if h == nil || len(h.order) == 0 {
+		return nil
+	}
+	r := &LatencyHeatmap{
+		Start:       h.start,
+		Interval:    h.interval,
+		Connections: h.connections,
+	}
+	for _, host := range h.order {
+		latencies := make([]time.Duration, len(h.connections))
+		for i, c := range h.hosts[host] {
+			if c.count == 0 {
+				continue
+			}
+			// Instant replies of fake networks must not look absent
+			latencies[i] = max(c.total/time.Duration(c.count), 1)
+			r.Max = max(r.Max, latencies[i])
+		}
+		r.Hosts = append(r.Hosts, HostLatencies{Host: host, Latencies: latencies})
+	}
+	return r
+}
+
+// heatColor is the colour of a latency on the scale of the heatmap, from
+// green at zero to red at top.
+func heatColor(latency, top time.Duration) string {
+	f := 1.0
+	if top > 0 {
+		f = min(float64(latency)/float64(top), 1)
+	}
+	return fmt.Sprintf("#%02x%02x00", int(255*f), int(255*(1-f)))
+}
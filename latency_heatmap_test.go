@@ -0,0 +1,95 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestLatencyHeatmap(t *testing.T) {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) time.Time { return start.Add(d) }
+
+	testcases := map[string]struct {
+		inReplies      []time.Duration
+		expInterval    time.Duration
+		expConnections []int
+		expLatencies   []time.Duration
+	}{
+		"Within the columns": {
+			inReplies:      []time.Duration{0, 1500 * time.Millisecond, 2 * time.Second},
+			expInterval:    heatmapInterval,
+			expConnections: []int{1, 2, 3},
+			expLatencies:   []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 30 * time.Millisecond},
+		},
+		"Widened": {
+			inReplies:      []time.Duration{0, 1500 * time.Millisecond, 2 * time.Second, 61 * time.Second},
+			expInterval:    2 * heatmapInterval,
+			expConnections: append(append([]int{2, 3}, make([]int, 28)...), 4),
+			expLatencies:   append(append([]time.Duration{15 * time.Millisecond, 30 * time.Millisecond}, make([]time.Duration, 28)...), 40*time.Millisecond),
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			h := newLatencyHeatmap(start)
+			for i, d := range tc.inReplies {
+				latency := time.Duration(i+1) * 10 * time.Millisecond
+				h.add("a.test:80", at(d-latency), at(d), i+1)
+			}
+			h.add("b.test:80", at(tc.inReplies[len(tc.inReplies)-1]), at(tc.inReplies[len(tc.inReplies)-1]), len(tc.inReplies))
+
+			r := h.report()
+			if r.Interval != tc.expInterval {
+				t.Errorf("expected interval %v, got %v", tc.expInterval, r.Interval)
+			}
+			if !slices.Equal(r.Connections, tc.expConnections) {
+				t.Errorf("expected connections %v, got %v", tc.expConnections, r.Connections)
+			}
+			if len(r.Hosts) != 2 || r.Hosts[0].Host != "a.test:80" {
+				t.Fatalf("expected a.test:80 then b.test:80, got %+v", r.Hosts)
+			}
+			if !slices.Equal(r.Hosts[0].Latencies, tc.expLatencies) {
+				t.Errorf("expected latencies %v, got %v", tc.expLatencies, r.Hosts[0].Latencies)
+			}
+			if last := r.Hosts[1].Latencies[len(r.Hosts[1].Latencies)-1]; last == 0 {
+				t.Error("expected an instant reply to still be in the heatmap")
+			}
+			if r.Max != slices.Max(tc.expLatencies) {
+				t.Errorf("expected max %v, got %v", slices.Max(tc.expLatencies), r.Max)
+			}
+		})
+	}
+}
+
+func TestHeatColor(t *testing.T) {
+	testcases := map[string]struct {
+		inLatency time.Duration
+		inTop     time.Duration
+		expColor  string
+	}{
+		"Fastest": {inLatency: 0, inTop: time.Second, expColor: "#00ff00"},
+		"Half":    {inLatency: 500 * time.Millisecond, inTop: time.Second, expColor: "#7f7f00"},
+		"Slowest": {inLatency: time.Second, inTop: time.Second, expColor: "#ff0000"},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			if c := heatColor(tc.inLatency, tc.inTop); c != tc.expColor {
+				t.Errorf("expected %v, got %v", tc.expColor, c)
+			}
+		})
+	}
+}
+
+func TestMeasureLatencyHeatmap(t *testing.T) {
+	n := &benchNetwork{hosts: 4, seeds: 4}
+	m := Measurer{network: n}
+	r, err := m.Measure(n.seedUrls())
+	if err != nil {
+		t.Fatal("Failed to measure: ", err)
+	}
+	if r.LatencyHeatmap == nil || len(r.LatencyHeatmap.Hosts) != 4 {
+		t.Errorf("expected a heatmap of 4 hosts, got %+v", r.LatencyHeatmap)
+	}
+}
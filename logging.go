@@ -0,0 +1,57 @@
+// Functions related to logging the lifecycle of each connection, to debug
+// why particular hosts never become active connections.
+package main
+
+import (
+	"io"
+	"log/slog"
+)
+
+// discardLogger logs nothing, for measurements without a Measurer.Logger.
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// verbosityLevel is the level logged at with -v given verbosity times.
+// Only warnings and errors are logged by default, -v adds the lifecycle of
+// each connection and -vv each request.
+func verbosityLevel(verbosity int) slog.Level {
+	switch {
+	case verbosity <= 0:
+		return slog.LevelWarn
+	case verbosity == 1:
+		return slog.LevelInfo
+	}
+	return slog.LevelDebug
+}
+
+// newLogger logs text to w at the level of verbosity. The time is only
+// logged when verbose, to keep the warnings of quiet runs short.
+func newLogger(w io.Writer, verbosity int) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: verbosityLevel(verbosity)}
+	if verbosity <= 0 {
+		opts.ReplaceAttr = func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey && len(groups) == 0 {
+				return slog.Attr{}
+			}
+			return a
+		}
+	}
+	return slog.New(slog.NewTextHandler(w, opts))
+}
+
+// log is the logger of the measurement.
+func (m *Measurer) log() *slog.Logger {
+	if m.Logger == nil {
+		return discardLogger
+	}
+	return m.Logger
+}
+
+// connectionAttrs are the attributes identifying c in the log.
+func connectionAttrs(c *connection) []any {
+	return []any{
+		slog.Uint64("id", uint64(c.id)),
+		slog.String("scheme", c.url.Scheme),
+		slog.String("host", c.host.hostPort),
+		slog.String("addr", c.host.ip.String()),
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"log/slog"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestVerbosityLevel(t *testing.T) {
+	testcases := map[string]struct {
+		in     int
+		expect slog.Level
+	}{
+		"Quiet":        {in: 0, expect: slog.LevelWarn},
+		"Verbose":      {in: 1, expect: slog.LevelInfo},
+		"Very verbose": {in: 2, expect: slog.LevelDebug},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			if got := verbosityLevel(tc.in); got != tc.expect {
+				t.Errorf("expected level %v, got %v", tc.expect, got)
+			}
+		})
+	}
+}
+
+func TestConnectionLifecycleLogs(t *testing.T) {
+	testcases := map[string]struct {
+		inVerbosity int
+		expect      []string
+		expectNot   []string
+	}{
+		"Quiet": {
+			expectNot: []string{"msg=resolved", "msg=dialing", "msg=crawled"},
+		},
+		"Verbose": {
+			inVerbosity: 1,
+			expect:      []string{"msg=resolved", "msg=dialing", "msg=established", `msg="lookup failed" host=unknown.bench`},
+			expectNot:   []string{"msg=crawled"},
+		},
+		"Very verbose": {
+			inVerbosity: 2,
+			expect:      []string{"msg=dialing", "msg=crawled", "url=http://h0.bench/", "status="},
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			var b strings.Builder
+			n := &benchNetwork{hosts: 5, fanout: 2, seeds: 2}
+			m := Measurer{network: n, Logger: newLogger(&b, tc.inVerbosity)}
+			seeds := append(n.seedUrls(), &url.URL{Scheme: "http", Host: "unknown.bench", Path: "/"})
+			if _, err := m.Measure(seeds); err != nil {
+				t.Fatal("Failed to measure: ", err)
+			}
+
+			log := b.String()
+			for _, s := range tc.expect {
+				if !strings.Contains(log, s) {
+					t.Errorf("expected the log to contain %q, got %v", s, log)
+				}
+			}
+			for _, s := range tc.expectNot {
+				if strings.Contains(log, s) {
+					t.Errorf("expected the log not to contain %q", s)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,28 @@
+// Functions related to running directly on devices with little memory and
+// CPU, like OpenWrt routers, where users most want to measure their NAT.
+package main
+
+const (
+	// Workers of Measurer.LowResource, enough to keep a few thousand
+	// connections alive
+	lowResourceWorkerLimit = 256
+	// Memory budget of Measurer.LowResource, unless one is given
+	lowResourceMemoryBudget = 32 * 1024 * 1024
+)
+
+// workers is the limit of concurrent lookups and requests.
+func (m *Measurer) workers() int {
+	limit := m.policy().WorkerLimit
+	if m.LowResource {
+		return min(lowResourceWorkerLimit, limit)
+	}
+	return limit
+}
+
+// memoryBudget is the heap size memory is shed above, zero is no limit.
+func (m *Measurer) memoryBudget() uint64 {
+	if m.LowResource && m.MemoryBudget == 0 {
+		return lowResourceMemoryBudget
+	}
+	return m.MemoryBudget
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWorkers(t *testing.T) {
+	testcases := map[string]struct {
+		inMeasurer Measurer
+		expect     int
+	}{
+		"Default":      {expect: workerLimit},
+		"Low resource": {inMeasurer: Measurer{LowResource: true}, expect: lowResourceWorkerLimit},
+		"Policy limit": {inMeasurer: Measurer{Policy: Policy{WorkerLimit: 500}}, expect: 500},
+		"Policy, low resource": {
+			inMeasurer: Measurer{LowResource: true, Policy: Policy{WorkerLimit: 100}},
+			expect:     100,
+		},
+	}
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			if got := tc.inMeasurer.workers(); got != tc.expect {
+				t.Errorf("expected %d workers, got %d", tc.expect, got)
+			}
+		})
+	}
+}
+
+func TestLowResource(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping due to sustaining connections.")
+	}
+
+	srv := &httpTestServer{name: "server"}
+	startHttpServer(t, srv)
+	root := makeServerRoot(t, tPath("wildcard_robots.txt"))
+	makeHtmlDocWithLinks(t, []*url.URL{srv.tUrl(t, "blog.html")}, path.Join(root, "index.html"))
+	cpFile(t, tPath("no_links.html"), path.Join(root, "blog.html"))
+
+	var m sync.Mutex
+	methods := []string{}
+	srv.server.Handler = HandlerChain{
+		func(res http.ResponseWriter, req *http.Request) bool {
+			m.Lock()
+			methods = append(methods, req.Method)
+			m.Unlock()
+			return true
+		},
+		makeFileHandler(root),
+	}
+
+	measurer := Measurer{
+		Strategy:          "sustain-only",
+		SustainDuration:   3 * time.Second,
+		KeepAliveInterval: 500 * time.Millisecond,
+		LowResource:       true,
+	}
+	r, err := measurer.Measure([]*url.URL{srv.tUrl(t, "")})
+	if err != nil {
+		t.Fatal("Failed to measure: ", err)
+	}
+	if r.MaxConnections != 1 {
+		t.Errorf("expected to measure 1 connection, got %d", r.MaxConnections)
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	// robots.txt then the first page are fetched, only HEAD after
+	if len(methods) < 3 {
+		t.Fatalf("expected the connection to be kept alive, got requests %v", methods)
+	}
+	for i, method := range methods {
+		expected := http.MethodHead
+		if i < 2 {
+			expected = http.MethodGet
+		}
+		if method != expected {
+			t.Errorf("expected request %d to be %v, got %v", i, expected, method)
+		}
+	}
+}
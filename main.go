@@ -2,21 +2,28 @@ package main
 
 import (
 	"bufio"
+	"cmp"
+	"context"
+	"flag"
 	"fmt"
 	"io"
+	"log/slog"
+	"net/netip"
 	"net/url"
 	"os"
 	"strings"
+	"time"
 )
 
-func readUrls(input io.Reader) ([]*url.URL, error) {
+func readUrls(input io.Reader) ([]*url.URL, map[string]netip.Addr, error) {
 	urls := make([]*url.URL, 0)
+	pins := map[string]netip.Addr{}
 	r := bufio.NewReaderSize(input, 160)
 	for more := true; more; {
 		line, rErr := r.ReadString('\n')
 		if rErr != nil && rErr != io.EOF {
 			err := fmt.Errorf("failed to read url line: %w", rErr)
-			return nil, err
+			return nil, nil, err
 		}
 		more = rErr != io.EOF
 
@@ -25,23 +32,978 @@ func readUrls(input io.Reader) ([]*url.URL, error) {
 			continue
 		}
 
-		u, err := url.Parse(line)
+		u, pin, err := parseSeedLine(line)
 		if err != nil {
 			continue
 		}
+		if pin.IsValid() {
+			pins[canonicalHost(u)] = pin
+		}
 
 		urls = append(urls, u)
 	}
-	return urls, nil
+	return urls, pins, nil
+}
+
+// confirm asks the user a yes/no question on the terminal. Stdin is
+// reserved for the url list, so the terminal is opened directly.
+func confirm(question string) (bool, error) {
+	tty, err := os.Open("/dev/tty")
+	if err != nil {
+		return false, fmt.Errorf("failed to open terminal: %w", err)
+	}
+	defer tty.Close()
+
+	fmt.Fprintf(os.Stderr, "%v [y/N] ", question)
+	answer, err := bufio.NewReader(tty).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return false, fmt.Errorf("failed to read answer: %w", err)
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes", nil
+}
+
+func printEstimate(w io.Writer, nSeeds int, e runEstimate) {
+	fmt.Fprintf(w, "Crawling %d seed urls is estimated to take at least %v and use about %d bytes\n", nSeeds, e.duration, e.bytes)
+}
+
+func startReplay(m *Measurer, path string) ([]*url.URL, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	t, err := readTrace(f)
+	if err != nil {
+		return nil, err
+	}
+	m.network = newReplayNetwork(t)
+	return t.seedUrls()
 }
 
-func main() {
-	urls, err := readUrls(os.Stdin)
+func writeTrace(rec *recordingNetwork, path string) error {
+	f, err := os.Create(path)
 	if err != nil {
-		fmt.Printf("Failed to read urls from stdin: %v", err)
+		return err
+	}
+	defer f.Close()
+	return rec.write(f)
+}
+
+func printSummary(w io.Writer, m *Measurer, r *Result) {
+	fmt.Fprintf(w, "Max connections are %d, counted once %v\n", r.MaxConnections, countedAfterDescription(r.CountedAfter))
+	fmt.Fprintf(w, "Peaked at %d established connections, %d were verified alive in their last keep-alive window\n", r.PeakEstablished, r.MaxConnections)
+	if len(r.BySchemePort) > 1 {
+		for _, s := range r.BySchemePort {
+			fmt.Fprintf(w, "  %v on port %v: %d\n", s.Scheme, s.Port, s.MaxConnections)
+		}
+	}
+	if st := r.Statuses; r.MaxConnections > 0 {
+		fmt.Fprintf(w, "Last answered with 2xx %d, 3xx %d, 4xx %d, 5xx %d, 429 %d, 503 %d, nothing %d\n",
+			st.Status2xx, st.Status3xx, st.Status4xx, st.Status5xx, st.Status429, st.Status503, st.None)
+	}
+	if len(r.Stages) > 0 {
+		fmt.Fprintln(w, "Stages:")
+		for _, st := range r.Stages {
+			fmt.Fprintf(w, "  %v: %d connections, %d counted, %d failed\n", st.Stage, st.Connections, st.Counted, st.Failed)
+		}
+	}
+	if m.Preload > 0 {
+		fmt.Fprintf(w, "Headroom of %d connections beyond the %d preloaded\n", r.Headroom, r.Preloaded)
+	}
+	if r.Destination != "" {
+		fmt.Fprintf(w, "All connections were to %v, the limit per destination rather than the global limit\n", r.Destination)
+	}
+	fmt.Fprintf(w, "Sent %d bytes, received %d bytes\n", r.BytesSent, r.BytesReceived)
+	if md := r.Metadata; md != nil && md.LocalIp != "" {
+		fmt.Fprintf(w, "Measured from %v", md.LocalIp)
+		if md.Interface != "" {
+			fmt.Fprintf(w, " on %v", md.Interface)
+		}
+		if md.ExternalIp != "" {
+			fmt.Fprintf(w, ", seen as %v", md.ExternalIp)
+		}
+		fmt.Fprintln(w)
+	}
+	if len(r.Warnings) > 0 {
+		fmt.Fprintln(w, "Warnings:")
+		for _, warning := range r.Warnings {
+			fmt.Fprintln(w, "  "+warning)
+		}
+	}
+	if r.MappingsLost > 0 {
+		fmt.Fprintf(w, "Lost the NAT mappings of %d established connections\n", r.MappingsLost)
+	}
+	if len(r.SchemeUpgrades) > 0 {
+		fmt.Fprintf(w, "Moved %d connections to https, as their hosts asked\n", len(r.SchemeUpgrades))
+	}
+	if r.RobotsFailures > 0 {
+		fmt.Fprintf(w, "Failed to fetch robots.txt %d times, handled with the %v policy\n", r.RobotsFailures, cmp.Or(m.RobotsFailurePolicy, RobotsFailureRfc9309))
+	}
+	if r.RobotsServerErrors > 0 || r.ContentServerErrors > 0 {
+		fmt.Fprintf(w, "Servers replied 5xx %d times to robots.txt and %d times to other pages, handled with the %v policy\n",
+			r.RobotsServerErrors, r.ContentServerErrors, cmp.Or(m.ServerErrorPolicy, ServerErrorsIgnore))
+	}
+	if len(r.Tls) > 0 {
+		resumed, echAccepted := 0, 0
+		for _, c := range r.Tls {
+			if c.Resumed {
+				resumed++
+			}
+			if c.EchAccepted {
+				echAccepted++
+			}
+		}
+		fmt.Fprintf(w, "Resumed TLS sessions on %d of %d TLS connections\n", resumed, len(r.Tls))
+		if m.EnableEch {
+			fmt.Fprintf(w, "Encrypted ClientHello accepted on %d of %d TLS connections\n", echAccepted, len(r.Tls))
+		}
+	}
+	if k := r.KeepAliveTuning; k != nil {
+		fmt.Fprintf(w, "Keep-alive tuned to %v, connections survived %v idle", k.Interval, k.SafeIdle)
+		if k.DroppedIdle > 0 {
+			fmt.Fprintf(w, " and were dropped after %v", k.DroppedIdle)
+		}
+		fmt.Fprintln(w)
+	}
+	if h := r.Hairpin; h != nil {
+		supports := "supports"
+		if !h.Supported {
+			supports = "does not support"
+		}
+		fmt.Fprintf(w, "The NAT %v hairpinning to %v, learnt by %v\n", supports, h.ExternalAddress, h.Method)
+	}
+	if d := r.DoubleNat; d != nil {
+		fmt.Fprintf(w, "First hops %v, crossing private networks %v\n", strings.Join(d.Hops, " "), strings.Join(d.Networks, " "))
+	}
+	if u := r.Upnp; u != nil {
+		fmt.Fprintf(w, "The gateway %v reports over UPnP %v for %v with WAN address %v", cmp.Or(u.Name, cmp.Or(u.Model, "unnamed")), cmp.Or(u.ConnectionStatus, "unknown status"), u.Uptime, u.ExternalIp)
+		if u.PortMappings != nil {
+			capped := ""
+			if u.PortMappingsCapped {
+				capped = "+"
+			}
+			fmt.Fprintf(w, " and %d%v port mappings", *u.PortMappings, capped)
+		}
+		fmt.Fprintln(w)
+	}
+	if p := r.MappingProtocol; p != nil {
+		switch {
+		case p.Protocol == "":
+			fmt.Fprintln(w, "The gateway answered neither PCP nor NAT-PMP")
+		case p.Mapped:
+			fmt.Fprintf(w, "The gateway granted a mapping over %v, %d to %v:%d for %v\n", p.Protocol, p.InternalPort, p.ExternalIp, p.ExternalPort, p.Lifetime)
+		default:
+			fmt.Fprintf(w, "The gateway refused a mapping over %v, %v\n", p.Protocol, p.Refused)
+		}
+	}
+	if n := sharedConnections(r.Hostnames); n > 0 {
+		fmt.Fprintf(w, "%d connections were shared by several hostnames, %d hostnames were aliases\n", n, r.Aliases)
+	}
+	if d := r.DualStack; d != nil {
+		fmt.Fprintf(w, "%d of %d hosts looked up were dual-stacked, %d were IPv6 only\n", d.DualStacked, d.Hosts, d.Ipv6Only)
+	}
+	if rtt := r.UplinkRtt; rtt != nil {
+		fmt.Fprintf(w, "Uplink rtt min/median/max %v/%v/%v, %d of %d echoes lost\n", rtt.Min, rtt.Median, rtt.Max, rtt.Lost, rtt.Sent)
+	}
+	if e := r.Exhaustion; e != nil {
+		fmt.Fprintf(w, "Once exhausted, the NAT evicted %d established connections (%v)\n", len(e.Evicted), e.Policy)
+		if len(e.Evicted) > 1 {
+			fmt.Fprintf(w, "  Eviction order correlates %.2f with establishment order\n", e.OrderCorrelation)
+		}
+		for _, ev := range e.Evicted {
+			fmt.Fprintf(w, "  %v after %v\n", ev.Host, ev.AfterExhaustion)
+		}
+	}
+	for _, n := range r.Notices {
+		fmt.Fprintln(w, "Notice:", n)
+	}
+}
+
+// measureOptions are the flags of the measure and server commands.
+type measureOptions struct {
+	fs *flag.FlagSet
+	m  Measurer
+
+	yes               bool
+	verbose           bool
+	veryVerbose       bool
+	reportFormat      string
+	reportFile        string
+	input             string
+	schedule          string
+	dnsSearch         string
+	dnsRoutes         string
+	caFile            string
+	clientCert        string
+	clientKey         string
+	clientCertHosts   string
+	overrides         string
+	policy            string
+	events            string
+	eventsFile        string
+	notifyUrl         string
+	notifyExhaustion  bool
+	statsSinkTarget   string
+	resultStore       string
+	crawlDb           string
+	statsInterval     time.Duration
+	systemLog         string
+	listen            string
+	interval          time.Duration
+	varianceThreshold float64
+	confirmationRuns  int
+	confirmationPause time.Duration
+	alpn              string
+	sweep             string
+	sweepPause        time.Duration
+	interfaces        string
+	compareIfaces     string
+	hopTarget         string
+	compareRounds     int
+	comparePause      time.Duration
+	tcpNoDelay        bool
+	keepAlive         string
+	captureHeaders    string
+	singleTarget      string
+	record            string
+	replay            string
+	icmpTarget        string
+	statusSocket      string
+	debugListen       string
+	dialFailures      float64
+	responseFailures  float64
+	holdTimeout       time.Duration
+	requirePrivileged bool
+}
+
+// newMeasureFlags defines the flags of the measure and server commands.
+// Only the server command runs as a daemon.
+func newMeasureFlags(name string) *measureOptions {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	o := &measureOptions{fs: fs}
+	fs.Uint64Var(&o.m.MaxTotalBytes, "max-total-bytes", 0, "stop after sending and receiving this many bytes, 0 is unlimited")
+	fs.Uint64Var(&o.m.MemoryBudget, "memory-budget", 0, "shed urls to keep the heap under this many bytes, for low-memory devices, 0 is unlimited")
+	fs.IntVar(&o.m.ConnectionLimit, "max-connections", 0, "stop once this many connections are counted, as the NAT allows at least that many, 0 is no limit")
+	fs.DurationVar(&o.m.Timeout, "timeout", 0, "stop the measurement after this long, reporting the connections so far, 0 is no limit")
+	fs.StringVar(&o.policy, "policy", "", "tune the scheduler with the poll_interval, re_request_interval, backoff_increment, max_repeated_dial_fails and worker_limit in this YAML file, overridden by their flags")
+	fs.DurationVar(&o.m.Policy.PollInterval, "poll-interval", 0, fmt.Sprintf("longest the scheduler waits for a lookup or reply before deciding again, 0 is %v", defaultPollInterval))
+	fs.DurationVar(&o.m.Policy.ReRequestInterval, "re-request-interval", 0, fmt.Sprintf("time between requests over a connection, 0 is %v", reRequestInterval))
+	fs.DurationVar(&o.m.Policy.BackoffIncrement, "backoff-increment", 0, fmt.Sprintf("added to the crawl delay of a host on each HTTP 429 without Retry-After, 0 is %v", defaultBackoffIncrement))
+	fs.IntVar(&o.m.Policy.MaxRepeatedDialFails, "max-dial-fails", 0, fmt.Sprintf("consecutive dial failures before the NAT is suspected to be exhausted, 0 is %d", maxRepeatedDialFails))
+	fs.IntVar(&o.m.Policy.WorkerLimit, "worker-limit", 0, fmt.Sprintf("most concurrent lookups and requests, 0 is %d, or %d with --low-resource", workerLimit, lowResourceWorkerLimit))
+	fs.DurationVar(&o.m.ProgressInterval, "progress", defaultProgressInterval, "time between reports of progress to stderr, 0 to stay quiet")
+	fs.BoolVar(&o.m.LowResource, "low-resource", false, "run on routers and other low-memory devices, with fewer workers, streamed html parsing and HEAD keep-alives")
+	fs.BoolVar(&o.yes, "yes", false, "start without asking to confirm the estimated cost")
+	fs.BoolVar(&o.verbose, "v", false, "log the lifecycle of each connection to stderr")
+	fs.BoolVar(&o.veryVerbose, "vv", false, "also log each request to stderr")
+	fs.StringVar(&o.reportFormat, "report", "text", "print the result as text, json, csv or html")
+	fs.StringVar(&o.reportFile, "report-file", "", "write the result to this file instead of stdout")
+	fs.StringVar(&o.reportFile, "output", "", "same as --report-file")
+	fs.StringVar(&o.input, "input", "", "read the urls from this file instead of the url-file argument or stdin")
+	fs.StringVar(&o.events, "events", "", "stream events in the given format (ndjson) as they happen")
+	fs.StringVar(&o.eventsFile, "events-file", "", "write events to this file instead of stdout")
+	fs.StringVar(&o.notifyUrl, "notify-url", "", "post the result to this webhook once finished")
+	fs.BoolVar(&o.notifyExhaustion, "notify-exhaustion", false, "also post to the webhook when NAT exhaustion is suspected")
+	fs.StringVar(&o.statsSinkTarget, "stats-sink", "", "periodically export gauges to influx://host:8086/db or graphite://host:2003")
+	fs.DurationVar(&o.statsInterval, "stats-interval", 10*time.Second, "time between exports to the stats sink")
+	fs.StringVar(&o.systemLog, "system-log", "", "also log the result and warnings to the system log (syslog or journald)")
+	fs.StringVar(&o.crawlDb, "db", "", "store the connections, requests and result in this SQLite database, queried by natck query")
+	fs.StringVar(&o.resultStore, "store", "", "keep each result in file:history.jsonl, sqlite:history.db or post it to an http:// url, listed by natck history")
+	if name == "server" {
+		fs.StringVar(&o.listen, "listen", ":9090", "serve /metrics, /healthz and /readyz on this address")
+		fs.DurationVar(&o.interval, "interval", time.Hour, "time between measurements")
+		fs.Float64Var(&o.varianceThreshold, "variance-threshold", 0, "measure again when the max connections differ from the last measurement by more than this percent, 0 never does")
+		fs.IntVar(&o.confirmationRuns, "confirmation-runs", defaultConfirmationRuns, "times to measure again when over --variance-threshold, serving the median")
+		fs.DurationVar(&o.confirmationPause, "confirmation-pause", defaultConfirmationPause, "time before each confirmation run for the NAT to release closed mappings")
+	}
+	fs.StringVar(&o.m.Strategy, "strategy", "linear-ramp", "how connections are ramped up and down, one of "+strategyNames())
+	fs.DurationVar(&o.m.RampInterval, "ramp-interval", 0, "minimum time between opening connections with linear-ramp")
+	fs.IntVar(&o.m.Preload, "preload", 0, "first establish this many connections as background load, like normal household traffic, and report the headroom beyond them")
+	fs.StringVar(&o.schedule, "schedule", "", "open and hold connections in these comma separated stages, like \"open 200, hold 5m, open 200, hold 5m\", with the schedule strategy")
+	fs.IntVar(&o.m.SustainConnections, "sustain-connections", 0, "connections sustain-only opens, 0 is one per url")
+	fs.DurationVar(&o.m.SustainDuration, "sustain-duration", defaultSustainDuration, "how long sustain-only keeps connections alive for")
+	fs.DurationVar(&o.m.ChurnInterval, "churn-interval", defaultChurnInterval, "time between churn replacing its oldest connection")
+	fs.StringVar(&o.m.Script, "script", "", "customise the strategy with the hooks defined in this Starlark script")
+	fs.StringVar(&o.alpn, "alpn", "", "comma separated protocols to offer with ALPN, like http/1.1, or none, instead of h2 and http/1.1")
+	fs.BoolVar(&o.m.DisableHttp2, "http1", false, "only speak HTTP/1.1, so servers cannot multiplex over HTTP/2 and each host holds one TCP connection")
+	fs.BoolVar(&o.m.DisableTlsResumption, "disable-tls-resumption", false, "stop TLS sessions being resumed across connections and measurements")
+	fs.BoolVar(&o.m.InsecureSkipVerify, "insecure", false, "accept any certificate, for lab servers with self-signed certificates")
+	fs.StringVar(&o.caFile, "ca-file", "", "also verify certificates against the PEM root CAs in this file")
+	fs.StringVar(&o.clientCert, "client-cert", "", "present the PEM certificate in this file to servers asking for one, like mTLS protected internal servers")
+	fs.StringVar(&o.clientKey, "client-key", "", "PEM key of --client-cert, if not in the same file")
+	fs.StringVar(&o.clientCertHosts, "client-cert-hosts", "", "comma separated client certificates of hosts and their subdomains, like \"lab.example=lab.crt:lab.key\", instead of --client-cert")
+	fs.StringVar(&o.m.TlsServerName, "tls-server-name", "", "verify certificates for and send this SNI name instead of the hostname of each url, for https targets given by IP address")
+	fs.BoolVar(&o.m.AllowSensitivePorts, "allow-sensitive-ports", false, "connect to linked hosts on the ports of sensitive services, like SMTP (25), SMB (445) and RDP (3389), which may trigger abuse reports")
+	fs.BoolVar(&o.m.UpgradeInsecure, "upgrade-insecure", false, "move hosts to https once they send Strict-Transport-Security or upgrade-insecure-requests, dialing them once more")
+	fs.IntVar(&o.m.TrapLimits.MaxUrlLength, "max-url-length", defaultMaxUrlLength, "skip links longer than this many bytes, as crawler traps, negative is no limit")
+	fs.IntVar(&o.m.TrapLimits.MaxRepeatedSegments, "max-repeated-segments", defaultMaxRepeatedSegments, "skip links whose path repeats a segment more than this many times, negative is no limit")
+	fs.IntVar(&o.m.TrapLimits.MaxQueryVariants, "max-query-variants", defaultMaxQueryVariants, "crawl at most this many distinct queries of a path on each server, negative is no limit")
+	fs.BoolVar(&o.m.RotateUserAgent, "ua-rotate", false, "give each connection its own User-Agent from a pool of common browsers, to find middleboxes with per User-Agent policies")
+	fs.StringVar(&o.captureHeaders, "capture-headers", "", "record these comma separated response headers of each connection in the report, like "+strings.Join(diagnosticHeaders, ",")+", to identify CDNs and proxies")
+	fs.BoolVar(&o.m.StrictPoliteness, "strict-politeness", false, "close connections to hosts whose robots.txt disallows everything or sets an extreme Crawl-delay")
+	fs.StringVar(&o.m.RobotsFailurePolicy, "robots-failure", RobotsFailureRfc9309, "how to treat hosts whose robots.txt fails to be fetched, one of "+strings.Join(robotsFailurePolicies, ", "))
+	fs.StringVar(&o.m.ServerErrorPolicy, "server-errors", ServerErrorsIgnore, "whether 5xx replies fail connections, one of "+strings.Join(serverErrorPolicies, ", ")+", those to robots.txt being otherwise handled by --robots-failure")
+	fs.StringVar(&o.m.CountAfter, "count-after", CountAfterConnect, "when connections count towards the maximum, one of "+strings.Join(countAfterStages, ", "))
+	fs.DurationVar(&o.m.KeepAliveInterval, "keep-alive-interval", 0, "time a connection may be idle before it is kept alive, 0 is the re-request interval")
+	fs.Float64Var(&o.m.KeepAliveReserve, "keep-alive-reserve", defaultKeepAliveReserve, "fraction of the workers reserved for keep-alives, so crawling for new hosts cannot delay them, negative reserves none")
+	fs.BoolVar(&o.m.TuneKeepAlive, "tune-keep-alive", false, "start with a long keep-alive interval and shorten it as connections are dropped, to find the NAT's idle tolerance")
+	fs.StringVar(&o.overrides, "overrides", "", "override the scheme, port, headers, keep-alive or crawl delay of the hosts matched in this YAML file, keyed by hostname, *.domain or CIDR")
+	fs.StringVar(&o.keepAlive, "keep-alive", "", "keep connections alive with one of "+keepAliverNames()+" once there is nothing new to crawl, instead of re-requesting pages or HTTP/2 PINGs")
+	fs.StringVar(&o.sweep, "sweep-keep-alive", "", "repeat the measurement with each of these comma separated keep-alive intervals, like 1s,5s,30s,120s")
+	fs.DurationVar(&o.sweepPause, "sweep-pause", 2*time.Minute, "time between sweep measurements for the NAT to release closed mappings")
+	fs.BoolVar(&o.m.NoEnvProxy, "no-env-proxy", false, "connect directly, ignoring the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables")
+	fs.BoolVar(&o.tcpNoDelay, "tcp-nodelay", true, "disable Nagle's algorithm with TCP_NODELAY, so small keep-alive requests are sent at once")
+	fs.IntVar(&o.m.Socket.SendBuffer, "send-buffer", 0, "bytes of the socket send buffer (SO_SNDBUF), 0 is the system default")
+	fs.IntVar(&o.m.Socket.ReceiveBuffer, "receive-buffer", 0, "bytes of the socket receive buffer (SO_RCVBUF), 0 is the system default")
+	fs.DurationVar(&o.m.Socket.UserTimeout, "tcp-user-timeout", 0, "close connections whose sent data is unacknowledged for this long (TCP_USER_TIMEOUT, linux only), 0 is 20s and negative is the system default")
+	fs.DurationVar(&o.m.HalfOpenInterval, "half-open-interval", 0, "time between checking sockets for half-open connections without sending anything (linux only), 0 is 5s and negative never checks")
+	fs.StringVar(&o.m.Reflector, "reflector", "", "record the external IP replied by this reflector url, like one served by natck reflector")
+	fs.DurationVar(&o.m.ReflectorInterval, "reflector-interval", defaultReflectorInterval, "time between asking the reflector whether the external IP changed, negative never asks again")
+	fs.StringVar(&o.singleTarget, "single-target", "", "measure the connections allowed to one destination over a range of its ports, like 198.51.100.7:8000-8999 served by natck reflector --ports, instead of crawling a url list")
+	fs.StringVar(&o.interfaces, "interfaces", "", "measure over each of these comma separated local interfaces or VLANs at once, like eth0.10,eth0.20")
+	fs.StringVar(&o.compareIfaces, "compare-interfaces", "", "compare the paths of these comma separated local interfaces, like eth0,wlan0, measuring over each in turn")
+	fs.IntVar(&o.compareRounds, "compare-rounds", defaultCompareRounds, "rounds of measuring over each of --compare-interfaces, reporting the median")
+	fs.DurationVar(&o.comparePause, "compare-pause", 2*time.Minute, "time between the measurements of --compare-interfaces for the NAT to release closed mappings")
+	fs.BoolVar(&o.m.Ipv6, "ipv6", false, "connect over IPv6 instead of IPv4, to measure NAT66 or stateful IPv6 firewalls")
+	fs.StringVar(&o.dnsSearch, "dns-search", "", "comma separated domains appended to hostnames without a dot, like lab.example")
+	fs.BoolVar(&o.m.Dns.Mdns, "enable-mdns", false, "resolve .local hostnames with multicast DNS, for labs between home network segments")
+	fs.StringVar(&o.dnsRoutes, "dns-route", "", "comma separated domain=nameserver routes resolving those domains with their own nameserver, like lab.example=10.0.0.53")
+	fs.BoolVar(&o.m.CompareDualStack, "dual-stack-report", false, "also lookup IPv6 addresses to report how many hosts could bypass the NAT over IPv6")
+	fs.BoolVar(&o.m.CheckHairpin, "hairpin", false, "check whether the NAT hairpins UDP to its own external address, learnt with STUN or from --reflector")
+	fs.BoolVar(&o.m.DetectDoubleNat, "double-nat", false, "trace the first hops of the path to flag double NATs, needing raw sockets")
+	fs.BoolVar(&o.m.CheckMappingProtocols, "pcp", false, "ask the gateway for a UDP mapping with PCP, or NAT-PMP, reporting whether it honours explicit mapping protocols")
+	fs.BoolVar(&o.m.DisableUpnp, "no-upnp", false, "do not ask the gateway over UPnP IGD for its WAN status and port mappings")
+	fs.StringVar(&o.hopTarget, "hop-target", defaultHopTarget, "public address to trace the first hops towards for --double-nat")
+	fs.IntVar(&o.m.MaxHops, "max-hops", defaultMaxHops, "hops to trace for --double-nat")
+	fs.StringVar(&o.m.HairpinStunServer, "hairpin-stun-server", defaultStunServers, "STUN server to learn the external address from for --hairpin")
+	fs.BoolVar(&o.m.EnableEch, "ech", false, "use Encrypted ClientHello with servers that publish ECH configs in DNS")
+	fs.StringVar(&o.record, "record", "", "record what the measurement learns from the network to this file")
+	fs.StringVar(&o.replay, "replay", "", "replay a measurement recorded with --record, without the network")
+	fs.StringVar(&o.icmpTarget, "icmp-monitor", "", "monitor the uplink latency by pinging this IPv4 address whilst measuring")
+	fs.StringVar(&o.debugListen, "debug-listen", "", "serve pprof profiles and scheduler counters with expvar on this address, like 127.0.0.1:6060")
+	fs.StringVar(&o.statusSocket, "status-socket", "", "list the local and remote address of each open connection to clients of this unix socket")
+	fs.StringVar(&o.m.OtlpEndpoint, "otlp-endpoint", "", "export spans of requests and scheduler decisions to this OTLP/HTTP collector, like http://localhost:4318")
+	fs.Float64Var(&o.dialFailures, "inject-dial-failures", 0, "for testing, fail this percentage of dials")
+	fs.Float64Var(&o.responseFailures, "inject-response-failures", 0, "for testing, fail this percentage of responses")
+	fs.DurationVar(&o.m.Faults.Latency, "inject-latency", 0, "for testing, add this latency to every request")
+	fs.BoolVar(&o.m.Hold, "hold", false, "keep the connections alive after printing the result, until Enter is pressed")
+	fs.DurationVar(&o.holdTimeout, "hold-timeout", 10*time.Minute, "release connections held with --hold after this long")
+	fs.BoolVar(&o.requirePrivileged, "require-privileged-features", false, "fail instead of disabling features that lack the privileges they need")
+	return o
+}
+
+// measureCommand measures the NAT once, or repeatedly when run as the
+// server command.
+func measureCommand(name string, args []string) {
+	o := newMeasureFlags(name)
+	parseCommandArgs(o.fs, args, "[url-file]", 1, true)
+	m := &o.m
+	verbosity := 0
+	if o.veryVerbose {
+		verbosity = 2
+	} else if o.verbose {
+		verbosity = 1
+	}
+	m.Logger = newLogger(os.Stderr, verbosity)
+	slog.SetDefault(m.Logger)
+	m.Alpn = parseAlpn(o.alpn)
+	m.Faults.DialFailureRate = o.dialFailures / 100
+	m.Faults.ResponseFailureRate = o.responseFailures / 100
+	m.Socket.Nagle = !o.tcpNoDelay
+	if o.captureHeaders != "" {
+		m.CaptureHeaders = parseHeaderNames(o.captureHeaders)
+	}
+	if o.caFile != "" {
+		pool, err := loadRootCAs(o.caFile)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		m.RootCAs = pool
+	}
+	if o.clientKey != "" && o.clientCert == "" {
+		fmt.Println("A client key is only used with a client certificate")
 		os.Exit(1)
 	}
+	if o.clientCert != "" {
+		cert, err := loadClientCertificate(o.clientCert, o.clientKey)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		m.ClientCerts.Default = cert
+	}
+	if o.clientCertHosts != "" {
+		certs, err := parseClientCertHosts(o.clientCertHosts)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		m.ClientCerts.Hosts = certs
+	}
+	if o.dnsSearch != "" {
+		m.Dns.SearchDomains = parseSearchDomains(o.dnsSearch)
+	}
+	if o.dnsRoutes != "" {
+		routes, err := parseDnsRoutes(o.dnsRoutes)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		m.Dns.Resolvers = routes
+	}
 
-	nConns := MeasureMaxConnections(urls)
-	fmt.Println("Max connections are", nConns)
+	if _, err := newStrategy(m); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	keepAlive, err := namedKeepAlive(o.keepAlive)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	m.KeepAlive = keepAlive
+	if o.overrides != "" {
+		overrides, err := loadOverrides(o.overrides)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		m.Overrides = overrides
+	}
+	if o.policy != "" {
+		policy, err := loadPolicy(o.policy)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		policy.merge(m.Policy)
+		m.Policy = policy
+	}
+	if err := m.Policy.validate(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	var sweepIntervals []time.Duration
+	if o.sweep != "" {
+		var err error
+		sweepIntervals, err = parseDurations(o.sweep)
+		if err != nil {
+			fmt.Printf("Invalid keep-alive intervals to sweep %q: %v\n", o.sweep, err)
+			os.Exit(1)
+		}
+		if o.listen != "" || m.Hold {
+			fmt.Println("Sweeps cannot be run as a daemon or hold connections")
+			os.Exit(1)
+		}
+		if o.reportFormat != "text" && o.reportFormat != "json" {
+			fmt.Println("Sweeps can only be reported as text or json")
+			os.Exit(1)
+		}
+	}
+	if o.schedule != "" {
+		stages, err := parseSchedule(o.schedule)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		explicit := false
+		o.fs.Visit(func(f *flag.Flag) { explicit = explicit || f.Name == "strategy" })
+		if explicit && m.Strategy != "schedule" {
+			fmt.Println("A schedule is only followed by the schedule strategy")
+			os.Exit(1)
+		}
+		m.Strategy = "schedule"
+		m.Schedule = stages
+	}
+	var targets []Target
+	if o.input != "" && o.fs.NArg() > 0 {
+		fmt.Println("Give the url file either as an argument or with --input, not both")
+		os.Exit(1)
+	}
+	if o.singleTarget != "" {
+		var err error
+		targets, err = parseSingleTarget(o.singleTarget)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if len(sweepIntervals) > 0 || o.interfaces != "" || o.record != "" || o.replay != "" {
+			fmt.Println("A single target cannot be swept, measured over several interfaces, recorded or replayed")
+			os.Exit(1)
+		}
+	}
+	ifaces := parseInterfaces(o.interfaces)
+	if len(ifaces) == 1 {
+		m.Interface = ifaces[0]
+	} else if len(ifaces) > 1 {
+		if len(sweepIntervals) > 0 || o.listen != "" || m.Hold {
+			fmt.Println("Several interfaces cannot be swept, run as a daemon or hold connections")
+			os.Exit(1)
+		}
+		if o.record != "" || o.replay != "" {
+			fmt.Println("Several interfaces cannot be recorded or replayed")
+			os.Exit(1)
+		}
+		if o.reportFormat != "text" && o.reportFormat != "json" {
+			fmt.Println("Several interfaces can only be reported as text or json")
+			os.Exit(1)
+		}
+	}
+	compareIfaces := parseInterfaces(o.compareIfaces)
+	if o.compareIfaces != "" {
+		if len(compareIfaces) < 2 || o.compareRounds < 1 {
+			fmt.Println("Comparing paths needs at least two interfaces and one round")
+			os.Exit(1)
+		}
+		if len(sweepIntervals) > 0 || len(ifaces) > 0 || targets != nil || o.listen != "" || m.Hold {
+			fmt.Println("Paths cannot be compared when swept, measured over --interfaces or a single target, run as a daemon or holding connections")
+			os.Exit(1)
+		}
+		if o.record != "" || o.replay != "" {
+			fmt.Println("Paths cannot be compared when recorded or replayed")
+			os.Exit(1)
+		}
+		if o.reportFormat != "text" && o.reportFormat != "json" {
+			fmt.Println("Compared paths can only be reported as text or json")
+			os.Exit(1)
+		}
+	}
+	if m.TuneKeepAlive {
+		if len(sweepIntervals) > 0 {
+			fmt.Println("The keep-alive interval cannot be both tuned and swept")
+			os.Exit(1)
+		}
+		// Start from a long interval, unless told where to start
+		explicit := false
+		o.fs.Visit(func(f *flag.Flag) { explicit = explicit || f.Name == "keep-alive-interval" })
+		if !explicit {
+			m.KeepAliveInterval = 0
+		}
+	}
+	if m.Ipv6 && m.CompareDualStack {
+		fmt.Println("The dual-stack report compares with IPv4 measurements, not --ipv6")
+		os.Exit(1)
+	}
+	if m.Ipv6 && m.CheckHairpin {
+		fmt.Println("Hairpinning is only checked over IPv4, not --ipv6")
+		os.Exit(1)
+	}
+	if m.Ipv6 && m.CheckMappingProtocols {
+		fmt.Println("PCP and NAT-PMP are only asked over IPv4, not --ipv6")
+		os.Exit(1)
+	}
+	if m.Hold && o.listen != "" {
+		fmt.Println("Connections cannot be held when running as a daemon")
+		os.Exit(1)
+	}
+	if err := checkRobotsFailurePolicy(m.RobotsFailurePolicy); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if err := checkServerErrorPolicy(m.ServerErrorPolicy); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if err := checkCountAfter(m.CountAfter); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if err := m.Socket.check(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if _, found := reportFormats[o.reportFormat]; !found && o.reportFormat != "text" {
+		fmt.Printf("Unsupported report format %q\n", o.reportFormat)
+		os.Exit(1)
+	}
+
+	notices := []string{}
+	var icmpAddr netip.Addr
+	if o.icmpTarget != "" {
+		var err error
+		icmpAddr, err = netip.ParseAddr(o.icmpTarget)
+		if err != nil || !icmpAddr.Is4() {
+			fmt.Printf("Invalid ICMP monitor address %q\n", o.icmpTarget)
+			os.Exit(1)
+		}
+
+		// Check up-front so the user finds out before measuring
+		conn, err := listenIcmp()
+		if err != nil && o.requirePrivileged {
+			slog.Error("ICMP monitoring is unavailable", "err", err)
+			os.Exit(1)
+		}
+		if err != nil {
+			notices = append(notices, degradedNotice("ICMP monitoring", err))
+			icmpAddr = netip.Addr{}
+		} else {
+			conn.Close()
+		}
+	}
+
+	if m.DetectDoubleNat {
+		var err error
+		m.HopTarget, err = netip.ParseAddr(o.hopTarget)
+		if err != nil || !m.HopTarget.Is4() || m.MaxHops < 1 {
+			fmt.Printf("Invalid hop target %q or max hops %d\n", o.hopTarget, m.MaxHops)
+			os.Exit(1)
+		}
+
+		// Check up-front so the user finds out before measuring
+		conn, err := listenRawIcmp()
+		if err != nil && o.requirePrivileged {
+			slog.Error("Double NAT detection is unavailable", "err", err)
+			os.Exit(1)
+		}
+		if err != nil {
+			notices = append(notices, degradedNotice("Double NAT detection", err))
+			m.DetectDoubleNat = false
+		} else {
+			conn.Close()
+		}
+	}
+
+	eventHandlers := []func(Event){}
+	var sysLogger systemLogger
+	if o.systemLog != "" {
+		var err error
+		sysLogger, err = openSystemLogger(o.systemLog)
+		if err != nil {
+			slog.Error("Failed to open system log", "err", err)
+			os.Exit(1)
+		}
+		defer sysLogger.Close()
+		eventHandlers = append(eventHandlers, systemLogWarner(sysLogger))
+	}
+
+	if o.events != "" {
+		if o.events != "ndjson" {
+			fmt.Printf("Unsupported events format %q\n", o.events)
+			os.Exit(1)
+		}
+
+		w := os.Stdout
+		if o.eventsFile != "" {
+			f, err := os.Create(o.eventsFile)
+			if err != nil {
+				slog.Error("Failed to create events file", "err", err)
+				os.Exit(1)
+			}
+			defer f.Close()
+			w = f
+		}
+		eventHandlers = append(eventHandlers, ndjsonEventWriter(w))
+	}
+	if o.statsSinkTarget != "" {
+		sink, err := openStatsSink(o.statsSinkTarget)
+		if err != nil {
+			slog.Error("Failed to open stats sink", "err", err)
+			os.Exit(1)
+		}
+		sink.start(o.statsInterval)
+		defer sink.close()
+		eventHandlers = append(eventHandlers, sink.onEvent)
+	}
+	if o.crawlDb != "" {
+		m.crawlDb, err = openCrawlDb(o.crawlDb)
+		if err != nil {
+			slog.Error("Failed to open database", "err", err)
+			os.Exit(1)
+		}
+		defer m.crawlDb.Close()
+	}
+	var store ResultStore
+	if o.resultStore != "" {
+		store, err = openResultStore(o.resultStore)
+		if err != nil {
+			slog.Error("Failed to open result store", "err", err)
+			os.Exit(1)
+		}
+		defer store.Close()
+	}
+	var notifier *exhaustionNotifier
+	if o.notifyUrl != "" && o.notifyExhaustion {
+		notifier = newExhaustionNotifier(o.notifyUrl)
+		eventHandlers = append(eventHandlers, notifier.onEvent)
+		defer notifier.wait()
+	}
+	if len(eventHandlers) > 0 {
+		m.OnEvent = multiEventHandler(eventHandlers...)
+	}
+	// Daemons are watched through their metrics instead
+	if m.ProgressInterval > 0 && o.listen == "" {
+		m.OnProgress = progressWriter(os.Stderr)
+	}
+
+	if o.statusSocket != "" {
+		m.openConns = &openConns{}
+		l, err := serveStatusSocket(o.statusSocket, m.openConns)
+		if err != nil {
+			slog.Error("Failed to serve status", "err", err)
+			os.Exit(1)
+		}
+		defer l.Close()
+	}
+
+	if o.debugListen != "" {
+		m.publishVars = true
+		l, err := serveDebug(o.debugListen)
+		if err != nil {
+			slog.Error("Failed to serve debug endpoints", "err", err)
+			os.Exit(1)
+		}
+		defer l.Close()
+	}
+
+	var urls []*url.URL
+	if o.replay != "" {
+		urls, err = startReplay(m, o.replay)
+		if err != nil {
+			slog.Error("Failed to replay", "trace", o.replay, "err", err)
+			os.Exit(1)
+		}
+	} else if targets == nil {
+		urls, m.Pins, err = readUrlFile(cmp.Or(o.input, o.fs.Arg(0)))
+		if err != nil {
+			slog.Error("Failed to read urls", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	nSeeds := len(urls) + len(targets)
+	printEstimate(os.Stderr, nSeeds, estimateRun(m, nSeeds))
+	// Replays do not touch the network, so cost nothing, and servers run
+	// unattended without a terminal to ask on
+	if !o.yes && o.replay == "" && name != "server" {
+		ok, err := confirm("Start the measurement?")
+		if err != nil {
+			slog.Error("Failed to confirm the measurement, use --yes to skip", "err", err)
+			os.Exit(1)
+		}
+		if !ok {
+			os.Exit(1)
+		}
+	}
+
+	measure := func(ctx context.Context) (*Result, error) {
+		m.ctx = ctx
+		runNotices := notices
+		var mon *icmpMonitor
+		if icmpAddr.IsValid() {
+			var err error
+			mon, err = startIcmpMonitor(icmpAddr)
+			if err != nil {
+				runNotices = append(runNotices, degradedNotice("ICMP monitoring", err))
+			}
+		}
+
+		var rec *recordingNetwork
+		if o.record != "" {
+			rec = newRecordingNetwork(liveNetwork{ech: m.EnableEch, ipv6: m.Ipv6, dns: &m.Dns}, urls)
+			m.network = rec
+		}
+
+		var r *Result
+		var err error
+		if targets != nil {
+			r, err = m.MeasureTargets(targets)
+		} else {
+			r, err = m.Measure(urls)
+		}
+		var uplinkRtt *RttSummary
+		if mon != nil {
+			uplinkRtt = mon.close()
+		}
+		if err != nil {
+			return nil, err
+		}
+		if targets != nil {
+			r.Destination = targets[0].AddrPort.Addr().String()
+		}
+		if rec != nil {
+			err := writeTrace(rec, o.record)
+			if err != nil {
+				return nil, fmt.Errorf("failed to record trace: %w", err)
+			}
+		}
+		if mon != nil {
+			r.UplinkRtt = uplinkRtt
+			r.Warnings = append(r.Warnings, uplinkWarnings(r.UplinkRtt)...)
+		}
+		r.Notices = append(r.Notices, runNotices...)
+		return r, nil
+	}
+
+	report := func(r *Result) error {
+		w := os.Stdout
+		if o.reportFile != "" {
+			f, err := os.Create(o.reportFile)
+			if err != nil {
+				return fmt.Errorf("failed to create report file: %w", err)
+			}
+			defer f.Close()
+			w = f
+		}
+		if o.reportFormat == "text" {
+			printSummary(w, m, r)
+		} else if err := writeReport(w, o.reportFormat, r); err != nil {
+			return fmt.Errorf("failed to write report: %w", err)
+		}
+
+		if sysLogger != nil {
+			err := logResult(sysLogger, r)
+			if err != nil {
+				slog.Error("Failed to log result", "log", o.systemLog, "err", err)
+			}
+		}
+		if notifier != nil {
+			notifier.wait()
+		}
+		if o.notifyUrl != "" {
+			err := notifyResult(o.notifyUrl, r)
+			if err != nil {
+				return fmt.Errorf("failed to notify %v: %w", o.notifyUrl, err)
+			}
+		}
+		if store != nil {
+			err := store.Save(StoredResult{Finished: time.Now(), Result: r})
+			if err != nil {
+				return fmt.Errorf("failed to store result: %w", err)
+			}
+		}
+		return nil
+	}
+
+	// exit fails once measuring has started, waiting first for the
+	// exhaustion alerts being posted, which os.Exit would lose
+	exit := func() {
+		if notifier != nil {
+			notifier.wait()
+		}
+		os.Exit(1)
+	}
+
+	if len(ifaces) > 1 {
+		ir, err := measureInterfaces(m, urls, ifaces)
+		if err != nil {
+			slog.Error("Failed to measure", "err", err)
+			exit()
+		}
+
+		w := os.Stdout
+		if o.reportFile != "" {
+			f, err := os.Create(o.reportFile)
+			if err != nil {
+				slog.Error("Failed to create report file", "err", err)
+				exit()
+			}
+			defer f.Close()
+			w = f
+		}
+		err = writeInterfaces(w, o.reportFormat, m, ir)
+		if err != nil {
+			slog.Error("Failed to report", "err", err)
+			exit()
+		}
+		return
+	}
+
+	if len(compareIfaces) > 1 {
+		c, err := comparePaths(compareIfaces, o.compareRounds, o.comparePause, func(iface string) (*Result, error) {
+			im := *m
+			im.Interface = iface
+			return im.Measure(urls)
+		})
+		if err != nil {
+			slog.Error("Failed to compare paths", "err", err)
+			exit()
+		}
+
+		w := os.Stdout
+		if o.reportFile != "" {
+			f, err := os.Create(o.reportFile)
+			if err != nil {
+				slog.Error("Failed to create report file", "err", err)
+				exit()
+			}
+			defer f.Close()
+			w = f
+		}
+		err = writePathComparison(w, o.reportFormat, c)
+		if err != nil {
+			slog.Error("Failed to report", "err", err)
+			exit()
+		}
+		return
+	}
+
+	if len(sweepIntervals) > 0 {
+		points, err := sweepKeepAlive(m, urls, sweepIntervals, o.sweepPause)
+		if err != nil {
+			slog.Error("Failed to sweep", "err", err)
+			exit()
+		}
+
+		w := os.Stdout
+		if o.reportFile != "" {
+			f, err := os.Create(o.reportFile)
+			if err != nil {
+				slog.Error("Failed to create report file", "err", err)
+				exit()
+			}
+			defer f.Close()
+			w = f
+		}
+		err = writeSweep(w, o.reportFormat, points)
+		if err != nil {
+			slog.Error("Failed to report", "err", err)
+			exit()
+		}
+		return
+	}
+
+	if o.listen != "" {
+		d := daemon{
+			measure:  measure,
+			interval: o.interval,
+			variance: varianceCheck{threshold: o.varianceThreshold, runs: o.confirmationRuns, pause: o.confirmationPause},
+			onResult: func(r *Result) {
+				err := report(r)
+				if err != nil {
+					slog.Error("Failed to report", "err", err)
+				}
+			},
+		}
+		err := runDaemon(o.listen, &d)
+		if err != nil {
+			slog.Error("Daemon failed", "err", err)
+			exit()
+		}
+		return
+	}
+
+	r, err := measure(context.Background())
+	if err != nil {
+		slog.Error("Failed to measure", "err", err)
+		exit()
+	}
+	err = report(r)
+	if err != nil {
+		slog.Error("Failed to report", "err", err)
+		exit()
+	}
+
+	if m.Hold {
+		release, err := releaseOnEnter(o.holdTimeout)
+		if err != nil {
+			slog.Error("Failed to hold connections", "err", err)
+			exit()
+		}
+		fmt.Fprintf(os.Stderr, "Holding %d connections open for up to %v, press Enter to release them\n", r.MaxConnections, o.holdTimeout)
+		alive := m.KeepAliveHeld(release)
+		fmt.Fprintf(os.Stderr, "Released %d of %d held connections\n", alive, r.MaxConnections)
+	}
 }
@@ -0,0 +1,123 @@
+// Functions related to resolving .local hostnames with multicast DNS, for
+// labs measuring the NAT between the segments of a home network.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// Longest to wait for a responder, as absent hosts never answer
+	mdnsTimeout = 2 * time.Second
+	mdnsGroup4  = "224.0.0.251:5353"
+	mdnsGroup6  = "[ff02::fb]:5353"
+)
+
+var errNoMdnsResponder = errors.New("no mDNS responder answered")
+
+// isMdnsHost reports whether host is resolved with multicast DNS.
+func (d *DnsConfig) isMdnsHost(host string) bool {
+	if d == nil || !d.Mdns {
+		return false
+	}
+	return strings.HasSuffix(strings.ToLower(strings.TrimSuffix(host, ".")), ".local")
+}
+
+// mdnsGroup is the multicast group queried for the addresses of network.
+func mdnsGroup(network string) string {
+	if network == "ip6" {
+		return mdnsGroup6
+	}
+	return mdnsGroup4
+}
+
+// lookupMdns asks group for the addresses of host with a one-shot query,
+// RFC 6762 section 5.1, so responders answer the port queried from.
+func lookupMdns(ctx context.Context, group, network, host string) ([]netip.Addr, error) {
+	name, err := dnsmessage.NewName(strings.TrimSuffix(host, ".") + ".")
+	if err != nil {
+		return nil, fmt.Errorf("failed to make dns name: %w", err)
+	}
+	qType := dnsmessage.TypeA
+	if network == "ip6" {
+		qType = dnsmessage.TypeAAAA
+	}
+
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{})
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{Name: name, Type: qType, Class: dnsmessage.ClassINET})
+	query, err := b.Finish()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build mDNS query: %w", err)
+	}
+
+	groupAddr, err := net.ResolveUDPAddr("udp", group)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse mDNS group: %w", err)
+	}
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for mDNS responses: %w", err)
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(mdnsTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+	// Unblock the read once the measurement is cancelled
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	_, err = conn.WriteTo(query, groupAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send mDNS query: %w", err)
+	}
+
+	buf := make([]byte, 9000)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, errNoMdnsResponder
+		}
+
+		var p dnsmessage.Parser
+		h, err := p.Start(buf[:n])
+		if err != nil || !h.Response {
+			continue
+		}
+		p.SkipAllQuestions()
+		answers, err := p.AllAnswers()
+		if err != nil {
+			continue
+		}
+		addrs := []netip.Addr{}
+		for _, a := range answers {
+			if !strings.EqualFold(a.Header.Name.String(), name.String()) {
+				continue
+			}
+			switch r := a.Body.(type) {
+			case *dnsmessage.AResource:
+				if qType == dnsmessage.TypeA {
+					addrs = append(addrs, netip.AddrFrom4(r.A))
+				}
+			case *dnsmessage.AAAAResource:
+				if qType == dnsmessage.TypeAAAA {
+					addrs = append(addrs, netip.AddrFrom16(r.AAAA))
+				}
+			}
+		}
+		// Responses for other hosts may share the port
+		if len(addrs) > 0 {
+			return addrs, nil
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestIsMdnsHost(t *testing.T) {
+	testcases := map[string]struct {
+		inDns  *DnsConfig
+		inHost string
+		expect bool
+	}{
+		"Local":        {inDns: &DnsConfig{Mdns: true}, inHost: "nas.local", expect: true},
+		"Root dot":     {inDns: &DnsConfig{Mdns: true}, inHost: "NAS.Local.", expect: true},
+		"Not local":    {inDns: &DnsConfig{Mdns: true}, inHost: "nas.lab.example"},
+		"Disabled":     {inDns: &DnsConfig{}, inHost: "nas.local"},
+		"No config":    {inHost: "nas.local"},
+		"Local suffix": {inDns: &DnsConfig{Mdns: true}, inHost: "nas.notlocal"},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			if got := tc.inDns.isMdnsHost(tc.inHost); got != tc.expect {
+				t.Errorf("expected %v, got %v", tc.expect, got)
+			}
+		})
+	}
+}
+
+// serveMdns answers queries for nas.local. with addr as a responder
+// would, after an answer for another host sharing the port.
+func serveMdns(t *testing.T, addr netip.Addr) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Failed to listen: ", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var p dnsmessage.Parser
+			if _, err := p.Start(buf[:n]); err != nil {
+				continue
+			}
+			q, err := p.Question()
+			if err != nil || q.Name.String() != "nas.local." {
+				continue
+			}
+
+			for _, name := range []string{"printer.local.", "nas.local."} {
+				b := dnsmessage.NewBuilder(nil, dnsmessage.Header{Response: true, Authoritative: true})
+				b.StartAnswers()
+				// Responders set the cache-flush bit of the class
+				b.AResource(
+					dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET | 0x8000, TTL: 120},
+					dnsmessage.AResource{A: addr.As4()},
+				)
+				reply, err := b.Finish()
+				if err != nil {
+					continue
+				}
+				conn.WriteTo(reply, from)
+			}
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestLookupMdns(t *testing.T) {
+	want := netip.MustParseAddr("192.168.2.20")
+	group := serveMdns(t, want)
+
+	addrs, err := lookupMdns(context.Background(), group, "ip4", "nas.local")
+	if err != nil {
+		t.Fatal("Failed to lookup: ", err)
+	}
+	if len(addrs) != 1 || addrs[0] != want {
+		t.Errorf("expected addresses [%v], got %v", want, addrs)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = lookupMdns(ctx, group, "ip4", "absent.local")
+	if !errors.Is(err, errNoMdnsResponder) {
+		t.Errorf("expected no responder to answer, got %v", err)
+	}
+	if waited := time.Since(start); waited > time.Second {
+		t.Errorf("expected the lookup to stop with its context, waited %v", waited)
+	}
+}
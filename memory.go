@@ -0,0 +1,99 @@
+// Functions related to keeping a measurement within a memory budget, so
+// probes with little memory, like routers and Raspberry Pis, shed the
+// urls least likely to be needed instead of running out of memory.
+package main
+
+import (
+	"maps"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"time"
+)
+
+const (
+	// Time between reading the heap size, which stops the world
+	memoryCheckInterval = time.Second
+	// Uncrawled urls each connection keeps when shedding, enough to
+	// keep it alive with real requests
+	shedUncrawledKeep = 4
+)
+
+// heapInUse is the bytes of allocated heap objects.
+func heapInUse() uint64 {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return ms.HeapAlloc
+}
+
+// checkMemory sheds memory when the heap is over the budget, checking at
+// most every memoryCheckInterval.
+func (s *scheduler) checkMemory() {
+	if s.m.memoryBudget() == 0 || time.Since(s.memoryChecked) < memoryCheckInterval {
+		return
+	}
+	s.memoryChecked = time.Now()
+	if heapInUse() <= s.m.memoryBudget() {
+		return
+	}
+	s.shedMemory()
+}
+
+// trimUncrawledUrls drops all but keep of the uncrawled urls of a
+// connection, keeping robots.txt and the urls robots.txt allows first.
+// Returns the number of urls dropped.
+func trimUncrawledUrls(c *connection, keep int) int {
+	if len(c.uncrawledUrls) <= keep {
+		return 0
+	}
+
+	robots := pathToRelativeUrl("/robots.txt")
+	kept := map[relativeUrl]bool{}
+	if c.uncrawledUrls[robots] {
+		kept[robots] = true
+	}
+	for _, allowed := range []bool{true, false} {
+		for r := range c.uncrawledUrls {
+			if len(kept) == keep {
+				break
+			}
+			if c.robots.pathAllowed(r.getRawPath()) == allowed {
+				kept[r] = true
+			}
+		}
+	}
+	shed := len(c.uncrawledUrls) - len(kept)
+	c.uncrawledUrls = kept
+	return shed
+}
+
+// shedMemory drops the least useful urls first, compacting what is left,
+// then the hosts furthest from being connected to if that was not enough.
+func (s *scheduler) shedMemory() {
+	shed := 0
+	for _, c := range slices.Concat(s.pendingConns, s.activeConns) {
+		shed += trimUncrawledUrls(c, shedUncrawledKeep)
+		// Maps never shrink, copies are only as large as needed
+		c.crawledUrls = maps.Clone(c.crawledUrls)
+	}
+	// Closed and failed connections are only kept so their hosts are not
+	// connected to again
+	for _, c := range slices.Concat(s.failedConns, s.closedConns) {
+		shed += len(c.uncrawledUrls)
+		c.uncrawledUrls, c.crawlingUrls, c.crawledUrls = nil, nil, nil
+		c.bodyHashes, c.trapPatterns, c.queryVariants = nil, nil, nil
+		if c.client != nil {
+			c.client.CloseIdleConnections()
+			c.client = nil
+		}
+	}
+	debug.FreeOSMemory()
+
+	if heapInUse() > s.m.memoryBudget() {
+		shed += s.pendingResolutions.halve()
+		debug.FreeOSMemory()
+	}
+
+	s.memorySheds++
+	s.shedUrls += shed
+}
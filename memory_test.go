@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestTrimUncrawledUrls(t *testing.T) {
+	c := &connection{uncrawledUrls: map[relativeUrl]bool{}}
+	for _, p := range []string{"/robots.txt", "/a", "/b", "/c", "/private/d", "/private/e"} {
+		c.uncrawledUrls[pathToRelativeUrl(p)] = true
+	}
+	c.robots = RobotsTxt{ruleDisallow: {"/private/"}}
+
+	shed := trimUncrawledUrls(c, 4)
+	if shed != 2 || len(c.uncrawledUrls) != 4 {
+		t.Fatalf("expected 2 urls to be shed leaving 4, got %d leaving %d", shed, len(c.uncrawledUrls))
+	}
+	if !c.uncrawledUrls[pathToRelativeUrl("/robots.txt")] {
+		t.Error("expected robots.txt to be kept")
+	}
+	for r := range c.uncrawledUrls {
+		if !c.robots.pathAllowed(r.getRawPath()) {
+			t.Errorf("expected disallowed url %v to be shed first", r)
+		}
+	}
+}
+
+func TestMemoryBudget(t *testing.T) {
+	n := &benchNetwork{hosts: 200, fanout: 4, seeds: 10}
+	// Always over budget, so sheds on the first check
+	m := Measurer{network: n, MemoryBudget: 1}
+	r, err := m.Measure(n.seedUrls())
+	if err != nil {
+		t.Fatal("Failed to measure: ", err)
+	}
+	if r.MemorySheds == 0 || r.ShedUrls == 0 {
+		t.Errorf("expected urls to be shed, got %d sheds of %d urls", r.MemorySheds, r.ShedUrls)
+	}
+	if r.MaxConnections == 0 {
+		t.Error("expected to still measure connections")
+	}
+}
@@ -0,0 +1,95 @@
+// Functions related to notifying webhooks of measurement results.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const notifyTimeout = 10 * time.Second
+
+// notification is posted to webhooks. The text field lets chat webhooks,
+// like Slack's, display the notification without any adapters.
+type notification struct {
+	Text   string  `json:"text"`
+	Result *Result `json:"result,omitempty"`
+	Event  *Event  `json:"event,omitempty"`
+}
+
+func postNotification(target string, n *notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return fmt.Errorf("failed to encode notification: %w", err)
+	}
+
+	client := http.Client{Timeout: notifyTimeout}
+	resp, err := client.Post(target, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to post notification: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook replied with %v", resp.Status)
+	}
+	return nil
+}
+
+func notifyResult(target string, r *Result) error {
+	n := notification{
+		Text:   fmt.Sprintf("natck measured %d max connections", r.MaxConnections),
+		Result: r,
+	}
+	return postNotification(target, &n)
+}
+
+// exhaustionNotifier posts to the webhook as soon as the NAT is
+// suspected to have run out of connections.
+type exhaustionNotifier struct {
+	target string
+	posts  sync.WaitGroup
+}
+
+func newExhaustionNotifier(target string) *exhaustionNotifier {
+	return &exhaustionNotifier{target: target}
+}
+
+// onEvent posts the alert without holding up the measurement.
+func (en *exhaustionNotifier) onEvent(e Event) {
+	if e.Type != EventExhaustionSuspected {
+		return
+	}
+
+	n := notification{
+		Text:  fmt.Sprintf("natck suspects NAT exhaustion at %d connections", e.ActiveConnections),
+		Event: &e,
+	}
+	en.posts.Add(1)
+	go func() {
+		defer en.posts.Done()
+		err := postNotification(en.target, &n)
+		if err != nil {
+			slog.Error("Failed to notify exhaustion", "webhook", en.target, "err", err)
+		}
+	}()
+}
+
+// wait waits up to notifyTimeout for the alerts being posted, so they
+// are not lost when natck exits, and precede the result notification.
+func (en *exhaustionNotifier) wait() {
+	posted := make(chan struct{})
+	go func() {
+		en.posts.Wait()
+		close(posted)
+	}()
+	select {
+	case <-posted:
+	case <-time.After(notifyTimeout):
+		slog.Warn("Gave up waiting for exhaustion notifications", "timeout", notifyTimeout)
+	}
+}
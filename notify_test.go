@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNotifyResult(t *testing.T) {
+	received := make(chan notification, 1)
+	srv := &httpTestServer{
+		name: "webhook",
+		handlers: HandlerChain{
+			func(res http.ResponseWriter, req *http.Request) bool {
+				n := notification{}
+				err := json.NewDecoder(req.Body).Decode(&n)
+				if err != nil {
+					t.Error("Failed to decode notification: ", err)
+				}
+				received <- n
+				return false
+			},
+		},
+	}
+	startHttpServer(t, srv)
+
+	r := Result{MaxConnections: 42}
+	err := notifyResult(srv.tUrl(t, "hook").String(), &r)
+	if err != nil {
+		t.Fatal("Failed to notify: ", err)
+	}
+
+	n := <-received
+	if n.Result == nil || n.Result.MaxConnections != r.MaxConnections {
+		t.Errorf("expected notification of %v connections, got %v", r.MaxConnections, n.Result)
+	}
+	if n.Text == "" {
+		t.Error("expected notification to have text")
+	}
+}
+
+func TestExhaustionNotifier(t *testing.T) {
+	var received atomic.Int32
+	srv := &httpTestServer{
+		name: "webhook",
+		handlers: HandlerChain{
+			func(res http.ResponseWriter, req *http.Request) bool {
+				// Slower than the measurement finishing
+				time.Sleep(100 * time.Millisecond)
+				n := notification{}
+				err := json.NewDecoder(req.Body).Decode(&n)
+				if err != nil || n.Event == nil || n.Event.Type != EventExhaustionSuspected {
+					t.Error("expected an exhaustion notification, got ", n.Event, err)
+				}
+				received.Add(1)
+				return false
+			},
+		},
+	}
+	startHttpServer(t, srv)
+
+	en := newExhaustionNotifier(srv.tUrl(t, "hook").String())
+	en.onEvent(Event{Type: EventConnectionEstablished})
+	en.onEvent(Event{Type: EventExhaustionSuspected, ActiveConnections: 42})
+	en.onEvent(Event{Type: EventExhaustionSuspected, ActiveConnections: 43})
+	en.wait()
+	if n := received.Load(); n != 2 {
+		t.Errorf("expected 2 exhaustion notifications posted before waiting returned, got %d", n)
+	}
+}
@@ -0,0 +1,238 @@
+// Functions related to exporting spans of requests and scheduler decisions
+// to OpenTelemetry collectors, encoded as OTLP/HTTP JSON.
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	otlpExportInterval = 5 * time.Second
+	otlpTimeout        = 10 * time.Second
+	// OTLP span status codes
+	otlpStatusOk    = 1
+	otlpStatusError = 2
+	// OTLP span kinds
+	otlpKindInternal = 1
+	otlpKindClient   = 3
+)
+
+type otlpAttribute struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	// Int64 are encoded as strings in OTLP JSON
+	IntValue *string `json:"intValue,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceId           string          `json:"traceId"`
+	SpanId            string          `json:"spanId"`
+	ParentSpanId      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+// otlpTracer batches the spans of one measurement, exporting them every
+// otlpExportInterval. A nil tracer drops all spans.
+type otlpTracer struct {
+	endpoint string
+	traceId  string
+	root     otlpSpan
+
+	m     sync.Mutex
+	spans []otlpSpan
+	err   error
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func otlpString(k, v string) otlpAttribute {
+	return otlpAttribute{Key: k, Value: otlpAnyValue{StringValue: &v}}
+}
+
+func otlpInt(k string, v int) otlpAttribute {
+	s := strconv.Itoa(v)
+	return otlpAttribute{Key: k, Value: otlpAnyValue{IntValue: &s}}
+}
+
+func otlpTime(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// startOtlpTracer starts a trace for a measurement, exporting to the
+// OTLP/HTTP collector at endpoint, like http://localhost:4318.
+func startOtlpTracer(endpoint string) *otlpTracer {
+	t := &otlpTracer{
+		endpoint: strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		traceId:  randomHex(16),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	t.root = otlpSpan{
+		TraceId:           t.traceId,
+		SpanId:            randomHex(8),
+		Name:              "measure",
+		Kind:              otlpKindInternal,
+		StartTimeUnixNano: otlpTime(time.Now()),
+	}
+
+	go func() {
+		defer close(t.done)
+		ticker := time.NewTicker(otlpExportInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				t.export()
+			case <-t.stop:
+				return
+			}
+		}
+	}()
+	return t
+}
+
+func (t *otlpTracer) add(name string, kind int, start, end time.Time, err error, attrs ...otlpAttribute) {
+	if t == nil {
+		return
+	}
+
+	s := otlpSpan{
+		TraceId:           t.traceId,
+		SpanId:            randomHex(8),
+		ParentSpanId:      t.root.SpanId,
+		Name:              name,
+		Kind:              kind,
+		StartTimeUnixNano: otlpTime(start),
+		EndTimeUnixNano:   otlpTime(end),
+		Attributes:        attrs,
+		Status:            otlpStatus{Code: otlpStatusOk},
+	}
+	if err != nil {
+		s.Status = otlpStatus{Code: otlpStatusError, Message: err.Error()}
+	}
+
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.spans = append(t.spans, s)
+}
+
+func (t *otlpTracer) request(r *roundtrip) {
+	kind := "GET"
+	if r.ping {
+		kind = "PING"
+	}
+	t.add("request", otlpKindClient, r.requestTs, r.replyTs, r.err,
+		otlpString("http.request.method", kind),
+		otlpString("url.full", r.url.String()),
+		otlpString("server.address", r.host.hostPort),
+		otlpString("network.peer.address", r.host.ip.String()),
+		otlpInt("natck.connection.id", int(r.connId)),
+	)
+}
+
+func (t *otlpTracer) iteration(start time.Time, decision string, activeConns int) {
+	t.add("scheduler.iteration", otlpKindInternal, start, time.Now(), nil,
+		otlpString("natck.decision", decision),
+		otlpInt("natck.active_connections", activeConns),
+	)
+}
+
+func postOtlpSpans(endpoint string, spans []otlpSpan) error {
+	body := map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{
+				"attributes": []otlpAttribute{otlpString("service.name", "natck")},
+			},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]string{"name": "natck"},
+				"spans": spans,
+			}},
+		}},
+	}
+	b, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("failed to encode spans: %w", err)
+	}
+
+	client := http.Client{Timeout: otlpTimeout}
+	resp, err := client.Post(endpoint, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("failed to post spans: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("collector replied with %v", resp.Status)
+	}
+	return nil
+}
+
+func (t *otlpTracer) export() {
+	t.m.Lock()
+	spans := t.spans
+	t.spans = nil
+	t.m.Unlock()
+	if len(spans) == 0 {
+		return
+	}
+
+	err := postOtlpSpans(t.endpoint, spans)
+	if err != nil {
+		t.m.Lock()
+		t.err = err
+		t.m.Unlock()
+	}
+}
+
+// end finishes the trace, exporting the remaining spans. It returns the
+// last export error, if any.
+func (t *otlpTracer) end(activeConns int) error {
+	if t == nil {
+		return nil
+	}
+
+	close(t.stop)
+	<-t.done
+
+	t.root.EndTimeUnixNano = otlpTime(time.Now())
+	t.root.Attributes = []otlpAttribute{otlpInt("natck.max_connections", activeConns)}
+	t.root.Status = otlpStatus{Code: otlpStatusOk}
+	t.m.Lock()
+	t.spans = append(t.spans, t.root)
+	t.m.Unlock()
+	t.export()
+
+	t.m.Lock()
+	defer t.m.Unlock()
+	return t.err
+}
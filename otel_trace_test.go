@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+)
+
+func TestOtlpExport(t *testing.T) {
+	var m sync.Mutex
+	spans := map[string]int{}
+	traces := map[string]bool{}
+	collector := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/v1/traces" {
+			t.Errorf("expected spans to be posted to /v1/traces, got %v", req.URL.Path)
+		}
+		body := struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []otlpSpan
+				}
+			}
+		}{}
+		err := json.NewDecoder(req.Body).Decode(&body)
+		if err != nil {
+			t.Errorf("Failed to decode spans: %v", err)
+		}
+
+		m.Lock()
+		defer m.Unlock()
+		for _, rs := range body.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				for _, s := range ss.Spans {
+					spans[s.Name]++
+					traces[s.TraceId] = true
+				}
+			}
+		}
+	}))
+	defer collector.Close()
+
+	root := makeServerRoot(t, tPath("wildcard_robots.txt"), tPath("no_links.html"))
+	srv := &httpTestServer{
+		name:     "http",
+		handlers: HandlerChain{makeFileHandler(root)},
+	}
+	startHttpServer(t, srv)
+
+	measurer := Measurer{OtlpEndpoint: collector.URL}
+	r, err := measurer.Measure([]*url.URL{srv.tUrl(t, "index.html")})
+	if err != nil {
+		t.Fatal("Failed to measure: ", err)
+	}
+	if len(r.Notices) != 0 {
+		t.Errorf("expected every span to be exported, got %v", r.Notices)
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	if spans["measure"] != 1 {
+		t.Errorf("expected one measure span, got %d", spans["measure"])
+	}
+	if spans["request"] < 2 {
+		t.Errorf("expected request spans for robots.txt and index.html, got %d", spans["request"])
+	}
+	if spans["scheduler.iteration"] == 0 {
+		t.Error("expected scheduler iteration spans")
+	}
+	if len(traces) != 1 {
+		t.Errorf("expected spans of one trace, got %d", len(traces))
+	}
+}
@@ -0,0 +1,222 @@
+// Functions related to overriding how particular hosts are measured, like
+// "for *.example.com use HEAD keep-alives and a 10s crawl delay", from a
+// YAML file keyed by hostname or CIDR.
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// HostOverride changes how the hosts it matches are measured, the zero
+// value of each field changing nothing.
+type HostOverride struct {
+	// Hostname, *. wildcard of the subdomains of a domain, or CIDR of
+	// the addresses the override applies to
+	Match string `yaml:"-"`
+	// Scheme and port dialed instead of those of the url
+	Scheme string `yaml:"scheme"`
+	Port   int    `yaml:"port"`
+	// Sent with every request, replacing those natck sends
+	Headers map[string]string `yaml:"headers"`
+	// Name of the KeepAliver, like head
+	KeepAlive string `yaml:"keep_alive"`
+	// Least time between requests, raising any Crawl-delay of robots.txt
+	CrawlDelay time.Duration `yaml:"crawl_delay"`
+
+	prefix netip.Prefix
+}
+
+// matches reports whether the override applies to host or any of its
+// addresses.
+func (o *HostOverride) matches(host string, addrs []netip.AddrPort) bool {
+	if o.prefix.IsValid() {
+		for _, a := range addrs {
+			if o.prefix.Contains(a.Addr().Unmap()) {
+				return true
+			}
+		}
+		return false
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	pattern := strings.ToLower(strings.TrimSuffix(o.Match, "."))
+	if domain, found := strings.CutPrefix(pattern, "*."); found {
+		return strings.HasSuffix(host, "."+domain)
+	}
+	return host == pattern
+}
+
+// merge sets the fields set by other, taking precedence over o.
+func (o *HostOverride) merge(other *HostOverride) {
+	o.Scheme = cmp.Or(other.Scheme, o.Scheme)
+	o.Port = cmp.Or(other.Port, o.Port)
+	o.KeepAlive = cmp.Or(other.KeepAlive, o.KeepAlive)
+	o.CrawlDelay = cmp.Or(other.CrawlDelay, o.CrawlDelay)
+	for k, v := range other.Headers {
+		if o.Headers == nil {
+			o.Headers = map[string]string{}
+		}
+		o.Headers[k] = v
+	}
+}
+
+// hostOverride merges the overrides matching the resolved host, later
+// overrides taking precedence. Nil if none match.
+func hostOverride(overrides []HostOverride, h *resolvedUrl) *HostOverride {
+	var merged *HostOverride
+	for i := range overrides {
+		if !overrides[i].matches(h.url.Hostname(), h.addresses) {
+			continue
+		}
+		if merged == nil {
+			merged = &HostOverride{}
+		}
+		merged.merge(&overrides[i])
+	}
+	return merged
+}
+
+// rewrite is h with the scheme and port of the override.
+func (o *HostOverride) rewrite(h *resolvedUrl) *resolvedUrl {
+	if o.Scheme == "" && o.Port == 0 {
+		return h
+	}
+	u := *h.url
+	u.Scheme = cmp.Or(o.Scheme, u.Scheme)
+	if o.Port != 0 {
+		u.Host = net.JoinHostPort(u.Hostname(), strconv.Itoa(o.Port))
+	}
+	port, err := strconv.ParseUint(urlPort(&u), 10, 16)
+	if err != nil {
+		return h
+	}
+	rewritten := *h
+	rewritten.url = &u
+	rewritten.addresses = make([]netip.AddrPort, 0, len(h.addresses))
+	for _, a := range h.addresses {
+		rewritten.addresses = append(rewritten.addresses, netip.AddrPortFrom(a.Addr(), uint16(port)))
+	}
+	return &rewritten
+}
+
+// apply sets the headers, keep-alive and crawl delay of the override on
+// c. Applied before the User-Agent is set, so a User-Agent header of the
+// override wins.
+func (o *HostOverride) apply(c *connection) {
+	if o.KeepAlive != "" {
+		c.keepAliver = keepAlivers[o.KeepAlive]()
+	}
+	c.minCrawlDelay = o.CrawlDelay
+	c.crawlDelay = max(c.crawlDelay, o.CrawlDelay)
+	if len(o.Headers) > 0 {
+		c.client.Transport = &headerTransport{RoundTripper: c.client.Transport, headers: o.Headers}
+	}
+}
+
+// headerTransport sends every request with the headers.
+type headerTransport struct {
+	http.RoundTripper
+	headers map[string]string
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	for k, v := range t.headers {
+		req.Header.Set(k, v)
+	}
+	return t.RoundTripper.RoundTrip(req)
+}
+
+func (t *headerTransport) CloseIdleConnections() {
+	if c, ok := t.RoundTripper.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
+
+// check checks the override can be applied.
+func (o *HostOverride) check() error {
+	if o.Match == "" {
+		return errors.New("empty hostname")
+	}
+	if o.Scheme != "" && o.Scheme != "http" && o.Scheme != "https" {
+		return fmt.Errorf("unsupported scheme %q, expected http or https", o.Scheme)
+	}
+	if o.Port < 0 || o.Port > 65535 {
+		return fmt.Errorf("invalid port %d", o.Port)
+	}
+	if _, found := keepAlivers[o.KeepAlive]; o.KeepAlive != "" && !found {
+		return fmt.Errorf("unknown keep-alive %q, one of %v", o.KeepAlive, keepAliverNames())
+	}
+	if o.CrawlDelay < 0 {
+		return fmt.Errorf("negative crawl delay %v", o.CrawlDelay)
+	}
+	return nil
+}
+
+// parseOverrides parses a YAML mapping of hostnames, *. wildcards or CIDRs
+// to their overrides, in the order given, like
+//
+//	"*.example.com":
+//	  keep_alive: head
+//	  crawl_delay: 10s
+//	10.0.0.0/8:
+//	  scheme: http
+//	  port: 8080
+//	  headers:
+//	    Authorization: Bearer lab-token
+func parseOverrides(r io.Reader) ([]HostOverride, error) {
+	var doc yaml.Node
+	err := yaml.NewDecoder(r).Decode(&doc)
+	if errors.Is(err, io.EOF) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse overrides: %w", err)
+	}
+	root := &doc
+	if root.Kind == yaml.DocumentNode && len(root.Content) > 0 {
+		root = root.Content[0]
+	}
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("overrides on line %d are not a mapping of hostnames to overrides", root.Line)
+	}
+
+	overrides := []HostOverride{}
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, value := root.Content[i], root.Content[i+1]
+		o := HostOverride{Match: key.Value}
+		err = value.Decode(&o)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse override of %v: %w", key.Value, err)
+		}
+		if prefix, err := netip.ParsePrefix(key.Value); err == nil {
+			o.prefix = prefix.Masked()
+		}
+		err = o.check()
+		if err != nil {
+			return nil, fmt.Errorf("invalid override of %q on line %d: %w", key.Value, key.Line, err)
+		}
+		overrides = append(overrides, o)
+	}
+	return overrides, nil
+}
+
+func loadOverrides(path string) ([]HostOverride, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open overrides: %w", err)
+	}
+	defer f.Close()
+	return parseOverrides(f)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseOverrides(t *testing.T) {
+	overrides, err := parseOverrides(strings.NewReader(`
+"*.example.com":
+  keep_alive: head
+  crawl_delay: 10s
+10.0.0.0/8:
+  scheme: http
+  port: 8080
+  headers:
+    Authorization: Bearer lab-token
+`))
+	if err != nil {
+		t.Fatal("Failed to parse overrides: ", err)
+	}
+	if len(overrides) != 2 {
+		t.Fatalf("expected 2 overrides, got %v", len(overrides))
+	}
+	wildcard, cidr := overrides[0], overrides[1]
+	if wildcard.Match != "*.example.com" || wildcard.KeepAlive != "head" || wildcard.CrawlDelay != 10*time.Second {
+		t.Errorf("unexpected override of *.example.com %+v", wildcard)
+	}
+	if cidr.prefix != netip.MustParsePrefix("10.0.0.0/8") || cidr.Scheme != "http" || cidr.Port != 8080 ||
+		cidr.Headers["Authorization"] != "Bearer lab-token" {
+		t.Errorf("unexpected override of 10.0.0.0/8 %+v", cidr)
+	}
+
+	for name, in := range map[string]string{
+		"not a mapping":      "- example.com",
+		"unknown scheme":     "example.com:\n  scheme: ftp\n",
+		"invalid port":       "example.com:\n  port: 70000\n",
+		"unknown keep-alive": "example.com:\n  keep_alive: carrier-pigeon\n",
+		"invalid delay":      "example.com:\n  crawl_delay: soon\n",
+	} {
+		if _, err := parseOverrides(strings.NewReader(in)); err == nil {
+			t.Errorf("expected %v to be rejected", name)
+		}
+	}
+}
+
+func TestHostOverride(t *testing.T) {
+	overrides := []HostOverride{
+		{Match: "*.example.com", KeepAlive: "head", Headers: map[string]string{"X-Lab": "a"}},
+		{Match: "www.example.com", KeepAlive: "get", Headers: map[string]string{"X-Other": "b"}},
+		{Match: "10.0.0.0/8", Port: 8080, prefix: netip.MustParsePrefix("10.0.0.0/8")},
+	}
+	resolved := func(rawUrl, addr string) *resolvedUrl {
+		u, err := url.Parse(rawUrl)
+		if err != nil {
+			t.Fatal("Failed to parse test url: ", err)
+		}
+		return &resolvedUrl{url: u, addresses: []netip.AddrPort{netip.MustParseAddrPort(addr)}}
+	}
+
+	testcases := map[string]struct {
+		in  *resolvedUrl
+		out *HostOverride
+	}{
+		"no match": {
+			in:  resolved("http://example.org/", "192.0.2.1:80"),
+			out: nil,
+		},
+		"wildcard skips the domain": {
+			in:  resolved("http://example.com/", "192.0.2.1:80"),
+			out: nil,
+		},
+		"wildcard": {
+			in:  resolved("http://Mail.Example.com/", "192.0.2.1:80"),
+			out: &HostOverride{KeepAlive: "head", Headers: map[string]string{"X-Lab": "a"}},
+		},
+		"later takes precedence": {
+			in:  resolved("http://www.example.com/", "192.0.2.1:80"),
+			out: &HostOverride{KeepAlive: "get", Headers: map[string]string{"X-Lab": "a", "X-Other": "b"}},
+		},
+		"cidr": {
+			in:  resolved("http://lab.internal/", "10.1.2.3:80"),
+			out: &HostOverride{Port: 8080},
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			got := hostOverride(overrides, tc.in)
+			if (got == nil) != (tc.out == nil) {
+				t.Fatalf("expected %+v, got %+v", tc.out, got)
+			}
+			if got == nil {
+				return
+			}
+			if got.KeepAlive != tc.out.KeepAlive || got.Port != tc.out.Port || len(got.Headers) != len(tc.out.Headers) {
+				t.Errorf("expected %+v, got %+v", tc.out, got)
+			}
+			for k, v := range tc.out.Headers {
+				if got.Headers[k] != v {
+					t.Errorf("expected header %v of %v, got %v", k, v, got.Headers[k])
+				}
+			}
+		})
+	}
+}
+
+func TestOverrideRewrite(t *testing.T) {
+	u, err := url.Parse("https://lab.internal/index.html")
+	if err != nil {
+		t.Fatal("Failed to parse test url: ", err)
+	}
+	h := &resolvedUrl{url: u, addresses: []netip.AddrPort{netip.MustParseAddrPort("10.0.0.1:443")}}
+
+	testcases := map[string]struct {
+		in       HostOverride
+		outUrl   string
+		outAddrs string
+	}{
+		"nothing": {
+			outUrl:   "https://lab.internal/index.html",
+			outAddrs: "10.0.0.1:443",
+		},
+		"scheme": {
+			in:       HostOverride{Scheme: "http"},
+			outUrl:   "http://lab.internal/index.html",
+			outAddrs: "10.0.0.1:80",
+		},
+		"port": {
+			in:       HostOverride{Port: 8443},
+			outUrl:   "https://lab.internal:8443/index.html",
+			outAddrs: "10.0.0.1:8443",
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			got := tc.in.rewrite(h)
+			if got.url.String() != tc.outUrl {
+				t.Errorf("expected url %v, got %v", tc.outUrl, got.url)
+			}
+			if got.addresses[0].String() != tc.outAddrs {
+				t.Errorf("expected address %v, got %v", tc.outAddrs, got.addresses[0])
+			}
+		})
+	}
+	if u.String() != "https://lab.internal/index.html" {
+		t.Errorf("expected the url to be left alone, got %v", u)
+	}
+}
+
+func TestOverrideApply(t *testing.T) {
+	var m sync.Mutex
+	headers := http.Header{}
+	srv := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		m.Lock()
+		defer m.Unlock()
+		headers = req.Header.Clone()
+	}))
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal("Failed to parse server url: ", err)
+	}
+	addr := netip.MustParseAddrPort(u.Host)
+	ctx := context.WithValue(context.Background(), ctxAddrKey{}, addr)
+
+	c := makeConnection(addr, u, &traffic{}, nil)
+	defer c.client.CloseIdleConnections()
+	o := &HostOverride{KeepAlive: "head", CrawlDelay: time.Minute, Headers: map[string]string{"Authorization": "Bearer lab-token"}}
+	o.apply(c)
+	if _, ok := c.keepAliver.(*HeadKeepAlive); !ok {
+		t.Errorf("expected a HEAD keep-alive, got %T", c.keepAliver)
+	}
+	if c.crawlDelay != time.Minute {
+		t.Errorf("expected a crawl delay of a minute, got %v", c.crawlDelay)
+	}
+
+	if r := scrapConnection(ctx, makeCrawlRequest(c)); r.err != nil {
+		t.Fatal("Failed to get: ", r.err)
+	}
+	m.Lock()
+	defer m.Unlock()
+	if got := headers.Get("Authorization"); got != "Bearer lab-token" {
+		t.Errorf("expected the overridden header, got %q", got)
+	}
+}
@@ -0,0 +1,104 @@
+// Functions related to recording how requests to each host were paced,
+// to check Crawl-delay and HTTP 429 backoff are honored over long runs.
+package main
+
+import (
+	"cmp"
+	"slices"
+	"time"
+)
+
+// Upper bounds of the pacing histogram buckets, intervals past the last
+// fall in an unbounded bucket.
+var pacingBuckets = [...]time.Duration{
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+	30 * time.Second,
+	time.Minute,
+}
+
+// HostPacing is a histogram of the intervals between requests to a host.
+type HostPacing struct {
+	Host string `json:"host"`
+	// Crawl-delay requested by the host, by robots.txt or HTTP 429
+	CrawlDelay time.Duration `json:"crawl_delay"`
+	// Intervals shorter than the Crawl-delay in force when requested
+	BelowCrawlDelay int            `json:"below_crawl_delay"`
+	Min             time.Duration  `json:"min"`
+	Buckets         []PacingBucket `json:"buckets"`
+}
+
+// PacingBucket counts the intervals shorter than Below, and at least the
+// previous bucket. Below is zero for the unbounded last bucket.
+type PacingBucket struct {
+	Below time.Duration `json:"below,omitempty"`
+	Count int           `json:"count"`
+}
+
+// pacing is the histogram of the intervals between requests on a
+// connection.
+type pacing struct {
+	counts          [len(pacingBuckets) + 1]int
+	min             time.Duration
+	belowCrawlDelay int
+}
+
+func (p *pacing) add(interval, crawlDelay time.Duration) {
+	i, _ := slices.BinarySearch(pacingBuckets[:], interval+1)
+	p.counts[i]++
+	if p.intervals() == 1 || interval < p.min {
+		p.min = interval
+	}
+	if interval < crawlDelay {
+		p.belowCrawlDelay++
+	}
+}
+
+func (p *pacing) intervals() int {
+	n := 0
+	for _, count := range p.counts {
+		n += count
+	}
+	return n
+}
+
+// hostPacing merges the pacing of the connections to each host,
+// ordered by host.
+func hostPacing(conns ...[]*connection) []HostPacing {
+	byHost := map[string]*HostPacing{}
+	for _, c := range slices.Concat(conns...) {
+		if c.pacing.intervals() == 0 {
+			continue
+		}
+
+		h, found := byHost[c.host.hostPort]
+		if !found {
+			h = &HostPacing{Host: c.host.hostPort, Min: c.pacing.min}
+			for _, below := range pacingBuckets {
+				h.Buckets = append(h.Buckets, PacingBucket{Below: below})
+			}
+			h.Buckets = append(h.Buckets, PacingBucket{})
+			byHost[c.host.hostPort] = h
+		}
+		h.CrawlDelay = max(h.CrawlDelay, c.crawlDelay)
+		h.BelowCrawlDelay += c.pacing.belowCrawlDelay
+		h.Min = min(h.Min, c.pacing.min)
+		for i, count := range c.pacing.counts {
+			h.Buckets[i].Count += count
+		}
+	}
+
+	hosts := []HostPacing{}
+	for _, h := range byHost {
+		hosts = append(hosts, *h)
+	}
+	slices.SortFunc(hosts, func(a, b HostPacing) int {
+		return cmp.Compare(a.Host, b.Host)
+	})
+	return hosts
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/url"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestHostPacing(t *testing.T) {
+	makeConn := func(hostPort string, crawlDelay time.Duration, intervals ...time.Duration) *connection {
+		c := &connection{host: &host{hostPort: hostPort}, crawlDelay: crawlDelay}
+		for _, i := range intervals {
+			c.pacing.add(i, crawlDelay)
+		}
+		return c
+	}
+
+	active := []*connection{
+		makeConn("b:80", time.Second, 2*time.Second, 1100*time.Millisecond),
+		makeConn("a:80", 0, 50*time.Millisecond),
+		makeConn("idle:80", 0),
+	}
+	closed := []*connection{
+		makeConn("b:80", time.Second, 500*time.Millisecond, 2*time.Hour),
+	}
+
+	hosts := hostPacing(active, closed)
+	if len(hosts) != 2 || hosts[0].Host != "a:80" || hosts[1].Host != "b:80" {
+		t.Fatalf("expected pacing of a:80 then b:80, got %v", hosts)
+	}
+
+	b := hosts[1]
+	if b.Min != 500*time.Millisecond {
+		t.Errorf("expected min interval 500ms, got %v", b.Min)
+	}
+	if b.BelowCrawlDelay != 1 {
+		t.Errorf("expected 1 interval below the crawl delay, got %v", b.BelowCrawlDelay)
+	}
+	want := map[time.Duration]int{
+		time.Second:             1,
+		2500 * time.Millisecond: 2,
+		0:                       1,
+	}
+	for _, bucket := range b.Buckets {
+		if bucket.Count != want[bucket.Below] {
+			t.Errorf("expected %d intervals below %v, got %d", want[bucket.Below], bucket.Below, bucket.Count)
+		}
+	}
+}
+
+func TestPacingHonorsCrawlDelay(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping due to re-request timeouts.")
+	}
+
+	srv := &httpTestServer{name: "server"}
+	startHttpServer(t, srv)
+
+	root := makeServerRoot(t)
+	pages := []*url.URL{srv.tUrl(t, "page1.html"), srv.tUrl(t, "page2.html")}
+	makeHtmlDocWithLinks(t, pages, path.Join(root, "index.html"))
+	cpFile(t, tPath("no_links.html"), path.Join(root, "page1.html"))
+	cpFile(t, tPath("no_links.html"), path.Join(root, "page2.html"))
+	robotsTxt := *defaultRobotsTxtRecord.Clone()
+	robotsTxt.Rules = []rule{
+		{Token: "Crawl-delay", Value: "0.3"},
+	}
+	makeRobotsTxt(t, []record{robotsTxt}, path.Join(root, "robots.txt"))
+	srv.server.Handler = HandlerChain{
+		makeFileHandler(root),
+	}
+
+	m := Measurer{}
+	r, err := m.Measure([]*url.URL{srv.tUrl(t, "")})
+	if err != nil {
+		t.Fatal("Failed to measure: ", err)
+	}
+	if len(r.Pacing) != 1 {
+		t.Fatalf("expected pacing of 1 host, got %v", r.Pacing)
+	}
+
+	p := r.Pacing[0]
+	if p.CrawlDelay != 300*time.Millisecond {
+		t.Errorf("expected crawl delay of 300ms, got %v", p.CrawlDelay)
+	}
+	if p.BelowCrawlDelay != 0 {
+		t.Errorf("expected crawl delay to be honored, got %d shorter intervals", p.BelowCrawlDelay)
+	}
+	if p.Min < p.CrawlDelay {
+		t.Errorf("expected intervals of at least %v, got %v", p.CrawlDelay, p.Min)
+	}
+}
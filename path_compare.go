@@ -0,0 +1,107 @@
+// Functions related to comparing the NAT paths of several local
+// interfaces, like Wi-Fi against Ethernet, by interleaving their
+// measurements so time of day weighs on each path alike.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+)
+
+const defaultCompareRounds = 3
+
+// PathComparison is the capacity of each interface, measured in rounds.
+type PathComparison struct {
+	Rounds int          `json:"rounds"`
+	Paths  []PathResult `json:"paths"`
+}
+
+// PathResult is the capacity of the path of one interface.
+type PathResult struct {
+	Interface string `json:"interface"`
+	// Max connections of each round, in order
+	MaxConnections []int `json:"max_connections"`
+	Median         int   `json:"median"`
+}
+
+// interleavedOrder is the order the paths are measured in round, reversed
+// every other round so neither is always measured first.
+func interleavedOrder(paths, round int) []int {
+	order := make([]int, paths)
+	for i := range order {
+		order[i] = i
+	}
+	if round%2 == 1 {
+		slices.Reverse(order)
+	}
+	return order
+}
+
+// comparePaths measures over each interface in turn for rounds, pausing
+// between measurements for the NAT to release the mappings of the last.
+func comparePaths(ifaces []string, rounds int, pause time.Duration, measure func(iface string) (*Result, error)) (*PathComparison, error) {
+	c := &PathComparison{Rounds: rounds, Paths: make([]PathResult, len(ifaces))}
+	for i, iface := range ifaces {
+		c.Paths[i] = PathResult{Interface: iface, MaxConnections: make([]int, rounds)}
+	}
+
+	first := true
+	for round := range rounds {
+		for _, i := range interleavedOrder(len(ifaces), round) {
+			if !first {
+				time.Sleep(pause)
+			}
+			first = false
+
+			r, err := measure(ifaces[i])
+			if err != nil {
+				return nil, fmt.Errorf("failed to measure over %v in round %d: %w", ifaces[i], round+1, err)
+			}
+			c.Paths[i].MaxConnections[round] = r.MaxConnections
+		}
+	}
+	for i := range c.Paths {
+		sorted := slices.Clone(c.Paths[i].MaxConnections)
+		slices.Sort(sorted)
+		c.Paths[i].Median = sorted[len(sorted)/2]
+	}
+	return c, nil
+}
+
+func printPathComparison(w io.Writer, c *PathComparison) {
+	header := []string{"Round"}
+	for _, p := range c.Paths {
+		header = append(header, fmt.Sprintf("%15v", p.Interface))
+	}
+	fmt.Fprintln(w, strings.Join(header, "  "))
+	for round := range c.Rounds {
+		row := []string{fmt.Sprintf("%-5d", round+1)}
+		for _, p := range c.Paths {
+			row = append(row, fmt.Sprintf("%15d", p.MaxConnections[round]))
+		}
+		fmt.Fprintln(w, strings.Join(row, "  "))
+	}
+	row := []string{"Median"}
+	for _, p := range c.Paths {
+		row = append(row, fmt.Sprintf("%14d", p.Median))
+	}
+	fmt.Fprintln(w, strings.Join(row, "  "))
+}
+
+func writePathComparison(w io.Writer, format string, c *PathComparison) error {
+	switch format {
+	case "text":
+		printPathComparison(w, c)
+		return nil
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(c)
+	default:
+		return fmt.Errorf("unsupported comparison report format %q, expected text or json", format)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestComparePaths(t *testing.T) {
+	capacity := map[string][]int{
+		"eth0":  {500, 520, 480},
+		"wlan0": {300, 100, 310},
+	}
+	order := []string{}
+	c, err := comparePaths([]string{"eth0", "wlan0"}, 3, 0, func(iface string) (*Result, error) {
+		order = append(order, iface)
+		next := capacity[iface][0]
+		capacity[iface] = capacity[iface][1:]
+		return &Result{MaxConnections: next}, nil
+	})
+	if err != nil {
+		t.Fatal("Failed to compare paths: ", err)
+	}
+
+	expectedOrder := []string{"eth0", "wlan0", "wlan0", "eth0", "eth0", "wlan0"}
+	if !slices.Equal(order, expectedOrder) {
+		t.Errorf("expected the paths to be interleaved like %v, got %v", expectedOrder, order)
+	}
+	if got := c.Paths[0]; got.Median != 500 || !slices.Equal(got.MaxConnections, []int{500, 520, 480}) {
+		t.Errorf("unexpected eth0 path %+v", got)
+	}
+	if got := c.Paths[1]; got.Median != 300 || !slices.Equal(got.MaxConnections, []int{300, 100, 310}) {
+		t.Errorf("unexpected wlan0 path %+v", got)
+	}
+
+	var b bytes.Buffer
+	printPathComparison(&b, c)
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 5 || !strings.HasPrefix(lines[4], "Median") || !strings.HasSuffix(lines[4], "300") {
+		t.Errorf("unexpected comparison %q", b.String())
+	}
+}
+
+func TestComparePathsFailure(t *testing.T) {
+	_, err := comparePaths([]string{"eth0", "wlan0"}, 2, 0, func(iface string) (*Result, error) {
+		if iface == "wlan0" {
+			return nil, errors.New("no carrier")
+		}
+		return &Result{}, nil
+	})
+	if err == nil || !strings.Contains(err.Error(), "wlan0") {
+		t.Errorf("expected the failure over wlan0 to be reported, got %v", err)
+	}
+}
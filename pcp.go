@@ -0,0 +1,249 @@
+// Functions related to asking the gateway for a mapping with the Port
+// Control Protocol (RFC 6887), or NAT-PMP (RFC 6886) which it replaced,
+// to tell whether applications can ask for the mappings they need rather
+// than relying on the implicit mappings measured.
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+)
+
+const (
+	pcpPort = 5351
+	// Longest to wait for the gateway to answer each protocol
+	pcpTimeout = 2 * time.Second
+	// Lifetime asked for the mapping, which is deleted once granted
+	pcpMappingLifetime = 60 * time.Second
+
+	pcpVersion    = 2
+	natPmpVersion = 0
+	pcpOpMap      = 1
+	// PCP replies set the top bit of the opcode, NAT-PMP adds 128
+	pcpReplyBit      = 0x80
+	pcpHeaderLen     = 24
+	pcpMapLen        = 36
+	natPmpOpAddress  = 0
+	natPmpOpMapUdp   = 1
+	ipProtocolUdp    = 17
+	pcpUnsuppVersion = 1
+)
+
+// Protocols of MappingProtocolReport
+const (
+	MappingProtocolPcp    = "pcp"
+	MappingProtocolNatPmp = "nat-pmp"
+)
+
+var errNoPcpReply = errors.New("no reply")
+
+// Names of the result codes of PCP, RFC 6887 section 7.4
+var pcpResults = []string{
+	"SUCCESS", "UNSUPP_VERSION", "NOT_AUTHORIZED", "MALFORMED_REQUEST",
+	"UNSUPP_OPCODE", "UNSUPP_OPTION", "MALFORMED_OPTION", "NETWORK_FAILURE",
+	"NO_RESOURCES", "UNSUPP_PROTOCOL", "USER_EX_QUOTA",
+	"CANNOT_PROVIDE_EXTERNAL", "ADDRESS_MISMATCH", "EXCESSIVE_REMOTE_PEERS",
+}
+
+// Names of the result codes of NAT-PMP, RFC 6886 section 3.5
+var natPmpResults = []string{
+	"SUCCESS", "UNSUPPORTED_VERSION", "NOT_AUTHORIZED", "NETWORK_FAILURE",
+	"OUT_OF_RESOURCES", "UNSUPPORTED_OPCODE",
+}
+
+func resultName(names []string, code int) string {
+	if code < len(names) {
+		return names[code]
+	}
+	return fmt.Sprintf("result %d", code)
+}
+
+// MappingProtocolReport is whether the gateway granted a UDP mapping
+// asked for explicitly.
+type MappingProtocolReport struct {
+	// The protocol the gateway answered, empty if it answered neither
+	Protocol string `json:"protocol,omitempty"`
+	// The gateway granted the mapping
+	Mapped bool `json:"mapped"`
+	// Why the gateway refused the mapping, like NOT_AUTHORIZED
+	Refused      string        `json:"refused,omitempty"`
+	ExternalIp   string        `json:"external_ip,omitempty"`
+	InternalPort uint16        `json:"internal_port,omitempty"`
+	ExternalPort uint16        `json:"external_port,omitempty"`
+	Lifetime     time.Duration `json:"lifetime,omitempty"`
+}
+
+// pcpExchange sends req until a reply valid accepts arrives, resending
+// it with doubling intervals as RFC 6887 section 8.1.1 suggests.
+func pcpExchange(conn net.Conn, req []byte, valid func([]byte) bool, timeout time.Duration) ([]byte, error) {
+	deadline := time.Now().Add(timeout)
+	buf := make([]byte, 1100)
+	for wait := stunRetransmit; time.Now().Before(deadline); wait *= 2 {
+		_, err := conn.Write(req)
+		if err != nil {
+			return nil, fmt.Errorf("failed to send request: %w", err)
+		}
+		readDeadline := time.Now().Add(wait)
+		if readDeadline.After(deadline) {
+			readDeadline = deadline
+		}
+		conn.SetReadDeadline(readDeadline)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				break
+			}
+			if valid(buf[:n]) {
+				return buf[:n], nil
+			}
+		}
+	}
+	return nil, errNoPcpReply
+}
+
+// pcpMapRequest asks for a UDP mapping of internal for lifetime, from
+// client, zero lifetime deleting it.
+func pcpMapRequest(client netip.Addr, nonce []byte, internal uint16, lifetime time.Duration) []byte {
+	req := make([]byte, pcpHeaderLen+pcpMapLen)
+	req[0] = pcpVersion
+	req[1] = pcpOpMap
+	binary.BigEndian.PutUint32(req[4:], uint32(lifetime/time.Second))
+	// IPv4 addresses are mapped into IPv6
+	clientIp := client.As16()
+	copy(req[8:24], clientIp[:])
+	m := req[pcpHeaderLen:]
+	copy(m[0:12], nonce)
+	m[12] = ipProtocolUdp
+	binary.BigEndian.PutUint16(m[16:], internal)
+	// The suggested external port and address are left zero, any will do
+	copy(m[20:36], netip.IPv6Unspecified().AsSlice())
+	m[30], m[31] = 0xff, 0xff
+	return req
+}
+
+// askPcp asks for a mapping of internal with PCP. The error is
+// errNoPcpReply if the gateway did not answer, and the report has no
+// protocol if it only speaks NAT-PMP.
+func askPcp(conn net.Conn, client netip.Addr, internal uint16, timeout time.Duration) (*MappingProtocolReport, error) {
+	nonce := make([]byte, 12)
+	rand.Read(nonce)
+	valid := func(b []byte) bool {
+		// NAT-PMP gateways answer with their own version, RFC 6887
+		// section 9
+		if len(b) >= 4 && b[0] == natPmpVersion {
+			return b[1] == pcpReplyBit|pcpOpMap && binary.BigEndian.Uint16(b[2:]) == pcpUnsuppVersion
+		}
+		return len(b) >= pcpHeaderLen && b[0] == pcpVersion && b[1] == pcpReplyBit|pcpOpMap &&
+			(b[3] != 0 || len(b) >= pcpHeaderLen+pcpMapLen && bytes.Equal(b[pcpHeaderLen:pcpHeaderLen+12], nonce))
+	}
+	reply, err := pcpExchange(conn, pcpMapRequest(client, nonce, internal, pcpMappingLifetime), valid, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if reply[0] == natPmpVersion {
+		return &MappingProtocolReport{}, nil
+	}
+
+	report := &MappingProtocolReport{Protocol: MappingProtocolPcp, InternalPort: internal}
+	if reply[3] != 0 {
+		report.Refused = resultName(pcpResults, int(reply[3]))
+		return report, nil
+	}
+	m := reply[pcpHeaderLen:]
+	external, _ := netip.AddrFromSlice(m[20:36])
+	report.Mapped = true
+	report.ExternalIp = external.Unmap().String()
+	report.ExternalPort = binary.BigEndian.Uint16(m[18:])
+	report.Lifetime = time.Duration(binary.BigEndian.Uint32(reply[4:])) * time.Second
+
+	// Delete the mapping, it was only asked for to see it granted
+	pcpExchange(conn, pcpMapRequest(client, nonce, internal, 0), valid, timeout)
+	return report, nil
+}
+
+// askNatPmp asks for the external address and a mapping of internal
+// with NAT-PMP.
+func askNatPmp(conn net.Conn, internal uint16, timeout time.Duration) (*MappingProtocolReport, error) {
+	reply, err := pcpExchange(conn, []byte{natPmpVersion, natPmpOpAddress}, func(b []byte) bool {
+		return len(b) >= 12 && b[0] == natPmpVersion && b[1] == pcpReplyBit+natPmpOpAddress
+	}, timeout)
+	if err != nil {
+		return nil, err
+	}
+	report := &MappingProtocolReport{Protocol: MappingProtocolNatPmp, InternalPort: internal}
+	if result := binary.BigEndian.Uint16(reply[2:]); result != 0 {
+		report.Refused = resultName(natPmpResults, int(result))
+		return report, nil
+	}
+	report.ExternalIp = netip.AddrFrom4([4]byte(reply[8:12])).String()
+
+	mapRequest := func(lifetime time.Duration) []byte {
+		req := make([]byte, 12)
+		req[0], req[1] = natPmpVersion, natPmpOpMapUdp
+		binary.BigEndian.PutUint16(req[4:], internal)
+		binary.BigEndian.PutUint32(req[8:], uint32(lifetime/time.Second))
+		return req
+	}
+	valid := func(b []byte) bool {
+		return len(b) >= 16 && b[0] == natPmpVersion && b[1] == pcpReplyBit+natPmpOpMapUdp &&
+			binary.BigEndian.Uint16(b[8:]) == internal
+	}
+	reply, err = pcpExchange(conn, mapRequest(pcpMappingLifetime), valid, timeout)
+	if errors.Is(err, errNoPcpReply) {
+		report.Refused = "no reply"
+		return report, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to ask for a mapping: %w", err)
+	}
+	if result := binary.BigEndian.Uint16(reply[2:]); result != 0 {
+		report.Refused = resultName(natPmpResults, int(result))
+		return report, nil
+	}
+	report.Mapped = true
+	report.ExternalPort = binary.BigEndian.Uint16(reply[10:])
+	report.Lifetime = time.Duration(binary.BigEndian.Uint32(reply[12:])) * time.Second
+
+	pcpExchange(conn, mapRequest(0), valid, timeout)
+	return report, nil
+}
+
+// askMappingProtocols asks gateway for a mapping of a UDP socket of its
+// own, with PCP or failing that NAT-PMP. A gateway answering neither is
+// reported without a protocol.
+func askMappingProtocols(gateway netip.AddrPort, timeout time.Duration) (*MappingProtocolReport, error) {
+	conn, err := net.DialUDP("udp4", nil, net.UDPAddrFromAddrPort(gateway))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open UDP socket: %w", err)
+	}
+	defer conn.Close()
+	local := conn.LocalAddr().(*net.UDPAddr).AddrPort()
+
+	report, err := askPcp(conn, local.Addr(), local.Port(), timeout)
+	if err == nil && report.Protocol != "" {
+		return report, nil
+	}
+	if err != nil && !errors.Is(err, errNoPcpReply) {
+		return nil, err
+	}
+	report, err = askNatPmp(conn, local.Port(), timeout)
+	if errors.Is(err, errNoPcpReply) {
+		return &MappingProtocolReport{}, nil
+	}
+	return report, err
+}
+
+// checkMappingProtocols asks the gateway of the metadata for a mapping.
+func checkMappingProtocols(metadata *RunMetadata) (*MappingProtocolReport, error) {
+	gateway, err := netip.ParseAddr(metadata.Gateway)
+	if err != nil || !gateway.Is4() {
+		return nil, errors.New("the IPv4 gateway is unknown")
+	}
+	return askMappingProtocols(netip.AddrPortFrom(gateway, pcpPort), pcpTimeout)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// servePcp answers PCP and NAT-PMP as a gateway speaking protocol, one
+// of MappingProtocolPcp, MappingProtocolNatPmp or empty for neither,
+// refusing mappings with the result code refuse. Deleted counts the
+// mappings deleted.
+func servePcp(t *testing.T, protocol string, refuse byte, deleted *atomic.Int32) netip.AddrPort {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Failed to listen: ", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	external := netip.MustParseAddr("198.51.100.7")
+
+	go func() {
+		buf := make([]byte, 1100)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			req := buf[:n]
+			var reply []byte
+			switch {
+			case protocol == MappingProtocolPcp && req[0] == pcpVersion:
+				reply = make([]byte, pcpHeaderLen+pcpMapLen)
+				reply[0], reply[1], reply[3] = pcpVersion, pcpReplyBit|req[1], refuse
+				lifetime := binary.BigEndian.Uint32(req[4:])
+				if lifetime == 0 {
+					deleted.Add(1)
+				}
+				binary.BigEndian.PutUint32(reply[4:], lifetime)
+				copy(reply[pcpHeaderLen:], req[pcpHeaderLen:pcpHeaderLen+pcpMapLen])
+				m := reply[pcpHeaderLen:]
+				binary.BigEndian.PutUint16(m[18:], 40000)
+				ip := external.As16()
+				copy(m[20:36], ip[:])
+			case protocol == MappingProtocolNatPmp && req[0] == pcpVersion:
+				reply = []byte{natPmpVersion, pcpReplyBit | req[1], 0, pcpUnsuppVersion, 0, 0, 0, 0}
+			case protocol == MappingProtocolNatPmp && req[1] == natPmpOpAddress:
+				reply = make([]byte, 12)
+				reply[1] = pcpReplyBit + natPmpOpAddress
+				ip := external.As4()
+				copy(reply[8:], ip[:])
+			case protocol == MappingProtocolNatPmp && req[1] == natPmpOpMapUdp:
+				reply = make([]byte, 16)
+				reply[1] = pcpReplyBit + natPmpOpMapUdp
+				reply[3] = refuse
+				lifetime := binary.BigEndian.Uint32(req[8:])
+				if lifetime == 0 {
+					deleted.Add(1)
+				}
+				copy(reply[8:10], req[4:6])
+				binary.BigEndian.PutUint16(reply[10:], 40001)
+				binary.BigEndian.PutUint32(reply[12:], lifetime)
+			default:
+				continue
+			}
+			conn.WriteTo(reply, from)
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr).AddrPort()
+}
+
+func TestAskMappingProtocols(t *testing.T) {
+	testcases := map[string]struct {
+		inProtocol  string
+		inRefuse    byte
+		outReport   MappingProtocolReport
+		outDeleted  int32
+		outInternal bool
+	}{
+		"PCP": {
+			inProtocol: MappingProtocolPcp,
+			outReport: MappingProtocolReport{
+				Protocol: MappingProtocolPcp, Mapped: true, ExternalIp: "198.51.100.7",
+				ExternalPort: 40000, Lifetime: pcpMappingLifetime,
+			},
+			outDeleted:  1,
+			outInternal: true,
+		},
+		"PCP refused": {
+			inProtocol:  MappingProtocolPcp,
+			inRefuse:    2,
+			outReport:   MappingProtocolReport{Protocol: MappingProtocolPcp, Refused: "NOT_AUTHORIZED"},
+			outInternal: true,
+		},
+		"NAT-PMP": {
+			inProtocol: MappingProtocolNatPmp,
+			outReport: MappingProtocolReport{
+				Protocol: MappingProtocolNatPmp, Mapped: true, ExternalIp: "198.51.100.7",
+				ExternalPort: 40001, Lifetime: pcpMappingLifetime,
+			},
+			outDeleted:  1,
+			outInternal: true,
+		},
+		"NAT-PMP out of resources": {
+			inProtocol: MappingProtocolNatPmp,
+			inRefuse:   4,
+			outReport: MappingProtocolReport{
+				Protocol: MappingProtocolNatPmp, Refused: "OUT_OF_RESOURCES", ExternalIp: "198.51.100.7",
+			},
+			outInternal: true,
+		},
+		"Neither": {outReport: MappingProtocolReport{}},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			var deleted atomic.Int32
+			gateway := servePcp(t, tc.inProtocol, tc.inRefuse, &deleted)
+			r, err := askMappingProtocols(gateway, 300*time.Millisecond)
+			if err != nil {
+				t.Fatal("Failed to ask for a mapping: ", err)
+			}
+			if (r.InternalPort != 0) != tc.outInternal {
+				t.Errorf("expected an internal port %v, got %d", tc.outInternal, r.InternalPort)
+			}
+			r.InternalPort = 0
+			if *r != tc.outReport {
+				t.Errorf("expected %+v, got %+v", tc.outReport, *r)
+			}
+			if n := deleted.Load(); n != tc.outDeleted {
+				t.Errorf("expected %d mappings deleted, got %d", tc.outDeleted, n)
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+// Functions related to pinning the address of seeds, like
+// "http://example.com/ @203.0.113.9", to reproduce issues against a
+// specific CDN edge without looking the seed up.
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// parseSeedLine parses a line of the url list, a url optionally followed
+// by @ and the address to pin it to. The address is invalid if not
+// pinned.
+func parseSeedLine(line string) (*url.URL, netip.Addr, error) {
+	rawUrl, pin, pinned := strings.Cut(line, " @")
+	u, err := parseTargetUrl(strings.TrimSpace(rawUrl))
+	if err != nil || !pinned {
+		return u, netip.Addr{}, err
+	}
+	addr, err := netip.ParseAddr(strings.TrimSpace(pin))
+	if err != nil {
+		return nil, netip.Addr{}, fmt.Errorf("invalid pinned address: %w", err)
+	}
+	return u, addr.Unmap(), nil
+}
+
+// pinnedSeed is the seed u already resolved to its pinned address, nil if
+// not pinned.
+func (m *Measurer) pinnedSeed(u *url.URL) *resolvedUrl {
+	addr, found := m.Pins[canonicalHost(u)]
+	if !found {
+		return nil
+	}
+	port, err := strconv.ParseUint(urlPort(u), 10, 16)
+	if err != nil {
+		return nil
+	}
+	return &resolvedUrl{url: u, addresses: []netip.AddrPort{netip.AddrPortFrom(addr, uint16(port))}}
+}
+
+// checkPins checks the pinned addresses are of the IP version measured.
+func checkPins(m *Measurer) error {
+	for host, addr := range m.Pins {
+		if addr.Is6() != m.Ipv6 {
+			return fmt.Errorf("pinned address %v of %v is not of the IP version measured", addr, host)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestParseSeedLine(t *testing.T) {
+	testcases := map[string]struct {
+		in          string
+		expectUrl   string
+		expectPin   netip.Addr
+		expectError bool
+	}{
+		"Unpinned":       {in: "http://example.com/", expectUrl: "http://example.com/"},
+		"Pinned":         {in: "http://example.com/ @203.0.113.9", expectUrl: "http://example.com/", expectPin: netip.MustParseAddr("203.0.113.9")},
+		"Pinned IPv6":    {in: "https://example.com/a @2001:db8::9", expectUrl: "https://example.com/a", expectPin: netip.MustParseAddr("2001:db8::9")},
+		"Mapped IPv4":    {in: "http://example.com/ @::ffff:203.0.113.9", expectUrl: "http://example.com/", expectPin: netip.MustParseAddr("203.0.113.9")},
+		"Invalid pin":    {in: "http://example.com/ @edge.example", expectError: true},
+		"Url with an at": {in: "http://user@example.com/", expectUrl: "http://user@example.com/"},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			u, pin, err := parseSeedLine(tc.in)
+			if (err != nil) != tc.expectError {
+				t.Fatalf("expected error %v, got %v", tc.expectError, err)
+			}
+			if tc.expectError {
+				return
+			}
+			if u.String() != tc.expectUrl || pin != tc.expectPin {
+				t.Errorf("expected %v pinned to %v, got %v pinned to %v", tc.expectUrl, tc.expectPin, u, pin)
+			}
+		})
+	}
+}
+
+func TestPinnedSeeds(t *testing.T) {
+	n := &benchNetwork{hosts: 5, fanout: 2, seeds: 2}
+	seeds := n.seedUrls()
+	pin := netip.MustParseAddr("192.0.2.9")
+	addrs := map[string]string{}
+	m := Measurer{
+		network: n,
+		Pins:    map[string]netip.Addr{canonicalHost(seeds[0]): pin},
+		OnEvent: func(e Event) {
+			if e.Type == EventConnectionEstablished {
+				addrs[e.Host] = e.Addr
+			}
+		},
+	}
+	r, err := m.Measure(seeds)
+	if err != nil {
+		t.Fatal("Failed to measure: ", err)
+	}
+	if r.MaxConnections != n.hosts {
+		t.Errorf("expected %d connections, got %d", n.hosts, r.MaxConnections)
+	}
+	if addr := addrs[canonicalHost(seeds[0])]; addr != netip.AddrPortFrom(pin, 80).String() {
+		t.Errorf("expected the pinned seed to connect to %v, got %v", pin, addr)
+	}
+	if lookups := int(n.lookups.Load()); lookups != n.hosts-1 {
+		t.Errorf("expected every host but the pinned seed to be looked up, got %d lookups", lookups)
+	}
+
+	m.Ipv6 = true
+	if _, err := m.Measure(seeds); err == nil {
+		t.Error("expected an IPv4 pin to be rejected when measuring IPv6")
+	}
+}
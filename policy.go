@@ -0,0 +1,132 @@
+// Functions related to the timings and thresholds the scheduler measures
+// with, gathered in a Policy so they can be tuned from the command line or
+// a YAML file instead of recompiling.
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Defaults of Policy
+const (
+	defaultPollInterval     = 50 * time.Millisecond
+	reRequestInterval       = 3500 * time.Millisecond
+	defaultBackoffIncrement = time.Second
+	maxRepeatedDialFails    = 5
+	workerLimit             = 10000
+)
+
+// Policy holds the timings and thresholds of the scheduler, the zero
+// value of each field being its default.
+type Policy struct {
+	// Longest the scheduler waits for a lookup or reply before deciding
+	// again, 50ms by default
+	PollInterval time.Duration `yaml:"poll_interval"`
+	// Time between requests over a connection, and that it may be idle
+	// before it is kept alive, 3.5s by default
+	ReRequestInterval time.Duration `yaml:"re_request_interval"`
+	// Added to the crawl delay of a connection on each HTTP 429 without
+	// a Retry-After header, 1s by default
+	BackoffIncrement time.Duration `yaml:"backoff_increment"`
+	// Consecutive dial failures before the NAT is suspected to have run
+	// out of connections, 5 by default
+	MaxRepeatedDialFails int `yaml:"max_repeated_dial_fails"`
+	// Most concurrent lookups and requests, 10000 by default
+	WorkerLimit int `yaml:"worker_limit"`
+}
+
+// DefaultPolicy is the policy natck measures with unless told otherwise.
+func DefaultPolicy() Policy {
+	return Policy{
+		PollInterval:         defaultPollInterval,
+		ReRequestInterval:    reRequestInterval,
+		BackoffIncrement:     defaultBackoffIncrement,
+		MaxRepeatedDialFails: maxRepeatedDialFails,
+		WorkerLimit:          workerLimit,
+	}
+}
+
+// withDefaults sets the fields of p left zero to their defaults.
+func (p Policy) withDefaults() Policy {
+	d := DefaultPolicy()
+	return Policy{
+		PollInterval:         cmp.Or(p.PollInterval, d.PollInterval),
+		ReRequestInterval:    cmp.Or(p.ReRequestInterval, d.ReRequestInterval),
+		BackoffIncrement:     cmp.Or(p.BackoffIncrement, d.BackoffIncrement),
+		MaxRepeatedDialFails: cmp.Or(p.MaxRepeatedDialFails, d.MaxRepeatedDialFails),
+		WorkerLimit:          cmp.Or(p.WorkerLimit, d.WorkerLimit),
+	}
+}
+
+// merge sets the fields set by other, taking precedence over p.
+func (p *Policy) merge(other Policy) {
+	p.PollInterval = cmp.Or(other.PollInterval, p.PollInterval)
+	p.ReRequestInterval = cmp.Or(other.ReRequestInterval, p.ReRequestInterval)
+	p.BackoffIncrement = cmp.Or(other.BackoffIncrement, p.BackoffIncrement)
+	p.MaxRepeatedDialFails = cmp.Or(other.MaxRepeatedDialFails, p.MaxRepeatedDialFails)
+	p.WorkerLimit = cmp.Or(other.WorkerLimit, p.WorkerLimit)
+}
+
+// validate rejects policies the scheduler cannot measure with. The poll
+// interval must stay under the re-request interval, else connections are
+// requested late and look idle to the NAT.
+func (p Policy) validate() error {
+	if p.PollInterval < 0 || p.ReRequestInterval < 0 || p.BackoffIncrement < 0 {
+		return errors.New("policy intervals cannot be negative")
+	}
+	if p.MaxRepeatedDialFails < 0 {
+		return errors.New("policy dial failures cannot be negative")
+	}
+	if p.WorkerLimit < 0 {
+		return errors.New("policy worker limit cannot be negative")
+	}
+	p = p.withDefaults()
+	if p.PollInterval < time.Millisecond {
+		return fmt.Errorf("policy poll interval %v is under 1ms, the scheduler would spin", p.PollInterval)
+	}
+	if p.PollInterval >= p.ReRequestInterval {
+		return fmt.Errorf("policy poll interval %v must be shorter than the re-request interval %v", p.PollInterval, p.ReRequestInterval)
+	}
+	return nil
+}
+
+// policy is the policy of the measurement, with the defaults filled in.
+func (m *Measurer) policy() Policy {
+	return m.Policy.withDefaults()
+}
+
+// parsePolicy reads a policy from YAML like
+//
+//	poll_interval: 100ms
+//	re_request_interval: 5s
+//	max_repeated_dial_fails: 10
+func parsePolicy(r io.Reader) (Policy, error) {
+	var p Policy
+	dec := yaml.NewDecoder(r)
+	dec.KnownFields(true)
+	err := dec.Decode(&p)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return Policy{}, fmt.Errorf("failed to parse policy: %w", err)
+	}
+	err = p.validate()
+	if err != nil {
+		return Policy{}, err
+	}
+	return p, nil
+}
+
+func loadPolicy(path string) (Policy, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Policy{}, fmt.Errorf("failed to open policy: %w", err)
+	}
+	defer f.Close()
+	return parsePolicy(f)
+}
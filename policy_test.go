@@ -0,0 +1,64 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePolicy(t *testing.T) {
+	testcases := map[string]struct {
+		in     string
+		expect Policy
+		err    bool
+	}{
+		"Empty": {in: "", expect: Policy{}},
+		"Some fields": {
+			in:     "poll_interval: 100ms\nmax_repeated_dial_fails: 10\n",
+			expect: Policy{PollInterval: 100 * time.Millisecond, MaxRepeatedDialFails: 10},
+		},
+		"Every field": {
+			in: "poll_interval: 20ms\nre_request_interval: 5s\nbackoff_increment: 2s\nmax_repeated_dial_fails: 3\nworker_limit: 500\n",
+			expect: Policy{
+				PollInterval:         20 * time.Millisecond,
+				ReRequestInterval:    5 * time.Second,
+				BackoffIncrement:     2 * time.Second,
+				MaxRepeatedDialFails: 3,
+				WorkerLimit:          500,
+			},
+		},
+		"Unknown field":              {in: "poll: 100ms\n", err: true},
+		"Bad duration":               {in: "poll_interval: soon\n", err: true},
+		"Negative":                   {in: "worker_limit: -1\n", err: true},
+		"Spinning poll interval":     {in: "poll_interval: 1us\n", err: true},
+		"Poll over re-request":       {in: "poll_interval: 5s\n", err: true},
+		"Poll over given re-request": {in: "poll_interval: 5s\nre_request_interval: 10s\n", expect: Policy{PollInterval: 5 * time.Second, ReRequestInterval: 10 * time.Second}},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			p, err := parsePolicy(strings.NewReader(tc.in))
+			if (err != nil) != tc.err {
+				t.Fatalf("expected error %v, got %v", tc.err, err)
+			}
+			if p != tc.expect {
+				t.Errorf("expected %+v, got %+v", tc.expect, p)
+			}
+		})
+	}
+}
+
+func TestPolicyMerge(t *testing.T) {
+	p := Policy{PollInterval: 100 * time.Millisecond, WorkerLimit: 500}
+	p.merge(Policy{WorkerLimit: 200, BackoffIncrement: 2 * time.Second})
+	expect := Policy{PollInterval: 100 * time.Millisecond, BackoffIncrement: 2 * time.Second, WorkerLimit: 200}
+	if p != expect {
+		t.Errorf("expected %+v, got %+v", expect, p)
+	}
+
+	m := Measurer{Policy: p}
+	got := m.policy()
+	if got.PollInterval != 100*time.Millisecond || got.ReRequestInterval != reRequestInterval || got.MaxRepeatedDialFails != maxRepeatedDialFails {
+		t.Errorf("expected the defaults to fill the fields left zero, got %+v", got)
+	}
+}
@@ -0,0 +1,32 @@
+// Functions related to excluding hosts that ask not to be crawled, when
+// measuring strictly politely.
+package main
+
+import "time"
+
+// Crawl-delays longer than this are extreme, longer than most servers
+// keep idle connections alive for.
+const strictMaxCrawlDelay = 30 * time.Second
+
+// welcomesCrawling reports whether a robots.txt allows crawling the
+// site at a reasonable rate.
+func welcomesCrawling(r RobotsTxt) bool {
+	if !r.pathAllowed("/") {
+		return false
+	}
+	delay, _ := r.crawlDelay()
+	return delay <= strictMaxCrawlDelay
+}
+
+// excludeImpolite closes the connection if its host does not welcome
+// crawling, when measuring strictly politely. It reports whether the
+// connection was closed.
+func (s *scheduler) excludeImpolite(c *connection) bool {
+	if !s.m.StrictPoliteness || welcomesCrawling(c.robots) {
+		return false
+	}
+	s.politenessExclusions++
+	s.m.log().Info("excluded as robots.txt does not welcome crawling", connectionAttrs(c)...)
+	s.closeConnection(c)
+	return true
+}
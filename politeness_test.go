@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/url"
+	"path"
+	"testing"
+)
+
+func TestWelcomesCrawling(t *testing.T) {
+	testcases := map[string]struct {
+		in  RobotsTxt
+		out bool
+	}{
+		"No rules":            {in: RobotsTxt{}, out: true},
+		"Disallow some":       {in: RobotsTxt{ruleDisallow: {"/private"}}, out: true},
+		"Disallow all":        {in: RobotsTxt{ruleDisallow: {"/"}}, out: false},
+		"Short Crawl-delay":   {in: RobotsTxt{ruleCrawlDelay: {"10s"}}, out: true},
+		"Extreme Crawl-delay": {in: RobotsTxt{ruleCrawlDelay: {"1h0m0s"}}, out: false},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			if got := welcomesCrawling(tc.in); got != tc.out {
+				t.Errorf("expected welcomesCrawling to be %v, got %v", tc.out, got)
+			}
+		})
+	}
+}
+
+func TestStrictPoliteness(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping due to re-request timeouts.")
+	}
+
+	robots := map[string][]rule{
+		"welcoming":    {{Token: ruleCrawlDelay, Value: "0.000001"}, {Token: ruleAllow, Value: "/"}},
+		"disallow-all": {{Token: ruleDisallow, Value: "/"}},
+		"slow":         {{Token: ruleCrawlDelay, Value: "3600"}},
+	}
+	urls := []*url.URL{}
+	for name, rules := range robots {
+		srv := &httpTestServer{name: name}
+		startHttpServer(t, srv)
+
+		root := makeServerRoot(t, tPath("no_links.html"))
+		makeRobotsTxt(t, []record{{Agents: []string{"*"}, Rules: rules}}, path.Join(root, "robots.txt"))
+		srv.server.Handler = HandlerChain{
+			makeFileHandler(root),
+		}
+		urls = append(urls, srv.tUrl(t, ""))
+	}
+
+	// Crawling the slow host would take hours without strict politeness
+	m := Measurer{StrictPoliteness: true}
+	r, err := m.Measure(urls)
+	if err != nil {
+		t.Fatal("Failed to measure: ", err)
+	}
+	if r.MaxConnections != 1 {
+		t.Errorf("expected to measure 1 connection, got %d", r.MaxConnections)
+	}
+	if r.PolitenessExclusions != 2 {
+		t.Errorf("expected 2 hosts excluded, got %d", r.PolitenessExclusions)
+	}
+}
@@ -0,0 +1,29 @@
+// Functions related to measuring from an existing load, the first
+// connections standing in for the household's usual traffic, so the
+// result is the headroom users have left rather than the absolute
+// capacity.
+package main
+
+// preloadEstablished counts c towards the preload, if it is still being
+// established.
+func (s *scheduler) preloadEstablished(c *connection) {
+	if s.preloaded >= s.m.Preload {
+		return
+	}
+	c.preload = true
+	s.preloaded++
+	if s.preloaded == s.m.Preload {
+		s.markPhase(PhasePreloadEstablished)
+	}
+}
+
+// headroom is the number of conns beyond the preload.
+func headroom(conns []*connection) int {
+	n := 0
+	for _, c := range conns {
+		if !c.preload {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestPreload(t *testing.T) {
+	testcases := map[string]struct {
+		inPreload       int
+		expectPreloaded int
+		expectHeadroom  int
+		expectWarning   bool
+	}{
+		"None":          {expectHeadroom: 20},
+		"Some":          {inPreload: 5, expectPreloaded: 5, expectHeadroom: 15},
+		"Every host":    {inPreload: 20, expectPreloaded: 20},
+		"Past capacity": {inPreload: 30, expectPreloaded: 20, expectWarning: true},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			n := &benchNetwork{hosts: 20, fanout: 2, seeds: 2}
+			m := Measurer{network: n, Preload: tc.inPreload}
+			r, err := m.Measure(n.seedUrls())
+			if err != nil {
+				t.Fatal("Failed to measure: ", err)
+			}
+			if r.Preloaded != tc.expectPreloaded || r.Headroom != tc.expectHeadroom {
+				t.Errorf("expected %d preloaded with headroom of %d, got %d with %d", tc.expectPreloaded, tc.expectHeadroom, r.Preloaded, r.Headroom)
+			}
+			if r.MaxConnections != n.hosts {
+				t.Errorf("expected to measure %d connections, got %d", n.hosts, r.MaxConnections)
+			}
+			established := slices.ContainsFunc(r.Phases, func(p Phase) bool { return p.Name == PhasePreloadEstablished })
+			if established != (tc.inPreload > 0 && !tc.expectWarning) {
+				t.Errorf("expected the preload established phase %v, got %v", !tc.expectWarning, established)
+			}
+			if warned := len(r.Warnings) > 0; warned != tc.expectWarning {
+				t.Errorf("expected a warning %v, got %v", tc.expectWarning, r.Warnings)
+			}
+		})
+	}
+}
@@ -0,0 +1,36 @@
+// Functions related to detecting whether optional features that need
+// raw sockets can run with the privileges natck was started with.
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/net/icmp"
+)
+
+var errNoRawSockets = errors.New("raw sockets are unavailable, run as root or grant CAP_NET_RAW")
+
+// listenIcmp opens an ICMP socket, preferring raw sockets but falling
+// back to the unprivileged ping sockets some kernels allow.
+func listenIcmp() (*icmp.PacketConn, error) {
+	return listenIcmpWith(icmp.ListenPacket)
+}
+
+func listenIcmpWith(listen func(network, address string) (*icmp.PacketConn, error)) (*icmp.PacketConn, error) {
+	conn, err := listen("ip4:icmp", "0.0.0.0")
+	if err == nil {
+		return conn, nil
+	}
+
+	conn, err = listen("udp4", "0.0.0.0")
+	if err == nil {
+		return conn, nil
+	}
+	return nil, errNoRawSockets
+}
+
+// degradedNotice explains in the report why a feature was skipped.
+func degradedNotice(feature string, err error) string {
+	return fmt.Sprintf("%v was disabled: %v", feature, err)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	"golang.org/x/net/icmp"
+)
+
+func TestListenIcmp(t *testing.T) {
+	testcases := map[string]struct {
+		inAllowed   []string
+		expectTried []string
+		expectConn  string
+		expectErr   error
+	}{
+		"Raw": {
+			inAllowed:   []string{"ip4:icmp", "udp4"},
+			expectTried: []string{"ip4:icmp"},
+			expectConn:  "ip4:icmp",
+		},
+		"Unprivileged fallback": {
+			inAllowed:   []string{"udp4"},
+			expectTried: []string{"ip4:icmp", "udp4"},
+			expectConn:  "udp4",
+		},
+		"Neither": {
+			expectTried: []string{"ip4:icmp", "udp4"},
+			expectErr:   errNoRawSockets,
+		},
+	}
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			var tried []string
+			conns := map[string]*icmp.PacketConn{}
+			listen := func(network, address string) (*icmp.PacketConn, error) {
+				tried = append(tried, network)
+				if !slices.Contains(tc.inAllowed, network) {
+					return nil, errors.New("operation not permitted")
+				}
+				conns[network] = &icmp.PacketConn{}
+				return conns[network], nil
+			}
+
+			conn, err := listenIcmpWith(listen)
+			if !errors.Is(err, tc.expectErr) {
+				t.Errorf("expected error %v, got %v", tc.expectErr, err)
+			}
+			if !slices.Equal(tried, tc.expectTried) {
+				t.Errorf("expected to try %v, got %v", tc.expectTried, tried)
+			}
+			if conn != conns[tc.expectConn] {
+				t.Errorf("expected the %q socket", tc.expectConn)
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+// Functions related to reporting the progress of long measurements, so a
+// large seed list converging can be told apart from a stuck one.
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"time"
+)
+
+// defaultProgressInterval is the time between reports of progress, by
+// default.
+const defaultProgressInterval = 10 * time.Second
+
+// Progress is how far a measurement underway has got.
+type Progress struct {
+	Elapsed            time.Duration
+	ActiveConnections  int
+	PendingConnections int
+	// Urls of hosts waiting to be looked up
+	PendingResolutions int
+	FailedHosts        int
+}
+
+func (p Progress) String() string {
+	return fmt.Sprintf("%v elapsed, %d active connections, %d pending, %d hosts to resolve, %d failed",
+		p.Elapsed.Round(time.Second), p.ActiveConnections, p.PendingConnections, p.PendingResolutions, p.FailedHosts)
+}
+
+// checkProgress reports the progress every Measurer.ProgressInterval.
+func (s *scheduler) checkProgress() {
+	if s.m.OnProgress == nil {
+		return
+	}
+	now := time.Now()
+	if now.Sub(cmp.Or(s.progressReported, s.started)) < cmp.Or(s.m.ProgressInterval, defaultProgressInterval) {
+		return
+	}
+	s.progressReported = now
+	s.m.OnProgress(Progress{
+		Elapsed:            now.Sub(s.started),
+		ActiveConnections:  len(s.activeConns),
+		PendingConnections: len(s.pendingConns),
+		PendingResolutions: s.pendingResolutions.len(),
+		FailedHosts:        len(s.failedConns),
+	})
+}
+
+// progressWriter writes each report of progress as a line.
+func progressWriter(w io.Writer) func(Progress) {
+	return func(p Progress) {
+		fmt.Fprintf(w, "Progress: %v\n", p)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProgress(t *testing.T) {
+	n := &benchNetwork{hosts: 20, fanout: 2, seeds: 2}
+	reports := []Progress{}
+	m := Measurer{
+		network:          n,
+		ProgressInterval: time.Nanosecond,
+		OnProgress:       func(p Progress) { reports = append(reports, p) },
+	}
+	r, err := m.Measure(n.seedUrls())
+	if err != nil {
+		t.Fatal("Failed to measure: ", err)
+	}
+	if len(reports) == 0 {
+		t.Fatal("expected the progress to be reported")
+	}
+	for i, p := range reports {
+		if p.ActiveConnections > n.hosts || p.FailedHosts != 0 {
+			t.Errorf("expected at most %d active connections and none failed, got %v", n.hosts, p)
+		}
+		if i > 0 && p.Elapsed < reports[i-1].Elapsed {
+			t.Errorf("expected the elapsed time to grow, got %v after %v", p.Elapsed, reports[i-1].Elapsed)
+		}
+	}
+	if last := reports[len(reports)-1]; last.ActiveConnections != r.MaxConnections {
+		t.Errorf("expected the last report to have %d active connections, got %d", r.MaxConnections, last.ActiveConnections)
+	}
+}
+
+func TestProgressWriter(t *testing.T) {
+	var b strings.Builder
+	progressWriter(&b)(Progress{
+		Elapsed:            90*time.Second + 400*time.Millisecond,
+		ActiveConnections:  120,
+		PendingConnections: 3,
+		PendingResolutions: 500,
+		FailedHosts:        12,
+	})
+	expect := "Progress: 1m30s elapsed, 120 active connections, 3 pending, 500 hosts to resolve, 12 failed\n"
+	if b.String() != expect {
+		t.Errorf("expected %q, got %q", expect, b.String())
+	}
+}
@@ -0,0 +1,49 @@
+// Functions related to connecting through the proxies of the
+// environment. Proxied measurements measure the NAT of the proxy rather
+// than the local one, so the proxies used are reported.
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+)
+
+// usedProxies are the proxies connections were made through.
+type usedProxies struct {
+	m       sync.Mutex
+	proxies map[string]bool
+}
+
+// add records a proxy, without any credentials in its url.
+func (p *usedProxies) add(u *url.URL) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if p.proxies == nil {
+		p.proxies = map[string]bool{}
+	}
+	p.proxies[(&url.URL{Scheme: u.Scheme, Host: u.Host}).String()] = true
+}
+
+func (p *usedProxies) list() []string {
+	p.m.Lock()
+	defer p.m.Unlock()
+	proxies := []string{}
+	for proxy := range p.proxies {
+		proxies = append(proxies, proxy)
+	}
+	slices.Sort(proxies)
+	return proxies
+}
+
+// proxyFunc chooses the proxy of each request, nil connects directly.
+func (m *Measurer) proxyFunc() func(*http.Request) (*url.URL, error) {
+	if m.NoEnvProxy {
+		return nil
+	}
+	if m.proxy != nil {
+		return m.proxy
+	}
+	return http.ProxyFromEnvironment
+}
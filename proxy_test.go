@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"sync/atomic"
+	"testing"
+)
+
+func TestProxy(t *testing.T) {
+	origin := &httpTestServer{name: "origin"}
+	startHttpServer(t, origin)
+	proxy := &httpTestServer{name: "proxy"}
+	startHttpServer(t, proxy)
+
+	root := makeServerRoot(t, tPath("wildcard_robots.txt"))
+	cpFile(t, tPath("no_links.html"), path.Join(root, "index.html"))
+	counter := func(n *atomic.Int32) HandlerFunc {
+		return func(res http.ResponseWriter, req *http.Request) bool {
+			n.Add(1)
+			return true
+		}
+	}
+	var originRequests, proxyRequests atomic.Int32
+	origin.server.Handler = HandlerChain{counter(&originRequests), makeFileHandler(root)}
+	proxy.server.Handler = HandlerChain{counter(&proxyRequests), makeFileHandler(root)}
+	proxyUrl := &url.URL{Scheme: "http", Host: proxy.server.Addr}
+
+	testcases := map[string]struct {
+		noEnvProxy      bool
+		expectedProxies []string
+	}{
+		"proxied": {
+			expectedProxies: []string{proxyUrl.String()},
+		},
+		"no env proxy": {
+			noEnvProxy:      true,
+			expectedProxies: []string{},
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			originRequests.Store(0)
+			proxyRequests.Store(0)
+			m := Measurer{NoEnvProxy: tc.noEnvProxy, proxy: http.ProxyURL(proxyUrl)}
+			r, err := m.Measure([]*url.URL{origin.tUrl(t, "")})
+			if err != nil {
+				t.Fatal("Failed to measure: ", err)
+			}
+
+			if !slices.Equal(r.Proxies, tc.expectedProxies) {
+				t.Errorf("expected proxies %v, got %v", tc.expectedProxies, r.Proxies)
+			}
+			viaProxy := len(tc.expectedProxies) > 0
+			if viaProxy != (proxyRequests.Load() > 0) || viaProxy == (originRequests.Load() > 0) {
+				t.Errorf("expected requests via the proxy to be %v, got %d to the proxy and %d to the origin", viaProxy, proxyRequests.Load(), originRequests.Load())
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+// Functions related to the reflector, replying to each request with the
+// address it came from, so natck can find the external IP of a NAT.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+)
+
+// reflectorOptions are the flags of the reflector command.
+type reflectorOptions struct {
+	fs     *flag.FlagSet
+	listen string
+	ports  string
+}
+
+func newReflectorFlags(name string) *reflectorOptions {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	o := &reflectorOptions{fs: fs}
+	fs.StringVar(&o.listen, "listen", ":8080", "reply to requests on this address")
+	fs.StringVar(&o.ports, "ports", "", "also reply on each of this range of ports, like 8000-8999, for measurements with --single-target")
+	return o
+}
+
+// reflectorHandler replies with the address of the client, allowing
+// robots to request everything.
+func reflectorHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/robots.txt", func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprint(res, "User-agent: *\nAllow: /\n")
+	})
+	mux.HandleFunc("/", reflectAddr)
+	return mux
+}
+
+// listenReflector listens on addr and on each port of ports on its host,
+// if any.
+func listenReflector(addr string, ports string) ([]net.Listener, error) {
+	addrs := []string{addr}
+	if ports != "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid listen address: %w", err)
+		}
+		r, err := parsePortRange(ports)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range r.ports() {
+			addrs = append(addrs, net.JoinHostPort(host, strconv.Itoa(int(p))))
+		}
+	}
+
+	listeners := []net.Listener{}
+	for _, a := range addrs {
+		l, err := net.Listen("tcp", a)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("failed to listen on %v: %w", a, err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// reflectAddr replies with the address the request came from, the
+// external address of any NAT on the way.
+func reflectAddr(res http.ResponseWriter, req *http.Request) {
+	addr, err := netip.ParseAddrPort(req.RemoteAddr)
+	if err != nil {
+		http.Error(res, "unknown client address", http.StatusInternalServerError)
+		return
+	}
+	res.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(res, addr.Addr().Unmap())
+}
+
+func reflectorCommand(name string, args []string) {
+	o := newReflectorFlags(name)
+	parseCommandArgs(o.fs, args, "", 0, false)
+
+	listeners, err := listenReflector(o.listen, o.ports)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	served := make(chan error)
+	for _, l := range listeners {
+		go func() {
+			served <- http.Serve(l, reflectorHandler())
+		}()
+	}
+	fmt.Printf("Failed to serve: %v\n", <-served)
+	os.Exit(1)
+}
@@ -0,0 +1,439 @@
+// Functions related to writing the result of a measurement in formats
+// for downstream analysis.
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var reportFormats = map[string]func(w io.Writer, r *Result) error{
+	"json": writeJsonReport,
+	"csv":  writeCsvReport,
+	"html": writeHtmlReport,
+}
+
+var htmlReport = template.Must(template.New("report").Funcs(template.FuncMap{
+	"heatColor": heatColor,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>natck report</title>
+<style>.heatmap td { min-width: 0.5em; height: 1em; padding: 0; }</style>
+</head>
+<body>
+<h1>natck measured {{.MaxConnections}} max connections</h1>
+<table>
+<tr><th>Peak established</th><td>{{.PeakEstablished}}</td></tr>
+<tr><th>Counted after</th><td>{{.CountedAfter}}</td></tr>
+<tr><th>Bytes sent</th><td>{{.BytesSent}}</td></tr>
+<tr><th>Bytes received</th><td>{{.BytesReceived}}</td></tr>
+<tr><th>Over budget</th><td>{{.OverBudget}}</td></tr>
+<tr><th>Unstable</th><td>{{.Unstable}}{{if .ConfirmationRuns}} after {{.ConfirmationRuns}} confirmation runs{{end}}</td></tr>
+<tr><th>Refused redials</th><td>{{.RefusedRedials}}</td></tr>
+<tr><th>Mappings lost</th><td>{{.MappingsLost}}</td></tr>
+<tr><th>Aliases</th><td>{{.Aliases}}</td></tr>
+<tr><th>Half-open connections</th><td>{{.HalfOpenConnections}}</td></tr>
+<tr><th>Memory sheds</th><td>{{.MemorySheds}}, {{.ShedUrls}} urls</td></tr>
+<tr><th>Politeness exclusions</th><td>{{.PolitenessExclusions}}</td></tr>
+<tr><th>Sensitive port hosts</th><td>{{.SensitivePortHosts}}</td></tr>
+<tr><th>Duplicate pages</th><td>{{.DuplicatePages}}</td></tr>
+<tr><th>Crawler trap urls</th><td>{{.TrapUrls}}</td></tr>
+<tr><th>robots.txt failures</th><td>{{.RobotsFailures}}</td></tr>
+<tr><th>5xx replies to robots.txt</th><td>{{.RobotsServerErrors}}</td></tr>
+<tr><th>5xx replies to content</th><td>{{.ContentServerErrors}}</td></tr>
+{{- if .Preloaded}}
+<tr><th>Preloaded</th><td>{{.Preloaded}}, headroom of {{.Headroom}}</td></tr>
+{{- end}}
+{{- with .Destination}}
+<tr><th>Single destination</th><td>{{.}}</td></tr>
+{{- end}}
+{{- with .Metadata}}
+{{- with .Interface}}
+<tr><th>Interface</th><td>{{.}}</td></tr>
+{{- end}}
+{{- with .LocalIp}}
+<tr><th>Local IP</th><td>{{.}}</td></tr>
+{{- end}}
+{{- with .Gateway}}
+<tr><th>Gateway</th><td>{{.}}</td></tr>
+{{- end}}
+{{- with .GatewayMac}}
+<tr><th>Gateway MAC</th><td>{{.}}</td></tr>
+{{- end}}
+{{- with .GatewayVendor}}
+<tr><th>Gateway vendor</th><td>{{.}}</td></tr>
+{{- end}}
+{{- with .ExternalIp}}
+<tr><th>External IP</th><td>{{.}}</td></tr>
+{{- end}}
+{{- end}}
+{{- range .ExternalIps}}
+<tr><th>External IP used</th><td>{{.Ip}} by {{.Connections}} connections to the reflector</td></tr>
+{{- end}}
+{{- range .ExternalIpChanges}}
+<tr><th>External IP changed</th><td>{{.From}} to {{.To}} at {{.Time.Format "2006-01-02T15:04:05.999999999Z07:00"}}, {{.LostConnections}} of {{.EstablishedConnections}} established connections lost after</td></tr>
+{{- end}}
+{{- range .Proxies}}
+<tr><th>Proxied through</th><td>{{.}}</td></tr>
+{{- end}}
+{{- range .SchemeUpgrades}}
+<tr><th>Upgraded to https</th><td>{{.From}} to {{.To}}</td></tr>
+{{- end}}
+{{- with .KeepAliveTuning}}
+<tr><th>Keep-alive tuned to</th><td>{{.Interval}}, survived {{.SafeIdle}} idle, dropped after {{.DroppedIdle}}</td></tr>
+{{- end}}
+{{- with .Hairpin}}
+<tr><th>Hairpinning</th><td>{{if .Supported}}supported{{else}}not supported{{end}}, to {{.ExternalAddress}} learnt by {{.Method}}</td></tr>
+{{- end}}
+{{- with .DoubleNat}}
+<tr><th>Double NAT</th><td>{{.DoubleNat}}{{if .CarrierGrade}}, carrier-grade{{end}}, hops {{range $i, $h := .Hops}}{{if $i}}, {{end}}{{or $h "*"}}{{end}}</td></tr>
+{{- end}}
+{{- with .Upnp}}
+<tr><th>UPnP gateway</th><td>{{or .Name .Model "unnamed"}} {{.Service}}, {{or .ConnectionStatus "unknown status"}} for {{.Uptime}}, WAN address {{.ExternalIp}}{{with .PortMappings}}, {{.}}{{end}}{{if .PortMappingsCapped}}+{{end}}{{if .PortMappings}} port mappings{{end}}</td></tr>
+{{- end}}
+{{- with .MappingProtocol}}
+<tr><th>Explicit mappings</th><td>{{if not .Protocol}}neither PCP nor NAT-PMP answered{{else if .Mapped}}granted over {{.Protocol}}, {{.InternalPort}} to {{.ExternalIp}}:{{.ExternalPort}} for {{.Lifetime}}{{else}}refused over {{.Protocol}}, {{.Refused}}{{end}}</td></tr>
+{{- end}}
+{{- with .DualStack}}
+<tr><th>Dual-stacked hosts</th><td>{{.DualStacked}} of {{.Hosts}}, {{.Ipv6Only}} IPv6 only</td></tr>
+{{- end}}
+{{- with .UplinkRtt}}
+<tr><th>Uplink rtt min/median/max</th><td>{{.Min}}/{{.Median}}/{{.Max}}, {{.Lost}} of {{.Sent}} echoes lost</td></tr>
+{{- end}}
+</table>
+{{- with .Statuses}}
+<h2>Last HTTP status of the connections</h2>
+<table>
+<tr><th>2xx</th><th>3xx</th><th>4xx</th><th>5xx</th><th>429</th><th>503</th><th>None</th></tr>
+<tr><td>{{.Status2xx}}</td><td>{{.Status3xx}}</td><td>{{.Status4xx}}</td><td>{{.Status5xx}}</td><td>{{.Status429}}</td><td>{{.Status503}}</td><td>{{.None}}</td></tr>
+</table>
+{{- end}}
+{{- with .BySchemePort}}
+<h2>Connections by scheme and port</h2>
+<table>
+<tr><th>Scheme</th><th>Port</th><th>Max connections</th></tr>
+{{- range .}}
+<tr><td>{{.Scheme}}</td><td>{{.Port}}</td><td>{{.MaxConnections}}</td></tr>
+{{- end}}
+</table>
+{{- end}}
+{{- with .Tls}}
+<h2>TLS connections</h2>
+<table>
+<tr><th>Host</th><th>ALPN</th><th>Resumed</th><th>ECH accepted</th></tr>
+{{- range .}}
+<tr><td>{{.Host}}</td><td>{{.Alpn}}</td><td>{{.Resumed}}</td><td>{{.EchAccepted}}</td></tr>
+{{- end}}
+</table>
+{{- end}}
+{{- with .UserAgents}}
+<h2>User-Agents</h2>
+<table>
+<tr><th>Host</th><th>User-Agent</th></tr>
+{{- range .}}
+<tr><td>{{.Host}}</td><td>{{.UserAgent}}</td></tr>
+{{- end}}
+</table>
+{{- end}}
+{{- with .Hostnames}}
+<h2>Hostnames of the connections</h2>
+<table>
+<tr><th>Address</th><th>Hostnames</th><th>Aliases</th></tr>
+{{- range .}}
+<tr><td>{{.Address}}</td><td>{{range $i, $h := .Hostnames}}{{if $i}}, {{end}}{{$h}}{{end}}</td><td>{{.Aliases}}</td></tr>
+{{- end}}
+</table>
+{{- end}}
+{{- with .Headers}}
+<h2>Response headers</h2>
+<table>
+<tr><th>Host</th><th>Header</th><th>Value</th></tr>
+{{- range .}}
+{{- $host := .Host}}
+{{- range $name, $value := .Headers}}
+<tr><td>{{$host}}</td><td>{{$name}}</td><td>{{$value}}</td></tr>
+{{- end}}
+{{- end}}
+</table>
+{{- end}}
+{{- with .LatencyHeatmap}}
+<h2>Latency heatmap</h2>
+<p>Mean latency of each host every {{.Interval}}, from green to red at {{.Max}}</p>
+<table class="heatmap">
+<tr><th>Connections</th>{{range .Connections}}<td>{{.}}</td>{{end}}</tr>
+{{- $max := .Max}}
+{{- range .Hosts}}
+<tr><th>{{.Host}}</th>{{range .Latencies}}{{if .}}<td style="background-color: {{heatColor . $max}}" title="{{.}}"></td>{{else}}<td></td>{{end}}{{end}}</tr>
+{{- end}}
+</table>
+{{- end}}
+{{- with .Exhaustion}}
+<h2>Exhaustion</h2>
+<p>Eviction policy: {{.Policy}}, order correlation {{.OrderCorrelation}}</p>
+{{- with .Evicted}}
+<table>
+<tr><th>Evicted host</th><th>After exhaustion</th></tr>
+{{- range .}}
+<tr><td>{{.Host}}</td><td>{{.AfterExhaustion}}</td></tr>
+{{- end}}
+</table>
+{{- end}}
+{{- end}}
+{{- with .Stages}}
+<h2>Stages</h2>
+<table>
+<tr><th>Stage</th><th>Start</th><th>End</th><th>Connections</th><th>Counted</th><th>Failed</th></tr>
+{{- range .}}
+<tr><td>{{.Stage}}</td><td>{{.Start.Format "2006-01-02T15:04:05.999999999Z07:00"}}</td><td>{{.End.Format "2006-01-02T15:04:05.999999999Z07:00"}}</td><td>{{.Connections}}</td><td>{{.Counted}}</td><td>{{.Failed}}</td></tr>
+{{- end}}
+</table>
+{{- end}}
+<h2>Phases</h2>
+<table>
+<tr><th>Phase</th><th>Time</th></tr>
+{{- range .Phases}}
+<tr><td>{{.Name}}</td><td>{{.Time.Format "2006-01-02T15:04:05.999999999Z07:00"}}</td></tr>
+{{- end}}
+</table>
+{{- with .Warnings}}
+<h2>Warnings</h2>
+<ul>
+{{- range .}}
+<li>{{.}}</li>
+{{- end}}
+</ul>
+{{- end}}
+{{- with .Notices}}
+<h2>Notices</h2>
+<ul>
+{{- range .}}
+<li>{{.}}</li>
+{{- end}}
+</ul>
+{{- end}}
+</body>
+</html>
+`))
+
+func writeJsonReport(w io.Writer, r *Result) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// reportRows are the kind, name and value of each figure of the result,
+// phase, eviction and notice.
+func reportRows(r *Result) [][]string {
+	rows := [][]string{
+		{"result", "max_connections", strconv.Itoa(r.MaxConnections)},
+		{"result", "peak_established", strconv.Itoa(r.PeakEstablished)},
+		{"result", "counted_after", r.CountedAfter},
+		{"result", "bytes_sent", strconv.FormatUint(r.BytesSent, 10)},
+		{"result", "bytes_received", strconv.FormatUint(r.BytesReceived, 10)},
+		{"result", "over_budget", strconv.FormatBool(r.OverBudget)},
+		{"result", "confirmation_runs", strconv.Itoa(r.ConfirmationRuns)},
+		{"result", "unstable", strconv.FormatBool(r.Unstable)},
+		{"result", "refused_redials", strconv.Itoa(r.RefusedRedials)},
+		{"result", "mappings_lost", strconv.Itoa(r.MappingsLost)},
+		{"result", "aliases", strconv.Itoa(r.Aliases)},
+		{"result", "half_open_connections", strconv.Itoa(r.HalfOpenConnections)},
+		{"result", "memory_sheds", strconv.Itoa(r.MemorySheds)},
+		{"result", "shed_urls", strconv.Itoa(r.ShedUrls)},
+		{"result", "dropped_lookups", strconv.Itoa(r.DroppedLookups)},
+		{"result", "politeness_exclusions", strconv.Itoa(r.PolitenessExclusions)},
+		{"result", "sensitive_port_hosts", strconv.Itoa(r.SensitivePortHosts)},
+		{"result", "duplicate_pages", strconv.Itoa(r.DuplicatePages)},
+		{"result", "trap_urls", strconv.Itoa(r.TrapUrls)},
+		{"result", "robots_failures", strconv.Itoa(r.RobotsFailures)},
+		{"result", "robots_server_errors", strconv.Itoa(r.RobotsServerErrors)},
+		{"result", "content_server_errors", strconv.Itoa(r.ContentServerErrors)},
+		{"result", "preloaded", strconv.Itoa(r.Preloaded)},
+		{"result", "headroom", strconv.Itoa(r.Headroom)},
+	}
+	if r.Destination != "" {
+		rows = append(rows, []string{"result", "destination", r.Destination})
+	}
+	if md := r.Metadata; md != nil {
+		for _, f := range [][2]string{
+			{"interface", md.Interface},
+			{"local_ip", md.LocalIp},
+			{"gateway", md.Gateway},
+			{"gateway_mac", md.GatewayMac},
+			{"gateway_vendor", md.GatewayVendor},
+			{"external_ip", md.ExternalIp},
+		} {
+			if f[1] != "" {
+				rows = append(rows, []string{"metadata", f[0], f[1]})
+			}
+		}
+	}
+	if k := r.KeepAliveTuning; k != nil {
+		rows = append(rows,
+			[]string{"keep_alive_tuning", "interval", k.Interval.String()},
+			[]string{"keep_alive_tuning", "safe_idle", k.SafeIdle.String()},
+			[]string{"keep_alive_tuning", "dropped_idle", k.DroppedIdle.String()},
+		)
+	}
+	if h := r.Hairpin; h != nil {
+		rows = append(rows,
+			[]string{"hairpin", "supported", strconv.FormatBool(h.Supported)},
+			[]string{"hairpin", "method", h.Method},
+			[]string{"hairpin", "external_address", h.ExternalAddress},
+		)
+	}
+	if d := r.DoubleNat; d != nil {
+		rows = append(rows,
+			[]string{"double_nat", "double_nat", strconv.FormatBool(d.DoubleNat)},
+			[]string{"double_nat", "carrier_grade", strconv.FormatBool(d.CarrierGrade)},
+			[]string{"double_nat", "hops", strings.Join(d.Hops, " ")},
+			[]string{"double_nat", "networks", strings.Join(d.Networks, " ")},
+		)
+	}
+	if u := r.Upnp; u != nil {
+		mappings := ""
+		if u.PortMappings != nil {
+			mappings = strconv.Itoa(*u.PortMappings)
+		}
+		rows = append(rows,
+			[]string{"upnp", "name", u.Name},
+			[]string{"upnp", "manufacturer", u.Manufacturer},
+			[]string{"upnp", "model", u.Model},
+			[]string{"upnp", "service", u.Service},
+			[]string{"upnp", "connection_status", u.ConnectionStatus},
+			[]string{"upnp", "uptime", u.Uptime.String()},
+			[]string{"upnp", "external_ip", u.ExternalIp},
+			[]string{"upnp", "port_mappings", mappings},
+			[]string{"upnp", "port_mappings_capped", strconv.FormatBool(u.PortMappingsCapped)},
+		)
+	}
+	if p := r.MappingProtocol; p != nil {
+		rows = append(rows,
+			[]string{"mapping_protocol", "protocol", p.Protocol},
+			[]string{"mapping_protocol", "mapped", strconv.FormatBool(p.Mapped)},
+			[]string{"mapping_protocol", "refused", p.Refused},
+			[]string{"mapping_protocol", "external_ip", p.ExternalIp},
+			[]string{"mapping_protocol", "internal_port", strconv.Itoa(int(p.InternalPort))},
+			[]string{"mapping_protocol", "external_port", strconv.Itoa(int(p.ExternalPort))},
+			[]string{"mapping_protocol", "lifetime", p.Lifetime.String()},
+		)
+	}
+	if d := r.DualStack; d != nil {
+		rows = append(rows,
+			[]string{"dual_stack", "hosts", strconv.Itoa(d.Hosts)},
+			[]string{"dual_stack", "dual_stacked", strconv.Itoa(d.DualStacked)},
+			[]string{"dual_stack", "ipv6_only", strconv.Itoa(d.Ipv6Only)},
+		)
+	}
+	if rtt := r.UplinkRtt; rtt != nil {
+		rows = append(rows,
+			[]string{"uplink_rtt", "min", rtt.Min.String()},
+			[]string{"uplink_rtt", "median", rtt.Median.String()},
+			[]string{"uplink_rtt", "max", rtt.Max.String()},
+			[]string{"uplink_rtt", "sent", strconv.Itoa(rtt.Sent)},
+			[]string{"uplink_rtt", "lost", strconv.Itoa(rtt.Lost)},
+		)
+	}
+	st := r.Statuses
+	for _, s := range []struct {
+		class string
+		n     int
+	}{{"2xx", st.Status2xx}, {"3xx", st.Status3xx}, {"4xx", st.Status4xx}, {"5xx", st.Status5xx}, {"429", st.Status429}, {"503", st.Status503}, {"none", st.None}} {
+		rows = append(rows, []string{"status", s.class, strconv.Itoa(s.n)})
+	}
+	for _, s := range r.BySchemePort {
+		rows = append(rows, []string{"scheme_port", s.Scheme + ":" + s.Port, strconv.Itoa(s.MaxConnections)})
+	}
+	for _, c := range r.Tls {
+		rows = append(rows,
+			[]string{"tls_alpn", c.Host, c.Alpn},
+			[]string{"tls_resumed", c.Host, strconv.FormatBool(c.Resumed)},
+			[]string{"tls_ech_accepted", c.Host, strconv.FormatBool(c.EchAccepted)},
+		)
+	}
+	for _, c := range r.UserAgents {
+		rows = append(rows, []string{"user_agent", c.Host, c.UserAgent})
+	}
+	for _, c := range r.Hostnames {
+		rows = append(rows, []string{"hostnames", c.Address, strings.Join(c.Hostnames, " ")})
+	}
+	for _, c := range r.Headers {
+		for _, n := range slices.Sorted(maps.Keys(c.Headers)) {
+			rows = append(rows, []string{"header", c.Host, n + ": " + c.Headers[n]})
+		}
+	}
+	for _, p := range r.Proxies {
+		rows = append(rows, []string{"proxy", p, "true"})
+	}
+	for _, u := range r.SchemeUpgrades {
+		rows = append(rows, []string{"scheme_upgrade", u.From, u.To})
+	}
+	for _, u := range r.ExternalIps {
+		rows = append(rows, []string{"external_ip", u.Ip, strconv.Itoa(u.Connections)})
+	}
+	for _, c := range r.ExternalIpChanges {
+		at := c.Time.Format(time.RFC3339Nano)
+		rows = append(rows,
+			[]string{"external_ip_change", at, c.From + " -> " + c.To},
+			[]string{"external_ip_change_established", at, strconv.Itoa(c.EstablishedConnections)},
+			[]string{"external_ip_change_lost", at, strconv.Itoa(c.LostConnections)},
+		)
+	}
+	if e := r.Exhaustion; e != nil {
+		rows = append(rows,
+			[]string{"exhaustion", "policy", e.Policy},
+			[]string{"exhaustion", "order_correlation", strconv.FormatFloat(e.OrderCorrelation, 'f', -1, 64)},
+		)
+		for _, ev := range e.Evicted {
+			rows = append(rows, []string{"evicted", ev.Host, ev.AfterExhaustion.String()})
+		}
+	}
+	for _, st := range r.Stages {
+		rows = append(rows,
+			[]string{"stage", st.Stage, st.Start.Format(time.RFC3339Nano)},
+			[]string{"stage_connections", st.Stage, strconv.Itoa(st.Connections)},
+			[]string{"stage_counted", st.Stage, strconv.Itoa(st.Counted)},
+			[]string{"stage_failed", st.Stage, strconv.Itoa(st.Failed)},
+		)
+	}
+	for _, p := range r.Phases {
+		rows = append(rows, []string{"phase", string(p.Name), p.Time.Format(time.RFC3339Nano)})
+	}
+	for _, w := range r.Warnings {
+		rows = append(rows, []string{"warning", "", w})
+	}
+	for _, n := range r.Notices {
+		rows = append(rows, []string{"notice", "", n})
+	}
+	return rows
+}
+
+// writeCsvReport writes one kind,name,value row per figure of the result,
+// phase, eviction and notice.
+func writeCsvReport(w io.Writer, r *Result) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"kind", "name", "value"})
+	cw.WriteAll(reportRows(r))
+	return cw.Error()
+}
+
+func writeHtmlReport(w io.Writer, r *Result) error {
+	return htmlReport.Execute(w, r)
+}
+
+func writeReport(w io.Writer, format string, r *Result) error {
+	write, found := reportFormats[format]
+	if !found {
+		return fmt.Errorf("unsupported report format %q", format)
+	}
+	return write(w, r)
+}
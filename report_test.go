@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteReport(t *testing.T) {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	r := &Result{
+		MaxConnections: 42,
+		Warnings:       []string{"12 hosts excluded by robots.txt"},
+		Notices:        []string{"ICMP monitoring was disabled"},
+		BySchemePort: []SchemePortConnections{
+			{Scheme: "http", Port: "80", MaxConnections: 30},
+			{Scheme: "https", Port: "443", MaxConnections: 12},
+		},
+		ExternalIps: []ExternalIpUse{{Ip: "203.0.113.5", Connections: 6}, {Ip: "203.0.113.6", Connections: 2}},
+		ExternalIpChanges: []ExternalIpChange{
+			{Time: start.Add(time.Minute), From: "203.0.113.5", To: "203.0.113.9", EstablishedConnections: 30, LostConnections: 28},
+		},
+		Metadata: &RunMetadata{Interface: "eth0", LocalIp: "192.168.2.20", ExternalIp: "203.0.113.5"},
+		LatencyHeatmap: &LatencyHeatmap{
+			Start:       start,
+			Interval:    time.Second,
+			Connections: []int{1, 2},
+			Max:         time.Second,
+			Hosts:       []HostLatencies{{Host: "a.test:80", Latencies: []time.Duration{0, time.Second}}},
+		},
+		Headers: []ConnectionHeaders{
+			{Host: "a.test:80", Headers: map[string]string{"Via": "1.1 varnish", "Cf-Ray": "8f1c-SYD"}},
+		},
+		Exhaustion: &ExhaustionReport{
+			Policy:  EvictionPolicyLru,
+			Evicted: []Eviction{{Host: "a.test:80", AfterExhaustion: 2 * time.Second}},
+		},
+		Phases: []Phase{
+			{Name: PhaseResolutionStart, Time: start},
+			{Name: PhaseExhaustionDetected, Time: start.Add(90 * time.Second)},
+			{Name: PhaseEnd, Time: start.Add(2 * time.Minute)},
+		},
+	}
+
+	testcases := map[string]struct {
+		format   string
+		contains []string
+	}{
+		"JSON": {
+			format: "json",
+			contains: []string{
+				`"max_connections": 42`,
+				`"scheme": "https"`,
+				`"name": "exhaustion-detected"`,
+				`"time": "2024-05-01T12:01:30Z"`,
+				`"policy": "lru"`,
+				`"Cf-Ray": "8f1c-SYD"`,
+				`"external_ip": "203.0.113.5"`,
+			},
+		},
+		"CSV": {
+			format: "csv",
+			contains: []string{
+				"result,max_connections,42\n",
+				"scheme_port,https:443,12\n",
+				"phase,exhaustion-detected,2024-05-01T12:01:30Z\n",
+				"evicted,a.test:80,2s\n",
+				"external_ip,203.0.113.5,6\nexternal_ip,203.0.113.6,2\n",
+				"external_ip_change,2024-05-01T12:01:00Z,203.0.113.5 -> 203.0.113.9\n",
+				"metadata,interface,eth0\nmetadata,local_ip,192.168.2.20\nmetadata,external_ip,203.0.113.5\n",
+				"header,a.test:80,Cf-Ray: 8f1c-SYD\nheader,a.test:80,Via: 1.1 varnish\n",
+				"warning,,12 hosts excluded by robots.txt\n",
+				"notice,,ICMP monitoring was disabled\n",
+			},
+		},
+		"HTML": {
+			format: "html",
+			contains: []string{
+				"42 max connections",
+				"<td>https</td><td>443</td><td>12</td>",
+				"<td>exhaustion-detected</td><td>2024-05-01T12:01:30Z</td>",
+				"<li>12 hosts excluded by robots.txt</li>",
+				"<li>ICMP monitoring was disabled</li>",
+				"<td>a.test:80</td><td>2s</td>",
+				"<td>a.test:80</td><td>Via</td><td>1.1 varnish</td>",
+				"<tr><th>External IP</th><td>203.0.113.5</td></tr>",
+				"<td>203.0.113.6 by 2 connections to the reflector</td>",
+				"<td>203.0.113.5 to 203.0.113.9 at 2024-05-01T12:01:00Z, 28 of 30 established connections lost after</td>",
+				`<tr><th>a.test:80</th><td></td><td style="background-color: #ff0000" title="1s"></td></tr>`,
+			},
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			var b bytes.Buffer
+			err := writeReport(&b, tc.format, r)
+			if err != nil {
+				t.Fatal("Failed to write report: ", err)
+			}
+			for _, c := range tc.contains {
+				if !strings.Contains(b.String(), c) {
+					t.Errorf("expected report to contain %q, got\n%v", c, b.String())
+				}
+			}
+		})
+	}
+}
+
+func TestUnsupportedReportFormat(t *testing.T) {
+	var b bytes.Buffer
+	if err := writeReport(&b, "xml", &Result{}); err == nil {
+		t.Error("expected unsupported format to fail")
+	}
+}
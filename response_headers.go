@@ -0,0 +1,75 @@
+// Functions related to recording response headers of each connection, to
+// identify the CDNs and proxies mediating the measurement.
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// diagnosticHeaders are the response headers that usually reveal a CDN or
+// proxy, suggested for Measurer.CaptureHeaders.
+var diagnosticHeaders = []string{"Server", "Via", "CF-RAY", "X-Cache"}
+
+// ConnectionHeaders are the captured response headers of a connection,
+// the last value seen of each.
+type ConnectionHeaders struct {
+	Host    string            `json:"host"`
+	Headers map[string]string `json:"headers"`
+}
+
+// parseHeaderNames parses a comma separated list of header names.
+func parseHeaderNames(s string) []string {
+	names := []string{}
+	for _, n := range strings.Split(s, ",") {
+		n = strings.TrimSpace(n)
+		if n != "" {
+			names = append(names, http.CanonicalHeaderKey(n))
+		}
+	}
+	return names
+}
+
+// captureHeaders are the values of the named headers in h, nil if none
+// were sent.
+func captureHeaders(h http.Header, names []string) map[string]string {
+	var captured map[string]string
+	for _, n := range names {
+		v := h.Values(n)
+		if len(v) == 0 {
+			continue
+		}
+		if captured == nil {
+			captured = map[string]string{}
+		}
+		captured[http.CanonicalHeaderKey(n)] = strings.Join(v, ", ")
+	}
+	return captured
+}
+
+// recordHeaders keeps the headers captured from the reply on c.
+func recordHeaders(c *connection, reply *roundtrip) {
+	if len(reply.headers) == 0 {
+		return
+	}
+	if c.headers == nil {
+		c.headers = map[string]string{}
+	}
+	for n, v := range reply.headers {
+		c.headers[n] = v
+	}
+}
+
+func connectionHeaders(conns []*connection) []ConnectionHeaders {
+	headers := []ConnectionHeaders{}
+	for _, c := range conns {
+		if len(c.headers) == 0 {
+			continue
+		}
+		headers = append(headers, ConnectionHeaders{
+			Host:    c.host.hostPort,
+			Headers: c.headers,
+		})
+	}
+	return headers
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"testing"
+)
+
+func TestCaptureHeaders(t *testing.T) {
+	testcases := map[string]struct {
+		inNames    string
+		expHeaders map[string]string
+	}{
+		"None": {
+			inNames:    "",
+			expHeaders: nil,
+		},
+		"Diagnostic": {
+			inNames:    "Server,Via,CF-RAY,X-Cache",
+			expHeaders: map[string]string{"Server": "cloudflare", "Cf-Ray": "8f1c-SYD", "X-Cache": "HIT, MISS"},
+		},
+		"Lower case": {
+			inNames:    " server , x-cache",
+			expHeaders: map[string]string{"Server": "cloudflare", "X-Cache": "HIT, MISS"},
+		},
+		"Not sent": {
+			inNames:    "Via",
+			expHeaders: nil,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+				res.Header().Set("Server", "cloudflare")
+				res.Header().Set("CF-RAY", "8f1c-SYD")
+				res.Header().Add("X-Cache", "HIT")
+				res.Header().Add("X-Cache", "MISS")
+			}))
+			defer srv.Close()
+			u, err := url.Parse(srv.URL)
+			if err != nil {
+				t.Fatal("Failed to parse server url: ", err)
+			}
+			addr := netip.MustParseAddrPort(u.Host)
+			ctx := context.WithValue(context.Background(), ctxAddrKey{}, addr)
+			c := makeConnection(addr, u, &traffic{}, nil)
+			defer c.client.CloseIdleConnections()
+
+			r := makeCrawlRequest(c)
+			r.captureHeaders = parseHeaderNames(tc.inNames)
+			r = scrapConnection(ctx, r)
+			if r.err != nil {
+				t.Fatal("Failed to scrap: ", r.err)
+			}
+			recordHeaders(c, r)
+			if !maps.Equal(c.headers, tc.expHeaders) {
+				t.Errorf("expected headers %v, got %v", tc.expHeaders, c.headers)
+			}
+		})
+	}
+}
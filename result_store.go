@@ -0,0 +1,319 @@
+// Functions related to storing the results of past measurements, so the
+// history of a daemon survives restarts and can be queried later.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	resultStoreTimeout = 10 * time.Second
+	// Results natck history lists by default
+	defaultHistoryLimit = 20
+)
+
+// errStoreNotListable is listing a store only results are sent to.
+var errStoreNotListable = errors.New("the store cannot be listed")
+
+// StoredResult is a result kept by a ResultStore.
+type StoredResult struct {
+	Finished time.Time `json:"finished"`
+	Result   *Result   `json:"result"`
+}
+
+// ResultStore keeps the results of past measurements.
+type ResultStore interface {
+	Save(r StoredResult) error
+	// List the limit most recent results, oldest first, all of them if
+	// limit is zero.
+	List(limit int) ([]StoredResult, error)
+	Close() error
+}
+
+// openResultStore parses target as file:path for JSON lines,
+// sqlite:path for a SQLite database, or an http:// or https:// url to
+// post each result to.
+func openResultStore(target string) (ResultStore, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse result store: %w", err)
+	}
+	path := cmp.Or(u.Opaque, u.Path)
+
+	switch u.Scheme {
+	case "file":
+		if path == "" {
+			return nil, fmt.Errorf("file result store %v has no path", target)
+		}
+		return &fileStore{path: path}, nil
+	case "sqlite":
+		if path == "" {
+			return nil, fmt.Errorf("sqlite result store %v has no path", target)
+		}
+		return openSqliteStore(path)
+	case "http", "https":
+		return &httpStore{target: target}, nil
+	}
+	return nil, fmt.Errorf("unsupported result store %q, expected file:, sqlite:, http:// or https://", u.Scheme)
+}
+
+// lastResults are the limit last of results, all of them if limit is
+// zero.
+func lastResults(results []StoredResult, limit int) []StoredResult {
+	if limit > 0 && len(results) > limit {
+		return results[len(results)-limit:]
+	}
+	return results
+}
+
+// fileStore appends each result to a file as a line of JSON.
+type fileStore struct {
+	path string
+	m    sync.Mutex
+}
+
+func (s *fileStore) Save(r StoredResult) error {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("failed to encode result: %w", err)
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open result store: %w", err)
+	}
+	_, err = f.Write(append(line, '\n'))
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write result store: %w", err)
+	}
+	return f.Close()
+}
+
+func (s *fileStore) List(limit int) ([]StoredResult, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	f, err := os.Open(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return []StoredResult{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open result store: %w", err)
+	}
+	defer f.Close()
+
+	results := []StoredResult{}
+	scanner := bufio.NewScanner(f)
+	// Results with many connections make for long lines
+	scanner.Buffer(nil, 64<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var r StoredResult
+		err := json.Unmarshal(scanner.Bytes(), &r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse line %d of result store: %w", line, err)
+		}
+		results = append(results, r)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read result store: %w", err)
+	}
+	return lastResults(results, limit), nil
+}
+
+func (s *fileStore) Close() error {
+	return nil
+}
+
+// sqliteStore keeps the results in a SQLite database, with the max
+// connections in a column of their own for queries.
+type sqliteStore struct {
+	db *sql.DB
+}
+
+// sqliteSupported is whether a database/sql driver for SQLite was
+// compiled in, see sqlite_driver.go.
+func sqliteSupported() bool {
+	return slices.Contains(sql.Drivers(), "sqlite")
+}
+
+func openSqliteStore(path string) (*sqliteStore, error) {
+	if !sqliteSupported() {
+		return nil, errors.New("sqlite result stores need natck built with -tags sqlite")
+	}
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open result store: %w", err)
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS results (
+		finished TEXT NOT NULL,
+		max_connections INTEGER NOT NULL,
+		result TEXT NOT NULL
+	)`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create results table: %w", err)
+	}
+	return &sqliteStore{db: db}, nil
+}
+
+func (s *sqliteStore) Save(r StoredResult) error {
+	result, err := json.Marshal(r.Result)
+	if err != nil {
+		return fmt.Errorf("failed to encode result: %w", err)
+	}
+	_, err = s.db.Exec("INSERT INTO results (finished, max_connections, result) VALUES (?, ?, ?)",
+		r.Finished.UTC().Format(time.RFC3339Nano), r.Result.MaxConnections, string(result))
+	if err != nil {
+		return fmt.Errorf("failed to insert result: %w", err)
+	}
+	return nil
+}
+
+func (s *sqliteStore) List(limit int) ([]StoredResult, error) {
+	// A negative limit is no limit to SQLite
+	rows, err := s.db.Query(`SELECT finished, result FROM (
+		SELECT rowid, finished, result FROM results ORDER BY rowid DESC LIMIT ?
+	) ORDER BY rowid`, cmp.Or(limit, -1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query results: %w", err)
+	}
+	defer rows.Close()
+
+	results := []StoredResult{}
+	for rows.Next() {
+		var finished, result string
+		err := rows.Scan(&finished, &result)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read result: %w", err)
+		}
+		r := StoredResult{Result: &Result{}}
+		r.Finished, err = time.Parse(time.RFC3339Nano, finished)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse finished time %q: %w", finished, err)
+		}
+		err = json.Unmarshal([]byte(result), r.Result)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse result: %w", err)
+		}
+		results = append(results, r)
+	}
+	return results, rows.Err()
+}
+
+func (s *sqliteStore) Close() error {
+	return s.db.Close()
+}
+
+// httpStore posts each result as JSON to a url, like a collector that
+// keeps the history itself.
+type httpStore struct {
+	target string
+}
+
+func (s *httpStore) Save(r StoredResult) error {
+	body, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("failed to encode result: %w", err)
+	}
+
+	client := http.Client{Timeout: resultStoreTimeout}
+	resp, err := client.Post(s.target, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to post result: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("result store replied with %v", resp.Status)
+	}
+	return nil
+}
+
+func (s *httpStore) List(limit int) ([]StoredResult, error) {
+	return nil, fmt.Errorf("%w, results are only posted to %v", errStoreNotListable, s.target)
+}
+
+func (s *httpStore) Close() error {
+	return nil
+}
+
+func printHistory(w io.Writer, results []StoredResult) {
+	if len(results) == 0 {
+		fmt.Fprintln(w, "No results stored yet")
+		return
+	}
+	fmt.Fprintln(w, "Finished                   Max connections  Warnings")
+	for _, r := range results {
+		fmt.Fprintf(w, "%-25v  %15d  %d\n", r.Finished.Format(time.RFC3339), r.Result.MaxConnections, len(r.Result.Warnings))
+	}
+}
+
+// historyOptions are the flags of the history command.
+type historyOptions struct {
+	fs    *flag.FlagSet
+	store string
+	limit int
+	json  bool
+}
+
+func newHistoryFlags(name string) *historyOptions {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	o := &historyOptions{fs: fs}
+	fs.StringVar(&o.store, "store", "", "result store to list, like file:history.jsonl or sqlite:history.db")
+	fs.IntVar(&o.limit, "limit", defaultHistoryLimit, "most recent results to list, 0 lists all")
+	fs.BoolVar(&o.json, "json", false, "print the results as json, for scripts")
+	return o
+}
+
+func historyCommand(name string, args []string) {
+	o := newHistoryFlags(name)
+	parseCommandArgs(o.fs, args, "", 0, false)
+	if o.store == "" {
+		fmt.Println("No result store, set one with --store")
+		os.Exit(2)
+	}
+
+	store, err := openResultStore(o.store)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	defer store.Close()
+	results, err := store.List(max(o.limit, 0))
+	if err != nil {
+		fmt.Printf("Failed to list results: %v\n", err)
+		os.Exit(1)
+	}
+	if !o.json {
+		printHistory(os.Stdout, results)
+		return
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	err = enc.Encode(results)
+	if err != nil {
+		fmt.Printf("Failed to print results: %v\n", err)
+		os.Exit(1)
+	}
+}
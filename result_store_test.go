@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestOpenResultStore(t *testing.T) {
+	testcases := map[string]struct {
+		in  string
+		out ResultStore
+	}{
+		"file":           {in: "file:history.jsonl", out: &fileStore{path: "history.jsonl"}},
+		"file url":       {in: "file:///var/lib/natck/history.jsonl", out: &fileStore{path: "/var/lib/natck/history.jsonl"}},
+		"http":           {in: "https://collector.example.com/results", out: &httpStore{target: "https://collector.example.com/results"}},
+		"no path":        {in: "file:"},
+		"unknown":        {in: "carrier-pigeon:coop"},
+		"sqlite no path": {in: "sqlite:"},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			got, err := openResultStore(tc.in)
+			if tc.out == nil {
+				if err == nil {
+					t.Errorf("expected %v to be rejected", tc.in)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal("Failed to open result store: ", err)
+			}
+			switch s := got.(type) {
+			case *fileStore:
+				if s.path != tc.out.(*fileStore).path {
+					t.Errorf("expected path %v, got %v", tc.out.(*fileStore).path, s.path)
+				}
+			case *httpStore:
+				if s.target != tc.out.(*httpStore).target {
+					t.Errorf("expected target %v, got %v", tc.out.(*httpStore).target, s.target)
+				}
+			}
+		})
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	s := &fileStore{path: filepath.Join(t.TempDir(), "history.jsonl")}
+	results, err := s.List(0)
+	if err != nil || len(results) != 0 {
+		t.Fatalf("expected no results before any were saved, got %v and %v", results, err)
+	}
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := range 5 {
+		err := s.Save(StoredResult{Finished: start.Add(time.Duration(i) * time.Hour), Result: &Result{MaxConnections: 100 + i}})
+		if err != nil {
+			t.Fatal("Failed to save result: ", err)
+		}
+	}
+
+	testcases := map[string]struct {
+		inLimit int
+		outMax  []int
+	}{
+		"all":         {inLimit: 0, outMax: []int{100, 101, 102, 103, 104}},
+		"most recent": {inLimit: 2, outMax: []int{103, 104}},
+		"over limit":  {inLimit: 10, outMax: []int{100, 101, 102, 103, 104}},
+	}
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			results, err := s.List(tc.inLimit)
+			if err != nil {
+				t.Fatal("Failed to list results: ", err)
+			}
+			if len(results) != len(tc.outMax) {
+				t.Fatalf("expected %v results, got %v", len(tc.outMax), len(results))
+			}
+			for i, r := range results {
+				if r.Result.MaxConnections != tc.outMax[i] {
+					t.Errorf("expected result %v to have %v connections, got %v", i, tc.outMax[i], r.Result.MaxConnections)
+				}
+				if !r.Finished.Equal(start.Add(time.Duration(tc.outMax[i]-100) * time.Hour)) {
+					t.Errorf("unexpected finished time %v of result %v", r.Finished, i)
+				}
+			}
+		})
+	}
+}
+
+func TestHttpStore(t *testing.T) {
+	var got StoredResult
+	srv := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(res, "not a post", http.StatusMethodNotAllowed)
+			return
+		}
+		json.NewDecoder(req.Body).Decode(&got)
+	}))
+	defer srv.Close()
+
+	s := &httpStore{target: srv.URL}
+	err := s.Save(StoredResult{Finished: time.Now(), Result: &Result{MaxConnections: 42}})
+	if err != nil {
+		t.Fatal("Failed to save result: ", err)
+	}
+	if got.Result == nil || got.Result.MaxConnections != 42 {
+		t.Errorf("expected the result to be posted, got %+v", got)
+	}
+	if _, err := s.List(0); !errors.Is(err, errStoreNotListable) {
+		t.Errorf("expected %v, got %v", errStoreNotListable, err)
+	}
+}
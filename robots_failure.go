@@ -0,0 +1,95 @@
+// Functions related to handling hosts whose robots.txt could not be
+// fetched, see RFC 9309 section 2.3.1.
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+const (
+	// Allow everything when robots.txt is unavailable (4xx), disallow
+	// everything when it is unreachable (5xx or timeout).
+	RobotsFailureRfc9309        = "rfc9309"
+	RobotsFailureAssumeAllow    = "assume-allow"
+	RobotsFailureAssumeDisallow = "assume-disallow"
+	// Disallow everything, but fetch robots.txt again with the next
+	// keep-alive.
+	RobotsFailureRetryLater = "retry-later"
+)
+
+var robotsFailurePolicies = []string{
+	RobotsFailureRfc9309,
+	RobotsFailureAssumeAllow,
+	RobotsFailureAssumeDisallow,
+	RobotsFailureRetryLater,
+}
+
+var disallowAllRobotsTxt = RobotsTxt{ruleDisallow: {"/"}}
+
+func checkRobotsFailurePolicy(policy string) error {
+	if policy != "" && !slices.Contains(robotsFailurePolicies, policy) {
+		return fmt.Errorf("unknown robots.txt failure policy %q, expected one of %v", policy, strings.Join(robotsFailurePolicies, ", "))
+	}
+	return nil
+}
+
+// robotsFetchFailed reports whether a reply fetching robots.txt failed,
+// and whether robots.txt was unreachable rather than unavailable. Dial
+// errors fail the connection rather than the fetch.
+func robotsFetchFailed(reply *roundtrip) (bool, bool) {
+	if reply.url.Path != "/robots.txt" {
+		return false, false
+	}
+	if reply.err != nil {
+		return !isDialError(reply.err), true
+	}
+	if reply.status >= 500 {
+		return true, true
+	}
+	return reply.status >= 400, false
+}
+
+// handleRobotsFailure applies the robots.txt failure policy to a
+// connection, keeping it despite the failed fetch. Only the first fetch
+// and its retries count, later keep-alives fetching robots.txt fail like
+// any other request.
+func (s *scheduler) handleRobotsFailure(c *connection, reply *roundtrip, firstReply bool) {
+	failed, unreachable := robotsFetchFailed(reply)
+	if !firstReply && !c.robotsRetry {
+		return
+	}
+	if !failed {
+		if c.robotsRetry && reply.err == nil {
+			// Fetched on retry, drop the delay retrying added
+			c.robotsRetry = false
+			c.crawlDelay, _ = c.robots.crawlDelay()
+			c.crawlDelay = max(c.crawlDelay, c.minCrawlDelay)
+		}
+		return
+	}
+
+	s.robotsFailures++
+	reply.err = nil
+	switch cmp.Or(s.m.RobotsFailurePolicy, RobotsFailureRfc9309) {
+	case RobotsFailureRfc9309:
+		c.robots = RobotsTxt{}
+		if unreachable {
+			c.robots = disallowAllRobotsTxt
+		}
+	case RobotsFailureAssumeAllow:
+		c.robots = RobotsTxt{}
+	case RobotsFailureAssumeDisallow:
+		c.robots = disallowAllRobotsTxt
+	case RobotsFailureRetryLater:
+		c.robots = disallowAllRobotsTxt
+		c.robotsRetry = true
+		robots := urlToRelativeUrl(reply.url)
+		delete(c.crawledUrls, robots)
+		c.uncrawledUrls[robots] = true
+		// Retry at the pace of keep-alives, not as fast as possible
+		c.crawlDelay = max(c.crawlDelay, cmp.Or(c.keepAliveInterval, reRequestInterval))
+	}
+}
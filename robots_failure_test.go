@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"sync/atomic"
+	"testing"
+)
+
+// makeRobotsFailureHandler replies to the first failures requests for
+// robots.txt with status.
+func makeRobotsFailureHandler(status int, failures int32) HandlerFunc {
+	var served atomic.Int32
+	return func(res http.ResponseWriter, req *http.Request) bool {
+		if req.URL.Path != "/robots.txt" || served.Add(1) > failures {
+			return true
+		}
+		res.WriteHeader(status)
+		return false
+	}
+}
+
+func TestRobotsFailurePolicy(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping due to re-request timeouts.")
+	}
+
+	testcases := map[string]struct {
+		policy    string
+		status    int
+		failures  int32
+		outNConns int
+	}{
+		"Unavailable": {
+			status:    http.StatusNotFound,
+			failures:  1,
+			outNConns: 2,
+		},
+		"Unreachable": {
+			status:    http.StatusServiceUnavailable,
+			failures:  1,
+			outNConns: 1,
+		},
+		"Assume allow": {
+			policy:    RobotsFailureAssumeAllow,
+			status:    http.StatusServiceUnavailable,
+			failures:  1,
+			outNConns: 2,
+		},
+		"Assume disallow": {
+			policy:    RobotsFailureAssumeDisallow,
+			status:    http.StatusNotFound,
+			failures:  1,
+			outNConns: 1,
+		},
+		"Retry later": {
+			policy:    RobotsFailureRetryLater,
+			status:    http.StatusServiceUnavailable,
+			failures:  2,
+			outNConns: 2,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			linked := &httpTestServer{name: "linked"}
+			startHttpServer(t, linked)
+			linked.server.Handler = HandlerChain{
+				makeFileHandler(makeServerRoot(t, tPath("wildcard_robots.txt"), tPath("no_links.html"))),
+			}
+
+			srv := &httpTestServer{name: "server"}
+			startHttpServer(t, srv)
+			root := makeServerRoot(t, tPath("wildcard_robots.txt"))
+			makeHtmlDocWithLinks(t, []*url.URL{linked.tUrl(t, "")}, path.Join(root, "index.html"))
+			srv.server.Handler = HandlerChain{
+				makeRobotsFailureHandler(tc.status, tc.failures),
+				makeFileHandler(root),
+			}
+
+			m := Measurer{RobotsFailurePolicy: tc.policy}
+			r, err := m.Measure([]*url.URL{srv.tUrl(t, "")})
+			if err != nil {
+				t.Fatal("Failed to measure: ", err)
+			}
+			if r.MaxConnections != tc.outNConns {
+				t.Errorf("expected to measure %d connections, got %d", tc.outNConns, r.MaxConnections)
+			}
+			if r.RobotsFailures != int(tc.failures) {
+				t.Errorf("expected %d robots.txt failures, got %d", tc.failures, r.RobotsFailures)
+			}
+		})
+	}
+}
+
+func TestUnknownRobotsFailurePolicy(t *testing.T) {
+	m := Measurer{RobotsFailurePolicy: "ignore"}
+	_, err := m.Measure(nil)
+	if err == nil {
+		t.Error("expected an unknown robots.txt failure policy to fail")
+	}
+}
@@ -0,0 +1,93 @@
+// Functions related to running a measurement in the background, streaming
+// its events, for programs embedding natck like a router's web interface.
+package main
+
+import (
+	"context"
+	"errors"
+	"net/url"
+)
+
+// Events buffered before the measurement waits for them to be received
+const runEventBuffer = 256
+
+// check reports the options that would stop a measurement starting.
+func (m *Measurer) check() error {
+	if _, err := newStrategy(m); err != nil {
+		return err
+	}
+	if err := checkRobotsFailurePolicy(m.RobotsFailurePolicy); err != nil {
+		return err
+	}
+	if err := checkServerErrorPolicy(m.ServerErrorPolicy); err != nil {
+		return err
+	}
+	if err := checkCountAfter(m.CountAfter); err != nil {
+		return err
+	}
+	if err := checkKeepAliveReserve(m.KeepAliveReserve); err != nil {
+		return err
+	}
+	if err := checkSchedule(m); err != nil {
+		return err
+	}
+	if err := checkPins(m); err != nil {
+		return err
+	}
+	if err := checkAlpn(m); err != nil {
+		return err
+	}
+	return m.Socket.check()
+}
+
+// Run measures from urls in the background, streaming the events as they
+// happen. The last event is measurement-finished, with the result, or
+// measurement-failed, then the channel is closed. Cancelling ctx stops
+// the measurement early, reporting the connections so far. Events must
+// be received, or the measurement waits for them.
+//
+// Connections cannot be held, as nothing could release them.
+func (m *Measurer) Run(ctx context.Context, urls []*url.URL) (<-chan Event, error) {
+	if m.Hold {
+		return nil, errors.New("connections cannot be held when running in the background")
+	}
+	if err := m.check(); err != nil {
+		return nil, err
+	}
+
+	events := make(chan Event, runEventBuffer)
+	send := func(e Event) {
+		select {
+		case events <- e:
+			return
+		default:
+		}
+		select {
+		case events <- e:
+		case <-ctx.Done():
+			// Nobody may be receiving once cancelled, events that do
+			// not fit in the buffer are dropped
+		}
+	}
+
+	// A copy, so the caller's Measurer is left as is
+	rm := *m
+	rm.ctx = ctx
+	rm.OnEvent = func(e Event) {
+		if m.OnEvent != nil {
+			m.OnEvent(e)
+		}
+		send(e)
+	}
+	go func() {
+		defer close(events)
+		r, err := rm.Measure(urls)
+		if err != nil {
+			rm.emit(Event{Type: EventMeasurementFailed, Reason: err.Error()})
+			return
+		}
+		e := Event{Type: EventMeasurementFinished, ActiveConnections: r.MaxConnections, Result: r}
+		rm.emit(e)
+	}()
+	return events, nil
+}
@@ -0,0 +1,256 @@
+// Functions related to recording where a measurement was run from, so
+// results from many probes can be attributed to the right network.
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Time to wait for the reflector to reply
+const reflectorTimeout = 10 * time.Second
+
+// ouiFiles are where distributions install the IEEE OUI registry, to
+// find the vendor of the gateway.
+var ouiFiles = []string{
+	"/usr/share/ieee-data/oui.txt",
+	"/usr/share/hwdata/oui.txt",
+	"/usr/share/misc/oui.txt",
+}
+
+// RunMetadata is where the measurement was run from. Anything that could
+// not be found is left empty.
+type RunMetadata struct {
+	Interface     string `json:"interface,omitempty"`
+	LocalIp       string `json:"local_ip,omitempty"`
+	Gateway       string `json:"gateway,omitempty"`
+	GatewayMac    string `json:"gateway_mac,omitempty"`
+	GatewayVendor string `json:"gateway_vendor,omitempty"`
+	// The address the reflector saw, see Measurer.Reflector.
+	ExternalIp string `json:"external_ip,omitempty"`
+}
+
+// localAddr is the address connections are dialed from, the address the
+// dialer binds to or otherwise that of the default route.
+func localAddr(dialer *net.Dialer, ipv6 bool) (netip.Addr, error) {
+	if dialer != nil {
+		if a, ok := dialer.LocalAddr.(*net.TCPAddr); ok {
+			return a.AddrPort().Addr().Unmap(), nil
+		}
+	}
+	// Connecting a UDP socket only picks the route, nothing is sent
+	target := "192.0.2.1:9"
+	if ipv6 {
+		target = "[2001:db8::1]:9"
+	}
+	conn, err := net.Dial("udp", target)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("failed to find the default route: %w", err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).AddrPort().Addr().Unmap(), nil
+}
+
+// interfaceWithAddr is the name of the interface with the address.
+func interfaceWithAddr(addr netip.Addr) (string, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return "", fmt.Errorf("failed to list interfaces: %w", err)
+	}
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			ipNet, ok := a.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			if ip, ok := netip.AddrFromSlice(ipNet.IP); ok && ip.Unmap() == addr {
+				return iface.Name, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no interface has the address %v", addr)
+}
+
+// parseRouteGateway parses the default gateway of iface from a routing
+// table in the format of /proc/net/route.
+func parseRouteGateway(r io.Reader, iface string) (netip.Addr, error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[0] != iface || fields[1] != "00000000" {
+			continue
+		}
+		gateway, err := strconv.ParseUint(fields[2], 16, 32)
+		if err != nil {
+			return netip.Addr{}, fmt.Errorf("failed to parse gateway %q: %w", fields[2], err)
+		}
+		// The kernel writes addresses in host byte order
+		var ip [4]byte
+		binary.LittleEndian.PutUint32(ip[:], uint32(gateway))
+		return netip.AddrFrom4(ip), nil
+	}
+	if err := scanner.Err(); err != nil {
+		return netip.Addr{}, fmt.Errorf("failed to read routes: %w", err)
+	}
+	return netip.Addr{}, fmt.Errorf("%v has no default gateway", iface)
+}
+
+// parseArpMac parses the MAC address of ip from a neighbour table in the
+// format of /proc/net/arp.
+func parseArpMac(r io.Reader, ip netip.Addr) (string, error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || fields[0] != ip.String() {
+			continue
+		}
+		// Incomplete entries have no address yet
+		if fields[2] == "0x0" || fields[3] == "00:00:00:00:00:00" {
+			break
+		}
+		return fields[3], nil
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("failed to read neighbours: %w", err)
+	}
+	return "", fmt.Errorf("the MAC address of %v is unknown", ip)
+}
+
+// parseOuiVendor parses the vendor of mac from the IEEE OUI registry.
+func parseOuiVendor(r io.Reader, mac string) (string, error) {
+	oui := strings.ToUpper(strings.ReplaceAll(mac, ":", "-"))
+	if len(oui) < 8 {
+		return "", fmt.Errorf("invalid MAC address %q", mac)
+	}
+	oui = oui[:8]
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		prefix, vendor, found := strings.Cut(scanner.Text(), "(hex)")
+		if found && strings.TrimSpace(prefix) == oui {
+			return strings.TrimSpace(vendor), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("failed to read the OUI registry: %w", err)
+	}
+	return "", fmt.Errorf("no vendor registered %v", oui)
+}
+
+// macVendor is the vendor of mac in the first OUI registry installed,
+// empty without one.
+func macVendor(mac string) string {
+	for _, path := range ouiFiles {
+		f, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		vendor, err := parseOuiVendor(f, mac)
+		f.Close()
+		if err == nil {
+			return vendor
+		}
+	}
+	return ""
+}
+
+// lookupExternalIp asks the reflector at target for the address it sees
+// the client connecting from, replied as the body.
+func lookupExternalIp(ctx context.Context, client *http.Client, target string) (netip.Addr, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("failed to make request: %w", err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("failed to reach reflector: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return netip.Addr{}, fmt.Errorf("reflector replied %v", resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 256))
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("failed to read reflector reply: %w", err)
+	}
+	reply := strings.TrimSpace(string(body))
+	if addrPort, err := netip.ParseAddrPort(reply); err == nil {
+		return addrPort.Addr().Unmap(), nil
+	}
+	addr, err := netip.ParseAddr(reply)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("reflector replied without an address: %w", err)
+	}
+	return addr.Unmap(), nil
+}
+
+// reflectorClient requests the reflector like the connections are
+// requested, from the same interface and through the same proxy. Each
+// request is on a new connection, so none hold a NAT mapping.
+func (s *scheduler) reflectorClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = s.traffic.proxy
+	transport.DisableKeepAlives = true
+	if s.traffic.dialer != nil {
+		transport.DialContext = s.traffic.dialer.DialContext
+	}
+	return &http.Client{Transport: transport, Timeout: reflectorTimeout}
+}
+
+// runMetadata finds where the measurement is run from, along with the
+// notices of what was asked for but could not be found. The gateway is
+// only found where the platform allows it.
+func (s *scheduler) runMetadata() (*RunMetadata, []string) {
+	md := &RunMetadata{}
+	notices := []string{}
+
+	// Asking the reflector first also resolves the MAC address of the
+	// gateway
+	if s.m.Reflector != "" {
+		ip, err := lookupExternalIp(s.m.context(), s.reflectorClient(), s.m.Reflector)
+		if err != nil {
+			notices = append(notices, degradedNotice("External IP lookup", err))
+		} else {
+			md.ExternalIp = ip.String()
+		}
+	}
+
+	local, err := localAddr(s.traffic.dialer, s.m.Ipv6)
+	if err != nil {
+		return md, notices
+	}
+	md.LocalIp = local.String()
+	md.Interface = s.m.Interface
+	if md.Interface == "" {
+		md.Interface, _ = interfaceWithAddr(local)
+	}
+	if !gatewaySupported || md.Interface == "" || s.m.Ipv6 {
+		return md, notices
+	}
+
+	gateway, mac, err := defaultGateway(md.Interface)
+	if gateway.IsValid() {
+		md.Gateway = gateway.String()
+	}
+	if err != nil {
+		return md, notices
+	}
+	md.GatewayMac = mac
+	md.GatewayVendor = macVendor(mac)
+	return md, notices
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+const testRoutes = `Iface	Destination	Gateway 	Flags	RefCnt	Use	Metric	Mask		MTU	Window	IRTT
+eth0	00000000	0102A8C0	0003	0	0	100	00000000	0	0	0
+eth0	0002A8C0	00000000	0001	0	0	100	00FFFFFF	0	0	0
+wlan0	0000000A	00000000	0001	0	0	600	000000FF	0	0	0
+`
+
+const testNeighbours = `IP address       HW type     Flags       HW address            Mask     Device
+192.168.2.1      0x1         0x2         28:6f:b9:12:34:56     *        eth0
+192.168.2.7      0x1         0x0         00:00:00:00:00:00     *        eth0
+`
+
+const testOui = `OUI/MA-L                                                    Organization
+company_id                                                  Organization
+                                                            Address
+
+28-6F-B9   (hex)		Nokia Shanghai Bell Co., Ltd.
+286FB9     (base 16)		Nokia Shanghai Bell Co., Ltd.
+`
+
+func TestParseRouteGateway(t *testing.T) {
+	testcases := map[string]struct {
+		inIface    string
+		expGateway netip.Addr
+		expErr     bool
+	}{
+		"Default route": {inIface: "eth0", expGateway: netip.MustParseAddr("192.168.2.1")},
+		"No default":    {inIface: "wlan0", expErr: true},
+		"Unknown":       {inIface: "eth1", expErr: true},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			gateway, err := parseRouteGateway(strings.NewReader(testRoutes), tc.inIface)
+			if (err != nil) != tc.expErr {
+				t.Fatalf("expected error to be %v, got %v", tc.expErr, err)
+			}
+			if gateway != tc.expGateway {
+				t.Errorf("expected %v, got %v", tc.expGateway, gateway)
+			}
+		})
+	}
+}
+
+func TestParseArpMac(t *testing.T) {
+	testcases := map[string]struct {
+		inIp   string
+		expMac string
+		expErr bool
+	}{
+		"Resolved":   {inIp: "192.168.2.1", expMac: "28:6f:b9:12:34:56"},
+		"Incomplete": {inIp: "192.168.2.7", expErr: true},
+		"Unknown":    {inIp: "192.168.2.9", expErr: true},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			mac, err := parseArpMac(strings.NewReader(testNeighbours), netip.MustParseAddr(tc.inIp))
+			if (err != nil) != tc.expErr {
+				t.Fatalf("expected error to be %v, got %v", tc.expErr, err)
+			}
+			if mac != tc.expMac {
+				t.Errorf("expected %v, got %v", tc.expMac, mac)
+			}
+		})
+	}
+}
+
+func TestParseOuiVendor(t *testing.T) {
+	testcases := map[string]struct {
+		inMac     string
+		expVendor string
+		expErr    bool
+	}{
+		"Registered":   {inMac: "28:6f:b9:12:34:56", expVendor: "Nokia Shanghai Bell Co., Ltd."},
+		"Unregistered": {inMac: "02:00:00:12:34:56", expErr: true},
+		"Invalid":      {inMac: "28:6f", expErr: true},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			vendor, err := parseOuiVendor(strings.NewReader(testOui), tc.inMac)
+			if (err != nil) != tc.expErr {
+				t.Fatalf("expected error to be %v, got %v", tc.expErr, err)
+			}
+			if vendor != tc.expVendor {
+				t.Errorf("expected %q, got %q", tc.expVendor, vendor)
+			}
+		})
+	}
+}
+
+func TestLookupExternalIp(t *testing.T) {
+	testcases := map[string]struct {
+		inHandler http.HandlerFunc
+		expIp     netip.Addr
+		expErr    bool
+	}{
+		"Reflector": {
+			inHandler: reflectAddr,
+			expIp:     netip.MustParseAddr("127.0.0.1"),
+		},
+		"Address and port": {
+			inHandler: func(res http.ResponseWriter, req *http.Request) { res.Write([]byte("203.0.113.5:40000\n")) },
+			expIp:     netip.MustParseAddr("203.0.113.5"),
+		},
+		"Not an address": {
+			inHandler: func(res http.ResponseWriter, req *http.Request) { res.Write([]byte("<html></html>")) },
+			expErr:    true,
+		},
+		"Failed": {
+			inHandler: func(res http.ResponseWriter, req *http.Request) { http.NotFound(res, req) },
+			expErr:    true,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			srv := httptest.NewServer(tc.inHandler)
+			defer srv.Close()
+
+			ip, err := lookupExternalIp(context.Background(), srv.Client(), srv.URL)
+			if (err != nil) != tc.expErr {
+				t.Fatalf("expected error to be %v, got %v", tc.expErr, err)
+			}
+			if ip != tc.expIp {
+				t.Errorf("expected %v, got %v", tc.expIp, ip)
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRun(t *testing.T) {
+	n := &benchNetwork{hosts: 20, fanout: 2, seeds: 2}
+	m := Measurer{network: n}
+	events, err := m.Run(context.Background(), n.seedUrls())
+	if err != nil {
+		t.Fatal("Failed to run: ", err)
+	}
+
+	established := 0
+	var last Event
+	for e := range events {
+		if e.Type == EventConnectionEstablished {
+			established++
+		}
+		last = e
+	}
+	if established != n.hosts {
+		t.Errorf("expected %d connection-established events, got %d", n.hosts, established)
+	}
+	if last.Type != EventMeasurementFinished || last.Result == nil {
+		t.Fatalf("expected the last event to be measurement-finished with the result, got %+v", last)
+	}
+	if last.Result.MaxConnections != n.hosts {
+		t.Errorf("expected to measure %d hosts, got %d", n.hosts, last.Result.MaxConnections)
+	}
+}
+
+func TestRunCancel(t *testing.T) {
+	n := &benchNetwork{hosts: 4, seeds: 4}
+	m := Measurer{
+		network:         n,
+		Strategy:        "sustain-only",
+		SustainDuration: time.Hour,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := m.Run(ctx, n.seedUrls())
+	if err != nil {
+		t.Fatal("Failed to run: ", err)
+	}
+
+	started := time.Now()
+	var last Event
+	for e := range events {
+		if e.Type == EventConnectionEstablished {
+			cancel()
+		}
+		last = e
+	}
+	if time.Since(started) > 10*time.Second {
+		t.Errorf("expected cancelling to stop the measurement, took %v", time.Since(started))
+	}
+	if last.Type != EventMeasurementFinished {
+		t.Errorf("expected the measurement to finish, got %+v", last)
+	}
+}
+
+func TestRunRejectsOptions(t *testing.T) {
+	testcases := map[string]struct {
+		inMeasurer Measurer
+	}{
+		"Hold": {
+			inMeasurer: Measurer{Hold: true},
+		},
+		"Unknown strategy": {
+			inMeasurer: Measurer{Strategy: "unknown"},
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			_, err := tc.inMeasurer.Run(context.Background(), nil)
+			if err == nil {
+				t.Error("expected the options to be rejected")
+			}
+		})
+	}
+}
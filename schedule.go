@@ -0,0 +1,142 @@
+// Functions related to the schedule strategy, which stages the load like
+// a household does, opening connections in steps and holding each step,
+// to observe the NAT under each level of load.
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Open more connections, on top of those already open
+	StageOpen = "open"
+	// Only keep the open connections alive for a while
+	StageHold = "hold"
+)
+
+// ScheduleStage is one step of a schedule, opening Connections more or
+// holding those open for Duration.
+type ScheduleStage struct {
+	Kind        string
+	Connections int
+	Duration    time.Duration
+}
+
+// StageResult is how the connections fared during a stage of the
+// schedule.
+type StageResult struct {
+	Stage string    `json:"stage"`
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	// Connections open at the end of the stage, counted as usable, and
+	// failed during it
+	Connections int `json:"connections"`
+	Counted     int `json:"counted"`
+	Failed      int `json:"failed"`
+}
+
+// schedule opens and holds connections in the stages given, stopping
+// once the last is over.
+type schedule struct {
+	stages []ScheduleStage
+	// Stage underway, its start, the connections it should end with and
+	// those failed before it
+	i          int
+	stageStart time.Time
+	target     int
+	failed     int
+}
+
+func (st ScheduleStage) String() string {
+	if st.Kind == StageHold {
+		return fmt.Sprintf("%v %v", st.Kind, st.Duration)
+	}
+	return fmt.Sprintf("%v %d", st.Kind, st.Connections)
+}
+
+// parseSchedule parses comma separated stages, like
+// "open 200, hold 5m, open 200, hold 5m".
+func parseSchedule(s string) ([]ScheduleStage, error) {
+	stages := []ScheduleStage{}
+	for _, field := range strings.Split(s, ",") {
+		kind, arg, found := strings.Cut(strings.TrimSpace(field), " ")
+		if !found {
+			return nil, fmt.Errorf("invalid stage %q, expected like open 200 or hold 5m", field)
+		}
+		arg = strings.TrimSpace(arg)
+		switch kind {
+		case StageOpen:
+			n, err := strconv.Atoi(arg)
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("invalid connections to open %q", arg)
+			}
+			stages = append(stages, ScheduleStage{Kind: StageOpen, Connections: n})
+		case StageHold:
+			d, err := time.ParseDuration(arg)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("invalid time to hold %q", arg)
+			}
+			stages = append(stages, ScheduleStage{Kind: StageHold, Duration: d})
+		default:
+			return nil, fmt.Errorf("unknown stage %q, expected %v or %v", kind, StageOpen, StageHold)
+		}
+	}
+	return stages, nil
+}
+
+func checkSchedule(m *Measurer) error {
+	if cmp.Or(m.Strategy, "linear-ramp") == "schedule" && len(m.Schedule) == 0 {
+		return errors.New("the schedule strategy needs a schedule")
+	}
+	return nil
+}
+
+// startStage starts the stage i, if there is one.
+func (sc *schedule) startStage(s *scheduler, i int) {
+	sc.i = i
+	sc.stageStart = s.now()
+	sc.failed = len(s.failedConns)
+	if i < len(sc.stages) && sc.stages[i].Kind == StageOpen {
+		sc.target = len(s.activeConns) + sc.stages[i].Connections
+	}
+}
+
+// endStage records the result of the stage underway and starts the next.
+func (sc *schedule) endStage(s *scheduler) {
+	s.stages = append(s.stages, StageResult{
+		Stage:       sc.stages[sc.i].String(),
+		Start:       sc.stageStart,
+		End:         s.now(),
+		Connections: len(s.activeConns),
+		Counted:     countUsable(s.activeConns, s.m.CountAfter),
+		Failed:      len(s.failedConns) - sc.failed,
+	})
+	sc.startStage(s, sc.i+1)
+}
+
+func (sc *schedule) next(s *scheduler) action {
+	if sc.stageStart.IsZero() {
+		sc.startStage(s, 0)
+	}
+	for sc.i < len(sc.stages) {
+		stage := sc.stages[sc.i]
+		switch stage.Kind {
+		case StageOpen:
+			if len(s.activeConns) < sc.target && !s.exhausted() && !s.outOfWork() {
+				return crawlAction(s.nextConnection(s.pendingConns, s.freeWorkers()))
+			}
+		case StageHold:
+			if s.now().Sub(sc.stageStart) <= stage.Duration {
+				// Only keep-alives whilst holding
+				return crawlAction(s.nextConnection(nil, 0))
+			}
+		}
+		sc.endStage(s)
+	}
+	return action{kind: actionStop}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseSchedule(t *testing.T) {
+	testcases := map[string]struct {
+		in          string
+		expect      []ScheduleStage
+		expectError bool
+	}{
+		"Open and hold": {
+			in: "open 200, hold 5m, open 100,hold 30s",
+			expect: []ScheduleStage{
+				{Kind: StageOpen, Connections: 200},
+				{Kind: StageHold, Duration: 5 * time.Minute},
+				{Kind: StageOpen, Connections: 100},
+				{Kind: StageHold, Duration: 30 * time.Second},
+			},
+		},
+		"Missing argument":   {in: "open", expectError: true},
+		"Unknown stage":      {in: "close 10", expectError: true},
+		"Negative open":      {in: "open -1", expectError: true},
+		"Invalid hold":       {in: "hold 5", expectError: true},
+		"Trailing separator": {in: "open 10,", expectError: true},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			stages, err := parseSchedule(tc.in)
+			if (err != nil) != tc.expectError {
+				t.Fatalf("expected error %v, got %v", tc.expectError, err)
+			}
+			if !tc.expectError && !reflect.DeepEqual(stages, tc.expect) {
+				t.Errorf("expected stages %v, got %v", tc.expect, stages)
+			}
+		})
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	n := &benchNetwork{hosts: 20, fanout: 2, seeds: 2}
+	m := Measurer{network: n, Strategy: "schedule", Schedule: []ScheduleStage{
+		{Kind: StageOpen, Connections: 5},
+		{Kind: StageHold, Duration: 200 * time.Millisecond},
+		{Kind: StageOpen, Connections: 5},
+		{Kind: StageHold, Duration: 200 * time.Millisecond},
+	}}
+	r, err := m.Measure(n.seedUrls())
+	if err != nil {
+		t.Fatal("Failed to measure: ", err)
+	}
+	if len(r.Stages) != len(m.Schedule) {
+		t.Fatalf("expected %d stages, got %v", len(m.Schedule), r.Stages)
+	}
+	for i, expect := range []int{5, 5, 10, 10} {
+		st := r.Stages[i]
+		if st.Stage != m.Schedule[i].String() {
+			t.Errorf("expected stage %d to be %v, got %v", i, m.Schedule[i], st.Stage)
+		}
+		if st.Connections != expect || st.Failed != 0 {
+			t.Errorf("expected %v to end with %d connections, got %d with %d failed", st.Stage, expect, st.Connections, st.Failed)
+		}
+	}
+	if held := r.Stages[1].End.Sub(r.Stages[1].Start); held < 200*time.Millisecond {
+		t.Errorf("expected the connections to be held for %v, got %v", 200*time.Millisecond, held)
+	}
+
+	m.Schedule = nil
+	if _, err := m.Measure(n.seedUrls()); err == nil {
+		t.Error("expected the schedule strategy to need a schedule")
+	}
+}
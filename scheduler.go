@@ -0,0 +1,1179 @@
+// Functions related to scheduling lookups and requests over connections
+// to measure the maximum allowed connections.
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"time"
+)
+
+// Measurer holds the options of a measurement, the zero value
+// measures with the defaults.
+type Measurer struct {
+	// Stop the measurement once more than this many bytes have been
+	// sent and received, zero means no limit.
+	MaxTotalBytes uint64
+	// Shed the urls least likely to be needed whenever the heap grows
+	// over this many bytes, zero means no limit.
+	MemoryBudget uint64
+	// Run on devices with little memory and CPU, like OpenWrt routers.
+	// Caps the workers, parses html with a tokenizer and only keeps
+	// connections alive with HEAD requests after their first page.
+	LowResource bool
+	// Stop once this many connections are counted, the NAT allowing at
+	// least that many, zero is no limit.
+	ConnectionLimit int
+	// Stop the measurement after this long, reporting the connections
+	// so far, zero is no limit.
+	Timeout time.Duration
+	// Timings and thresholds of the scheduler, see DefaultPolicy.
+	Policy Policy
+	// Called as significant events happen during the measurement.
+	OnEvent func(Event)
+	// Logs the lifecycle of each connection, nil logs nothing.
+	Logger *slog.Logger
+	// Called every ProgressInterval with how far the measurement has
+	// got, zero is defaultProgressInterval.
+	OnProgress       func(Progress)
+	ProgressInterval time.Duration
+	// Name of the strategy deciding how connections are ramped up and
+	// down, empty means linear-ramp. See strategies for the options.
+	Strategy string
+	// Minimum time between opening new connections in linear-ramp,
+	// zero opens connections as soon as servers are found.
+	RampInterval time.Duration
+	// Connections sustain-only opens before sustaining them, zero
+	// means one per url measured from.
+	SustainConnections int
+	// How long sustain-only keeps the connections alive for.
+	SustainDuration time.Duration
+	// Time between churn replacing its oldest connection.
+	ChurnInterval time.Duration
+	// Connections established as background load before the measured
+	// ramp, the first ones established. The result reports the headroom
+	// beyond them.
+	Preload int
+	// Stages the schedule strategy opens and holds connections in.
+	Schedule []ScheduleStage
+	// Path to a Starlark script customising the strategy, see script.go
+	// for the hooks it may define.
+	Script string
+	// Protocols offered with ALPN, nil offers h2 and http/1.1 and empty
+	// offers none. Offering h2 also offers http/1.1.
+	Alpn []string
+	// Stop TLS sessions being resumed, otherwise sessions are resumed
+	// across connections and measurements.
+	DisableTlsResumption bool
+	// Only speak HTTP/1.1, so servers cannot multiplex requests over an
+	// HTTP/2 connection and every measured host holds exactly one TCP
+	// connection of its own.
+	DisableHttp2 bool
+	// Roots certificates are verified against, nil is the system roots.
+	RootCAs *x509.CertPool
+	// Name certificates are verified for and sent with SNI, empty is the
+	// hostname of each url. For https targets given by IP address.
+	TlsServerName string
+	// Accept any certificate, for lab servers with self-signed
+	// certificates.
+	InsecureSkipVerify bool
+	// Certificates presented to servers asking for one, like mTLS
+	// protected internal servers.
+	ClientCerts ClientCertificates
+	// Change how the hosts each matches are measured, later overrides
+	// taking precedence.
+	Overrides []HostOverride
+	// Close the connections to hosts whose robots.txt disallows
+	// everything or sets an extreme Crawl-delay, rather than keep them
+	// alive without crawling.
+	StrictPoliteness bool
+	// Move hosts to https once they send Strict-Transport-Security or
+	// upgrade-insecure-requests, dialing their http connections once
+	// more over https.
+	UpgradeInsecure bool
+	// Connect to the ports of sensitive services, like SMTP and RDP,
+	// linked from crawled pages. See sensitivePorts for the ports.
+	AllowSensitivePorts bool
+	// Skip the links that look like crawler traps, by their length,
+	// repeated segments or queries.
+	TrapLimits TrapLimits
+	// Give each connection its own User-Agent from a pool of common
+	// browsers, the same for all its requests.
+	RotateUserAgent bool
+	// Response headers recorded for each connection, like those of
+	// diagnosticHeaders, to identify CDNs and proxies. Nil records none.
+	CaptureHeaders []string
+	// How to treat hosts whose robots.txt fails to be fetched, empty
+	// follows RFC 9309. See robotsFailurePolicies for the options.
+	RobotsFailurePolicy string
+	// Whether 5xx replies fail connections, apart for robots.txt and
+	// content. Empty keeps them, see serverErrorPolicies for the options.
+	ServerErrorPolicy string
+	// When connections count towards the maximum, empty counts them
+	// once connected. See countAfterStages for the options.
+	CountAfter string
+	// Also lookup the IPv6 addresses of each host, to report how many
+	// could bypass the NAT over IPv6. Ignored when measuring IPv6.
+	CompareDualStack bool
+	// Check whether the NAT hairpins, learning the external address
+	// from HairpinStunServer or Reflector. Empty uses
+	// defaultStunServers.
+	CheckHairpin      bool
+	HairpinStunServer string
+	// Trace the first MaxHops hops towards HopTarget, flagging paths
+	// through several NATs. Zero values are defaultMaxHops and
+	// defaultHopTarget.
+	DetectDoubleNat bool
+	HopTarget       netip.Addr
+	MaxHops         int
+	// Skip asking the gateway over UPnP IGD for its WAN status and port
+	// mappings. Otherwise it is asked whilst measuring, and left out of
+	// the result if it has not answered by the end.
+	DisableUpnp bool
+	// Ask the gateway for a mapping with PCP, or NAT-PMP, to tell
+	// whether applications could ask for the mappings they need.
+	CheckMappingProtocols bool
+	// Time a connection may be idle before it is kept alive, zero is
+	// reRequestInterval.
+	KeepAliveInterval time.Duration
+	// Tune the keep-alive interval to the NAT, starting from
+	// KeepAliveInterval, or 2 minutes if zero, and shortening it as
+	// connections are dropped.
+	TuneKeepAlive bool
+	// Fraction of the workers reserved for keep-alives, so crawling for
+	// new hosts cannot delay them past the NAT's idle timeout. Zero is
+	// defaultKeepAliveReserve and negative reserves none.
+	KeepAliveReserve float64
+	// Chooses how the connection to target is kept alive once there is
+	// nothing new to crawl on it, called once per connection. nil, or
+	// returning nil, re-requests pages or sends HTTP/2 PINGs.
+	KeepAlive func(target *url.URL) KeepAliver
+	// Rewrites the body of each html page before its links are scraped,
+	// nil scrapes the body as is.
+	HtmlPreprocessor HtmlPreprocessor
+	// Connect over IPv6 instead of IPv4, to measure NAT66 or stateful
+	// IPv6 firewalls. Link-local targets need a zone, like fe80::1%eth0.
+	Ipv6 bool
+	// Use Encrypted ClientHello with the servers that publish ECH
+	// configs in DNS. Servers rejecting ECH fail to connect.
+	EnableEch bool
+	// Search domains and nameservers of domains to resolve with, beside
+	// the system resolver.
+	Dns DnsConfig
+	// Addresses the seeds of each host:port are connected to without
+	// being looked up, see parseSeedLine.
+	Pins map[string]netip.Addr
+	// Connect directly, ignoring the HTTP_PROXY, HTTPS_PROXY and
+	// NO_PROXY environment variables.
+	NoEnvProxy bool
+	// Dial from this local interface, to measure the NAT of one of
+	// several internal networks. Empty dials over the default route.
+	Interface string
+	// Url of a reflector replying with the address the client connects
+	// from, like natck reflector, to record the external IP. Empty
+	// records none.
+	Reflector string
+	// Time between asking Reflector for the external IP again, to find
+	// the NAT moving the client to another, zero is
+	// defaultReflectorInterval and negative never asks again.
+	ReflectorInterval time.Duration
+	// Time between checking the sockets of the connections for
+	// half-open ones, zero is defaultHalfOpenInterval where supported
+	// and negative never checks. Only supported on linux.
+	HalfOpenInterval time.Duration
+	// Tunes the sockets of the connections, the zero value keeps the
+	// system defaults.
+	Socket SocketOptions
+	// Faults to inject into the client, the zero value injects none.
+	Faults Faults
+	// Export spans of each request and scheduler decision to the
+	// OTLP/HTTP collector at this url, empty exports nothing.
+	OtlpEndpoint string
+	// Keep the established connections open once measured, until
+	// KeepAliveHeld releases them.
+	Hold bool
+
+	// Reaches servers, nil is the live network.
+	network network
+	// Tracks the open connections for the status socket, nil is
+	// untracked.
+	openConns *openConns
+	// Stores the connections, requests and result, nil stores nothing.
+	crawlDb *crawlDb
+	// Chooses the proxy of each request, nil is from the environment.
+	proxy func(*http.Request) (*url.URL, error)
+	// Publish the scheduler counters with expvar
+	publishVars bool
+	// Sessions kept for resumption, unless disabled.
+	tlsSessions tls.ClientSessionCache
+	// Stops the measurement once done, nil runs until the strategy is
+	// finished.
+	ctx context.Context
+	// The last measurement, whilst its connections are held.
+	held *scheduler
+}
+
+// network is how the scheduler reaches servers, which may be recorded or
+// replayed rather than live.
+type network interface {
+	lookupAddr(ctx context.Context, network string, h *url.URL) *resolvedUrl
+	scrapConnection(ctx context.Context, r *roundtrip) *roundtrip
+}
+
+// liveNetwork reaches servers over the real network.
+type liveNetwork struct {
+	// Also lookup the configs for Encrypted ClientHello.
+	ech bool
+	// Connects over IPv6, so only IPv6 lookups need ECH configs.
+	ipv6 bool
+	// Search domains and nameservers beside the system resolver.
+	dns *DnsConfig
+}
+
+// Result is the outcome of a measurement.
+type Result struct {
+	// Connections verified alive within their last keep-alive window
+	// at the end of the measurement.
+	MaxConnections int `json:"max_connections"`
+	// Most connections established at once, which overstates the
+	// capacity if the NAT dropped some without the client noticing.
+	PeakEstablished int `json:"peak_established"`
+	// Connections established as the preload, and the connections
+	// counted beyond them, see Measurer.Preload.
+	Preloaded int `json:"preloaded"`
+	Headroom  int `json:"headroom"`
+	// Stage connections counted after, see Measurer.CountAfter.
+	CountedAfter  string `json:"counted_after"`
+	BytesSent     uint64 `json:"bytes_sent"`
+	BytesReceived uint64 `json:"bytes_received"`
+	// The measurement was stopped early by Measurer.MaxTotalBytes.
+	OverBudget bool `json:"over_budget"`
+	// Measurements repeated as this one differed greatly from the last,
+	// and whether they disagreed, see varianceCheck.
+	ConfirmationRuns int  `json:"confirmation_runs,omitempty"`
+	Unstable         bool `json:"unstable"`
+	// Latency of the uplink whilst measuring, if monitored.
+	UplinkRtt *RttSummary `json:"uplink_rtt,omitempty"`
+	// Times a connection's transport tried to dial its server again,
+	// which was refused to keep to one TCP connection per server.
+	RefusedRedials int `json:"refused_redials"`
+	// Established connections that timed out, as the NAT silently
+	// dropped their mappings, rather than failing with an HTTP error.
+	MappingsLost int `json:"mappings_lost"`
+	// Hostnames crawled that resolved to the address of a connection
+	// opened for another, so measured no connection of their own.
+	Aliases int `json:"aliases"`
+	// Established connections found half-open, dropped by the NAT
+	// whilst the client still believed they were established.
+	HalfOpenConnections int `json:"half_open_connections"`
+	// Times the heap exceeded Measurer.MemoryBudget, and the urls shed
+	// to bring it back under.
+	MemorySheds int `json:"memory_sheds"`
+	ShedUrls    int `json:"shed_urls"`
+	// Urls of hosts dropped as the frontier of hosts waiting to be
+	// looked up was full.
+	DroppedLookups int `json:"dropped_lookups"`
+	// Hosts closed by StrictPoliteness.
+	PolitenessExclusions int `json:"politeness_exclusions"`
+	// Hosts linked on the ports of sensitive services, not connected
+	// to without Measurer.AllowSensitivePorts.
+	SensitivePortHosts int `json:"sensitive_port_hosts"`
+	// Pages with the same content as another page of their server,
+	// whose links were not followed.
+	DuplicatePages int `json:"duplicate_pages"`
+	// Links skipped by Measurer.TrapLimits.
+	TrapUrls int `json:"trap_urls"`
+	// Hosts whose robots.txt failed to be fetched, handled by
+	// Measurer.RobotsFailurePolicy.
+	RobotsFailures int `json:"robots_failures"`
+	// 5xx replies to robots.txt and to other pages, handled by
+	// Measurer.ServerErrorPolicy.
+	RobotsServerErrors  int `json:"robots_server_errors"`
+	ContentServerErrors int `json:"content_server_errors"`
+	// Proxies connections were made through, which measures the NAT
+	// of the proxy rather than the local one.
+	Proxies []string `json:"proxies,omitempty"`
+	// Connections moved to https by Measurer.UpgradeInsecure.
+	SchemeUpgrades []SchemeUpgrade `json:"scheme_upgrades,omitempty"`
+	// The only destination connected to, measuring the limit per
+	// destination, empty when crawling.
+	Destination string `json:"destination,omitempty"`
+	// Where the measurement was run from, nil when not measured over the
+	// real network, like replays.
+	Metadata *RunMetadata `json:"metadata,omitempty"`
+	// Times the external IP changed whilst measuring, found by polling
+	// Measurer.Reflector.
+	ExternalIpChanges []ExternalIpChange `json:"external_ip_changes,omitempty"`
+	// External IPs of the connections to Measurer.Reflector, several if
+	// the NAT spreads the client over a pool.
+	ExternalIps []ExternalIpUse `json:"external_ips,omitempty"`
+	// Whether the NAT hairpins, nil unless Measurer.CheckHairpin.
+	Hairpin *HairpinReport `json:"hairpin,omitempty"`
+	// The NATs the first hops cross, nil unless
+	// Measurer.DetectDoubleNat.
+	DoubleNat *DoubleNatReport `json:"double_nat,omitempty"`
+	// What the gateway reports of itself over UPnP IGD, nil if none
+	// answered whilst measuring or Measurer.DisableUpnp.
+	Upnp *UpnpReport `json:"upnp,omitempty"`
+	// Whether the gateway granted a mapping asked for with PCP or
+	// NAT-PMP, nil unless Measurer.CheckMappingProtocols.
+	MappingProtocol *MappingProtocolReport `json:"mapping_protocol,omitempty"`
+	// Caveats that affect how the result should be interpreted.
+	Warnings []string `json:"warnings,omitempty"`
+	// Optional features that could not run, and why.
+	Notices []string `json:"notices,omitempty"`
+	// What the NAT did to established connections once exhausted, nil
+	// if it was never exhausted with connections established.
+	Exhaustion *ExhaustionReport `json:"exhaustion,omitempty"`
+	// What tuning the keep-alive interval learnt, nil unless
+	// Measurer.TuneKeepAlive.
+	KeepAliveTuning *KeepAliveTuning `json:"keep_alive_tuning,omitempty"`
+	// Hosts also reachable over IPv6, nil unless
+	// Measurer.CompareDualStack.
+	DualStack *DualStackReport `json:"dual_stack,omitempty"`
+	// Latency of each host over the measurement, nil with
+	// Measurer.LowResource.
+	LatencyHeatmap *LatencyHeatmap `json:"latency_heatmap,omitempty"`
+	// Intervals between requests to each host, to check Crawl-delay
+	// was honored.
+	Pacing []HostPacing `json:"pacing,omitempty"`
+	// When the measurement moved between phases, in order.
+	Phases []Phase `json:"phases"`
+	// How the connections fared in each stage of Measurer.Schedule.
+	Stages []StageResult `json:"stages,omitempty"`
+	// Totals of each minute and phase of the measurement, to plot it.
+	Aggregates *Aggregates `json:"aggregates,omitempty"`
+	// The connections counted in MaxConnections by the HTTP status they
+	// last answered with.
+	Statuses StatusDistribution `json:"statuses"`
+	// MaxConnections broken down by scheme and port, as NATs may apply
+	// different policies to each.
+	BySchemePort []SchemePortConnections `json:"by_scheme_port"`
+	// What was negotiated on each TLS connection.
+	Tls []TlsConnection `json:"tls,omitempty"`
+	// The User-Agent of each connection, with Measurer.RotateUserAgent.
+	UserAgents []UserAgentConnection `json:"user_agents,omitempty"`
+	// The response headers of each connection, with
+	// Measurer.CaptureHeaders.
+	Headers []ConnectionHeaders `json:"headers,omitempty"`
+	// The hostnames resolved to the address of each connection, several
+	// sharing one connection through the NAT.
+	Hostnames []ConnectionHostnames `json:"hostnames,omitempty"`
+}
+
+// SchemePortConnections are the connections made to servers on one scheme
+// and port.
+type SchemePortConnections struct {
+	Scheme         string `json:"scheme"`
+	Port           string `json:"port"`
+	MaxConnections int    `json:"max_connections"`
+}
+
+type PhaseName string
+
+const (
+	PhaseResolutionStart    PhaseName = "resolution-start"
+	PhaseRampStart          PhaseName = "ramp-start"
+	PhasePreloadEstablished PhaseName = "preload-established"
+	PhaseExhaustionDetected PhaseName = "exhaustion-detected"
+	PhaseSustainStart       PhaseName = "sustain-start"
+	PhaseDrainStart         PhaseName = "drain-start"
+	PhaseEnd                PhaseName = "end"
+)
+
+// Phase marks when a measurement moved into a phase, to align the
+// measurement with router logs and packet captures.
+type Phase struct {
+	Name PhaseName `json:"name"`
+	Time time.Time `json:"time"`
+}
+
+type actionKind int
+
+const (
+	actionWait actionKind = iota
+	actionCrawl
+	actionClose
+	actionStop
+)
+
+// action is the next step a strategy wants the scheduler to take.
+type action struct {
+	kind actionKind
+	conn *connection
+}
+
+// scheduler holds the state of a measurement. Strategies read it to
+// decide the next action.
+type scheduler struct {
+	m        *Measurer
+	strategy strategy
+	network  network
+	traffic  *traffic
+	// Shared by every connection of the measurement
+	tlsConfig *tls.Config
+	// Nil unless exporting spans
+	tracer *otlpTracer
+	// Nil unless storing the measurement in a database
+	dbRun   *crawlDbRun
+	seeds   int
+	started time.Time
+	semC    chan struct{}
+	err     error
+	// The current time, nil is time.Now. Injected by tests of the
+	// policies.
+	clock func() time.Time
+
+	pendingResolutions   frontier
+	connectionIdCtr      uint
+	repeatedDialFails    int
+	exhaustions          int
+	refusedRedials       int
+	mappingsLost         int
+	politenessExclusions int
+	robotsFailures       int
+	memoryChecked        time.Time
+	halfOpenChecked      time.Time
+	halfOpen             int
+	sensitivePortHosts   map[string]bool
+	peakEstablished      int
+	memorySheds          int
+	shedUrls             int
+	seedLookupFailures   int
+	// Hostnames resolved to an address already connected
+	aliases int
+	// Hosts of the seeds, to count their failed lookups
+	seedHosts map[string]bool
+	// 5xx replies to robots.txt and to other pages
+	robotsServerErrors  int
+	contentServerErrors int
+	// Hosts that asked for https, by hostname
+	httpsHosts     map[string]bool
+	schemeUpgrades []SchemeUpgrade
+	duplicatePages int
+	trapUrls       int
+	// Index of userAgentPool the rotation started from
+	userAgentStart int
+	// Nil unless tuning the keep-alive interval
+	tuner *keepAliveTuner
+	// Nil unless comparing with IPv6
+	dualStack *DualStackReport
+	// Nil with LowResource, to save its memory
+	heatmap *latencyHeatmap
+	// Nil unless polling the reflector
+	externalIp *externalIpWatch
+	// Nil without a reflector
+	externalIps *externalIpPool
+	// Connections established as the preload so far
+	preloaded int
+	// Stopped by Measurer.Timeout or Measurer.ConnectionLimit
+	timedOut     bool
+	limitReached bool
+	// Stages of the schedule strategy completed
+	stages []StageResult
+	// Nil until the measurement starts
+	aggregates *aggregator
+	// Last progress reported, zero before the first
+	progressReported time.Time
+	// Nil until the NAT is first suspected to be exhausted
+	evictions    *exhaustionWatch
+	phases       []Phase
+	lastOpened   time.Time
+	pendingConns []*connection
+	activeConns  []*connection
+	failedConns  []*connection
+	closedConns  []*connection
+}
+
+// MeasureMaxConnections measures the maximum number of concurrent connections
+// with the default options. Cancelling ctx, or its deadline passing, stops
+// the measurement early with the connections so far.
+func MeasureMaxConnections(ctx context.Context, urls []*url.URL) (int, error) {
+	m := Measurer{ctx: ctx}
+	r, err := m.Measure(urls)
+	if err != nil {
+		return 0, err
+	}
+	return r.MaxConnections, nil
+}
+
+// context is the context lookups and requests are made in, done once the
+// measurement should stop.
+func (m *Measurer) context() context.Context {
+	if m.ctx == nil {
+		return context.Background()
+	}
+	return m.ctx
+}
+
+func (n liveNetwork) lookupAddr(ctx context.Context, network string, h *url.URL) *resolvedUrl {
+	r := lookupAddr(ctx, network, h, n.dns)
+	if n.ech && network == ipNetwork(n.ipv6) && h.Scheme == "https" && len(r.addresses) > 0 {
+		// Lab domains publish their ECH configs on their own nameserver
+		nameserver := n.dns.nameserver(h.Hostname())
+		var err error
+		if nameserver == "" {
+			nameserver, err = systemNameserver()
+		}
+		if err == nil {
+			// Servers without ECH configs are connected to without ECH
+			r.echConfigList, _ = lookupEchConfigList(nameserver, h.Hostname())
+		}
+	}
+	return r
+}
+
+func (liveNetwork) scrapConnection(ctx context.Context, r *roundtrip) *roundtrip {
+	return scrapConnection(ctx, r)
+}
+
+func (s *scheduler) markPhase(name PhaseName) {
+	at := time.Now()
+	s.phases = append(s.phases, Phase{Name: name, Time: at})
+	s.aggregates.startPhase(name, at)
+}
+
+func (s *scheduler) keepAliveInterval() time.Duration {
+	if s.tuner != nil {
+		return s.tuner.interval
+	}
+	return cmp.Or(s.m.KeepAliveInterval, s.m.policy().ReRequestInterval)
+}
+
+func (s *scheduler) now() time.Time {
+	if s.clock == nil {
+		return time.Now()
+	}
+	return s.clock()
+}
+
+// freeWorkers is the number of idle workers, besides those reserved for
+// keep-alives.
+func (s *scheduler) freeWorkers() int {
+	return max(cap(s.semC)-len(s.semC)-s.m.reservedWorkers(cap(s.semC)), 0)
+}
+
+// exhausted reports whether the NAT is suspected to have run out of
+// connections, after repeated dial failures.
+func (s *scheduler) exhausted() bool {
+	return s.repeatedDialFails >= s.m.policy().MaxRepeatedDialFails
+}
+
+// outOfWork reports whether there are no more servers to connect to
+// or urls to crawl for new servers.
+func (s *scheduler) outOfWork() bool {
+	if len(s.pendingConns) > 0 || s.pendingResolutions.len() > 0 || len(s.semC) > 0 {
+		return false
+	}
+	haveMoreUrls := slices.ContainsFunc(s.activeConns, func(c *connection) bool {
+		return len(c.uncrawledUrls)+len(c.crawlingUrls) > 0
+	})
+	return !haveMoreUrls
+}
+
+// fail stops the measurement with an error.
+func (s *scheduler) fail(err error) {
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+// skipPendingConnection drops a connection before it is dialed.
+func (s *scheduler) skipPendingConnection(c *connection) {
+	i := indexConnectionById(s.pendingConns, c.id)
+	if i == -1 {
+		return
+	}
+	s.pendingConns = slices.Delete(s.pendingConns, i, i+1)
+	s.closedConns = append(s.closedConns, c)
+	c.finish(stateClosed)
+}
+
+func (s *scheduler) closeConnection(c *connection) {
+	i := indexConnectionById(s.activeConns, c.id)
+	if i == -1 {
+		return
+	}
+	s.activeConns = slices.Delete(s.activeConns, i, i+1)
+	s.closedConns = append(s.closedConns, c)
+	c.finish(stateClosed)
+}
+
+func (s *scheduler) closeActiveConnections() {
+	for _, c := range s.activeConns {
+		c.finish(stateClosed)
+	}
+}
+
+// countBySchemePort counts the connections to each scheme and port,
+// ordered by scheme then port.
+func countBySchemePort(conns []*connection) []SchemePortConnections {
+	counts := []SchemePortConnections{}
+	for _, c := range conns {
+		scheme, port := c.url.Scheme, urlPort(c.url)
+		i := slices.IndexFunc(counts, func(s SchemePortConnections) bool {
+			return s.Scheme == scheme && s.Port == port
+		})
+		if i == -1 {
+			counts = append(counts, SchemePortConnections{Scheme: scheme, Port: port})
+			i = len(counts) - 1
+		}
+		counts[i].MaxConnections++
+	}
+	slices.SortFunc(counts, func(a, b SchemePortConnections) int {
+		return cmp.Or(cmp.Compare(a.Scheme, b.Scheme), cmp.Compare(a.Port, b.Port))
+	})
+	return counts
+}
+
+// Measure crawls outwards from urls, opening one connection per server,
+// until the NAT refuses more connections or the strategy is finished.
+func (m *Measurer) Measure(urls []*url.URL) (*Result, error) {
+	return m.measure(urls, nil)
+}
+
+// measure crawls outwards from the urls, once looked up, and the already
+// resolved targets.
+func (m *Measurer) measure(urls []*url.URL, targets []*resolvedUrl) (*Result, error) {
+	if err := m.check(); err != nil {
+		return nil, err
+	}
+	strategy, err := newStrategy(m)
+	if err != nil {
+		return nil, err
+	}
+
+	s := scheduler{
+		m:         m,
+		strategy:  strategy,
+		network:   cmp.Or[network](m.network, liveNetwork{ech: m.EnableEch, ipv6: m.Ipv6, dns: &m.Dns}),
+		traffic:   &traffic{open: m.openConns, socket: m.Socket, proxy: m.proxyFunc()},
+		tlsConfig: m.tlsConfig(),
+		started:   time.Now(),
+		semC:      make(chan struct{}, m.workers()),
+	}
+
+	if m.Faults != (Faults{}) {
+		s.network = newFaultyNetwork(s.network, m.Faults)
+	}
+	if m.Interface != "" {
+		s.traffic.dialer, err = interfaceDialer(m.Interface, m.Ipv6)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if m.OtlpEndpoint != "" {
+		s.tracer = startOtlpTracer(m.OtlpEndpoint)
+	}
+	s.dbRun = m.crawlDb.startRun(time.Now())
+	if m.TuneKeepAlive {
+		s.tuner = newKeepAliveTuner(cmp.Or(m.KeepAliveInterval, defaultTuneKeepAliveStart))
+	}
+	if m.CompareDualStack && !m.Ipv6 {
+		s.dualStack = &DualStackReport{}
+	}
+	if m.RotateUserAgent {
+		s.userAgentStart = newUserAgentRotation()
+	}
+	if !m.LowResource {
+		s.heatmap = newLatencyHeatmap(time.Now())
+	}
+	var metadata *RunMetadata
+	var metadataNotices []string
+	if _, recording := m.network.(*recordingNetwork); m.network == nil || recording {
+		metadata, metadataNotices = s.runMetadata()
+	}
+	if metadata != nil && m.Reflector != "" {
+		s.externalIps = newExternalIpPool()
+		if current, err := netip.ParseAddr(metadata.ExternalIp); err == nil {
+			s.externalIps.add(current)
+			s.sampleExternalIps(externalIpSamples - 1)
+		}
+	}
+	if interval := m.reflectorInterval(); metadata != nil && m.Reflector != "" && interval > 0 {
+		current, _ := netip.ParseAddr(metadata.ExternalIp)
+		s.externalIp = newExternalIpWatch(s.reflectorClient(), m.Reflector, interval, current)
+	}
+	var hairpin *HairpinReport
+	if metadata != nil && m.CheckHairpin {
+		var err error
+		hairpin, err = s.checkHairpin(metadata)
+		if err != nil {
+			metadataNotices = append(metadataNotices, degradedNotice("Hairpin detection", err))
+		}
+	}
+	var doubleNat *DoubleNatReport
+	if metadata != nil && m.DetectDoubleNat {
+		var err error
+		target := m.HopTarget
+		if !target.IsValid() {
+			target = netip.MustParseAddr(defaultHopTarget)
+		}
+		doubleNat, err = detectDoubleNat(target, cmp.Or(m.MaxHops, defaultMaxHops))
+		if err != nil {
+			metadataNotices = append(metadataNotices, degradedNotice("Double NAT detection", err))
+		}
+	}
+	var mappingProtocol *MappingProtocolReport
+	if metadata != nil && m.CheckMappingProtocols {
+		var err error
+		mappingProtocol, err = checkMappingProtocols(metadata)
+		if err != nil {
+			metadataNotices = append(metadataNotices, degradedNotice("PCP and NAT-PMP", err))
+		}
+	}
+	var upnpC <-chan upnpResult
+	if metadata != nil && !m.DisableUpnp && !m.Ipv6 {
+		upnpC = s.startUpnp()
+	}
+
+	s.aggregates = newAggregator(time.Now(), s.traffic)
+	s.markPhase(PhaseResolutionStart)
+	urls = deleteDuplicateUrlsByHostPort(urls)
+	s.seeds = len(urls) + len(targets)
+	s.seedHosts = map[string]bool{}
+	for _, u := range urls {
+		s.seedHosts[canonicalHost(u)] = true
+		if h := m.pinnedSeed(u); h != nil {
+			s.addResolved(h)
+			continue
+		}
+		s.pendingResolutions.put(u)
+	}
+	for _, h := range targets {
+		s.seedHosts[canonicalHost(h.url)] = true
+		s.addResolved(h)
+	}
+
+	overBudget := s.run()
+	if s.err != nil {
+		s.tracer.end(len(s.activeConns))
+		s.releaseConnections(false)
+		return nil, s.err
+	}
+	usable := verifiedConnections(usableConnections(s.activeConns, m.CountAfter), time.Now())
+	var upnp *UpnpReport
+	select {
+	case u := <-upnpC:
+		upnp = u.report
+		// Most networks have no UPnP gateway, which is not worth noting
+		if u.err != nil && !errors.Is(u.err, errNoIgd) {
+			metadataNotices = append(metadataNotices, degradedNotice("UPnP", u.err))
+		}
+	default:
+		// Measurements finishing before the gateway answers, or before
+		// the search times out, are left without
+	}
+	r := &Result{
+		MaxConnections:       len(usable),
+		Preloaded:            s.preloaded,
+		Headroom:             headroom(usable),
+		CountedAfter:         cmp.Or(m.CountAfter, CountAfterConnect),
+		BytesSent:            s.traffic.sent.Load(),
+		BytesReceived:        s.traffic.received.Load(),
+		OverBudget:           overBudget,
+		PeakEstablished:      s.peakEstablished,
+		RefusedRedials:       s.refusedRedials,
+		Aliases:              s.aliases,
+		MappingsLost:         s.mappingsLost,
+		HalfOpenConnections:  s.halfOpen,
+		MemorySheds:          s.memorySheds,
+		ShedUrls:             s.shedUrls,
+		DroppedLookups:       s.pendingResolutions.dropped,
+		PolitenessExclusions: s.politenessExclusions,
+		SensitivePortHosts:   len(s.sensitivePortHosts),
+		DuplicatePages:       s.duplicatePages,
+		TrapUrls:             s.trapUrls,
+		RobotsFailures:       s.robotsFailures,
+		RobotsServerErrors:   s.robotsServerErrors,
+		ContentServerErrors:  s.contentServerErrors,
+		Phases:               s.phases,
+		Stages:               s.stages,
+		Aggregates:           s.aggregates.report(),
+		Statuses:             statusDistribution(usable),
+		BySchemePort:         countBySchemePort(usable),
+		Tls:                  tlsConnections(usable),
+		UserAgents:           userAgentConnections(usable),
+		Headers:              connectionHeaders(usable),
+		Hostnames:            connectionHostnames(usable),
+		Exhaustion:           s.evictions.report(),
+		DualStack:            s.dualStack,
+		KeepAliveTuning:      s.tuner.report(),
+		LatencyHeatmap:       s.heatmap.report(),
+		Pacing:               hostPacing(s.activeConns, s.failedConns, s.closedConns),
+		Proxies:              s.traffic.proxies.list(),
+		SchemeUpgrades:       s.schemeUpgrades,
+		Metadata:             metadata,
+		ExternalIpChanges:    s.externalIp.report(),
+		ExternalIps:          s.externalIps.report(),
+		Hairpin:              hairpin,
+		DoubleNat:            doubleNat,
+		Upnp:                 upnp,
+		MappingProtocol:      mappingProtocol,
+	}
+	r.Warnings = s.warnings(r)
+	if s.limitReached {
+		r.Notices = append(r.Notices, fmt.Sprintf("Stopped once %d connections were counted, the NAT allows at least that many", m.ConnectionLimit))
+	}
+	if m.Faults != (Faults{}) {
+		r.Notices = append(r.Notices, m.Faults.notice())
+	}
+	if m.InsecureSkipVerify {
+		r.Notices = append(r.Notices, "Certificates were not verified, any https server was connected to")
+	}
+	r.Notices = append(r.Notices, metadataNotices...)
+	if err := s.tracer.end(r.MaxConnections); err != nil {
+		r.Notices = append(r.Notices, fmt.Sprintf("Some spans were not exported: %v", err))
+	}
+	conns := slices.Concat(s.activeConns, s.pendingConns, s.failedConns, s.closedConns)
+	if err := s.dbRun.finish(r, conns, time.Now()); err != nil {
+		r.Notices = append(r.Notices, fmt.Sprintf("The measurement was not fully stored in the database: %v", err))
+	}
+	// Release the NAT mappings for the next measurement, unless held
+	s.releaseConnections(m.Hold)
+	if m.Hold {
+		m.held = &s
+	}
+	return r, nil
+}
+
+// run is the core loop of the measurement. It reports whether the loop
+// was stopped by the data budget.
+func (s *scheduler) run() bool {
+	lookupAddrReply := make(chan *resolvedUrl)
+	scrapedReply := make(chan *roundtrip)
+	stopC := make(chan struct{})
+	semC := s.semC
+	overBudget := false
+	ctx := s.m.context()
+
+	for {
+		iterStart := time.Now()
+		decision := ""
+		var lookupAddrSemC chan<- struct{} = nil
+		var scrapRequestSemC chan<- struct{} = nil
+
+		if s.pendingResolutions.peek() != nil && s.freeWorkers() > 0 {
+			lookupAddrSemC = semC
+		}
+
+		next := s.strategy.next(s)
+		if next.kind == actionStop || s.err != nil {
+			break
+		}
+		if s.m.Timeout > 0 && time.Since(s.started) > s.m.Timeout {
+			s.timedOut = true
+			break
+		}
+		if s.m.ConnectionLimit > 0 && countUsable(s.activeConns, s.m.CountAfter) >= s.m.ConnectionLimit {
+			s.limitReached = true
+			break
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		if next.kind == actionClose {
+			s.closeConnection(next.conn)
+			s.tracer.iteration(iterStart, "close", len(s.activeConns))
+			continue
+		}
+		crawlConnection := next.conn
+		if next.kind == actionCrawl && !crawlConnection.inFlight && s.mayRequest(crawlConnection) {
+			scrapRequestSemC = semC
+		}
+
+		select {
+		case <-time.After(s.m.policy().PollInterval):
+		case lookupAddrSemC <- struct{}{}:
+			decision = "lookup"
+			hUrl := s.pendingResolutions.pop()
+			go func() {
+				// Only lookup IPv4 addresses unless measuring IPv6.
+				// IPv6 addresses are not running out so no need for
+				// CGNAT, but stateful firewalls may still run out.
+				lookupAddrRequest(ctx, s.network, hUrl, ipNetwork(s.m.Ipv6), s.dualStack != nil, lookupAddrReply, stopC)
+				<-semC
+			}()
+		case h := <-lookupAddrReply:
+			decision = "resolved"
+			s.dualStack.add(h)
+			if len(h.addresses) == 0 && s.seedHosts[canonicalHost(h.url)] {
+				s.seedLookupFailures++
+			}
+			if len(h.addresses) == 0 {
+				s.m.log().Info("lookup failed", "host", h.url.Host)
+			} else if c := s.addResolved(h); c != nil {
+				s.m.log().Info("resolved", connectionAttrs(c)...)
+			} else if c := s.recordHostname(h); c != nil {
+				s.m.log().Info("alias", append(connectionAttrs(c), "hostname", h.url.Hostname())...)
+			} else {
+				s.m.log().Info("every address already connected", "host", h.url.Host, "addresses", len(h.addresses))
+			}
+		case scrapRequestSemC <- struct{}{}:
+			decision = "crawl"
+			request := makeCrawlRequest(crawlConnection)
+			request.streamHtml = s.m.LowResource
+			request.head = s.m.LowResource && crawlConnection.contentFetched && !request.ping
+			request.captureHeaders = s.m.CaptureHeaders
+			request.backoffIncrement = s.m.policy().BackoffIncrement
+			request.preprocessor = s.m.HtmlPreprocessor
+			if !crawlConnection.lastRequest.IsZero() {
+				interval := s.now().Sub(crawlConnection.lastRequest)
+				crawlConnection.pacing.add(interval, crawlConnection.crawlDelay)
+			}
+			crawlConnection.lastRequest = s.now()
+			crawlConnection.inFlight = true
+			go func() {
+				scrapConnectionRequest(ctx, s.network, request, scrapedReply, stopC)
+				<-semC
+			}()
+
+			rUrl := urlToRelativeUrl(request.url)
+			delete(crawlConnection.uncrawledUrls, rUrl)
+			crawlConnection.crawlingUrls[rUrl] = true
+
+			if len(s.pendingConns) > 0 && s.pendingConns[0] == crawlConnection {
+				if s.lastOpened.IsZero() {
+					s.markPhase(PhaseRampStart)
+				}
+				s.pendingConns = s.pendingConns[1:]
+				s.activeConns = append(s.activeConns, crawlConnection)
+				crawlConnection.state = stateDialing
+				s.lastOpened = crawlConnection.lastRequest
+				s.m.log().Info("dialing", connectionAttrs(crawlConnection)...)
+			}
+		case reply := <-scrapedReply:
+			decision = "reply"
+			s.handleReply(reply)
+		}
+		// Idle iterations would drown out the decisions
+		if decision != "" {
+			s.tracer.iteration(iterStart, decision, len(s.activeConns))
+		}
+		if s.m.publishVars {
+			s.publishVars(decision)
+		}
+		s.checkMemory()
+		s.checkHalfOpen()
+		s.checkExternalIp()
+		s.checkProgress()
+
+		if s.m.MaxTotalBytes > 0 && s.traffic.total() > s.m.MaxTotalBytes {
+			// Stop before the next request pushes a metered link
+			// further over the users data budget.
+			overBudget = true
+			s.m.emit(Event{
+				Type:              EventRampPaused,
+				Reason:            "exceeded data budget",
+				ActiveConnections: len(s.activeConns),
+			})
+			break
+		}
+	}
+
+	s.markPhase(PhaseDrainStart)
+	close(stopC)
+	for i := cap(semC); i > 0; i-- {
+		semC <- struct{}{}
+	}
+	close(semC)
+	close(lookupAddrReply)
+	close(scrapedReply)
+	s.markPhase(PhaseEnd)
+	return overBudget
+}
+
+// addResolved makes a pending connection to the first address of h not
+// already connected to, if any.
+func (s *scheduler) addResolved(h *resolvedUrl) *connection {
+	override := hostOverride(s.m.Overrides, h)
+	if override != nil {
+		h = override.rewrite(h)
+	}
+	i := slices.IndexFunc(h.addresses, func(a netip.AddrPort) bool {
+		return indexConnectionByAddr(s.pendingConns, a) == -1 &&
+			indexConnectionByAddr(s.activeConns, a) == -1
+	})
+	if i == -1 {
+		return nil
+	}
+	tlsConf := s.tlsConfig
+	if cert := s.m.ClientCerts.hostCertificate(h.url.Hostname()); cert != nil {
+		tlsConf = tlsConf.Clone()
+		tlsConf.Certificates = []tls.Certificate{*cert}
+	}
+	if h.echConfigList != nil {
+		tlsConf = tlsConf.Clone()
+		tlsConf.EncryptedClientHelloConfigList = h.echConfigList
+	}
+	c := makeConnection(h.addresses[i], h.url, s.traffic, tlsConf)
+	c.id = s.connectionIdCtr
+	c.crawlDelay = s.m.policy().ReRequestInterval
+	c.keepAliveInterval = s.keepAliveInterval()
+	if s.m.KeepAlive != nil {
+		c.keepAliver = s.m.KeepAlive(h.url)
+	}
+	if override != nil {
+		override.apply(c)
+	}
+	s.setUserAgent(c)
+	s.pendingConns = append(s.pendingConns, c)
+	s.connectionIdCtr++
+	return c
+}
+
+func (s *scheduler) handleReply(reply *roundtrip) {
+	s.tracer.request(reply)
+	s.dbRun.request(reply)
+	i := indexConnectionById(s.activeConns, reply.connId)
+	if i == -1 {
+		return
+	}
+
+	c := s.activeConns[i]
+	c.inFlight = false
+	firstReply := len(c.crawledUrls) == 0
+	// Every reply is only worth the attributes when debugging
+	if s.m.log().Enabled(context.Background(), slog.LevelDebug) {
+		s.m.log().Debug("crawled", append(connectionAttrs(c),
+			"url", reply.url.String(),
+			"status", reply.status,
+			"latency", reply.replyTs.Sub(reply.requestTs),
+			"links", len(reply.scrapedUrls),
+			"err", reply.err)...)
+	}
+
+	// Dial errors may signify the middleware NAT device has run out
+	// of ports for this client
+	if isDialError(reply.err) {
+		var err *crawlError
+		if errors.As(reply.err, &err) {
+			s.refusedRedials++
+		} else {
+			s.repeatedDialFails++
+			if s.repeatedDialFails == s.m.policy().MaxRepeatedDialFails {
+				s.exhaustions++
+				s.markPhase(PhaseExhaustionDetected)
+				if s.evictions == nil {
+					s.evictions = newExhaustionWatch(s.activeConns, s.keepAliveInterval())
+				}
+				s.m.emit(Event{
+					Type:              EventExhaustionSuspected,
+					Reason:            "repeated dial failures",
+					ActiveConnections: len(s.activeConns) - 1,
+				})
+			}
+		}
+	} else if reply.err == nil && firstReply {
+		s.repeatedDialFails = 0
+	}
+
+	if s.tuner != nil && !firstReply && !isDialError(reply.err) {
+		s.tuneKeepAlive(reply.requestTs.Sub(c.lastReply), reply.err != nil)
+	}
+
+	// Add new connections
+	rUrl := urlToRelativeUrl(reply.url)
+	recrawled := c.crawledUrls[rUrl]
+	delete(c.crawlingUrls, rUrl)
+	c.crawledUrls[rUrl] = true
+	c.robots = reply.robots
+	c.crawlDelay = max(reply.crawlDelay, c.minCrawlDelay)
+	c.lastRequest = reply.requestTs
+	c.lastReply = reply.replyTs
+	if c.tls == nil {
+		c.tls = reply.tls
+	}
+	recordHeaders(c, reply)
+	if reply.status != 0 {
+		c.lastStatus = reply.status
+	}
+	if reply.err == nil {
+		s.heatmap.add(c.host.hostPort, reply.requestTs, reply.replyTs, len(s.activeConns))
+	}
+	s.aggregates.reply(reply.requestTs, reply.replyTs, reply.err == nil && firstReply, reply.err != nil)
+	markUsable(c, reply)
+	markReused(c, reply)
+	s.handleRobotsFailure(c, reply, firstReply)
+	s.handleServerError(reply)
+
+	if reply.err != nil {
+		s.evictions.failed(c, reply.replyTs)
+		s.externalIp.failed(c)
+		s.failedConns = append(s.failedConns, s.activeConns[i])
+		s.activeConns = slices.Delete(s.activeConns, i, i+1)
+		c.finish(stateFailed)
+		eType := EventConnectionFailed
+		if isMappingLost(reply.err) {
+			s.mappingsLost++
+			eType = EventMappingLost
+		}
+		e := connectionEvent(eType, c, len(s.activeConns))
+		e.Reason = reply.err.Error()
+		s.m.emit(e)
+		s.m.log().Info("failed", append(connectionAttrs(c), "reason", reply.err, "established", !firstReply)...)
+	} else if firstReply {
+		c.established = reply.replyTs
+		c.state = stateActive
+		s.preloadEstablished(c)
+		s.m.emit(connectionEvent(EventConnectionEstablished, c, len(s.activeConns)))
+		s.m.log().Info("established", connectionAttrs(c)...)
+	}
+	s.peakEstablished = max(s.peakEstablished, countUsable(s.activeConns, s.m.CountAfter))
+
+	if reply.err == nil && rUrl == pathToRelativeUrl("/robots.txt") && s.excludeImpolite(c) {
+		return
+	}
+
+	// Keep-alives fall back to disallowed paths when nothing else is
+	// allowed, their links must not be crawled
+	if !c.robots.pathAllowed(rUrl.getRawPath()) {
+		reply.scrapedUrls = nil
+	}
+	// The links of a duplicate lead further into the trap
+	if reply.err == nil && s.duplicateContent(c, reply, recrawled) {
+		reply.scrapedUrls = nil
+	}
+
+	if reply.err == nil && reply.asksForHttps {
+		s.upgradeHost(c)
+	}
+	reply.scrapedUrls = s.upgradeUrls(reply.scrapedUrls)
+	reply.scrapedUrls = s.skipTrapUrls(reply.scrapedUrls)
+
+	// Determine where to put the newly scraped urls
+	newUrls := stealUrlsForConnections(s.activeConns, reply.scrapedUrls)
+	urlsToResolve := []*url.URL{}
+	for _, u := range newUrls {
+		if indexUrlByHostPort(urlsToResolve, u) != -1 {
+			continue
+		}
+		if indexConnectionByHostPort(s.pendingConns, u) != -1 {
+			continue
+		}
+		if indexConnectionByHostPort(s.failedConns, u) != -1 {
+			// Avoid consuming extra NAT translations on a bad server
+			continue
+		}
+		if indexConnectionByHostPort(s.closedConns, u) != -1 {
+			continue
+		}
+		if s.skipSensitivePort(u) {
+			continue
+		}
+		urlsToResolve = append(urlsToResolve, u)
+	}
+	if len(urlsToResolve) > 0 {
+		s.pendingResolutions.put(urlsToResolve...)
+	}
+}
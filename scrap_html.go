@@ -2,13 +2,82 @@
 package main
 
 import (
+	"bytes"
 	"io"
 	"net/url"
+	"slices"
 
 	"golang.org/x/net/html"
 	"golang.org/x/net/html/atom"
 )
 
+const (
+	// Documents are truncated after this many bytes
+	maxHtmlBytes = 8 * 1024 * 1024
+	// Elements nested deeper than this are ignored
+	maxHtmlDepth = 512
+	// Documents are truncated after this many elements
+	maxHtmlNodes = 100000
+)
+
+// Elements without an end tag, which never nest
+var voidElements = map[atom.Atom]bool{
+	atom.Area: true, atom.Base: true, atom.Br: true, atom.Col: true,
+	atom.Embed: true, atom.Hr: true, atom.Img: true, atom.Input: true,
+	atom.Link: true, atom.Meta: true, atom.Param: true, atom.Source: true,
+	atom.Track: true, atom.Wbr: true,
+}
+
+// Elements whose end tag may be left out, closed by their next sibling
+// rather than nesting, like paragraphs and list items
+var optionalEndElements = map[atom.Atom]bool{
+	atom.Html: true, atom.Head: true, atom.Body: true, atom.P: true,
+	atom.Li: true, atom.Dt: true, atom.Dd: true, atom.Option: true,
+	atom.Optgroup: true, atom.Tr: true, atom.Td: true, atom.Th: true,
+	atom.Thead: true, atom.Tbody: true, atom.Tfoot: true, atom.Colgroup: true,
+	atom.Rb: true, atom.Rt: true, atom.Rp: true, atom.Rtc: true,
+}
+
+// limitHtml copies the document read from body, dropping elements nested
+// deeper than maxHtmlDepth and truncating it after maxHtmlNodes elements,
+// so hostile or broken documents cannot make parsing them take
+// excessive CPU or memory. The depth counts elements that need an end
+// tag, as the rest are closed by their siblings or never nest.
+func limitHtml(body io.Reader) io.Reader {
+	limited := &bytes.Buffer{}
+	depth, nodes := 0, 0
+	z := html.NewTokenizer(body)
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			return limited
+		}
+		skip := depth > maxHtmlDepth
+		switch tt {
+		case html.StartTagToken, html.SelfClosingTagToken:
+			nodes++
+			if nodes > maxHtmlNodes {
+				return limited
+			}
+			name, _ := z.TagName()
+			tag := atom.Lookup(name)
+			if tt == html.StartTagToken && !voidElements[tag] && !optionalEndElements[tag] {
+				depth++
+				skip = depth > maxHtmlDepth
+			}
+		case html.EndTagToken:
+			name, _ := z.TagName()
+			tag := atom.Lookup(name)
+			if !voidElements[tag] && !optionalEndElements[tag] {
+				depth = max(depth-1, 0)
+			}
+		}
+		if !skip {
+			limited.Write(z.Raw())
+		}
+	}
+}
+
 func urlCmp(u1, u2 *url.URL) bool {
 	return u1.Host == u2.Host && u1.Path == u2.Path
 }
@@ -24,15 +93,22 @@ func findNodeAtomInNode(n *html.Node, tag atom.Atom) *html.Node {
 }
 
 func findAllAtomTagInNode(n *html.Node, tag atom.Atom) []*html.Node {
+	type nodeDepth struct {
+		node  *html.Node
+		depth int
+	}
+
 	matches := []*html.Node{}
-	stack := []*html.Node{}
-	for iter := n; iter != nil; {
-		if iter.DataAtom == tag {
-			matches = append(matches, iter)
+	stack := []nodeDepth{}
+	for iter := (nodeDepth{n, 0}); iter.node != nil; {
+		if iter.node.DataAtom == tag {
+			matches = append(matches, iter.node)
 		}
 		// Retain the ordering of the original document
-		for child := iter.LastChild; child != nil; child = child.PrevSibling {
-			stack = append(stack, child)
+		if iter.depth < maxHtmlDepth {
+			for child := iter.node.LastChild; child != nil; child = child.PrevSibling {
+				stack = append(stack, nodeDepth{child, iter.depth + 1})
+			}
 		}
 		if len(stack) == 0 {
 			break
@@ -75,9 +151,18 @@ func findBaseHrefInNode(n *html.Node) (*url.URL, error) {
 	return findHref(base)
 }
 
+// ScrapHtml returns the unique urls linked from the html document read
+// from body. Relative links are resolved against the document's base
+// href, if any, then host. Malformed documents give the links that
+// could be parsed, documents larger than maxHtmlBytes or with more than
+// maxHtmlNodes elements are truncated, giving the links before, and
+// elements nested deeper than maxHtmlDepth are ignored. Body is read
+// until EOF, or maxHtmlBytes past the truncation.
 func ScrapHtml(host *url.URL, body io.Reader) []*url.URL {
 	urls := []*url.URL{}
-	doc, err := html.Parse(body)
+	defer io.Copy(io.Discard, io.LimitReader(body, maxHtmlBytes))
+
+	doc, err := html.Parse(limitHtml(io.LimitReader(body, maxHtmlBytes)))
 	if err != nil {
 		return urls
 	}
@@ -123,7 +208,84 @@ func ScrapHtml(host *url.URL, body io.Reader) []*url.URL {
 		}
 		urls = append(urls, nUrl)
 	}
-
-	io.ReadAll(body)
 	return urls
 }
+
+// ScrapHtmlStream returns the same urls as ScrapHtml, but tokenizes body
+// rather than building the document tree, for devices with little memory.
+// Only the base href in the head is honored, as with ScrapHtml, and the
+// document is truncated after maxHtmlNodes elements likewise.
+func ScrapHtmlStream(host *url.URL, body io.Reader) []*url.URL {
+	urls := []*url.URL{}
+	defer io.Copy(io.Discard, io.LimitReader(body, maxHtmlBytes))
+
+	var baseHref *url.URL
+	inHead := false
+	nodes := 0
+	z := html.NewTokenizer(io.LimitReader(body, maxHtmlBytes))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			return urls
+		}
+		if tt == html.StartTagToken || tt == html.SelfClosingTagToken {
+			nodes++
+			if nodes > maxHtmlNodes {
+				return urls
+			}
+		}
+		name, hasAttr := z.TagName()
+		tag := atom.Lookup(name)
+		if tt == html.EndTagToken {
+			if tag == atom.Head {
+				inHead = false
+			}
+			continue
+		}
+		if tt != html.StartTagToken && tt != html.SelfClosingTagToken {
+			continue
+		}
+		if tag == atom.Head {
+			inHead = true
+			continue
+		}
+		if (tag != atom.A && (tag != atom.Base || !inHead)) || !hasAttr {
+			continue
+		}
+
+		var u *url.URL
+		var err error
+		for more := true; more && u == nil; {
+			var key, val []byte
+			key, val, more = z.TagAttr()
+			if atom.Lookup(key) == atom.Href {
+				u, err = url.Parse(string(val))
+			}
+		}
+		if tag == atom.Base {
+			if err != nil {
+				return []*url.URL{}
+			}
+			if baseHref == nil {
+				baseHref = u
+			}
+			continue
+		}
+		if u == nil || err != nil {
+			continue
+		}
+
+		if !u.IsAbs() && baseHref != nil {
+			u = baseHref.JoinPath(u.String())
+		}
+		if !u.IsAbs() {
+			path := u.Path
+			*u = *host
+			u.Path = path
+		}
+		if slices.ContainsFunc(urls, func(v *url.URL) bool { return urlCmp(u, v) }) {
+			continue
+		}
+		urls = append(urls, u)
+	}
+}
@@ -1,12 +1,14 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"net/url"
 	"os"
 	"reflect"
 	"sort"
+	"strings"
 	"testing"
 )
 
@@ -99,13 +101,90 @@ func TestScrap(t *testing.T) {
 				t.Fatal("Failed to parse test url: ", err)
 			}
 
-			links := ScrapHtml(u, openFile(t, tc.inHtml))
-			slinks := urlsToStrings(links)
-			sort.Strings(slinks)
 			sort.Strings(tc.outUrls)
-			if !reflect.DeepEqual(tc.outUrls, slinks) {
-				t.Error("Failed to parse urls out of html: ", tc.outUrls, " != ", slinks)
+			for scraper, scrap := range map[string]func(*url.URL, io.Reader) []*url.URL{"tree": ScrapHtml, "stream": ScrapHtmlStream} {
+				links := scrap(u, openFile(t, tc.inHtml))
+				slinks := urlsToStrings(links)
+				sort.Strings(slinks)
+				if !reflect.DeepEqual(tc.outUrls, slinks) {
+					t.Error("Failed to parse urls out of html with the ", scraper, " scraper: ", tc.outUrls, " != ", slinks)
+				}
 			}
 		})
 	}
 }
+
+func TestScrapLimits(t *testing.T) {
+	testcases := map[string]struct {
+		inHtml        string
+		outUrls       []string
+		outStreamUrls []string
+	}{
+		"Deep nesting": {
+			inHtml: "<html><body>" + strings.Repeat("<div>", 2*maxHtmlDepth) + `<a href="/deep.html">deep</a>` +
+				strings.Repeat("</div>", 2*maxHtmlDepth) + `<a href="/shallow.html">shallow</a></body></html>`,
+			outUrls:       []string{"http://localhost:8081/shallow.html"},
+			outStreamUrls: []string{"http://localhost:8081/deep.html", "http://localhost:8081/shallow.html"},
+		},
+		"Unclosed paragraphs": {
+			inHtml:        "<html><body>" + strings.Repeat("<p>text", 2*maxHtmlDepth) + `<a href="/last.html">last</a></body></html>`,
+			outUrls:       []string{"http://localhost:8081/last.html"},
+			outStreamUrls: []string{"http://localhost:8081/last.html"},
+		},
+		"Too many elements": {
+			inHtml: `<html><body><a href="/first.html">first</a>` + strings.Repeat("<b></b>", maxHtmlNodes) +
+				`<a href="/last.html">last</a></body></html>`,
+			outUrls:       []string{"http://localhost:8081/first.html"},
+			outStreamUrls: []string{"http://localhost:8081/first.html"},
+		},
+	}
+
+	host, err := url.Parse("http://localhost:8081/")
+	if err != nil {
+		t.Fatal("Failed to parse host url: ", err)
+	}
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			if got := urlsToStrings(ScrapHtml(host, strings.NewReader(tc.inHtml))); !reflect.DeepEqual(got, tc.outUrls) {
+				t.Errorf("expected %v with the tree scraper, got %v", tc.outUrls, got)
+			}
+			if got := urlsToStrings(ScrapHtmlStream(host, strings.NewReader(tc.inHtml))); !reflect.DeepEqual(got, tc.outStreamUrls) {
+				t.Errorf("expected %v with the stream scraper, got %v", tc.outStreamUrls, got)
+			}
+		})
+	}
+}
+
+func FuzzScrapHtml(f *testing.F) {
+	for _, p := range []string{
+		"testdata/no_links.html",
+		"testdata/absolute_hrefs.html",
+		"testdata/relative_hrefs.html",
+		"testdata/relative_hrefs_with_base.html",
+	} {
+		b, err := os.ReadFile(p)
+		if err != nil {
+			f.Fatal("Failed to read seed ", p, ": ", err)
+		}
+		f.Add(b)
+	}
+	f.Add([]byte(strings.Repeat("<div>", 10*maxHtmlDepth) + `<a href="/deep.html">deep</a>`))
+	f.Add([]byte(strings.Repeat("<b>", 2*maxHtmlNodes) + `<a href="/late.html">late</a>`))
+
+	host, err := url.Parse("http://localhost:8081/")
+	if err != nil {
+		f.Fatal("Failed to parse host url: ", err)
+	}
+	f.Fuzz(func(t *testing.T, doc []byte) {
+		for _, u := range ScrapHtml(host, bytes.NewReader(doc)) {
+			if u == nil {
+				t.Error("ScrapHtml returned a nil url")
+			}
+		}
+		for _, u := range ScrapHtmlStream(host, bytes.NewReader(doc)) {
+			if u == nil {
+				t.Error("ScrapHtmlStream returned a nil url")
+			}
+		}
+	})
+}
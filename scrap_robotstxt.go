@@ -9,6 +9,17 @@ import (
 	"time"
 )
 
+const (
+	// RFC 9309 requires parsing at least this much, the rest is ignored
+	maxRobotsTxtBytes = 500 * 1024
+	// Lines longer than this are ignored, rather than being truncated into
+	// a different rule.
+	maxRobotsTxtLineBytes = 16 * 1024
+	// Most of a robots.txt past maxRobotsTxtBytes read so its connection
+	// can be reused, larger remainders are left to the transport.
+	robotsTxtDrainBytes = 16 * 1024
+)
+
 const (
 	userAgent      = "User-agent"
 	ruleAllow      = "Allow"
@@ -16,9 +27,11 @@ const (
 	ruleCrawlDelay = "Crawl-delay"
 )
 
-type robotstxt map[string][]string
+// RobotsTxt holds the rules of a robots.txt that apply to all user-agents,
+// keyed by the rule token.
+type RobotsTxt map[string][]string
 
-func (r robotstxt) crawlDelay() (time.Duration, bool) {
+func (r RobotsTxt) crawlDelay() (time.Duration, bool) {
 	s, found := r[ruleCrawlDelay]
 	if !found {
 		return 0, false
@@ -32,7 +45,7 @@ func (r robotstxt) crawlDelay() (time.Duration, bool) {
 	return n, true
 }
 
-func (r robotstxt) pathAllowed(path string) bool {
+func (r RobotsTxt) pathAllowed(path string) bool {
 	disallowed, found := r[ruleDisallow]
 	if !found {
 		return true
@@ -96,15 +109,52 @@ func parseCrawlDelay(value string) (time.Duration, error) {
 	return time.ParseDuration(value + "s")
 }
 
-func scrapRobotsTxt(input io.Reader) robotstxt {
+// readRobotsTxtLine reads the next line of input, reporting whether the
+// line was too long to be kept.
+func readRobotsTxtLine(r *bufio.Reader) (string, bool, error) {
+	line := []byte{}
+	tooLong := false
+	for {
+		fragment, isPrefix, err := r.ReadLine()
+		if err != nil {
+			return "", false, err
+		}
+
+		tooLong = tooLong || len(line)+len(fragment) > maxRobotsTxtLineBytes
+		if !tooLong {
+			line = append(line, fragment...)
+		}
+		if !isPrefix {
+			return string(line), tooLong, nil
+		}
+	}
+}
+
+// ScrapRobotsTxt parses the rules applying to all user-agents out of a
+// robots.txt read from input. Malformed lines, and lines longer than
+// maxRobotsTxtLineBytes, are ignored. Anything after the first
+// maxRobotsTxtBytes is ignored, including a line cut short by the limit.
+// Input is read until EOF, an error or robotsTxtDrainBytes past the
+// truncation.
+func ScrapRobotsTxt(input io.Reader) RobotsTxt {
 	rules := map[string][]string{}
+	defer io.Copy(io.Discard, io.LimitReader(input, robotsTxtDrainBytes))
 
 	skipToNextValue := false
 	matchingAgent := true
-	scanner := bufio.NewScanner(input)
-	for scanner.Scan() {
-		line := scanner.Text()
-		if line == "" || strings.HasPrefix(line, "#") {
+	// A byte past the limit tells a line cut short from one ending at it
+	limited := &io.LimitedReader{R: input, N: maxRobotsTxtBytes + 1}
+	r := bufio.NewReader(limited)
+	for {
+		line, tooLong, err := readRobotsTxtLine(r)
+		if err != nil {
+			break
+		}
+		consumed := maxRobotsTxtBytes + 1 - limited.N - int64(r.Buffered())
+		if consumed > maxRobotsTxtBytes {
+			break
+		}
+		if tooLong || line == "" || strings.HasPrefix(line, "#") {
 			continue
 		}
 
@@ -155,7 +205,5 @@ func scrapRobotsTxt(input io.Reader) robotstxt {
 			rules[token] = append(rules[token], value)
 		}
 	}
-
-	io.ReadAll(input)
 	return rules
 }
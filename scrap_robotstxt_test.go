@@ -1,9 +1,12 @@
 package main
 
 import (
+	"bytes"
 	"html/template"
+	"os"
 	"path"
 	"slices"
+	"strings"
 	"testing"
 	"time"
 )
@@ -65,6 +68,39 @@ func TestScrapRobotsTxt(t *testing.T) {
 		},
 	}}, mixedPath)
 
+	// Lines past the limit should be skipped without losing the rest
+	overlongPath := path.Join(root, "overlong.txt")
+	makeRobotsTxt(t, []record{{
+		Agents: []string{"*"},
+		Rules: []rule{
+			{Token: ruleDisallow, Value: "/tmp" + strings.Repeat("a", 64*1024)},
+			{Token: ruleCrawlDelay, Value: "1"},
+			{Token: ruleDisallow, Value: "/private"},
+		},
+	}}, overlongPath)
+
+	// Rules past the size limit should be ignored
+	oversizedPath := path.Join(root, "oversized.txt")
+	oversizedRules := []rule{{Token: ruleCrawlDelay, Value: "1"}}
+	for len(oversizedRules)*len("Disallow: /padding\n") < maxRobotsTxtBytes {
+		oversizedRules = append(oversizedRules, rule{Token: ruleDisallow, Value: "/padding"})
+	}
+	oversizedRules = append(oversizedRules, rule{Token: ruleDisallow, Value: "/private"})
+	makeRobotsTxt(t, []record{{
+		Agents: []string{"*"},
+		Rules:  oversizedRules,
+	}}, oversizedPath)
+
+	// A robots.txt of exactly the limit is whole
+	fullPath := path.Join(root, "full.txt")
+	full := "User-agent: *\nCrawl-delay: 1\n"
+	last := "Disallow: /private\n"
+	full += strings.Repeat("#", maxRobotsTxtBytes-len(full)-len(last)-1) + "\n" + last
+	err := os.WriteFile(fullPath, []byte(full), 0o644)
+	if err != nil {
+		t.Fatal("Failed to write robots.txt: ", err)
+	}
+
 	testcases := map[string]struct {
 		in              string
 		outCrawlDelay   time.Duration
@@ -81,6 +117,24 @@ func TestScrapRobotsTxt(t *testing.T) {
 			outCrawlDelay: time.Microsecond,
 			allowedPaths:  []string{"/tmp", "/public"},
 		},
+		"Overlong line": {
+			in:              overlongPath,
+			outCrawlDelay:   time.Second,
+			allowedPaths:    []string{"/tmp"},
+			disallowedPaths: []string{"/private"},
+		},
+		"Oversized file": {
+			in:              oversizedPath,
+			outCrawlDelay:   time.Second,
+			allowedPaths:    []string{"/private"},
+			disallowedPaths: []string{"/padding"},
+		},
+		"Exactly the limit": {
+			in:              fullPath,
+			outCrawlDelay:   time.Second,
+			allowedPaths:    []string{"/public"},
+			disallowedPaths: []string{"/private"},
+		},
 		"Mixed Allow & Disallow": {
 			in:              mixedPath,
 			outCrawlDelay:   0,
@@ -91,7 +145,7 @@ func TestScrapRobotsTxt(t *testing.T) {
 
 	for name, tc := range testcases {
 		t.Run(name, func(t *testing.T) {
-			txt := scrapRobotsTxt(openFile(t, tc.in))
+			txt := ScrapRobotsTxt(openFile(t, tc.in))
 
 			delay, _ := txt.crawlDelay()
 			if delay != tc.outCrawlDelay {
@@ -112,3 +166,46 @@ func TestScrapRobotsTxt(t *testing.T) {
 		})
 	}
 }
+
+type endlessReader struct {
+	read int
+}
+
+func (r *endlessReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = "Disallow: /tmp\n"[(r.read+i)%len("Disallow: /tmp\n")]
+	}
+	r.read += len(p)
+	return len(p), nil
+}
+
+func TestScrapRobotsTxtEndless(t *testing.T) {
+	r := &endlessReader{}
+	txt := ScrapRobotsTxt(r)
+	if txt.pathAllowed("/tmp") {
+		t.Error("path /tmp, should be disallowed")
+	}
+	// Reading is bounded by the limit and the drain
+	if r.read > maxRobotsTxtBytes+1+robotsTxtDrainBytes {
+		t.Error("Read ", r.read, " bytes of an endless robots.txt")
+	}
+}
+
+func FuzzScrapRobotsTxt(f *testing.F) {
+	for _, p := range []string{
+		"testdata/no_wildcard_robots.txt",
+		"testdata/wildcard_robots.txt",
+	} {
+		b, err := os.ReadFile(p)
+		if err != nil {
+			f.Fatal("Failed to read seed ", p, ": ", err)
+		}
+		f.Add(b, "/tmp/a.html")
+	}
+
+	f.Fuzz(func(t *testing.T, txt []byte, path string) {
+		rules := ScrapRobotsTxt(bytes.NewReader(txt))
+		rules.crawlDelay()
+		rules.pathAllowed(path)
+	})
+}
@@ -0,0 +1,185 @@
+// Functions related to customising strategies with Starlark scripts.
+// A script may define any of the hooks
+//
+//	ramp(state) -> "ramp", "hold" or "stop"
+//	allow_host(host) -> bool, before connecting to a server
+//	keep_host(host) -> bool, after each reply from a server
+//
+// which are called by the scheduler at each decision point.
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+const (
+	scriptRamp = "ramp"
+	scriptHold = "hold"
+	scriptStop = "stop"
+)
+
+// scripted wraps a strategy with the decisions of a script.
+type scripted struct {
+	base   strategy
+	thread *starlark.Thread
+
+	ramp      starlark.Callable
+	allowHost starlark.Callable
+	keepHost  starlark.Callable
+
+	// Last reply each connection was checked with keep_host for
+	checked map[uint]time.Time
+}
+
+func loadScript(path string, base strategy) (*scripted, error) {
+	thread := &starlark.Thread{Name: "natck"}
+	globals, err := starlark.ExecFile(thread, path, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load script: %w", err)
+	}
+
+	hook := func(name string) (starlark.Callable, error) {
+		v, found := globals[name]
+		if !found {
+			return nil, nil
+		}
+		fn, ok := v.(starlark.Callable)
+		if !ok {
+			return nil, fmt.Errorf("script %v is a %v, not a function", name, v.Type())
+		}
+		return fn, nil
+	}
+
+	sc := &scripted{
+		base:    base,
+		thread:  thread,
+		checked: map[uint]time.Time{},
+	}
+	if sc.ramp, err = hook("ramp"); err != nil {
+		return nil, err
+	}
+	if sc.allowHost, err = hook("allow_host"); err != nil {
+		return nil, err
+	}
+	if sc.keepHost, err = hook("keep_host"); err != nil {
+		return nil, err
+	}
+	return sc, nil
+}
+
+func scriptState(s *scheduler) starlark.Value {
+	return starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+		"active":    starlark.MakeInt(len(s.activeConns)),
+		"pending":   starlark.MakeInt(len(s.pendingConns)),
+		"failed":    starlark.MakeInt(len(s.failedConns)),
+		"elapsed":   starlark.Float(s.now().Sub(s.started).Seconds()),
+		"exhausted": starlark.Bool(s.exhausted()),
+	})
+}
+
+func scriptHost(c *connection) starlark.Value {
+	latency := time.Duration(0)
+	if c.lastReply.After(c.lastRequest) {
+		latency = c.lastReply.Sub(c.lastRequest)
+	}
+	return starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+		"name":     starlark.String(c.url.Hostname()),
+		"addr":     starlark.String(c.host.ip.Addr().String()),
+		"port":     starlark.MakeInt(int(c.host.ip.Port())),
+		"scheme":   starlark.String(c.url.Scheme),
+		"requests": starlark.MakeInt(len(c.crawledUrls)),
+		"latency":  starlark.Float(latency.Seconds()),
+	})
+}
+
+func (sc *scripted) call(fn starlark.Callable, arg starlark.Value) (starlark.Value, error) {
+	v, err := starlark.Call(sc.thread, fn, starlark.Tuple{arg}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("script %v failed: %w", fn.Name(), err)
+	}
+	return v, nil
+}
+
+func (sc *scripted) decideRamp(s *scheduler) (string, error) {
+	if sc.ramp == nil {
+		return scriptRamp, nil
+	}
+
+	v, err := sc.call(sc.ramp, scriptState(s))
+	if err != nil {
+		return "", err
+	}
+	decision, ok := starlark.AsString(v)
+	if !ok || (decision != scriptRamp && decision != scriptHold && decision != scriptStop) {
+		return "", fmt.Errorf("script ramp returned %v, expected %q, %q or %q", v, scriptRamp, scriptHold, scriptStop)
+	}
+	return decision, nil
+}
+
+// hostToDrop finds the first connection keep_host rejects since its
+// last reply.
+func (sc *scripted) hostToDrop(s *scheduler) (*connection, error) {
+	if sc.keepHost == nil {
+		return nil, nil
+	}
+
+	for _, c := range s.activeConns {
+		if c.lastReply.IsZero() || sc.checked[c.id].Equal(c.lastReply) {
+			continue
+		}
+		sc.checked[c.id] = c.lastReply
+
+		v, err := sc.call(sc.keepHost, scriptHost(c))
+		if err != nil {
+			return nil, err
+		}
+		if !bool(v.Truth()) {
+			return c, nil
+		}
+	}
+	return nil, nil
+}
+
+func (sc *scripted) next(s *scheduler) action {
+	c, err := sc.hostToDrop(s)
+	if err != nil {
+		s.fail(err)
+		return action{kind: actionStop}
+	}
+	if c != nil {
+		return action{kind: actionClose, conn: c}
+	}
+
+	decision, err := sc.decideRamp(s)
+	if err != nil {
+		s.fail(err)
+		return action{kind: actionStop}
+	}
+	switch decision {
+	case scriptStop:
+		return action{kind: actionStop}
+	case scriptHold:
+		// Only keep-alives whilst holding
+		return crawlAction(s.nextConnection(nil, 0))
+	}
+
+	next := sc.base.next(s)
+	if next.kind != actionCrawl || sc.allowHost == nil || len(s.pendingConns) == 0 || next.conn != s.pendingConns[0] {
+		return next
+	}
+
+	v, err := sc.call(sc.allowHost, scriptHost(next.conn))
+	if err != nil {
+		s.fail(err)
+		return action{kind: actionStop}
+	}
+	if !bool(v.Truth()) {
+		s.skipPendingConnection(next.conn)
+		return action{kind: actionWait}
+	}
+	return next
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestScriptedStrategy(t *testing.T) {
+	testcases := map[string]struct {
+		inScript  string
+		outNConns int
+		outErr    bool
+	}{
+		"no hooks": {
+			inScript:  "x = 1\n",
+			outNConns: 3,
+		},
+		"skip host": {
+			inScript:  "def allow_host(host):\n    return host.port != {{skip}}\n",
+			outNConns: 2,
+		},
+		"drop host after reply": {
+			inScript:  "def keep_host(host):\n    return host.port != {{skip}}\n",
+			outNConns: 2,
+		},
+		"stop ramping": {
+			inScript:  "def ramp(state):\n    return 'stop' if state.elapsed > 0.5 else 'hold'\n",
+			outNConns: 0,
+		},
+		"bad ramp decision": {
+			inScript: "def ramp(state):\n    return 42\n",
+			outErr:   true,
+		},
+		"failing hook": {
+			inScript: "def allow_host(host):\n    return host.missing\n",
+			outErr:   true,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			srvs := []*httpTestServer{}
+			for i := range 3 {
+				root := makeServerRoot(t, tPath("wildcard_robots.txt"), tPath("no_links.html"))
+				srv := &httpTestServer{
+					name:     fmt.Sprintf("http.%v", i),
+					handlers: HandlerChain{makeFileHandler(root)},
+				}
+				startHttpServer(t, srv)
+				srvs = append(srvs, srv)
+			}
+			urls := []*url.URL{}
+			for _, srv := range srvs {
+				urls = append(urls, srv.tUrl(t, "index.html"))
+			}
+
+			skip := srvs[2].tUrl(t, "").Port()
+			script := strings.ReplaceAll(tc.inScript, "{{skip}}", skip)
+			scriptPath := path.Join(t.TempDir(), "strategy.star")
+			err := os.WriteFile(scriptPath, []byte(script), 0666)
+			if err != nil {
+				t.Fatal("Failed to write script: ", err)
+			}
+
+			m := Measurer{Script: scriptPath}
+			r, err := m.Measure(urls)
+			if tc.outErr {
+				if err == nil {
+					t.Error("expected the script to fail the measurement")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal("Failed to measure: ", err)
+			}
+			if r.MaxConnections != tc.outNConns {
+				t.Errorf("expected to measure %d connections, got %d", tc.outNConns, r.MaxConnections)
+			}
+		})
+	}
+}
@@ -0,0 +1,334 @@
+// Functions related to natck replacing itself with a newer release, for
+// fleets of probes on routers without a package manager.
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	selfUpdateTimeout = 5 * time.Minute
+	// Larger downloads are refused rather than filling a router's flash
+	maxReleaseBytes = 64 * 1024 * 1024
+)
+
+// Defaults of the self-update flags, set when building releases with
+// -ldflags "-X main.releaseUrl=https://... -X main.releasePublicKey=..."
+var (
+	releaseUrl       = ""
+	releasePublicKey = ""
+)
+
+// signedManifest is served at the release url, the manifest it carries
+// only trusted once its signature verifies.
+type signedManifest struct {
+	// Base64 JSON of the releaseManifest
+	Manifest string `json:"manifest"`
+	// Base64 ed25519 signature of the JSON of the manifest
+	Signature string `json:"signature"`
+}
+
+// releaseManifest describes the latest release.
+type releaseManifest struct {
+	Version string `json:"version"`
+	// Keyed by GOOS/GOARCH, like linux/mipsle
+	Binaries map[string]releaseBinary `json:"binaries"`
+}
+
+type releaseBinary struct {
+	// Relative to the release url
+	Url string `json:"url"`
+	// Hex SHA-256 of the binary
+	Sha256 string `json:"sha256"`
+}
+
+// selfUpdateOptions are the flags of the self-update command.
+type selfUpdateOptions struct {
+	fs        *flag.FlagSet
+	url       string
+	publicKey string
+	check     bool
+	force     bool
+}
+
+func newSelfUpdateFlags(name string) *selfUpdateOptions {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	o := &selfUpdateOptions{fs: fs}
+	fs.StringVar(&o.url, "release-url", releaseUrl, "url of the manifest describing the latest release")
+	fs.StringVar(&o.publicKey, "public-key", releasePublicKey, "base64 ed25519 public key releases are signed with")
+	fs.BoolVar(&o.check, "check", false, "only report whether a newer release is available")
+	fs.BoolVar(&o.force, "force", false, "replace the binary even if the release is not newer than the running version")
+	return o
+}
+
+func parsePublicKey(s string) (ed25519.PublicKey, error) {
+	if s == "" {
+		return nil, errors.New("no public key to verify releases with")
+	}
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode public key: %w", err)
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("public key is %d bytes, expected %d", len(key), ed25519.PublicKeySize)
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// fetchRelease reads the body of u, refusing more than maxReleaseBytes.
+func fetchRelease(client *http.Client, u *url.URL) ([]byte, error) {
+	resp, err := client.Get(u.String())
+	if err != nil {
+		return nil, fmt.Errorf("failed to get %v: %w", u, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to get %v: %v", u, resp.Status)
+	}
+
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxReleaseBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %v: %w", u, err)
+	}
+	if len(b) > maxReleaseBytes {
+		return nil, fmt.Errorf("%v is larger than %d bytes", u, maxReleaseBytes)
+	}
+	return b, nil
+}
+
+// fetchManifest fetches the signed manifest at u, verifying its signature
+// before decoding any of it, so the version and binaries are as released.
+func fetchManifest(client *http.Client, u *url.URL, key ed25519.PublicKey) (*releaseManifest, error) {
+	b, err := fetchRelease(client, u)
+	if err != nil {
+		return nil, err
+	}
+
+	signed := &signedManifest{}
+	err = json.Unmarshal(b, signed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode release manifest: %w", err)
+	}
+	manifest, err := base64.StdEncoding.DecodeString(signed.Manifest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode release manifest: %w", err)
+	}
+	sig, err := base64.StdEncoding.DecodeString(signed.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode signature: %w", err)
+	}
+	if !ed25519.Verify(key, manifest, sig) {
+		return nil, fmt.Errorf("signature of %v does not match the public key", u)
+	}
+
+	m := &releaseManifest{}
+	err = json.Unmarshal(manifest, m)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode release manifest: %w", err)
+	}
+	return m, nil
+}
+
+// downloadBinary downloads the binary for this platform, verifying it is
+// the one the manifest was signed with.
+func downloadBinary(client *http.Client, manifestUrl *url.URL, m *releaseManifest) ([]byte, error) {
+	platform := runtime.GOOS + "/" + runtime.GOARCH
+	rb, found := m.Binaries[platform]
+	if !found {
+		return nil, fmt.Errorf("release %v has no binary for %v", m.Version, platform)
+	}
+	u, err := manifestUrl.Parse(rb.Url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse binary url: %w", err)
+	}
+	sum, err := hex.DecodeString(rb.Sha256)
+	if err != nil || len(sum) != sha256.Size {
+		return nil, fmt.Errorf("release %v has no valid SHA-256 for %v", m.Version, platform)
+	}
+
+	b, err := fetchRelease(client, u)
+	if err != nil {
+		return nil, err
+	}
+	if got := sha256.Sum256(b); !bytes.Equal(got[:], sum) {
+		return nil, fmt.Errorf("SHA-256 of %v does not match the manifest", u)
+	}
+	return b, nil
+}
+
+// parseVersion splits a version like v1.2.3-rc.1+build into its numbers
+// and pre-release identifiers.
+func parseVersion(v string) ([3]int, []string, bool) {
+	numbers := [3]int{}
+	v, _, _ = strings.Cut(strings.TrimPrefix(v, "v"), "+")
+	v, pre, hasPre := strings.Cut(v, "-")
+	parts := strings.Split(v, ".")
+	if len(parts) != len(numbers) {
+		return numbers, nil, false
+	}
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return numbers, nil, false
+		}
+		numbers[i] = n
+	}
+	if !hasPre {
+		return numbers, nil, true
+	}
+	return numbers, strings.Split(pre, "."), pre != ""
+}
+
+// compareVersions orders semantic versions a and b, false if either is
+// not one, like the (devel) of builds outside a release.
+func compareVersions(a, b string) (int, bool) {
+	aNumbers, aPre, aOk := parseVersion(a)
+	bNumbers, bPre, bOk := parseVersion(b)
+	if !aOk || !bOk {
+		return 0, false
+	}
+	for i := range aNumbers {
+		if c := aNumbers[i] - bNumbers[i]; c != 0 {
+			return c, true
+		}
+	}
+	// A release follows its pre-releases
+	if len(aPre) == 0 || len(bPre) == 0 {
+		return len(bPre) - len(aPre), true
+	}
+	for i := 0; i < len(aPre) && i < len(bPre); i++ {
+		aN, aErr := strconv.Atoi(aPre[i])
+		bN, bErr := strconv.Atoi(bPre[i])
+		switch {
+		case aErr == nil && bErr == nil && aN != bN:
+			return aN - bN, true
+		// Numeric identifiers precede alphanumeric ones
+		case aErr == nil && bErr != nil:
+			return -1, true
+		case aErr != nil && bErr == nil:
+			return 1, true
+		case aErr != nil && aPre[i] != bPre[i]:
+			return strings.Compare(aPre[i], bPre[i]), true
+		}
+	}
+	return len(aPre) - len(bPre), true
+}
+
+// replaceBinary atomically replaces the file at path with b, keeping its
+// permissions. The new binary is written alongside so the rename does
+// not cross filesystems.
+func replaceBinary(path string, b []byte) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("failed to stat binary: %w", err)
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), ".natck-update-*")
+	if err != nil {
+		return fmt.Errorf("failed to create new binary: %w", err)
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Chmod(info.Mode().Perm())
+	}
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write new binary: %w", err)
+	}
+
+	err = os.Rename(f.Name(), path)
+	if err != nil {
+		return fmt.Errorf("failed to replace binary: %w", err)
+	}
+	return nil
+}
+
+// selfUpdate replaces the binary at path with the latest release, if it
+// is newer than the running version, so a replayed manifest cannot roll
+// probes back to an older release.
+func selfUpdate(w io.Writer, o *selfUpdateOptions, path string) error {
+	if o.url == "" {
+		return errors.New("no release url to update from")
+	}
+	key, err := parsePublicKey(o.publicKey)
+	if err != nil {
+		return err
+	}
+	manifestUrl, err := url.Parse(o.url)
+	if err != nil {
+		return fmt.Errorf("failed to parse release url: %w", err)
+	}
+
+	client := &http.Client{Timeout: selfUpdateTimeout}
+	m, err := fetchManifest(client, manifestUrl, key)
+	if err != nil {
+		return err
+	}
+	running := runningVersion()
+	newer, ok := compareVersions(m.Version, running)
+	switch {
+	case o.force:
+	case !ok:
+		return fmt.Errorf("cannot tell whether release %v is newer than the running %v, update with --force", m.Version, running)
+	case newer == 0:
+		fmt.Fprintf(w, "natck %v is the latest release\n", running)
+		return nil
+	case newer < 0:
+		fmt.Fprintf(w, "natck %v is newer than the release %v\n", running, m.Version)
+		return nil
+	}
+	if o.check {
+		fmt.Fprintf(w, "natck %v is available, running %v\n", m.Version, running)
+		return nil
+	}
+
+	b, err := downloadBinary(client, manifestUrl, m)
+	if err != nil {
+		return err
+	}
+	err = replaceBinary(path, b)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "Updated natck from %v to %v\n", running, m.Version)
+	return nil
+}
+
+func selfUpdateCommand(name string, args []string) {
+	o := newSelfUpdateFlags(name)
+	parseCommandArgs(o.fs, args, "", 0, false)
+
+	path, err := os.Executable()
+	if err == nil {
+		path, err = filepath.EvalSymlinks(path)
+	}
+	if err != nil {
+		fmt.Printf("Failed to find the natck binary: %v\n", err)
+		os.Exit(1)
+	}
+	err = selfUpdate(os.Stdout, o, path)
+	if err != nil {
+		fmt.Printf("Failed to update: %v\n", err)
+		os.Exit(1)
+	}
+}
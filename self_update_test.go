@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestSelfUpdate(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal("Failed to generate key: ", err)
+	}
+	_, otherPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal("Failed to generate key: ", err)
+	}
+	binary := []byte("#!/bin/sh\necho new\n")
+	sum := sha256.Sum256(binary)
+
+	testcases := map[string]struct {
+		signer     ed25519.PrivateKey
+		version    string
+		sha256     string
+		platform   string
+		tamper     bool
+		check      bool
+		force      bool
+		outError   bool
+		outUpdated bool
+	}{
+		"Updates":         {signer: priv, version: "v2.0.0", outUpdated: true},
+		"Latest":          {signer: priv, version: "v1.0.0"},
+		"Older":           {signer: priv, version: "v0.9.0"},
+		"Pre-release":     {signer: priv, version: "v1.0.0-rc.1"},
+		"Older forced":    {signer: priv, version: "v0.9.0", force: true, outUpdated: true},
+		"Check":           {signer: priv, version: "v2.0.0", check: true},
+		"Not a version":   {signer: priv, version: "latest", outError: true},
+		"Bad signature":   {signer: otherPriv, version: "v2.0.0", outError: true},
+		"Tampered":        {signer: priv, version: "v2.0.0", tamper: true, outError: true},
+		"Bad SHA-256":     {signer: priv, version: "v2.0.0", sha256: hex.EncodeToString(make([]byte, sha256.Size)), outError: true},
+		"Other platform":  {signer: priv, version: "v2.0.0", platform: "plan9/arm", outError: true},
+		"Missing SHA-256": {signer: priv, version: "v2.0.0", sha256: "-", outError: true},
+	}
+
+	version = "v1.0.0"
+	defer func() { version = "" }()
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			manifest := releaseManifest{Version: tc.version, Binaries: map[string]releaseBinary{
+				cmp.Or(tc.platform, runtime.GOOS+"/"+runtime.GOARCH): {
+					Url:    "natck",
+					Sha256: cmp.Or(tc.sha256, hex.EncodeToString(sum[:])),
+				},
+			}}
+			b, err := json.Marshal(manifest)
+			if err != nil {
+				t.Fatal("Failed to encode manifest: ", err)
+			}
+			signed := signedManifest{Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(tc.signer, b))}
+			if tc.tamper {
+				b = bytes.Replace(b, []byte(tc.version), []byte("v3.0.0"), 1)
+			}
+			signed.Manifest = base64.StdEncoding.EncodeToString(b)
+			srv := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+				switch req.URL.Path {
+				case "/releases/latest.json":
+					json.NewEncoder(res).Encode(signed)
+				case "/releases/natck":
+					res.Write(binary)
+				default:
+					res.WriteHeader(http.StatusNotFound)
+				}
+			}))
+			defer srv.Close()
+
+			path := filepath.Join(t.TempDir(), "natck")
+			err = os.WriteFile(path, []byte("old"), 0o755)
+			if err != nil {
+				t.Fatal("Failed to write binary: ", err)
+			}
+
+			o := &selfUpdateOptions{
+				url:       srv.URL + "/releases/latest.json",
+				publicKey: base64.StdEncoding.EncodeToString(pub),
+				check:     tc.check,
+				force:     tc.force,
+			}
+			var out bytes.Buffer
+			err = selfUpdate(&out, o, path)
+			if (err != nil) != tc.outError {
+				t.Fatalf("expected error %v, got %v", tc.outError, err)
+			}
+
+			b, err = os.ReadFile(path)
+			if err != nil {
+				t.Fatal("Failed to read binary: ", err)
+			}
+			if updated := bytes.Equal(b, binary); updated != tc.outUpdated {
+				t.Errorf("expected updated %v, got %v: %v", tc.outUpdated, updated, out.String())
+			}
+			info, err := os.Stat(path)
+			if err != nil || info.Mode().Perm() != 0o755 {
+				t.Errorf("expected the binary to stay executable, got %v %v", info, err)
+			}
+		})
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	testcases := map[string]struct {
+		inA, inB string
+		outSign  int
+		outOk    bool
+	}{
+		"Equal":              {inA: "v1.2.3", inB: "v1.2.3", outSign: 0, outOk: true},
+		"Patch":              {inA: "v1.2.4", inB: "v1.2.3", outSign: 1, outOk: true},
+		"Minor over patch":   {inA: "v1.3.0", inB: "v1.2.9", outSign: 1, outOk: true},
+		"Numeric not string": {inA: "v1.10.0", inB: "v1.9.0", outSign: 1, outOk: true},
+		"Pre-release":        {inA: "v1.2.3-rc.1", inB: "v1.2.3", outSign: -1, outOk: true},
+		"Pre-releases":       {inA: "v1.2.3-rc.2", inB: "v1.2.3-rc.10", outSign: -1, outOk: true},
+		"Numeric first":      {inA: "v1.2.3-1", inB: "v1.2.3-alpha", outSign: -1, outOk: true},
+		"Longer pre-release": {inA: "v1.2.3-rc.1.1", inB: "v1.2.3-rc.1", outSign: 1, outOk: true},
+		"Build metadata":     {inA: "v1.2.3+mips", inB: "v1.2.3", outSign: 0, outOk: true},
+		"Devel":              {inA: "v1.2.3", inB: "(devel)", outOk: false},
+		"Short":              {inA: "v1.2", inB: "v1.2.0", outOk: false},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			c, ok := compareVersions(tc.inA, tc.inB)
+			if ok != tc.outOk {
+				t.Fatalf("expected ok %v, got %v", tc.outOk, ok)
+			}
+			if sign := max(-1, min(c, 1)); ok && sign != tc.outSign {
+				t.Errorf("expected %v to compare %d to %v, got %d", tc.inA, tc.outSign, tc.inB, c)
+			}
+		})
+	}
+}
+
+func TestParsePublicKey(t *testing.T) {
+	for _, key := range []string{"", "not base64!", base64.StdEncoding.EncodeToString([]byte("short"))} {
+		_, err := parsePublicKey(key)
+		if err == nil {
+			t.Errorf("expected public key %q to be rejected", key)
+		}
+	}
+	_, err := parsePublicKey(base64.StdEncoding.EncodeToString(make([]byte, ed25519.PublicKeySize)))
+	if err != nil {
+		t.Error("expected a 32 byte key to be accepted: ", err)
+	}
+}
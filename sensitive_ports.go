@@ -0,0 +1,65 @@
+// Functions related to not connecting to the ports of sensitive services,
+// like mail and remote desktops, linked from crawled pages. Connections
+// to them look like port scans and trigger abuse reports mid-measurement.
+package main
+
+import (
+	"net/url"
+	"strconv"
+)
+
+// sensitivePorts are the ports of services scraped urls are not
+// connected to, unless Measurer.AllowSensitivePorts.
+var sensitivePorts = map[uint16]string{
+	21:    "ftp",
+	22:    "ssh",
+	23:    "telnet",
+	25:    "smtp",
+	110:   "pop3",
+	135:   "msrpc",
+	137:   "netbios-ns",
+	138:   "netbios-dgm",
+	139:   "netbios-ssn",
+	143:   "imap",
+	445:   "smb",
+	465:   "smtps",
+	587:   "submission",
+	993:   "imaps",
+	995:   "pop3s",
+	1433:  "mssql",
+	1521:  "oracle",
+	2049:  "nfs",
+	3306:  "mysql",
+	3389:  "rdp",
+	5432:  "postgresql",
+	5900:  "vnc",
+	6379:  "redis",
+	11211: "memcached",
+	27017: "mongodb",
+}
+
+// isSensitivePort reports whether u is on the port of a sensitive service.
+func isSensitivePort(u *url.URL) bool {
+	port, err := strconv.ParseUint(urlPort(u), 10, 16)
+	if err != nil {
+		return false
+	}
+	_, found := sensitivePorts[uint16(port)]
+	return found
+}
+
+// skipSensitivePort reports whether the scraped url should not be
+// connected to, counting the hosts skipped.
+func (s *scheduler) skipSensitivePort(u *url.URL) bool {
+	if s.m.AllowSensitivePorts || !isSensitivePort(u) {
+		return false
+	}
+	if s.sensitivePortHosts == nil {
+		s.sensitivePortHosts = map[string]bool{}
+	}
+	if !s.sensitivePortHosts[canonicalHost(u)] {
+		s.m.log().Info("skipped the port of a sensitive service", "host", u.Host)
+	}
+	s.sensitivePortHosts[canonicalHost(u)] = true
+	return true
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"testing"
+)
+
+func TestIsSensitivePort(t *testing.T) {
+	testcases := map[string]struct {
+		inUrl        string
+		expSensitive bool
+	}{
+		"Default http port":  {inUrl: "http://example.com/", expSensitive: false},
+		"Default https port": {inUrl: "https://example.com/", expSensitive: false},
+		"Alternative http":   {inUrl: "http://example.com:8080/", expSensitive: false},
+		"SMTP":               {inUrl: "http://example.com:25/", expSensitive: true},
+		"SMB":                {inUrl: "https://example.com:445/", expSensitive: true},
+		"RDP":                {inUrl: "http://192.0.2.1:3389/", expSensitive: true},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			u, err := url.Parse(tc.inUrl)
+			if err != nil {
+				t.Fatal("Failed to parse url: ", err)
+			}
+			if sensitive := isSensitivePort(u); sensitive != tc.expSensitive {
+				t.Errorf("expected sensitive to be %v, got %v", tc.expSensitive, sensitive)
+			}
+		})
+	}
+}
+
+// smtpLinkNetwork links the first host of a benchNetwork to the second on
+// the SMTP port.
+type smtpLinkNetwork struct {
+	benchNetwork
+}
+
+func (n *smtpLinkNetwork) scrapConnection(ctx context.Context, r *roundtrip) *roundtrip {
+	r = n.benchNetwork.scrapConnection(ctx, r)
+	if i, ok := benchHostIndex(r.url); ok && i == 0 && r.url.Path == "/" {
+		u := benchHostUrl(1)
+		u.Host += ":25"
+		r.scrapedUrls = append(r.scrapedUrls, u)
+	}
+	return r
+}
+
+func TestSensitivePortsSkipped(t *testing.T) {
+	testcases := map[string]struct {
+		inAllow        bool
+		expConnections int
+		expSkipped     int
+	}{
+		"Skipped": {inAllow: false, expConnections: 1, expSkipped: 1},
+		"Allowed": {inAllow: true, expConnections: 2, expSkipped: 0},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			n := &smtpLinkNetwork{benchNetwork{hosts: 2, seeds: 1}}
+			m := Measurer{network: n, AllowSensitivePorts: tc.inAllow}
+			r, err := m.Measure(n.seedUrls())
+			if err != nil {
+				t.Fatal("Failed to measure: ", err)
+			}
+			if r.MaxConnections != tc.expConnections {
+				t.Errorf("expected %d connections, got %d", tc.expConnections, r.MaxConnections)
+			}
+			if r.SensitivePortHosts != tc.expSkipped {
+				t.Errorf("expected %d hosts skipped, got %d", tc.expSkipped, r.SensitivePortHosts)
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+// Functions related to accounting for the 5xx replies of servers apart
+// for robots.txt and for content, as a server failing one may be fine for
+// the other.
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+const (
+	// Keep connections whatever their servers reply, robots.txt failures
+	// being handled by Measurer.RobotsFailurePolicy
+	ServerErrorsIgnore = "ignore"
+	// Fail connections once a page other than robots.txt gets a 5xx
+	ServerErrorsFailContent = "fail-content"
+	// Fail connections once any request, robots.txt too, gets a 5xx
+	ServerErrorsFailAny = "fail-any"
+)
+
+var serverErrorPolicies = []string{ServerErrorsIgnore, ServerErrorsFailContent, ServerErrorsFailAny}
+
+func checkServerErrorPolicy(policy string) error {
+	if policy != "" && !slices.Contains(serverErrorPolicies, policy) {
+		return fmt.Errorf("unknown server error policy %q, expected one of %v", policy, strings.Join(serverErrorPolicies, ", "))
+	}
+	return nil
+}
+
+// handleServerError counts a 5xx reply against robots.txt or content,
+// failing the connection if the policy says to. Runs after the robots.txt
+// failure policy, which would otherwise keep the connection.
+func (s *scheduler) handleServerError(reply *roundtrip) {
+	if reply.err != nil || reply.status < 500 {
+		return
+	}
+	robots := reply.url.Path == "/robots.txt"
+	if robots {
+		s.robotsServerErrors++
+	} else {
+		s.contentServerErrors++
+	}
+
+	policy := cmp.Or(s.m.ServerErrorPolicy, ServerErrorsIgnore)
+	if policy == ServerErrorsFailAny || (policy == ServerErrorsFailContent && !robots) {
+		reply.err = fmt.Errorf("server error %d on %v", reply.status, reply.url)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"testing"
+)
+
+// makeServerErrorHandler replies to every request but for robots.txt with
+// status.
+func makeServerErrorHandler(status int) HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) bool {
+		if req.URL.Path == "/robots.txt" {
+			return true
+		}
+		res.WriteHeader(status)
+		return false
+	}
+}
+
+func TestServerErrorPolicy(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping due to re-request timeouts.")
+	}
+
+	testcases := map[string]struct {
+		policy        string
+		robotsError   bool
+		contentError  bool
+		outNConns     int
+		outRobotsErrs bool
+		outContentErr bool
+	}{
+		"Ignore content errors": {
+			contentError:  true,
+			outNConns:     2,
+			outContentErr: true,
+		},
+		"Fail content errors": {
+			policy:        ServerErrorsFailContent,
+			contentError:  true,
+			outNConns:     1,
+			outContentErr: true,
+		},
+		"Fail content keeps robots errors": {
+			policy:        ServerErrorsFailContent,
+			robotsError:   true,
+			outNConns:     2,
+			outRobotsErrs: true,
+		},
+		"Fail any robots errors": {
+			policy:        ServerErrorsFailAny,
+			robotsError:   true,
+			outNConns:     1,
+			outRobotsErrs: true,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			linked := &httpTestServer{name: "linked"}
+			startHttpServer(t, linked)
+			linkedHandlers := HandlerChain{}
+			if tc.contentError {
+				linkedHandlers = append(linkedHandlers, makeServerErrorHandler(http.StatusInternalServerError))
+			}
+			if tc.robotsError {
+				linkedHandlers = append(linkedHandlers, makeRobotsFailureHandler(http.StatusServiceUnavailable, 1))
+			}
+			linked.server.Handler = append(linkedHandlers,
+				makeFileHandler(makeServerRoot(t, tPath("wildcard_robots.txt"), tPath("no_links.html"))))
+
+			srv := &httpTestServer{name: "server"}
+			startHttpServer(t, srv)
+			root := makeServerRoot(t, tPath("wildcard_robots.txt"))
+			makeHtmlDocWithLinks(t, []*url.URL{linked.tUrl(t, "")}, path.Join(root, "index.html"))
+			srv.server.Handler = HandlerChain{makeFileHandler(root)}
+
+			m := Measurer{RobotsFailurePolicy: RobotsFailureAssumeAllow, ServerErrorPolicy: tc.policy}
+			r, err := m.Measure([]*url.URL{srv.tUrl(t, "")})
+			if err != nil {
+				t.Fatal("Failed to measure: ", err)
+			}
+			if r.MaxConnections != tc.outNConns {
+				t.Errorf("expected to measure %d connections, got %d", tc.outNConns, r.MaxConnections)
+			}
+			if (r.RobotsServerErrors > 0) != tc.outRobotsErrs {
+				t.Errorf("expected robots.txt server errors %v, got %d", tc.outRobotsErrs, r.RobotsServerErrors)
+			}
+			if (r.ContentServerErrors > 0) != tc.outContentErr {
+				t.Errorf("expected content server errors %v, got %d", tc.outContentErr, r.ContentServerErrors)
+			}
+		})
+	}
+}
+
+func TestUnknownServerErrorPolicy(t *testing.T) {
+	m := Measurer{ServerErrorPolicy: "retry"}
+	_, err := m.Measure(nil)
+	if err == nil {
+		t.Error("expected an unknown server error policy to fail")
+	}
+}
@@ -0,0 +1,64 @@
+// Functions related to measuring the connections a NAT allows to a single
+// destination, over the ports of a cooperating server like natck
+// reflector, to tell per-destination limits from global ones.
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// portRange is an inclusive range of ports.
+type portRange struct {
+	first, last uint16
+}
+
+// parsePortRange parses a port, or a range of ports like 8000-8999.
+func parsePortRange(s string) (portRange, error) {
+	firstS, lastS, isRange := strings.Cut(s, "-")
+	first, err := strconv.ParseUint(firstS, 10, 16)
+	if err != nil || first == 0 {
+		return portRange{}, fmt.Errorf("invalid port %q", firstS)
+	}
+	last := first
+	if isRange {
+		last, err = strconv.ParseUint(lastS, 10, 16)
+		if err != nil || last < first {
+			return portRange{}, fmt.Errorf("invalid last port %q", lastS)
+		}
+	}
+	return portRange{first: uint16(first), last: uint16(last)}, nil
+}
+
+func (r portRange) ports() []uint16 {
+	ports := []uint16{}
+	for p := int(r.first); p <= int(r.last); p++ {
+		ports = append(ports, uint16(p))
+	}
+	return ports
+}
+
+// parseSingleTarget parses an address with a range of ports, like
+// 198.51.100.7:8000-8999, into an http target on each port.
+func parseSingleTarget(s string) ([]Target, error) {
+	i := strings.LastIndex(s, ":")
+	if i == -1 {
+		return nil, fmt.Errorf("invalid single target %q, expected address:ports", s)
+	}
+	addr, err := netip.ParseAddr(strings.Trim(s[:i], "[]"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid single target address: %w", err)
+	}
+	ports, err := parsePortRange(s[i+1:])
+	if err != nil {
+		return nil, fmt.Errorf("invalid single target ports: %w", err)
+	}
+
+	targets := []Target{}
+	for _, p := range ports.ports() {
+		targets = append(targets, Target{AddrPort: netip.AddrPortFrom(addr, p), Scheme: "http"})
+	}
+	return targets, nil
+}
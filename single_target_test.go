@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestParseSingleTarget(t *testing.T) {
+	testcases := map[string]struct {
+		inTarget     string
+		expAddrPorts []string
+		expErr       bool
+	}{
+		"Range": {
+			inTarget:     "198.51.100.7:8000-8002",
+			expAddrPorts: []string{"198.51.100.7:8000", "198.51.100.7:8001", "198.51.100.7:8002"},
+		},
+		"One port": {
+			inTarget:     "198.51.100.7:8000",
+			expAddrPorts: []string{"198.51.100.7:8000"},
+		},
+		"IPv6": {
+			inTarget:     "[2001:db8::1]:8000-8001",
+			expAddrPorts: []string{"[2001:db8::1]:8000", "[2001:db8::1]:8001"},
+		},
+		"No ports":       {inTarget: "198.51.100.7", expErr: true},
+		"Hostname":       {inTarget: "example.com:8000-8001", expErr: true},
+		"Reversed range": {inTarget: "198.51.100.7:8001-8000", expErr: true},
+		"Port zero":      {inTarget: "198.51.100.7:0-10", expErr: true},
+		"Out of range":   {inTarget: "198.51.100.7:65535-65536", expErr: true},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			targets, err := parseSingleTarget(tc.inTarget)
+			if tc.expErr {
+				if err == nil {
+					t.Errorf("expected an error, got %+v", targets)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal("Failed to parse: ", err)
+			}
+			if len(targets) != len(tc.expAddrPorts) {
+				t.Fatalf("expected %d targets, got %+v", len(tc.expAddrPorts), targets)
+			}
+			for i, target := range targets {
+				if target.AddrPort != netip.MustParseAddrPort(tc.expAddrPorts[i]) || target.Scheme != "http" {
+					t.Errorf("expected http to %v, got %+v", tc.expAddrPorts[i], target)
+				}
+			}
+		})
+	}
+}
+
+func TestReflectorHandler(t *testing.T) {
+	testcases := map[string]struct {
+		inPath  string
+		expBody string
+	}{
+		"Address":    {inPath: "/", expBody: "192.0.2.1\n"},
+		"Any page":   {inPath: "/any", expBody: "192.0.2.1\n"},
+		"robots.txt": {inPath: "/robots.txt", expBody: "User-agent: *\nAllow: /\n"},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tc.inPath, nil)
+			req.RemoteAddr = "192.0.2.1:40000"
+			res := httptest.NewRecorder()
+			reflectorHandler().ServeHTTP(res, req)
+
+			body, _ := io.ReadAll(res.Result().Body)
+			if string(body) != tc.expBody {
+				t.Errorf("expected %q, got %q", tc.expBody, body)
+			}
+			if ctype := res.Result().Header.Get("Content-Type"); !strings.HasPrefix(ctype, "text/plain;") {
+				t.Errorf("expected plain text, got %q", ctype)
+			}
+		})
+	}
+}
@@ -0,0 +1,67 @@
+// Functions related to tuning the sockets of the measured connections,
+// so keep-alives into a dropped mapping fail quickly instead of waiting
+// for the default retransmission timeouts.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// SocketOptions tune the sockets of the measured connections, the zero
+// value keeps the defaults of Go and the system.
+type SocketOptions struct {
+	// Re-enable Nagle's algorithm, which Go disables with TCP_NODELAY.
+	Nagle bool
+	// Bytes of the kernel send and receive buffers (SO_SNDBUF and
+	// SO_RCVBUF), zero is the system default. Small buffers keep the
+	// memory of many mostly idle connections down.
+	SendBuffer    int
+	ReceiveBuffer int
+	// Time sent data may go unacknowledged before the connection is
+	// closed (TCP_USER_TIMEOUT), zero is defaultUserTimeout where
+	// supported and negative is the system default. Only supported on
+	// linux.
+	UserTimeout time.Duration
+}
+
+func (o SocketOptions) check() error {
+	if o.SendBuffer < 0 || o.ReceiveBuffer < 0 {
+		return errors.New("socket buffers cannot be negative")
+	}
+	if o.UserTimeout > 0 && !userTimeoutSupported {
+		return errors.New("TCP_USER_TIMEOUT is only supported on linux")
+	}
+	return nil
+}
+
+// apply tunes the socket of conn, if it is TCP.
+func (o SocketOptions) apply(conn net.Conn) error {
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	if o.Nagle {
+		if err := tcp.SetNoDelay(false); err != nil {
+			return fmt.Errorf("failed to enable Nagle's algorithm: %w", err)
+		}
+	}
+	if o.SendBuffer > 0 {
+		if err := tcp.SetWriteBuffer(o.SendBuffer); err != nil {
+			return fmt.Errorf("failed to set send buffer: %w", err)
+		}
+	}
+	if o.ReceiveBuffer > 0 {
+		if err := tcp.SetReadBuffer(o.ReceiveBuffer); err != nil {
+			return fmt.Errorf("failed to set receive buffer: %w", err)
+		}
+	}
+	if d := o.userTimeout(); d > 0 {
+		if err := setUserTimeout(tcp, d); err != nil {
+			return fmt.Errorf("failed to set user timeout: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// Whether TCP_USER_TIMEOUT can be set on this platform
+const userTimeoutSupported = false
+
+func setUserTimeout(c *net.TCPConn, d time.Duration) error {
+	return errors.New("TCP_USER_TIMEOUT is only supported on linux")
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net"
+	"net/url"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestSocketOptionsCheck(t *testing.T) {
+	testcases := map[string]struct {
+		options SocketOptions
+		valid   bool
+	}{
+		"defaults":        {valid: true},
+		"buffers":         {options: SocketOptions{SendBuffer: 4096, ReceiveBuffer: 4096}, valid: true},
+		"negative buffer": {options: SocketOptions{SendBuffer: -1}},
+		"system timeout":  {options: SocketOptions{UserTimeout: -time.Second}, valid: true},
+		"user timeout":    {options: SocketOptions{UserTimeout: time.Second}, valid: userTimeoutSupported},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			err := tc.options.check()
+			if (err == nil) != tc.valid {
+				t.Errorf("expected options %+v to be valid %v, got %v", tc.options, tc.valid, err)
+			}
+		})
+	}
+}
+
+func TestSocketOptionsApply(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Failed to listen: ", err)
+	}
+	defer l.Close()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal("Failed to dial: ", err)
+	}
+	defer conn.Close()
+
+	o := SocketOptions{Nagle: true, SendBuffer: 8192, ReceiveBuffer: 8192}
+	if userTimeoutSupported {
+		o.UserTimeout = 5 * time.Second
+	}
+	err = o.apply(conn)
+	if err != nil {
+		t.Error("Failed to apply socket options: ", err)
+	}
+}
+
+func TestMeasureSocketOptions(t *testing.T) {
+	srv := &httpTestServer{name: "server"}
+	startHttpServer(t, srv)
+	root := makeServerRoot(t, tPath("wildcard_robots.txt"))
+	cpFile(t, tPath("no_links.html"), path.Join(root, "index.html"))
+	srv.server.Handler = HandlerChain{makeFileHandler(root)}
+
+	m := Measurer{Socket: SocketOptions{Nagle: true, SendBuffer: 8192, ReceiveBuffer: 8192}}
+	if userTimeoutSupported {
+		m.Socket.UserTimeout = 5 * time.Second
+	}
+	r, err := m.Measure([]*url.URL{srv.tUrl(t, "")})
+	if err != nil {
+		t.Fatal("Failed to measure: ", err)
+	}
+	if r.MaxConnections != 1 {
+		t.Errorf("expected to measure 1 connection, got %d", r.MaxConnections)
+	}
+}
@@ -0,0 +1,9 @@
+//go:build sqlite
+
+package main
+
+// Registers the pure Go SQLite driver for sqlite: result stores, built
+// in only with -tags sqlite to keep the default build small.
+import (
+	_ "modernc.org/sqlite"
+)
@@ -0,0 +1,185 @@
+// Functions related to periodically exporting the state of a measurement
+// to time series databases, for users without Prometheus.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const statsSinkTimeout = 10 * time.Second
+
+// statsSink tallies events into gauges, writing them to a time series
+// database every interval.
+type statsSink struct {
+	write func(s stats, ts time.Time) error
+
+	m     sync.Mutex
+	stats stats
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+type statField struct {
+	name  string
+	value int
+}
+
+type stats struct {
+	active       int
+	established  int
+	failed       int
+	exhaustions  int
+	mappingsLost int
+}
+
+// openStatsSink parses target as influx://host:port/db for the InfluxDB
+// line protocol, or graphite://host:port for the Graphite plaintext
+// protocol.
+func openStatsSink(target string) (*statsSink, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse stats sink: %w", err)
+	}
+
+	s := &statsSink{}
+	switch u.Scheme {
+	case "influx":
+		db := u.Path
+		if len(db) > 0 {
+			db = db[1:]
+		}
+		if db == "" {
+			return nil, fmt.Errorf("influx stats sink %v has no database", target)
+		}
+		w := url.URL{
+			Scheme:   "http",
+			Host:     u.Host,
+			Path:     "/write",
+			RawQuery: url.Values{"db": {db}, "precision": {"s"}}.Encode(),
+		}
+		s.write = func(st stats, ts time.Time) error {
+			return writeInflux(w.String(), st, ts)
+		}
+	case "graphite":
+		s.write = func(st stats, ts time.Time) error {
+			return writeGraphite(u.Host, st, ts)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported stats sink %q, expected influx:// or graphite://", u.Scheme)
+	}
+	return s, nil
+}
+
+func (st stats) fields() []statField {
+	return []statField{
+		{"active_connections", st.active},
+		{"established_connections", st.established},
+		{"failed_connections", st.failed},
+		{"exhaustions_suspected", st.exhaustions},
+		{"mappings_lost", st.mappingsLost},
+	}
+}
+
+func writeInflux(target string, st stats, ts time.Time) error {
+	var b bytes.Buffer
+	b.WriteString("natck ")
+	for i, f := range st.fields() {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		fmt.Fprintf(&b, "%v=%di", f.name, f.value)
+	}
+	fmt.Fprintf(&b, " %d\n", ts.Unix())
+
+	client := http.Client{Timeout: statsSinkTimeout}
+	resp, err := client.Post(target, "text/plain; charset=utf-8", &b)
+	if err != nil {
+		return fmt.Errorf("failed to write to influx: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("influx replied with %v", resp.Status)
+	}
+	return nil
+}
+
+func writeGraphite(addr string, st stats, ts time.Time) error {
+	conn, err := net.DialTimeout("tcp", addr, statsSinkTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to dial graphite: %w", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(statsSinkTimeout))
+
+	var b bytes.Buffer
+	for _, f := range st.fields() {
+		fmt.Fprintf(&b, "natck.%v %d %d\n", f.name, f.value, ts.Unix())
+	}
+	_, err = conn.Write(b.Bytes())
+	if err != nil {
+		return fmt.Errorf("failed to write to graphite: %w", err)
+	}
+	return nil
+}
+
+func (s *statsSink) onEvent(e Event) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.stats.active = e.ActiveConnections
+	switch e.Type {
+	case EventConnectionEstablished:
+		s.stats.established++
+	case EventConnectionFailed:
+		s.stats.failed++
+	case EventExhaustionSuspected:
+		s.stats.exhaustions++
+	case EventMappingLost:
+		s.stats.mappingsLost++
+	}
+}
+
+func (s *statsSink) flush() {
+	s.m.Lock()
+	st := s.stats
+	s.m.Unlock()
+
+	err := s.write(st, time.Now())
+	if err != nil {
+		slog.Warn("Failed to export stats", "err", err)
+	}
+}
+
+// start writes the stats every interval until closed.
+func (s *statsSink) start(interval time.Duration) {
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+	go func() {
+		defer close(s.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.flush()
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+// close stops the periodic writes, writing the final stats.
+func (s *statsSink) close() {
+	close(s.stop)
+	<-s.done
+	s.flush()
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestStatsSink(t *testing.T) {
+	received := make(chan string, 1)
+	influx := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		b, _ := io.ReadAll(req.Body)
+		received <- req.URL.Path + "?" + req.URL.RawQuery + " " + string(b)
+		res.WriteHeader(http.StatusNoContent)
+	}))
+	defer influx.Close()
+
+	graphite, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Failed to listen: ", err)
+	}
+	defer graphite.Close()
+	go func() {
+		for {
+			c, err := graphite.Accept()
+			if err != nil {
+				return
+			}
+			b, _ := io.ReadAll(c)
+			received <- string(b)
+			c.Close()
+		}
+	}()
+
+	testcases := map[string]struct {
+		target   string
+		contains []string
+	}{
+		"Influx": {
+			target: "influx://" + strings.TrimPrefix(influx.URL, "http://") + "/natck",
+			contains: []string{
+				"/write?db=natck&precision=s ",
+				"natck active_connections=2i,established_connections=3i,failed_connections=1i,exhaustions_suspected=0i,mappings_lost=0i ",
+			},
+		},
+		"Graphite": {
+			target: "graphite://" + graphite.Addr().String(),
+			contains: []string{
+				"natck.active_connections 2 ",
+				"natck.failed_connections 1 ",
+			},
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			s, err := openStatsSink(tc.target)
+			if err != nil {
+				t.Fatal("Failed to open stats sink: ", err)
+			}
+			for _, e := range []Event{
+				{Type: EventConnectionEstablished, ActiveConnections: 1},
+				{Type: EventConnectionEstablished, ActiveConnections: 2},
+				{Type: EventConnectionEstablished, ActiveConnections: 3},
+				{Type: EventConnectionFailed, ActiveConnections: 2},
+			} {
+				s.onEvent(e)
+			}
+			s.flush()
+
+			got := <-received
+			for _, c := range tc.contains {
+				if !strings.Contains(got, c) {
+					t.Errorf("expected %q in %q", c, got)
+				}
+			}
+		})
+	}
+}
+
+func TestUnsupportedStatsSink(t *testing.T) {
+	for _, target := range []string{"statsd://localhost:8125", "influx://localhost:8086"} {
+		if _, err := openStatsSink(target); err == nil {
+			t.Errorf("expected %v to be unsupported", target)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+// Functions related to the HTTP status the measured connections last
+// answered with, as a count reached mostly through 429 or 503 responses
+// means the targets, not the NAT, were the bottleneck.
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Fraction of the counted connections throttled worth warning of
+const throttledStatusWarning = 0.5
+
+// StatusDistribution counts the connections by the class of the HTTP
+// status they last answered with. 429 and 503 are counted apart from the
+// other 4xx and 5xx, as servers throttle with them.
+type StatusDistribution struct {
+	Status2xx int `json:"2xx"`
+	Status3xx int `json:"3xx"`
+	Status4xx int `json:"4xx"`
+	Status5xx int `json:"5xx"`
+	Status429 int `json:"429"`
+	Status503 int `json:"503"`
+	// Connections that never answered with a status
+	None int `json:"none"`
+}
+
+// statusDistribution counts conns by their last status.
+func statusDistribution(conns []*connection) StatusDistribution {
+	d := StatusDistribution{}
+	for _, c := range conns {
+		switch s := c.lastStatus; {
+		case s == 0:
+			d.None++
+		case s == http.StatusTooManyRequests:
+			d.Status429++
+		case s == http.StatusServiceUnavailable:
+			d.Status503++
+		case s < 300:
+			d.Status2xx++
+		case s < 400:
+			d.Status3xx++
+		case s < 500:
+			d.Status4xx++
+		default:
+			d.Status5xx++
+		}
+	}
+	return d
+}
+
+// throttled are the connections last answering 429 or 503.
+func (d StatusDistribution) throttled() int {
+	return d.Status429 + d.Status503
+}
+
+// throttledWarning warns when most of the counted connections were being
+// throttled by their servers, empty otherwise.
+func throttledWarning(d StatusDistribution, counted int) string {
+	if counted == 0 || float64(d.throttled())/float64(counted) <= throttledStatusWarning {
+		return ""
+	}
+	return fmt.Sprintf("%d of the %d connections counted last answered 429 or 503, the targets rather than the NAT may have been the bottleneck", d.throttled(), counted)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/netip"
+	"net/url"
+	"testing"
+)
+
+func TestStatusDistribution(t *testing.T) {
+	u, err := url.Parse("http://a.example/")
+	if err != nil {
+		t.Fatal("Failed to parse test url: ", err)
+	}
+	conns := []*connection{}
+	for _, status := range []int{200, 204, 301, 404, 429, 429, 500, 503, 0} {
+		c := makeConnection(netip.MustParseAddrPort("127.0.0.1:80"), u, &traffic{}, nil)
+		c.lastStatus = status
+		conns = append(conns, c)
+	}
+
+	expected := StatusDistribution{Status2xx: 2, Status3xx: 1, Status4xx: 1, Status5xx: 1, Status429: 2, Status503: 1, None: 1}
+	if got := statusDistribution(conns); got != expected {
+		t.Errorf("expected %+v, got %+v", expected, got)
+	}
+}
+
+func TestThrottledWarning(t *testing.T) {
+	testcases := map[string]struct {
+		inStatuses StatusDistribution
+		inCounted  int
+		outWarning bool
+	}{
+		"nothing counted": {
+			inStatuses: StatusDistribution{},
+			inCounted:  0,
+			outWarning: false,
+		},
+		"mostly 2xx": {
+			inStatuses: StatusDistribution{Status2xx: 8, Status429: 1, Status503: 1},
+			inCounted:  10,
+			outWarning: false,
+		},
+		"half throttled": {
+			inStatuses: StatusDistribution{Status2xx: 5, Status429: 5},
+			inCounted:  10,
+			outWarning: false,
+		},
+		"mostly throttled": {
+			inStatuses: StatusDistribution{Status2xx: 2, Status429: 5, Status503: 3},
+			inCounted:  10,
+			outWarning: true,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			w := throttledWarning(tc.inStatuses, tc.inCounted)
+			if (w != "") != tc.outWarning {
+				t.Errorf("expected warning %v, got %q", tc.outWarning, w)
+			}
+		})
+	}
+}
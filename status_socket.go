@@ -0,0 +1,68 @@
+// Functions related to reporting the connections in use whilst measuring,
+// so they can be cross-checked against the router or `ss`.
+package main
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+)
+
+// openConns tracks the connections currently open by a measurement.
+type openConns struct {
+	m     sync.Mutex
+	conns map[net.Conn]bool
+}
+
+func (o *openConns) add(c net.Conn) {
+	o.m.Lock()
+	defer o.m.Unlock()
+	if o.conns == nil {
+		o.conns = map[net.Conn]bool{}
+	}
+	o.conns[c] = true
+}
+
+func (o *openConns) remove(c net.Conn) {
+	o.m.Lock()
+	defer o.m.Unlock()
+	delete(o.conns, c)
+}
+
+// lines lists the local and remote address of each open connection,
+// sorted by the local address.
+func (o *openConns) lines() []string {
+	o.m.Lock()
+	defer o.m.Unlock()
+	lines := make([]string, 0, len(o.conns))
+	for c := range o.conns {
+		lines = append(lines, fmt.Sprintf("%v %v", c.LocalAddr(), c.RemoteAddr()))
+	}
+	slices.Sort(lines)
+	return lines
+}
+
+// serveStatusSocket answers each connection to the unix socket at path
+// with the open connections, one "local remote" address pair per line,
+// then hangs up.
+func serveStatusSocket(path string, o *openConns) (net.Listener, error) {
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on status socket: %w", err)
+	}
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			for _, line := range o.lines() {
+				fmt.Fprintln(c, line)
+			}
+			c.Close()
+		}
+	}()
+	return l, nil
+}
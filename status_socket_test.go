@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io"
+	"net"
+	"path"
+	"strings"
+	"testing"
+)
+
+func readStatusSocket(t *testing.T, path string) []string {
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal("Failed to dial status socket: ", err)
+	}
+	defer c.Close()
+
+	b, err := io.ReadAll(c)
+	if err != nil {
+		t.Fatal("Failed to read status socket: ", err)
+	}
+	return strings.Fields(string(b))
+}
+
+func TestStatusSocket(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Failed to listen: ", err)
+	}
+	defer l.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal("Failed to dial: ", err)
+	}
+	defer conn.Close()
+
+	o := &openConns{}
+	sockPath := path.Join(t.TempDir(), "status.sock")
+	sl, err := serveStatusSocket(sockPath, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sl.Close()
+
+	if got := readStatusSocket(t, sockPath); len(got) != 0 {
+		t.Errorf("expected no connections, got %v", got)
+	}
+
+	c := &countingConn{Conn: conn, traffic: &traffic{open: o}}
+	o.add(c)
+	got := readStatusSocket(t, sockPath)
+	want := []string{conn.LocalAddr().String(), l.Addr().String()}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+
+	c.Close()
+	if got := readStatusSocket(t, sockPath); len(got) != 0 {
+		t.Errorf("expected no connections after closing, got %v", got)
+	}
+}
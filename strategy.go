@@ -0,0 +1,216 @@
+// Functions related to the strategies deciding how a measurement ramps
+// connections up and down.
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	defaultSustainDuration = time.Minute
+	defaultChurnInterval   = 10 * time.Second
+	binarySearchFirstGuess = 16
+)
+
+// strategy decides the next action of the scheduler, given its
+// current state. Strategies are consulted every iteration of the
+// scheduler loop, so should be cheap.
+type strategy interface {
+	next(s *scheduler) action
+}
+
+var strategies = map[string]func(m *Measurer) strategy{
+	"linear-ramp": func(m *Measurer) strategy {
+		return &linearRamp{interval: m.RampInterval}
+	},
+	"binary-search": func(m *Measurer) strategy {
+		return &binarySearch{target: binarySearchFirstGuess}
+	},
+	"sustain-only": func(m *Measurer) strategy {
+		return &sustainOnly{
+			connections: m.SustainConnections,
+			duration:    cmp.Or(m.SustainDuration, defaultSustainDuration),
+		}
+	},
+	"schedule": func(m *Measurer) strategy {
+		return &schedule{stages: m.Schedule}
+	},
+	"churn": func(m *Measurer) strategy {
+		return &churn{interval: cmp.Or(m.ChurnInterval, defaultChurnInterval)}
+	},
+}
+
+// linearRamp opens a connection to each server as it is found, until the
+// NAT is exhausted or there are no more servers to be found.
+type linearRamp struct {
+	interval time.Duration
+}
+
+// binarySearch ramps to a target number of connections and holds them,
+// doubling the target until the NAT refuses connections then bisecting
+// between the largest target held and the smallest refused.
+type binarySearch struct {
+	lo, hi, target   int
+	holdStart        time.Time
+	roundExhaustions int
+}
+
+// sustainOnly opens a fixed number of connections then only keeps them
+// alive, to check the NAT holds them over time.
+type sustainOnly struct {
+	connections  int
+	duration     time.Duration
+	sustainStart time.Time
+}
+
+// churn ramps like linearRamp but periodically replaces its oldest
+// connection, to check the NAT releases the mappings of closed
+// connections.
+type churn struct {
+	linearRamp
+	interval   time.Duration
+	lastClosed time.Time
+}
+
+func strategyNames() string {
+	names := []string{}
+	for name := range strategies {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return strings.Join(names, ", ")
+}
+
+func newStrategy(m *Measurer) (strategy, error) {
+	name := cmp.Or(m.Strategy, "linear-ramp")
+	makeStrategy, found := strategies[name]
+	if !found {
+		return nil, fmt.Errorf("unknown strategy %q, expected one of %v", name, strategyNames())
+	}
+	if m.Script == "" {
+		return makeStrategy(m), nil
+	}
+	return loadScript(m.Script, makeStrategy(m))
+}
+
+func crawlAction(c *connection) action {
+	if c == nil {
+		return action{kind: actionWait}
+	}
+	return action{kind: actionCrawl, conn: c}
+}
+
+// keepAlivesUntilEvictionsWatched keeps the established connections
+// alive after exhaustion, to see whether the NAT evicts any of them.
+func keepAlivesUntilEvictionsWatched(s *scheduler) action {
+	if !s.evictions.watching() {
+		return action{kind: actionStop}
+	}
+	return crawlAction(s.nextConnection(nil, 0))
+}
+
+func (l *linearRamp) next(s *scheduler) action {
+	if s.exhausted() {
+		return keepAlivesUntilEvictionsWatched(s)
+	}
+	if s.outOfWork() {
+		return action{kind: actionStop}
+	}
+
+	pending := s.pendingConns
+	if s.now().Sub(s.lastOpened) < l.interval {
+		pending = nil
+	}
+	return crawlAction(s.nextConnection(pending, s.freeWorkers()))
+}
+
+func (b *binarySearch) nextTarget() {
+	if b.hi == 0 {
+		b.target *= 2
+		return
+	}
+	b.target = (b.lo + b.hi) / 2
+}
+
+func (b *binarySearch) next(s *scheduler) action {
+	if b.hi != 0 && b.hi-b.lo <= 1 {
+		return action{kind: actionStop}
+	}
+
+	if s.exhaustions > b.roundExhaustions {
+		// The NAT refused connections below the target
+		b.hi = min(b.target, len(s.activeConns)+1)
+		b.lo = min(b.lo, b.hi-1)
+		b.nextTarget()
+		b.holdStart = time.Time{}
+		b.roundExhaustions = s.exhaustions
+	}
+
+	if len(s.activeConns) > b.target {
+		newest := s.activeConns[len(s.activeConns)-1]
+		return action{kind: actionClose, conn: newest}
+	}
+
+	if len(s.activeConns) < b.target {
+		b.holdStart = time.Time{}
+	} else {
+		if b.holdStart.IsZero() {
+			b.holdStart = s.now()
+		}
+		// Long enough for every connection to be kept alive at least
+		// once
+		if s.now().Sub(b.holdStart) > 2*s.keepAliveInterval() {
+			b.lo = b.target
+			b.nextTarget()
+			b.holdStart = time.Time{}
+		}
+		return crawlAction(s.nextConnection(nil, s.freeWorkers()))
+	}
+
+	if s.outOfWork() {
+		// Ran out of servers before reaching the target
+		return action{kind: actionStop}
+	}
+	return crawlAction(s.nextConnection(s.pendingConns, s.freeWorkers()))
+}
+
+func (so *sustainOnly) next(s *scheduler) action {
+	target := cmp.Or(so.connections, s.seeds)
+	if so.sustainStart.IsZero() && (len(s.activeConns) >= target || s.exhausted() || s.outOfWork()) {
+		so.sustainStart = s.now()
+		s.markPhase(PhaseSustainStart)
+	}
+
+	if so.sustainStart.IsZero() {
+		return crawlAction(s.nextConnection(s.pendingConns, s.freeWorkers()))
+	}
+	if s.now().Sub(so.sustainStart) > so.duration {
+		return action{kind: actionStop}
+	}
+
+	// Only keep-alives whilst sustaining
+	return crawlAction(s.nextConnection(nil, 0))
+}
+
+func (ch *churn) next(s *scheduler) action {
+	if ch.lastClosed.IsZero() {
+		ch.lastClosed = s.now()
+	}
+	if s.exhausted() {
+		return keepAlivesUntilEvictionsWatched(s)
+	}
+	if s.outOfWork() {
+		return action{kind: actionStop}
+	}
+
+	// Only close connections that can be replaced
+	if s.now().Sub(ch.lastClosed) > ch.interval && len(s.activeConns) > 0 && len(s.pendingConns) > 0 {
+		ch.lastClosed = s.now()
+		return action{kind: actionClose, conn: s.activeConns[0]}
+	}
+	return ch.linearRamp.next(s)
+}
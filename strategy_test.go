@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/netip"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestLinearRampInterval(t *testing.T) {
+	now := time.Now()
+	u, _ := url.Parse("http://127.0.0.1/")
+	pending := makeConnection(netip.MustParseAddrPort("127.0.0.1:80"), u, &traffic{}, nil)
+
+	testcases := map[string]struct {
+		inOpened   time.Duration
+		expectKind actionKind
+	}{
+		"Within the interval": {inOpened: time.Second, expectKind: actionWait},
+		"Past the interval":   {inOpened: 3 * time.Second, expectKind: actionCrawl},
+	}
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			s := scheduler{
+				m:            &Measurer{},
+				clock:        func() time.Time { return now },
+				lastOpened:   now.Add(-tc.inOpened),
+				pendingConns: []*connection{pending},
+			}
+			l := linearRamp{interval: 2 * time.Second}
+			if next := l.next(&s); next.kind != tc.expectKind {
+				t.Errorf("expected action %v, got %v", tc.expectKind, next.kind)
+			}
+		})
+	}
+}
+
+func TestChurnInterval(t *testing.T) {
+	now := time.Now()
+	u, _ := url.Parse("http://127.0.0.1/")
+	makeConn := func() *connection {
+		c := makeConnection(netip.MustParseAddrPort("127.0.0.1:80"), u, &traffic{}, nil)
+		c.lastRequest, c.lastReply = now, now
+		return c
+	}
+
+	s := scheduler{
+		m:            &Measurer{},
+		clock:        func() time.Time { return now },
+		activeConns:  []*connection{makeConn()},
+		pendingConns: []*connection{makeConn()},
+	}
+	// The interval starts at the injected time
+	ch := churn{interval: time.Minute}
+	if next := ch.next(&s); next.kind != actionCrawl || next.conn != s.pendingConns[0] {
+		t.Errorf("expected to open the pending connection within the interval, got action %v", next.kind)
+	}
+
+	s.clock = func() time.Time { return now.Add(time.Minute + time.Second) }
+	if next := ch.next(&s); next.kind != actionClose || next.conn != s.activeConns[0] {
+		t.Errorf("expected to close the oldest connection past the interval, got action %v", next.kind)
+	}
+	if !ch.lastClosed.Equal(now.Add(time.Minute + time.Second)) {
+		t.Errorf("expected the close to be at the injected time, got %v", ch.lastClosed)
+	}
+}
@@ -0,0 +1,76 @@
+// Functions related to sweeping the measurement across keep-alive
+// intervals, revealing NATs whose capacity depends on how often the
+// mappings are refreshed.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// SweepPoint is the capacity measured with a keep-alive interval.
+type SweepPoint struct {
+	KeepAliveInterval time.Duration `json:"keep_alive_interval"`
+	MaxConnections    int           `json:"max_connections"`
+}
+
+// parseDurations parses a comma separated list of durations.
+func parseDurations(s string) ([]time.Duration, error) {
+	durations := []time.Duration{}
+	for _, field := range strings.Split(s, ",") {
+		d, err := time.ParseDuration(strings.TrimSpace(field))
+		if err != nil {
+			return nil, err
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("duration %v is not positive", d)
+		}
+		durations = append(durations, d)
+	}
+	return durations, nil
+}
+
+// sweepKeepAlive repeats the measurement with each keep-alive interval,
+// pausing between measurements for the NAT to release the mappings of
+// the last.
+func sweepKeepAlive(m *Measurer, urls []*url.URL, intervals []time.Duration, pause time.Duration) ([]SweepPoint, error) {
+	points := []SweepPoint{}
+	for i, interval := range intervals {
+		if i > 0 {
+			time.Sleep(pause)
+		}
+
+		m.KeepAliveInterval = interval
+		r, err := m.Measure(urls)
+		if err != nil {
+			return nil, fmt.Errorf("failed to measure with keep-alive interval %v: %w", interval, err)
+		}
+		points = append(points, SweepPoint{KeepAliveInterval: interval, MaxConnections: r.MaxConnections})
+	}
+	return points, nil
+}
+
+func printSweep(w io.Writer, points []SweepPoint) {
+	fmt.Fprintln(w, "Keep-alive interval  Max connections")
+	for _, p := range points {
+		fmt.Fprintf(w, "%-19v  %d\n", p.KeepAliveInterval, p.MaxConnections)
+	}
+}
+
+func writeSweep(w io.Writer, format string, points []SweepPoint) error {
+	switch format {
+	case "text":
+		printSweep(w, points)
+		return nil
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(points)
+	default:
+		return fmt.Errorf("unsupported sweep report format %q, expected text or json", format)
+	}
+}
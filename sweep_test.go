@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// idleNatNetwork simulates a NAT in front of a benchNetwork that drops
+// the mappings of connections idle for longer than timeout.
+type idleNatNetwork struct {
+	benchNetwork
+	timeout time.Duration
+
+	m        sync.Mutex
+	lastSeen map[uint]time.Time
+}
+
+func (n *idleNatNetwork) scrapConnection(ctx context.Context, r *roundtrip) *roundtrip {
+	n.m.Lock()
+	last, found := n.lastSeen[r.connId]
+	n.lastSeen[r.connId] = time.Now()
+	n.m.Unlock()
+
+	if found && time.Since(last) > n.timeout {
+		r.requestTs = time.Now()
+		r.replyTs = r.requestTs
+		r.err = errors.New("connection reset by peer")
+		return r
+	}
+	return n.benchNetwork.scrapConnection(ctx, r)
+}
+
+func TestParseDurations(t *testing.T) {
+	testcases := map[string]struct {
+		in       string
+		out      []time.Duration
+		outError bool
+	}{
+		"One":     {in: "5s", out: []time.Duration{5 * time.Second}},
+		"Many":    {in: "1s, 5s,2m", out: []time.Duration{time.Second, 5 * time.Second, 2 * time.Minute}},
+		"No unit": {in: "1s,5", outError: true},
+		"Zero":    {in: "0s", outError: true},
+		"Empty":   {in: "1s,", outError: true},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			got, err := parseDurations(tc.in)
+			if (err != nil) != tc.outError {
+				t.Fatalf("expected error %v, got %v", tc.outError, err)
+			}
+			if !slices.Equal(got, tc.out) {
+				t.Errorf("expected durations %v, got %v", tc.out, got)
+			}
+		})
+	}
+}
+
+func TestSweepKeepAlive(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping due to sustaining connections.")
+	}
+
+	n := &idleNatNetwork{
+		benchNetwork: benchNetwork{hosts: 4, seeds: 4},
+		timeout:      time.Second,
+		lastSeen:     map[uint]time.Time{},
+	}
+	m := Measurer{
+		network:         n,
+		Strategy:        "sustain-only",
+		SustainDuration: 3 * time.Second,
+	}
+
+	intervals := []time.Duration{200 * time.Millisecond, 2 * time.Second}
+	points, err := sweepKeepAlive(&m, n.seedUrls(), intervals, 0)
+	if err != nil {
+		t.Fatal("Failed to sweep: ", err)
+	}
+
+	want := []SweepPoint{
+		{KeepAliveInterval: 200 * time.Millisecond, MaxConnections: 4},
+		{KeepAliveInterval: 2 * time.Second, MaxConnections: 0},
+	}
+	if !slices.Equal(points, want) {
+		t.Errorf("expected sweep %v, got %v", want, points)
+	}
+}
@@ -0,0 +1,14 @@
+//go:build windows || plan9
+
+package main
+
+import (
+	"errors"
+)
+
+// Whether syslog can be logged to on this platform
+const syslogSupported = false
+
+func openSyslog() (systemLogger, error) {
+	return nil, errors.New("syslog is not supported on this platform")
+}
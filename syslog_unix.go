@@ -0,0 +1,34 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"log/syslog"
+)
+
+type syslogLogger struct {
+	w *syslog.Writer
+}
+
+// Whether syslog can be logged to on this platform
+const syslogSupported = true
+
+func openSyslog() (systemLogger, error) {
+	w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, "natck")
+	if err != nil {
+		return nil, err
+	}
+	return &syslogLogger{w: w}, nil
+}
+
+func (l *syslogLogger) info(msg string, fields ...logField) error {
+	return l.w.Info(formatLogFields(msg, fields))
+}
+
+func (l *syslogLogger) warning(msg string, fields ...logField) error {
+	return l.w.Warning(formatLogFields(msg, fields))
+}
+
+func (l *syslogLogger) Close() error {
+	return l.w.Close()
+}
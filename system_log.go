@@ -0,0 +1,83 @@
+// Functions related to logging results to the system log, for hosts
+// where stdout is not retained.
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type logField struct {
+	key, value string
+}
+
+type systemLogger interface {
+	info(msg string, fields ...logField) error
+	warning(msg string, fields ...logField) error
+	Close() error
+}
+
+func openSystemLogger(target string) (systemLogger, error) {
+	switch target {
+	case "syslog":
+		return openSyslog()
+	case "journald":
+		return openJournald()
+	}
+	return nil, fmt.Errorf("unsupported system log %q", target)
+}
+
+// formatLogFields renders fields as key=value pairs, for logs that
+// cannot store the fields separately.
+func formatLogFields(msg string, fields []logField) string {
+	b := strings.Builder{}
+	b.WriteString(msg)
+	for _, f := range fields {
+		fmt.Fprintf(&b, " %v=%v", strings.ToLower(f.key), strconv.Quote(f.value))
+	}
+	return b.String()
+}
+
+func resultLogFields(r *Result) []logField {
+	return []logField{
+		{"MAX_CONNECTIONS", strconv.Itoa(r.MaxConnections)},
+		{"COUNTED_AFTER", r.CountedAfter},
+		{"BYTES_SENT", strconv.FormatUint(r.BytesSent, 10)},
+		{"BYTES_RECEIVED", strconv.FormatUint(r.BytesReceived, 10)},
+		{"OVER_BUDGET", strconv.FormatBool(r.OverBudget)},
+		{"REFUSED_REDIALS", strconv.Itoa(r.RefusedRedials)},
+		{"MAPPINGS_LOST", strconv.Itoa(r.MappingsLost)},
+	}
+}
+
+func logResult(l systemLogger, r *Result) error {
+	msg := fmt.Sprintf("Max connections are %d", r.MaxConnections)
+	err := l.info(msg, resultLogFields(r)...)
+	if err != nil {
+		return err
+	}
+	for _, w := range r.Warnings {
+		err := l.warning(w, logField{"MAX_CONNECTIONS", strconv.Itoa(r.MaxConnections)})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// systemLogWarner logs the events that affect how the result should
+// be interpreted as warnings.
+func systemLogWarner(l systemLogger) func(Event) {
+	return func(e Event) {
+		if e.Type != EventExhaustionSuspected && e.Type != EventRampPaused && e.Type != EventExternalIpChanged {
+			return
+		}
+
+		msg := fmt.Sprintf("%v: %v", e.Type, e.Reason)
+		l.warning(msg,
+			logField{"EVENT", string(e.Type)},
+			logField{"ACTIVE_CONNECTIONS", strconv.Itoa(e.ActiveConnections)},
+		)
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestFormatLogFields(t *testing.T) {
+	testcases := map[string]struct {
+		in     []logField
+		expect string
+	}{
+		"No fields":    {expect: "Done"},
+		"Lower keys":   {in: []logField{{"MAX_CONNECTIONS", "42"}}, expect: `Done max_connections="42"`},
+		"Spaces":       {in: []logField{{"COUNTED_AFTER", "1 minute"}}, expect: `Done counted_after="1 minute"`},
+		"Quotes":       {in: []logField{{"EVENT", `say "hi"`}}, expect: `Done event="say \"hi\""`},
+		"New lines":    {in: []logField{{"EVENT", "a\nb"}}, expect: `Done event="a\nb"`},
+		"Empty":        {in: []logField{{"EVENT", ""}}, expect: `Done event=""`},
+		"Equals signs": {in: []logField{{"EVENT", "a=b c=d"}}, expect: `Done event="a=b c=d"`},
+		"Several fields": {
+			in:     []logField{{"BYTES_SENT", "1"}, {"BYTES_RECEIVED", "2"}},
+			expect: `Done bytes_sent="1" bytes_received="2"`,
+		},
+	}
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			if got := formatLogFields("Done", tc.in); got != tc.expect {
+				t.Errorf("expected %q, got %q", tc.expect, got)
+			}
+		})
+	}
+}
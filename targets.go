@@ -0,0 +1,63 @@
+// Functions related to measuring from targets whose addresses are already
+// known, for testbeds without DNS or programs that resolve hosts
+// themselves.
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Target is a server to measure from, already resolved.
+type Target struct {
+	// Name of the server, sent with SNI and the Host header. Empty uses
+	// the address.
+	Host string
+	// Address connected to, without looking Host up.
+	AddrPort netip.AddrPort
+	// http or https, empty is https.
+	Scheme string
+}
+
+// url is the url of the root of the target.
+func (t Target) url() (*url.URL, error) {
+	if !t.AddrPort.IsValid() {
+		return nil, errors.New("no address")
+	}
+	u := &url.URL{Scheme: cmp.Or(t.Scheme, "https"), Path: "/"}
+	host := t.Host
+	if host == "" {
+		host = t.AddrPort.Addr().Unmap().String()
+	}
+	port := strconv.Itoa(int(t.AddrPort.Port()))
+	u.Host = net.JoinHostPort(host, port)
+	if port == urlPort(&url.URL{Scheme: u.Scheme}) {
+		// Servers may not expect the default port in the Host header
+		u.Host = strings.TrimSuffix(u.Host, ":"+port)
+	}
+	if err := checkTargetUrl(u); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// MeasureTargets is Measure, starting from targets that are connected to
+// without being looked up. Links found on the targets are looked up as
+// usual. Targets sharing an address are connected to once.
+func (m *Measurer) MeasureTargets(targets []Target) (*Result, error) {
+	resolved := []*resolvedUrl{}
+	for _, t := range targets {
+		u, err := t.url()
+		if err != nil {
+			return nil, fmt.Errorf("failed to measure target %v: %w", t.AddrPort, err)
+		}
+		resolved = append(resolved, &resolvedUrl{url: u, addresses: []netip.AddrPort{t.AddrPort}})
+	}
+	return m.measure(nil, resolved)
+}
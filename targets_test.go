@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestTargetUrl(t *testing.T) {
+	testcases := map[string]struct {
+		inTarget Target
+		expUrl   string
+		expErr   bool
+	}{
+		"Host": {
+			inTarget: Target{Host: "example.com", AddrPort: netip.MustParseAddrPort("192.0.2.1:443")},
+			expUrl:   "https://example.com/",
+		},
+		"Non-default port": {
+			inTarget: Target{Host: "example.com", AddrPort: netip.MustParseAddrPort("192.0.2.1:8080"), Scheme: "http"},
+			expUrl:   "http://example.com:8080/",
+		},
+		"No host": {
+			inTarget: Target{AddrPort: netip.MustParseAddrPort("192.0.2.1:80"), Scheme: "http"},
+			expUrl:   "http://192.0.2.1/",
+		},
+		"No host IPv6": {
+			inTarget: Target{AddrPort: netip.MustParseAddrPort("[2001:db8::1]:443")},
+			expUrl:   "https://[2001:db8::1]/",
+		},
+		"No address": {
+			inTarget: Target{Host: "example.com"},
+			expErr:   true,
+		},
+		"Unsupported scheme": {
+			inTarget: Target{Host: "example.com", AddrPort: netip.MustParseAddrPort("192.0.2.1:21"), Scheme: "ftp"},
+			expErr:   true,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			u, err := tc.inTarget.url()
+			if tc.expErr {
+				if err == nil {
+					t.Errorf("expected an error, got %v", u)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal("Failed to make url: ", err)
+			}
+			if u.String() != tc.expUrl {
+				t.Errorf("expected %v, got %v", tc.expUrl, u)
+			}
+		})
+	}
+}
+
+func TestMeasureTargets(t *testing.T) {
+	n := &benchNetwork{hosts: 5}
+	targets := []Target{}
+	for i := range n.hosts {
+		ip := netip.AddrFrom4([4]byte{10, 0, 0, byte(i)})
+		targets = append(targets, Target{
+			Host:     benchHostUrl(i).Hostname(),
+			AddrPort: netip.AddrPortFrom(ip, 80),
+			Scheme:   "http",
+		})
+	}
+	// Sharing an address with the first target
+	targets = append(targets, Target{Host: "other.bench", AddrPort: targets[0].AddrPort, Scheme: "http"})
+
+	m := Measurer{network: n}
+	r, err := m.MeasureTargets(targets)
+	if err != nil {
+		t.Fatal("Failed to measure: ", err)
+	}
+	if r.MaxConnections != n.hosts {
+		t.Errorf("expected to measure %d hosts, got %d", n.hosts, r.MaxConnections)
+	}
+	if n.lookups.Load() != 0 {
+		t.Errorf("expected no lookups, got %d", n.lookups.Load())
+	}
+}
@@ -0,0 +1,120 @@
+// Functions related to how connections negotiate TLS, as some middleboxes
+// treat flows differently depending on the ALPN offered or whether the
+// session was resumed.
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+)
+
+// tlsState is what was negotiated on a TLS connection.
+type tlsState struct {
+	alpn        string
+	resumed     bool
+	echAccepted bool
+}
+
+// TlsConnection is what was negotiated on one of the measured TLS
+// connections.
+type TlsConnection struct {
+	Host        string `json:"host"`
+	Alpn        string `json:"alpn"`
+	Resumed     bool   `json:"resumed"`
+	EchAccepted bool   `json:"ech_accepted"`
+}
+
+// parseAlpn parses a comma separated list of protocols to offer, where
+// empty is the defaults and none offers nothing.
+func parseAlpn(s string) []string {
+	if s == "" {
+		return nil
+	}
+	if s == "none" {
+		return []string{}
+	}
+	return strings.Split(s, ",")
+}
+
+// tlsConfig is the TLS configuration every connection of the measurement
+// starts from.
+func (m *Measurer) tlsConfig() *tls.Config {
+	c := &tls.Config{
+		NextProtos:             m.Alpn,
+		SessionTicketsDisabled: m.DisableTlsResumption,
+		RootCAs:                m.RootCAs,
+		ServerName:             m.TlsServerName,
+		InsecureSkipVerify:     m.InsecureSkipVerify,
+		Certificates:           m.ClientCerts.certificates(""),
+	}
+	if m.DisableHttp2 && m.Alpn == nil {
+		c.NextProtos = []string{"http/1.1"}
+	}
+	if !m.DisableTlsResumption {
+		if m.tlsSessions == nil {
+			m.tlsSessions = tls.NewLRUClientSessionCache(0)
+		}
+		c.ClientSessionCache = m.tlsSessions
+	}
+	return c
+}
+
+// checkAlpn checks HTTP/2 is not offered whilst disabled.
+func checkAlpn(m *Measurer) error {
+	if m.DisableHttp2 && slices.Contains(m.Alpn, "h2") {
+		return errors.New("h2 cannot be offered with HTTP/2 disabled")
+	}
+	return nil
+}
+
+// loadRootCAs is the system roots with the PEM certificates of path
+// added, so lab servers verify without public servers failing to.
+func loadRootCAs(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA file: %w", err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no PEM certificates in %v", path)
+	}
+	return pool, nil
+}
+
+// applyTlsConfig configures the transport with c. HTTP/2 is only
+// attempted when offered, or by default.
+func applyTlsConfig(transport *http.Transport, c *tls.Config) {
+	if c == nil {
+		return
+	}
+	transport.TLSClientConfig = c.Clone()
+	if c.NextProtos != nil && !slices.Contains(c.NextProtos, "h2") {
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+}
+
+func tlsConnections(conns []*connection) []TlsConnection {
+	tlsConns := []TlsConnection{}
+	for _, c := range conns {
+		if c.tls == nil {
+			continue
+		}
+		tlsConns = append(tlsConns, TlsConnection{
+			Host:        c.host.hostPort,
+			Alpn:        c.tls.alpn,
+			Resumed:     c.tls.resumed,
+			EchAccepted: c.tls.echAccepted,
+		})
+	}
+	return tlsConns
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/pem"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync/atomic"
+	"testing"
+)
+
+func tlsGet(t *testing.T, srv *httptest.Server, m *Measurer) *tlsState {
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal("Failed to parse server url: ", err)
+	}
+
+	conf := m.tlsConfig()
+	conf.RootCAs = srv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+	client, _ := makeClient(&traffic{}, conf, nil)
+	defer client.CloseIdleConnections()
+
+	ctx := context.WithValue(context.Background(), ctxAddrKey{}, netip.MustParseAddrPort(u.Host))
+	resp, err := getUrl(ctx, client, http.MethodGet, u)
+	if err != nil {
+		t.Fatal("Failed to get: ", err)
+	}
+	defer resp.Body.Close()
+	io.ReadAll(resp.Body)
+	return &tlsState{alpn: resp.TLS.NegotiatedProtocol, resumed: resp.TLS.DidResume}
+}
+
+func TestParseAlpn(t *testing.T) {
+	testcases := map[string]struct {
+		in  string
+		out []string
+	}{
+		"Default": {in: "", out: nil},
+		"None":    {in: "none", out: []string{}},
+		"List":    {in: "h2,http/1.1", out: []string{"h2", "http/1.1"}},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			out := parseAlpn(tc.in)
+			if (out == nil) != (tc.out == nil) || !slices.Equal(out, tc.out) {
+				t.Errorf("expected %#v, got %#v", tc.out, out)
+			}
+		})
+	}
+}
+
+func TestAlpn(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {}))
+	srv.EnableHTTP2 = true
+	srv.TLS = &tls.Config{NextProtos: []string{"h2", "http/1.1"}}
+	srv.StartTLS()
+	defer srv.Close()
+
+	testcases := map[string]struct {
+		alpn         []string
+		disableHttp2 bool
+		out          string
+	}{
+		"Default":           {alpn: nil, out: "h2"},
+		"HTTP/1.1":          {alpn: []string{"http/1.1"}, out: "http/1.1"},
+		"None":              {alpn: []string{}, out: ""},
+		"HTTP/2 disabled":   {disableHttp2: true, out: "http/1.1"},
+		"Disabled and none": {alpn: []string{}, disableHttp2: true, out: ""},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			m := Measurer{Alpn: tc.alpn, DisableHttp2: tc.disableHttp2}
+			state := tlsGet(t, srv, &m)
+			if state.alpn != tc.out {
+				t.Errorf("expected to negotiate %q, got %q", tc.out, state.alpn)
+			}
+		})
+	}
+}
+
+func TestTlsResumption(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {}))
+	srv.TLS = &tls.Config{}
+	srv.StartTLS()
+	defer srv.Close()
+
+	testcases := map[string]struct {
+		disable bool
+		resumed bool
+	}{
+		"Enabled":  {disable: false, resumed: true},
+		"Disabled": {disable: true, resumed: false},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			m := Measurer{DisableTlsResumption: tc.disable}
+			if state := tlsGet(t, srv, &m); state.resumed {
+				t.Error("expected the first connection not to resume")
+			}
+			if state := tlsGet(t, srv, &m); state.resumed != tc.resumed {
+				t.Errorf("expected resumed to be %v, got %v", tc.resumed, state.resumed)
+			}
+		})
+	}
+}
+
+func TestTlsVerification(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {}))
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal("Failed to parse server url: ", err)
+	}
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	err = os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0o600)
+	if err != nil {
+		t.Fatal("Failed to write CA file: ", err)
+	}
+	roots, err := loadRootCAs(caFile)
+	if err != nil {
+		t.Fatal("Failed to load CA file: ", err)
+	}
+
+	testcases := map[string]struct {
+		in          Measurer
+		expectError bool
+	}{
+		"Unknown CA": {expectError: true},
+		"CA file":    {in: Measurer{RootCAs: roots}},
+		"Insecure":   {in: Measurer{InsecureSkipVerify: true}},
+		// The certificate of httptest is also for example.com
+		"Server name":       {in: Measurer{RootCAs: roots, TlsServerName: "example.com"}},
+		"Wrong server name": {in: Measurer{RootCAs: roots, TlsServerName: "other.example"}, expectError: true},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			client, _ := makeClient(&traffic{}, tc.in.tlsConfig(), nil)
+			defer client.CloseIdleConnections()
+
+			ctx := context.WithValue(context.Background(), ctxAddrKey{}, netip.MustParseAddrPort(u.Host))
+			resp, err := getUrl(ctx, client, http.MethodGet, u)
+			if err == nil {
+				resp.Body.Close()
+			}
+			if (err != nil) != tc.expectError {
+				t.Errorf("expected error %v, got %v", tc.expectError, err)
+			}
+		})
+	}
+}
+
+func TestLoadRootCAsInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(path, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal("Failed to write CA file: ", err)
+	}
+	if _, err := loadRootCAs(path); err == nil {
+		t.Error("expected a file without certificates to be rejected")
+	}
+	if _, err := loadRootCAs(filepath.Join(t.TempDir(), "missing.pem")); err == nil {
+		t.Error("expected a missing file to be rejected")
+	}
+}
+
+func TestDisableHttp2OneConnection(t *testing.T) {
+	var dials atomic.Int32
+	protos := make(chan string, 3)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		protos <- req.Proto
+	}))
+	srv.EnableHTTP2 = true
+	srv.Config.ConnState = func(_ net.Conn, st http.ConnState) {
+		if st == http.StateNew {
+			dials.Add(1)
+		}
+	}
+	srv.StartTLS()
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal("Failed to parse server url: ", err)
+	}
+
+	m := Measurer{DisableHttp2: true}
+	conf := m.tlsConfig()
+	conf.RootCAs = srv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+	client, _ := makeClient(&traffic{}, conf, nil)
+	defer client.CloseIdleConnections()
+	ctx := context.WithValue(context.Background(), ctxAddrKey{}, netip.MustParseAddrPort(u.Host))
+	for range cap(protos) {
+		resp, err := getUrl(ctx, client, http.MethodGet, u)
+		if err != nil {
+			t.Fatal("Failed to get: ", err)
+		}
+		io.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+
+	close(protos)
+	for proto := range protos {
+		if proto != "HTTP/1.1" {
+			t.Errorf("expected every request over HTTP/1.1, got %v", proto)
+		}
+	}
+	if n := dials.Load(); n != 1 {
+		t.Errorf("expected the requests to share one TCP connection, got %d", n)
+	}
+
+	m.Alpn = []string{"h2"}
+	if err := m.check(); err == nil {
+		t.Error("expected offering h2 with HTTP/2 disabled to be rejected")
+	}
+}
@@ -0,0 +1,288 @@
+// Functions related to recording the inputs of the scheduler, so a
+// measurement can be replayed offline to reproduce scheduling behaviour.
+package main
+
+import (
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+)
+
+// trace is everything the scheduler learnt from the network during a
+// measurement.
+type trace struct {
+	Seeds      []string
+	Lookups    []traceLookup
+	Roundtrips []traceRoundtrip
+}
+
+type traceLookup struct {
+	Url string
+	// Empty for ip4, which older traces only looked up
+	Network   string
+	Addresses []netip.AddrPort
+	Latency   time.Duration
+}
+
+type traceRoundtrip struct {
+	HostPort string
+	Url      string
+	// Order of the request among those to HostPort, zero for all of
+	// older traces, which were recorded in order
+	Seq int
+	// Offset of the request from the start of the measurement
+	Start       time.Duration
+	Latency     time.Duration
+	Err         string
+	DialErr     bool
+	RedialErr   bool
+	Robots      RobotsTxt
+	ScrapedUrls []string
+	CrawlDelay  time.Duration
+	Tls         bool
+	Alpn        string
+	Resumed     bool
+	EchAccepted bool
+}
+
+// recordingNetwork passes requests through to another network,
+// recording the replies.
+type recordingNetwork struct {
+	inner   network
+	started time.Time
+
+	m     sync.Mutex
+	trace trace
+	// Requests made to each host:port
+	requests map[string]int
+}
+
+// replayNetwork answers requests from a trace. The requests for each
+// url of a host:port are answered in the sequence they were recorded,
+// however requests for other urls are interleaved with them, taking
+// exactly their recorded latency. The last reply repeats if more are
+// requested, and urls the trace never saw fail.
+type replayNetwork struct {
+	lookups map[string]traceLookup
+
+	m          sync.Mutex
+	roundtrips map[string][]traceRoundtrip
+}
+
+func newRecordingNetwork(inner network, seeds []*url.URL) *recordingNetwork {
+	rec := &recordingNetwork{
+		inner:    inner,
+		started:  time.Now(),
+		requests: map[string]int{},
+	}
+	for _, u := range seeds {
+		rec.trace.Seeds = append(rec.trace.Seeds, u.String())
+	}
+	return rec
+}
+
+func lookupKey(network, u string) string {
+	if network == "" || network == "ip4" {
+		return u
+	}
+	return network + " " + u
+}
+
+func roundtripKey(hostPort, u string) string {
+	return hostPort + " " + u
+}
+
+func (rec *recordingNetwork) nextSeq(hostPort string) int {
+	rec.m.Lock()
+	defer rec.m.Unlock()
+	seq := rec.requests[hostPort]
+	rec.requests[hostPort]++
+	return seq
+}
+
+func (rec *recordingNetwork) lookupAddr(ctx context.Context, network string, h *url.URL) *resolvedUrl {
+	start := time.Now()
+	r := rec.inner.lookupAddr(ctx, network, h)
+
+	rec.m.Lock()
+	defer rec.m.Unlock()
+	l := traceLookup{
+		Url:       h.String(),
+		Addresses: r.addresses,
+		Latency:   time.Since(start),
+	}
+	if network != "ip4" {
+		l.Network = network
+	}
+	rec.trace.Lookups = append(rec.trace.Lookups, l)
+	return r
+}
+
+func (rec *recordingNetwork) scrapConnection(ctx context.Context, r *roundtrip) *roundtrip {
+	seq := rec.nextSeq(r.host.hostPort)
+	r = rec.inner.scrapConnection(ctx, r)
+
+	tr := traceRoundtrip{
+		HostPort:   r.host.hostPort,
+		Url:        r.url.String(),
+		Seq:        seq,
+		Start:      r.requestTs.Sub(rec.started),
+		Latency:    r.replyTs.Sub(r.requestTs),
+		Robots:     r.robots,
+		CrawlDelay: r.crawlDelay,
+	}
+	if r.err != nil {
+		var redialErr *crawlError
+		tr.Err = r.err.Error()
+		tr.DialErr = isDialError(r.err)
+		tr.RedialErr = errors.As(r.err, &redialErr)
+	}
+	if r.tls != nil {
+		tr.Tls = true
+		tr.Alpn = r.tls.alpn
+		tr.Resumed = r.tls.resumed
+		tr.EchAccepted = r.tls.echAccepted
+	}
+	for _, u := range r.scrapedUrls {
+		tr.ScrapedUrls = append(tr.ScrapedUrls, u.String())
+	}
+
+	rec.m.Lock()
+	defer rec.m.Unlock()
+	rec.trace.Roundtrips = append(rec.trace.Roundtrips, tr)
+	return r
+}
+
+func (rec *recordingNetwork) write(w io.Writer) error {
+	rec.m.Lock()
+	defer rec.m.Unlock()
+	return gob.NewEncoder(w).Encode(&rec.trace)
+}
+
+func readTrace(r io.Reader) (*trace, error) {
+	t := trace{}
+	err := gob.NewDecoder(r).Decode(&t)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode trace: %w", err)
+	}
+	return &t, nil
+}
+
+func (t *trace) seedUrls() ([]*url.URL, error) {
+	urls := []*url.URL{}
+	for _, s := range t.Seeds {
+		u, err := url.Parse(s)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse trace seed: %w", err)
+		}
+		urls = append(urls, u)
+	}
+	return urls, nil
+}
+
+func newReplayNetwork(t *trace) *replayNetwork {
+	replay := &replayNetwork{
+		lookups:    map[string]traceLookup{},
+		roundtrips: map[string][]traceRoundtrip{},
+	}
+	for _, l := range t.Lookups {
+		replay.lookups[lookupKey(l.Network, l.Url)] = l
+	}
+	for _, r := range t.Roundtrips {
+		k := roundtripKey(r.HostPort, r.Url)
+		replay.roundtrips[k] = append(replay.roundtrips[k], r)
+	}
+	for _, queue := range replay.roundtrips {
+		// Replies are recorded as they arrive, not in sequence
+		slices.SortStableFunc(queue, func(a, b traceRoundtrip) int {
+			return a.Seq - b.Seq
+		})
+	}
+	return replay
+}
+
+func (replay *replayNetwork) lookupAddr(ctx context.Context, network string, h *url.URL) *resolvedUrl {
+	l := replay.lookups[lookupKey(network, h.String())]
+	select {
+	case <-time.After(l.Latency):
+	case <-ctx.Done():
+		return &resolvedUrl{url: h}
+	}
+	return &resolvedUrl{url: h, addresses: l.Addresses}
+}
+
+// nextRoundtrip is the next recorded reply to a request to hostPort for
+// u, false if the trace never saw u requested from hostPort.
+func (replay *replayNetwork) nextRoundtrip(hostPort, u string) (traceRoundtrip, bool) {
+	replay.m.Lock()
+	defer replay.m.Unlock()
+
+	key := roundtripKey(hostPort, u)
+	queue := replay.roundtrips[key]
+	if len(queue) == 0 {
+		return traceRoundtrip{}, false
+	}
+	tr := queue[0]
+	if len(queue) > 1 {
+		replay.roundtrips[key] = queue[1:]
+	}
+	return tr, true
+}
+
+func replayError(tr *traceRoundtrip) error {
+	if tr.Err == "" {
+		return nil
+	}
+
+	var err error = errors.New(tr.Err)
+	if tr.RedialErr {
+		err = &crawlError{opErr: "dial", err: tr.Err}
+	}
+	if tr.DialErr {
+		err = &net.OpError{Op: "dial", Net: "tcp", Err: err}
+	}
+	return err
+}
+
+func (replay *replayNetwork) scrapConnection(ctx context.Context, r *roundtrip) *roundtrip {
+	r.requestTs = time.Now()
+	tr, found := replay.nextRoundtrip(r.host.hostPort, r.url.String())
+	if !found {
+		r.replyTs = r.requestTs
+		r.err = fmt.Errorf("%v was not recorded from %v", r.url, r.host.hostPort)
+		return r
+	}
+
+	latency := time.NewTimer(tr.Latency)
+	defer latency.Stop()
+	select {
+	case <-latency.C:
+	case <-ctx.Done():
+		r.replyTs = time.Now()
+		r.err = ctx.Err()
+		return r
+	}
+	r.replyTs = r.requestTs.Add(tr.Latency)
+	r.err = replayError(&tr)
+	r.robots = tr.Robots
+	r.crawlDelay = tr.CrawlDelay
+	if tr.Tls {
+		r.tls = &tlsState{alpn: tr.Alpn, resumed: tr.Resumed, echAccepted: tr.EchAccepted}
+	}
+	for _, s := range tr.ScrapedUrls {
+		u, err := url.Parse(s)
+		if err != nil {
+			continue
+		}
+		r.scrapedUrls = append(r.scrapedUrls, u)
+	}
+	return r
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/url"
+	"path"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	srvs := []*httpTestServer{}
+	for i := range 3 {
+		srv := &httpTestServer{name: fmt.Sprintf("http.%v", i)}
+		startHttpServer(t, srv)
+		srvs = append(srvs, srv)
+	}
+	for i, srv := range srvs {
+		root := makeServerRoot(t, tPath("wildcard_robots.txt"))
+		next := srvs[(i+1)%len(srvs)].tUrl(t, "index.html")
+		makeHtmlDocWithLinks(t, []*url.URL{next}, path.Join(root, "index.html"))
+		srv.server.Handler = HandlerChain{makeFileHandler(root)}
+	}
+	seeds := []*url.URL{srvs[0].tUrl(t, "index.html")}
+
+	rec := newRecordingNetwork(liveNetwork{}, seeds)
+	m := Measurer{network: rec}
+	recorded, err := m.Measure(seeds)
+	if err != nil {
+		t.Fatal("Failed to measure: ", err)
+	}
+
+	b := bytes.Buffer{}
+	err = rec.write(&b)
+	if err != nil {
+		t.Fatal("Failed to write trace: ", err)
+	}
+
+	// Servers are gone, so the replay can only use the trace
+	for _, srv := range srvs {
+		srv.server.Close()
+	}
+
+	tr, err := readTrace(&b)
+	if err != nil {
+		t.Fatal("Failed to read trace: ", err)
+	}
+	replaySeeds, err := tr.seedUrls()
+	if err != nil {
+		t.Fatal("Failed to read trace seeds: ", err)
+	}
+	m = Measurer{network: newReplayNetwork(tr)}
+	replayed, err := m.Measure(replaySeeds)
+	if err != nil {
+		t.Fatal("Failed to replay: ", err)
+	}
+
+	if recorded.MaxConnections != len(srvs) {
+		t.Errorf("expected to record %d connections, got %d", len(srvs), recorded.MaxConnections)
+	}
+	if replayed.MaxConnections != recorded.MaxConnections {
+		t.Errorf("expected replay to measure %d connections, got %d", recorded.MaxConnections, replayed.MaxConnections)
+	}
+}
+
+func TestReplayRoundtrips(t *testing.T) {
+	hostPort := "192.0.2.1:80"
+	tr := &trace{Roundtrips: []traceRoundtrip{
+		// Recorded as the replies arrived, out of sequence
+		{HostPort: hostPort, Url: "http://a.example/b", Seq: 2, Latency: 30 * time.Millisecond},
+		{HostPort: hostPort, Url: "http://a.example/b", Seq: 1, Latency: 20 * time.Millisecond, ScrapedUrls: []string{"http://b.example/"}},
+		{HostPort: hostPort, Url: "http://a.example/robots.txt", Seq: 0, Latency: 10 * time.Millisecond},
+		{HostPort: hostPort, Url: "http://a.example/c", Seq: 3, Latency: time.Hour},
+	}}
+
+	testcases := map[string]struct {
+		inUrls       []string
+		inCancel     bool
+		expErrs      []bool
+		expLatencies []time.Duration
+		expScraped   []int
+	}{
+		"In sequence": {
+			inUrls:       []string{"http://a.example/robots.txt", "http://a.example/b", "http://a.example/b"},
+			expErrs:      []bool{false, false, false},
+			expLatencies: []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 30 * time.Millisecond},
+			expScraped:   []int{0, 1, 0},
+		},
+		"Other url order": {
+			inUrls:       []string{"http://a.example/b", "http://a.example/robots.txt"},
+			expErrs:      []bool{false, false},
+			expLatencies: []time.Duration{20 * time.Millisecond, 10 * time.Millisecond},
+			expScraped:   []int{1, 0},
+		},
+		"Last repeated": {
+			inUrls:       []string{"http://a.example/robots.txt", "http://a.example/robots.txt"},
+			expErrs:      []bool{false, false},
+			expLatencies: []time.Duration{10 * time.Millisecond, 10 * time.Millisecond},
+			expScraped:   []int{0, 0},
+		},
+		"Not recorded": {
+			inUrls:       []string{"http://a.example/d"},
+			expErrs:      []bool{true},
+			expLatencies: []time.Duration{0},
+			expScraped:   []int{0},
+		},
+		"Cancelled": {
+			inUrls:     []string{"http://a.example/c"},
+			inCancel:   true,
+			expErrs:    []bool{true},
+			expScraped: []int{0},
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			replay := newReplayNetwork(tr)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tc.inCancel {
+				time.AfterFunc(10*time.Millisecond, cancel)
+			}
+
+			start := time.Now()
+			errs, latencies, scraped := []bool{}, []time.Duration{}, []int{}
+			for _, s := range tc.inUrls {
+				u, err := url.Parse(s)
+				if err != nil {
+					t.Fatal("Failed to parse url: ", err)
+				}
+				r := replay.scrapConnection(ctx, &roundtrip{url: u, host: &host{hostPort: hostPort}})
+				errs = append(errs, r.err != nil)
+				latencies = append(latencies, r.replyTs.Sub(r.requestTs))
+				scraped = append(scraped, len(r.scrapedUrls))
+			}
+			if !slices.Equal(errs, tc.expErrs) {
+				t.Errorf("expected errors %v, got %v", tc.expErrs, errs)
+			}
+			if tc.expLatencies != nil && !slices.Equal(latencies, tc.expLatencies) {
+				t.Errorf("expected latencies %v, got %v", tc.expLatencies, latencies)
+			}
+			if !slices.Equal(scraped, tc.expScraped) {
+				t.Errorf("expected scraped urls %v, got %v", tc.expScraped, scraped)
+			}
+			if time.Since(start) > time.Second {
+				t.Errorf("expected the replay to take the recorded latencies, took %v", time.Since(start))
+			}
+		})
+	}
+}
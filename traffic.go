@@ -0,0 +1,54 @@
+// Functions related to accounting for the traffic sent over connections.
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+)
+
+type traffic struct {
+	sent     atomic.Uint64
+	received atomic.Uint64
+	// Connections currently open, nil when not tracked.
+	open *openConns
+	// Dials the connections, nil dials like http.DefaultTransport.
+	dialer *net.Dialer
+	// Tunes the socket of each connection.
+	socket SocketOptions
+	// Chooses the proxy of each request, nil connects directly.
+	proxy func(*http.Request) (*url.URL, error)
+	// Proxies connections were made through.
+	proxies usedProxies
+}
+
+// countingConn tallies the bytes passing over a connection, including
+// any TLS and HTTP framing.
+type countingConn struct {
+	net.Conn
+	traffic *traffic
+}
+
+func (t *traffic) total() uint64 {
+	return t.sent.Load() + t.received.Load()
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.traffic.received.Add(uint64(n))
+	return n, err
+}
+
+func (c *countingConn) Close() error {
+	if c.traffic.open != nil {
+		c.traffic.open.remove(c)
+	}
+	return c.Conn.Close()
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.traffic.sent.Add(uint64(n))
+	return n, err
+}
@@ -0,0 +1,321 @@
+// Functions related to measuring the UDP mappings the NAT sustains, as
+// measuring TCP alone misses half the conntrack table. Each mapping is a
+// socket of its own, refreshed with STUN binding requests or DNS queries.
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	defaultUdpMaxMappings = 20000
+	defaultUdpBatch       = 100
+	// Shorter than the 30s UDP timeout of many NATs
+	defaultUdpRefresh = 15 * time.Second
+	defaultUdpSustain = time.Minute
+)
+
+// udpProbes answer whether the mapping of conn to server is alive, by
+// whether server answers a request from conn within timeout.
+var udpProbes = map[string]func(conn net.PacketConn, server netip.AddrPort, timeout time.Duration) error{
+	"stun": func(conn net.PacketConn, server netip.AddrPort, timeout time.Duration) error {
+		_, err := stunTransaction(conn, server, 0, timeout)
+		return err
+	},
+	"dns": dnsProbe,
+}
+
+// UdpMeasurer measures the UDP mappings the NAT sustains, opening
+// mappings in batches until a batch fails or MaxMappings are open, then
+// refreshing them for SustainDuration.
+type UdpMeasurer struct {
+	// Name of the probe of udpProbes
+	Probe string
+	// Servers the mappings are spread over
+	Servers     []netip.AddrPort
+	MaxMappings int
+	// Mappings opened at once
+	Batch int
+	// Time between refreshes of each mapping
+	RefreshInterval time.Duration
+	SustainDuration time.Duration
+	// Longest to wait for each answer
+	Timeout time.Duration
+}
+
+// UdpResult is how many UDP mappings the NAT sustained.
+type UdpResult struct {
+	Probe string `json:"probe"`
+	// Most mappings alive at once
+	MaxMappings int `json:"max_mappings"`
+	// Mappings still alive at the end
+	Sustained int `json:"sustained"`
+	Opened    int `json:"opened"`
+	// Mappings never answered
+	FailedOpens int `json:"failed_opens"`
+	// Mappings answered but later not refreshed
+	Lost int `json:"lost"`
+	// Opening stopped as a batch failed, rather than at MaxMappings
+	Exhausted bool          `json:"exhausted"`
+	Duration  time.Duration `json:"duration"`
+}
+
+// udpMappings counts the mappings as they are opened and lost.
+type udpMappings struct {
+	alive   atomic.Int64
+	maxSeen atomic.Int64
+	lost    atomic.Int64
+}
+
+func (u *udpMappings) add() {
+	n := u.alive.Add(1)
+	for {
+		seen := u.maxSeen.Load()
+		if n <= seen || u.maxSeen.CompareAndSwap(seen, n) {
+			return
+		}
+	}
+}
+
+func (u *udpMappings) remove() {
+	u.alive.Add(-1)
+	u.lost.Add(1)
+}
+
+// dnsProbe asks server for the nameservers of the root zone, which any
+// recursive resolver answers from its cache.
+func dnsProbe(conn net.PacketConn, server netip.AddrPort, timeout time.Duration) error {
+	id := uint16(rand.Uint32())
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: true})
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{Name: dnsmessage.MustNewName("."), Type: dnsmessage.TypeNS, Class: dnsmessage.ClassINET})
+	query, err := b.Finish()
+	if err != nil {
+		return fmt.Errorf("failed to build DNS query: %w", err)
+	}
+
+	to := net.UDPAddrFromAddrPort(server)
+	deadline := time.Now().Add(timeout)
+	buf := make([]byte, 1500)
+	for time.Now().Before(deadline) {
+		_, err := conn.WriteTo(query, to)
+		if err != nil {
+			return fmt.Errorf("failed to send DNS query: %w", err)
+		}
+		readDeadline := time.Now().Add(stunRetransmit)
+		if readDeadline.After(deadline) {
+			readDeadline = deadline
+		}
+		conn.SetReadDeadline(readDeadline)
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				break
+			}
+			var p dnsmessage.Parser
+			h, err := p.Start(buf[:n])
+			if err == nil && h.Response && h.ID == id {
+				return nil
+			}
+		}
+	}
+	return errors.New("no DNS response")
+}
+
+// keepMapping refreshes the mapping of conn until it is lost or ctx is
+// done.
+func (m *UdpMeasurer) keepMapping(ctx context.Context, conn net.PacketConn, server netip.AddrPort, mappings *udpMappings) {
+	probe := udpProbes[m.Probe]
+	t := time.NewTicker(m.RefreshInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		if err := probe(conn, server, m.Timeout); err != nil {
+			if ctx.Err() == nil {
+				mappings.remove()
+			}
+			return
+		}
+	}
+}
+
+// Measure opens the mappings then sustains them, returning how many the
+// NAT sustained.
+func (m *UdpMeasurer) Measure(ctx context.Context) (*UdpResult, error) {
+	probe, found := udpProbes[m.Probe]
+	if !found {
+		return nil, fmt.Errorf("unknown probe %q, expected stun or dns", m.Probe)
+	}
+	if len(m.Servers) == 0 {
+		return nil, errors.New("no servers to probe")
+	}
+	if m.Batch <= 0 || m.RefreshInterval <= 0 {
+		return nil, errors.New("the batch and refresh interval must be positive")
+	}
+	start := time.Now()
+	r := &UdpResult{Probe: m.Probe}
+	mappings := &udpMappings{}
+
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	conns := []net.PacketConn{}
+	defer func() {
+		// Closing the sockets unblocks the probes in flight
+		cancel()
+		for _, c := range conns {
+			c.Close()
+		}
+		wg.Wait()
+	}()
+
+	for r.Opened < m.MaxMappings && ctx.Err() == nil {
+		batch := min(m.Batch, m.MaxMappings-r.Opened)
+		var failed atomic.Int64
+		var opened sync.WaitGroup
+		for i := range batch {
+			conn, err := net.ListenUDP("udp4", nil)
+			if err != nil {
+				return nil, fmt.Errorf("failed to open UDP socket %d: %w", r.Opened+i, err)
+			}
+			conns = append(conns, conn)
+			server := m.Servers[(r.Opened+i)%len(m.Servers)]
+			opened.Add(1)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				err := probe(conn, server, m.Timeout)
+				if err != nil {
+					failed.Add(1)
+					opened.Done()
+					return
+				}
+				mappings.add()
+				opened.Done()
+				m.keepMapping(ctx, conn, server, mappings)
+			}()
+		}
+		opened.Wait()
+		r.Opened += batch
+		r.FailedOpens += int(failed.Load())
+		if failed.Load() >= int64(min(maxRepeatedDialFails, batch)) {
+			r.Exhausted = true
+			break
+		}
+	}
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(m.SustainDuration):
+	}
+	r.Sustained = int(mappings.alive.Load())
+	r.MaxMappings = int(mappings.maxSeen.Load())
+	r.Lost = int(mappings.lost.Load())
+	r.Duration = time.Since(start)
+	return r, nil
+}
+
+// parseUdpServers resolves comma separated host:port servers.
+func parseUdpServers(s string) ([]netip.AddrPort, error) {
+	servers := []netip.AddrPort{}
+	for _, field := range strings.Split(s, ",") {
+		addr, err := net.ResolveUDPAddr("udp4", strings.TrimSpace(field))
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve server %v: %w", field, err)
+		}
+		servers = append(servers, addr.AddrPort())
+	}
+	return servers, nil
+}
+
+func printUdpResult(w io.Writer, r *UdpResult) {
+	fmt.Fprintf(w, "Most UDP mappings alive at once: %v\n", r.MaxMappings)
+	fmt.Fprintf(w, "Sustained %v mappings, %v lost whilst refreshed\n", r.Sustained, r.Lost)
+	fmt.Fprintf(w, "Opened %v mappings, %v never answered\n", r.Opened, r.FailedOpens)
+	if !r.Exhausted {
+		fmt.Fprintln(w, "The NAT was not exhausted, open more mappings with --max-mappings")
+	}
+}
+
+// udpOptions are the flags of the udp command.
+type udpOptions struct {
+	fs      *flag.FlagSet
+	m       UdpMeasurer
+	servers string
+	json    bool
+}
+
+func newUdpFlags(name string) *udpOptions {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	o := &udpOptions{fs: fs}
+	fs.StringVar(&o.m.Probe, "probe", "stun", "keep mappings alive with stun binding requests or dns queries")
+	fs.StringVar(&o.servers, "servers", "", "comma separated servers to spread the mappings over, the default STUN server or the system nameserver by default")
+	fs.IntVar(&o.m.MaxMappings, "max-mappings", defaultUdpMaxMappings, "most mappings to open")
+	fs.IntVar(&o.m.Batch, "batch", defaultUdpBatch, "mappings opened at once, opening stops once a batch fails")
+	fs.DurationVar(&o.m.RefreshInterval, "refresh", defaultUdpRefresh, "time between refreshes of each mapping, shorter than the UDP timeout of the NAT")
+	fs.DurationVar(&o.m.SustainDuration, "sustain", defaultUdpSustain, "how long to refresh the mappings for once opened")
+	fs.DurationVar(&o.m.Timeout, "timeout", defaultStunTimeout, "how long to wait for each answer")
+	fs.BoolVar(&o.json, "json", false, "print the result as json, for scripts")
+	return o
+}
+
+func udpCommand(name string, args []string) {
+	o := newUdpFlags(name)
+	parseCommandArgs(o.fs, args, "", 0, false)
+
+	list := cmp.Or(o.servers, defaultStunServers)
+	if o.servers == "" && o.m.Probe == "dns" {
+		nameserver, err := systemNameserver()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		list = nameserver
+	}
+	servers, err := parseUdpServers(list)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	o.m.Servers = servers
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	r, err := o.m.Measure(ctx)
+	if err != nil {
+		fmt.Printf("Failed to measure UDP mappings: %v\n", err)
+		os.Exit(1)
+	}
+	if !o.json {
+		printUdpResult(os.Stdout, r)
+		return
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	err = enc.Encode(r)
+	if err != nil {
+		fmt.Printf("Failed to print result: %v\n", err)
+		os.Exit(1)
+	}
+}
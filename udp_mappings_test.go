@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeUdpNat answers the probes of the UDP mappings it allows, like a NAT
+// in front of a server.
+type fakeUdpNat struct {
+	m sync.Mutex
+	// Most mappings, zero is unlimited
+	limit int
+	// Answer each mapping only once, as if refreshes were dropped
+	once     bool
+	mappings map[netip.AddrPort]int
+}
+
+func (n *fakeUdpNat) allows(from netip.AddrPort) bool {
+	n.m.Lock()
+	defer n.m.Unlock()
+	seen, found := n.mappings[from]
+	if !found && n.limit > 0 && len(n.mappings) >= n.limit {
+		return false
+	}
+	n.mappings[from] = seen + 1
+	return !n.once || seen == 0
+}
+
+// serveUdpProbes answers STUN binding requests and DNS queries on a
+// loopback address, for the mappings nat allows.
+func serveUdpProbes(t *testing.T, nat *fakeUdpNat) netip.AddrPort {
+	nat.mappings = map[netip.AddrPort]int{}
+	conn, err := net.ListenUDP("udp4", net.UDPAddrFromAddrPort(netip.MustParseAddrPort("127.0.0.1:0")))
+	if err != nil {
+		t.Fatal("Failed to listen: ", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := conn.ReadFromUDPAddrPort(buf)
+			if err != nil {
+				return
+			}
+			if !nat.allows(from) {
+				continue
+			}
+			msg := buf[:n]
+			if n >= stunHeaderLen && binary.BigEndian.Uint16(msg) == stunBindingRequest {
+				s := &fakeStunServer{noOther: true}
+				conn.WriteToUDPAddrPort(s.response([12]byte(msg[8:20]), from), from)
+				continue
+			}
+			var p dnsmessage.Parser
+			h, err := p.Start(msg)
+			if err != nil {
+				continue
+			}
+			q, err := p.Question()
+			if err != nil {
+				continue
+			}
+			b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: h.ID, Response: true})
+			b.StartQuestions()
+			b.Question(q)
+			res, err := b.Finish()
+			if err == nil {
+				conn.WriteToUDPAddrPort(res, from)
+			}
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr).AddrPort()
+}
+
+func TestUdpMeasure(t *testing.T) {
+	testcases := map[string]struct {
+		inProbe        string
+		inLimit        int
+		inOnce         bool
+		inMaxMappings  int
+		outMaxMappings int
+		outSustained   int
+		outOpened      int
+		outLost        int
+		outExhausted   bool
+	}{
+		"stun exhausted": {
+			inProbe:        "stun",
+			inLimit:        30,
+			inMaxMappings:  100,
+			outMaxMappings: 30,
+			outSustained:   30,
+			outOpened:      40,
+			outExhausted:   true,
+		},
+		"dns exhausted": {
+			inProbe:        "dns",
+			inLimit:        15,
+			inMaxMappings:  100,
+			outMaxMappings: 15,
+			outSustained:   15,
+			outOpened:      20,
+			outExhausted:   true,
+		},
+		"max mappings": {
+			inProbe:        "stun",
+			inMaxMappings:  25,
+			outMaxMappings: 25,
+			outSustained:   25,
+			outOpened:      25,
+		},
+		"refreshes dropped": {
+			inProbe:        "stun",
+			inOnce:         true,
+			inMaxMappings:  20,
+			outMaxMappings: 20,
+			outSustained:   0,
+			outOpened:      20,
+			outLost:        20,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			server := serveUdpProbes(t, &fakeUdpNat{limit: tc.inLimit, once: tc.inOnce})
+			m := UdpMeasurer{
+				Probe:           tc.inProbe,
+				Servers:         []netip.AddrPort{server},
+				MaxMappings:     tc.inMaxMappings,
+				Batch:           10,
+				RefreshInterval: 50 * time.Millisecond,
+				SustainDuration: 400 * time.Millisecond,
+				Timeout:         100 * time.Millisecond,
+			}
+			r, err := m.Measure(context.Background())
+			if err != nil {
+				t.Fatal("Failed to measure: ", err)
+			}
+			if r.MaxMappings != tc.outMaxMappings || r.Sustained != tc.outSustained || r.Opened != tc.outOpened ||
+				r.Lost != tc.outLost || r.Exhausted != tc.outExhausted {
+				t.Errorf("expected %v most, %v sustained, %v opened, %v lost and exhausted %v, got %+v",
+					tc.outMaxMappings, tc.outSustained, tc.outOpened, tc.outLost, tc.outExhausted, r)
+			}
+		})
+	}
+}
+
+func TestUdpMeasureUnknownProbe(t *testing.T) {
+	m := UdpMeasurer{Probe: "carrier-pigeon", Servers: []netip.AddrPort{netip.MustParseAddrPort("127.0.0.1:3478")}}
+	if _, err := m.Measure(context.Background()); err == nil {
+		t.Error("expected an unknown probe to be rejected")
+	}
+}
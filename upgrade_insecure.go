@@ -0,0 +1,132 @@
+// Functions related to upgrading hosts to https once they ask for it, with
+// Strict-Transport-Security or upgrade-insecure-requests, so crawling
+// modern sites does not bounce between schemes.
+package main
+
+import (
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// SchemeUpgrade is a connection moved to https, as its host asked.
+type SchemeUpgrade struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// hstsEnabled reports whether the Strict-Transport-Security header asks
+// for https, a max-age of zero asks to forget it.
+func hstsEnabled(value string) bool {
+	for _, d := range strings.Split(value, ";") {
+		name, v, _ := strings.Cut(strings.TrimSpace(d), "=")
+		if !strings.EqualFold(name, "max-age") {
+			continue
+		}
+		age, err := strconv.Atoi(strings.Trim(v, `"`))
+		return err == nil && age > 0
+	}
+	return false
+}
+
+// cspUpgradesInsecure reports whether a Content-Security-Policy asks for
+// upgrade-insecure-requests.
+func cspUpgradesInsecure(header http.Header) bool {
+	for _, policy := range header.Values("Content-Security-Policy") {
+		for _, d := range strings.Split(policy, ";") {
+			if strings.EqualFold(strings.TrimSpace(d), "upgrade-insecure-requests") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// asksForHttps reports whether the response asks for its host to be
+// requested over https. Browsers ignore Strict-Transport-Security sent
+// without TLS.
+func asksForHttps(resp *http.Response) bool {
+	if resp.TLS != nil && hstsEnabled(resp.Header.Get("Strict-Transport-Security")) {
+		return true
+	}
+	return cspUpgradesInsecure(resp.Header)
+}
+
+// upgradeUrl is the https url of u, the default port moving to 443.
+func upgradeUrl(u *url.URL) *url.URL {
+	up := *u
+	up.Scheme = "https"
+	up.Host = strings.TrimSuffix(u.Host, ":80")
+	return &up
+}
+
+// upgradeUrls moves the http urls of the hosts that asked for https.
+func (s *scheduler) upgradeUrls(urls []*url.URL) []*url.URL {
+	for i, u := range urls {
+		if u.Scheme == "http" && s.httpsHosts[u.Hostname()] {
+			urls[i] = upgradeUrl(u)
+		}
+	}
+	return urls
+}
+
+// upgradeHost records that the host of c asked for https, moving its
+// http connections to https.
+func (s *scheduler) upgradeHost(c *connection) {
+	if !s.m.UpgradeInsecure {
+		return
+	}
+	if s.httpsHosts == nil {
+		s.httpsHosts = map[string]bool{}
+	}
+	hostname := c.url.Hostname()
+	s.httpsHosts[hostname] = true
+
+	for _, conn := range append(slices.Clone(s.pendingConns), s.activeConns...) {
+		if conn.url.Scheme == "http" && conn.url.Hostname() == hostname {
+			s.upgradeConnection(conn)
+		}
+	}
+}
+
+// upgradeConnection closes the http connection c and dials its host once
+// more over https, keeping one connection to the server. Its uncrawled
+// urls move with it, or to the https connection if there already is one.
+func (s *scheduler) upgradeConnection(c *connection) {
+	to := upgradeUrl(c.url)
+	if indexConnectionById(s.pendingConns, c.id) != -1 {
+		s.skipPendingConnection(c)
+	} else {
+		s.closeConnection(c)
+	}
+	s.schemeUpgrades = append(s.schemeUpgrades, SchemeUpgrade{
+		From: c.url.Scheme + "://" + c.host.hostPort,
+		To:   to.Scheme + "://" + canonicalHost(to),
+	})
+
+	https := s.pendingConns
+	i := indexConnectionByHostPort(https, to)
+	if i == -1 {
+		https = s.activeConns
+		i = indexConnectionByHostPort(https, to)
+	}
+	var upgraded *connection
+	if i != -1 {
+		upgraded = https[i]
+	} else if indexConnectionByHostPort(s.failedConns, to) == -1 && indexConnectionByHostPort(s.closedConns, to) == -1 {
+		port, _ := strconv.ParseUint(urlPort(to), 10, 16)
+		addr := netip.AddrPortFrom(c.host.ip.Addr(), uint16(port))
+		upgraded = s.addResolved(&resolvedUrl{url: to, addresses: []netip.AddrPort{addr}})
+	}
+	if upgraded == nil {
+		return
+	}
+	for r := range c.uncrawledUrls {
+		if !upgraded.crawledUrls[r] && !upgraded.crawlingUrls[r] {
+			upgraded.uncrawledUrls[r] = true
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"slices"
+	"testing"
+)
+
+func TestHstsEnabled(t *testing.T) {
+	testcases := map[string]struct {
+		inValue    string
+		expEnabled bool
+	}{
+		"Max-age":            {inValue: "max-age=31536000", expEnabled: true},
+		"Include subdomains": {inValue: "max-age=31536000; includeSubDomains", expEnabled: true},
+		"Quoted":             {inValue: `max-age="600"`, expEnabled: true},
+		"Forget":             {inValue: "max-age=0", expEnabled: false},
+		"No max-age":         {inValue: "includeSubDomains", expEnabled: false},
+		"Empty":              {inValue: "", expEnabled: false},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			if enabled := hstsEnabled(tc.inValue); enabled != tc.expEnabled {
+				t.Errorf("expected enabled to be %v, got %v", tc.expEnabled, enabled)
+			}
+		})
+	}
+}
+
+func TestCspUpgradesInsecure(t *testing.T) {
+	testcases := map[string]struct {
+		inPolicies []string
+		expUpgrade bool
+	}{
+		"Upgrade":      {inPolicies: []string{"upgrade-insecure-requests"}, expUpgrade: true},
+		"Among others": {inPolicies: []string{"default-src 'self'; Upgrade-Insecure-Requests"}, expUpgrade: true},
+		"Second":       {inPolicies: []string{"default-src 'self'", "upgrade-insecure-requests"}, expUpgrade: true},
+		"Other":        {inPolicies: []string{"default-src 'self'"}, expUpgrade: false},
+		"None":         {inPolicies: nil, expUpgrade: false},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			h := http.Header{}
+			for _, p := range tc.inPolicies {
+				h.Add("Content-Security-Policy", p)
+			}
+			if upgrade := cspUpgradesInsecure(h); upgrade != tc.expUpgrade {
+				t.Errorf("expected upgrade to be %v, got %v", tc.expUpgrade, upgrade)
+			}
+		})
+	}
+}
+
+func TestUpgradeUrl(t *testing.T) {
+	testcases := map[string]struct {
+		inUrl  string
+		expUrl string
+	}{
+		"Default port": {inUrl: "http://example.com/a?b=c", expUrl: "https://example.com/a?b=c"},
+		"Explicit 80":  {inUrl: "http://example.com:80/", expUrl: "https://example.com/"},
+		"Other port":   {inUrl: "http://example.com:8080/", expUrl: "https://example.com:8080/"},
+		"IPv6 port 80": {inUrl: "http://[2001:db8::1]:80/", expUrl: "https://[2001:db8::1]/"},
+		"IPv6 no port": {inUrl: "http://[2001:db8::1]/", expUrl: "https://[2001:db8::1]/"},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			u, err := url.Parse(tc.inUrl)
+			if err != nil {
+				t.Fatal("Failed to parse url: ", err)
+			}
+			if up := upgradeUrl(u).String(); up != tc.expUrl {
+				t.Errorf("expected %v, got %v", tc.expUrl, up)
+			}
+		})
+	}
+}
+
+// hstsNetwork has every host of a benchNetwork ask for https over http.
+type hstsNetwork struct {
+	benchNetwork
+}
+
+func (n *hstsNetwork) scrapConnection(ctx context.Context, r *roundtrip) *roundtrip {
+	r = n.benchNetwork.scrapConnection(ctx, r)
+	r.asksForHttps = r.url.Scheme == "http"
+	return r
+}
+
+func TestUpgradeInsecure(t *testing.T) {
+	testcases := map[string]struct {
+		inUpgrade   bool
+		expUpgrades []SchemeUpgrade
+		expScheme   string
+	}{
+		"Upgraded": {
+			inUpgrade:   true,
+			expUpgrades: []SchemeUpgrade{{From: "http://h0.bench:80", To: "https://h0.bench:443"}},
+			expScheme:   "https",
+		},
+		"Not upgraded": {
+			inUpgrade: false,
+			expScheme: "http",
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			n := &hstsNetwork{benchNetwork{hosts: 1, seeds: 1}}
+			m := Measurer{network: n, UpgradeInsecure: tc.inUpgrade}
+			r, err := m.Measure(n.seedUrls())
+			if err != nil {
+				t.Fatal("Failed to measure: ", err)
+			}
+			if !slices.Equal(r.SchemeUpgrades, tc.expUpgrades) {
+				t.Errorf("expected upgrades %v, got %v", tc.expUpgrades, r.SchemeUpgrades)
+			}
+			if r.MaxConnections != 1 || len(r.BySchemePort) != 1 || r.BySchemePort[0].Scheme != tc.expScheme {
+				t.Errorf("expected one %v connection, got %d %+v", tc.expScheme, r.MaxConnections, r.BySchemePort)
+			}
+		})
+	}
+}
@@ -0,0 +1,369 @@
+// Functions related to asking the gateway over UPnP IGD what it reports
+// of itself, like its WAN status and port mappings, to put next to the
+// max connections measured.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Longest to wait for the gateway to answer the search, and each
+	// request after
+	upnpTimeout = 2 * time.Second
+	ssdpGroup   = "239.255.255.250:1900"
+	// Port mappings listed before giving up on counting them, as each is
+	// a request of its own
+	maxUpnpPortMappings = 1024
+)
+
+// Devices searched for, IGDv2 gateways also answering for IGDv1
+var igdDeviceTypes = []string{
+	"urn:schemas-upnp-org:device:InternetGatewayDevice:2",
+	"urn:schemas-upnp-org:device:InternetGatewayDevice:1",
+}
+
+var errNoIgd = errors.New("no UPnP gateway answered")
+
+// UpnpReport is what the gateway reports of itself over UPnP IGD.
+type UpnpReport struct {
+	// Friendly name, manufacturer and model of the gateway
+	Name         string `json:"name,omitempty"`
+	Manufacturer string `json:"manufacturer,omitempty"`
+	Model        string `json:"model,omitempty"`
+	// The WAN connection service asked, like WANIPConnection:1
+	Service string `json:"service"`
+	// Status and uptime of the WAN connection, like Connected
+	ConnectionStatus string        `json:"connection_status,omitempty"`
+	Uptime           time.Duration `json:"uptime,omitempty"`
+	// The address of the WAN connection, private if the gateway is
+	// itself behind a NAT
+	ExternalIp string `json:"external_ip,omitempty"`
+	// Entries of the port mapping table, nil if the gateway does not
+	// list them
+	PortMappings *int `json:"port_mappings,omitempty"`
+	// More than maxUpnpPortMappings entries, PortMappings is a floor
+	PortMappingsCapped bool `json:"port_mappings_capped,omitempty"`
+}
+
+// ssdpSearch asks target, the SSDP multicast group or a gateway, for an
+// internet gateway device, returning the location of its description.
+func ssdpSearch(conn net.PacketConn, target *net.UDPAddr, timeout time.Duration) (string, error) {
+	for _, st := range igdDeviceTypes {
+		msg := "M-SEARCH * HTTP/1.1\r\n" +
+			"HOST: " + ssdpGroup + "\r\n" +
+			"MAN: \"ssdp:discover\"\r\n" +
+			"MX: 1\r\n" +
+			"ST: " + st + "\r\n\r\n"
+		_, err := conn.WriteTo([]byte(msg), target)
+		if err != nil {
+			return "", fmt.Errorf("failed to send SSDP search: %w", err)
+		}
+	}
+
+	buf := make([]byte, 2048)
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return "", errNoIgd
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+		if err != nil || resp.StatusCode != http.StatusOK {
+			continue
+		}
+		if location := resp.Header.Get("Location"); location != "" {
+			return location, nil
+		}
+	}
+}
+
+// igdDevice is a device of a UPnP description, with its embedded
+// devices.
+type igdDevice struct {
+	DeviceType   string       `xml:"deviceType"`
+	FriendlyName string       `xml:"friendlyName"`
+	Manufacturer string       `xml:"manufacturer"`
+	ModelName    string       `xml:"modelName"`
+	Services     []igdService `xml:"serviceList>service"`
+	Devices      []igdDevice  `xml:"deviceList>device"`
+}
+
+type igdService struct {
+	ServiceType string `xml:"serviceType"`
+	ControlUrl  string `xml:"controlURL"`
+}
+
+// services are those of d and the devices embedded in it.
+func (d *igdDevice) services() []igdService {
+	all := slices.Clone(d.Services)
+	for i := range d.Devices {
+		all = append(all, d.Devices[i].services()...)
+	}
+	return all
+}
+
+// wanService finds the WAN connection service of d, preferring
+// WANIPConnection over WANPPPConnection.
+func (d *igdDevice) wanService() (igdService, bool) {
+	services := d.services()
+	for _, kind := range []string{":WANIPConnection:", ":WANPPPConnection:"} {
+		for _, s := range services {
+			if strings.Contains(s.ServiceType, kind) {
+				return s, true
+			}
+		}
+	}
+	return igdService{}, false
+}
+
+// parseIgdDescription finds the WAN connection service in the device
+// description read from body, with its control url resolved against
+// location.
+func parseIgdDescription(location *url.URL, body io.Reader) (*igdDevice, *igdService, error) {
+	var root struct {
+		UrlBase string    `xml:"URLBase"`
+		Device  igdDevice `xml:"device"`
+	}
+	err := xml.NewDecoder(body).Decode(&root)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse gateway description: %w", err)
+	}
+	s, found := root.Device.wanService()
+	if !found {
+		return nil, nil, errors.New("the gateway has no WAN connection service")
+	}
+
+	base := location
+	if root.UrlBase != "" {
+		base, err = url.Parse(root.UrlBase)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to parse gateway URLBase: %w", err)
+		}
+	}
+	control, err := base.Parse(s.ControlUrl)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse gateway control url: %w", err)
+	}
+	service := &igdService{ServiceType: s.ServiceType, ControlUrl: control.String()}
+	return &root.Device, service, nil
+}
+
+// upnpError is a fault returned by a UPnP action, like 713 for an index
+// past the end of the port mapping table.
+type upnpError struct {
+	action string
+	code   int
+	desc   string
+}
+
+func (e *upnpError) Error() string {
+	return fmt.Sprintf("%v failed with UPnP error %d %v", e.action, e.code, e.desc)
+}
+
+// soapCall calls action of the service, returning the leaf elements of
+// the reply by name.
+func soapCall(client *http.Client, s *igdService, action string, args map[string]string) (map[string]string, error) {
+	body := &strings.Builder{}
+	body.WriteString(`<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`)
+	fmt.Fprintf(body, `<u:%v xmlns:u="%v">`, action, s.ServiceType)
+	for name, val := range args {
+		fmt.Fprintf(body, "<%v>", name)
+		xml.EscapeText(body, []byte(val))
+		fmt.Fprintf(body, "</%v>", name)
+	}
+	fmt.Fprintf(body, "</u:%v></s:Body></s:Envelope>", action)
+
+	req, err := http.NewRequest(http.MethodPost, s.ControlUrl, strings.NewReader(body.String()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to make %v request: %w", action, err)
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", fmt.Sprintf(`"%v#%v"`, s.ServiceType, action))
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to call %v: %w", action, err)
+	}
+	defer resp.Body.Close()
+
+	fields, err := soapFields(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		code, convErr := strconv.Atoi(fields["errorCode"])
+		if err != nil || convErr != nil {
+			return nil, fmt.Errorf("%v failed with %v", action, resp.Status)
+		}
+		return nil, &upnpError{action: action, code: code, desc: fields["errorDescription"]}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %v reply: %w", action, err)
+	}
+	return fields, nil
+}
+
+// soapFields are the text of the leaf elements of a SOAP envelope, by
+// local name.
+func soapFields(r io.Reader) (map[string]string, error) {
+	fields := map[string]string{}
+	dec := xml.NewDecoder(io.LimitReader(r, 64*1024))
+	var name string
+	var text strings.Builder
+	for {
+		tok, err := dec.Token()
+		if errors.Is(err, io.EOF) {
+			return fields, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			name = t.Name.Local
+			text.Reset()
+		case xml.CharData:
+			text.Write(t)
+		case xml.EndElement:
+			if name == t.Name.Local {
+				fields[name] = strings.TrimSpace(text.String())
+			}
+			name = ""
+		}
+	}
+}
+
+// countPortMappings lists the port mapping table by index until the
+// gateway says the index is past its end.
+func countPortMappings(client *http.Client, s *igdService) (int, bool, error) {
+	for i := range maxUpnpPortMappings {
+		_, err := soapCall(client, s, "GetGenericPortMappingEntry", map[string]string{"NewPortMappingIndex": strconv.Itoa(i)})
+		var uErr *upnpError
+		if errors.As(err, &uErr) && (uErr.code == 713 || uErr.code == 714) {
+			return i, false, nil
+		}
+		if err != nil {
+			return 0, false, err
+		}
+	}
+	return maxUpnpPortMappings, true, nil
+}
+
+// queryIgd asks the gateway described at location for the status of
+// its WAN connection and its port mappings.
+func queryIgd(client *http.Client, location string) (*UpnpReport, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse gateway location: %w", err)
+	}
+	resp, err := client.Get(location)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch gateway description: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("gateway description replied with %v", resp.Status)
+	}
+	device, service, err := parseIgdDescription(u, io.LimitReader(resp.Body, 1024*1024))
+	if err != nil {
+		return nil, err
+	}
+
+	report := &UpnpReport{
+		Name:         device.FriendlyName,
+		Manufacturer: device.Manufacturer,
+		Model:        device.ModelName,
+		Service:      strings.TrimPrefix(service.ServiceType, "urn:schemas-upnp-org:service:"),
+	}
+	status, err := soapCall(client, service, "GetStatusInfo", nil)
+	if err != nil {
+		return nil, err
+	}
+	report.ConnectionStatus = status["NewConnectionStatus"]
+	if uptime, err := strconv.Atoi(status["NewUptime"]); err == nil {
+		report.Uptime = time.Duration(uptime) * time.Second
+	}
+	external, err := soapCall(client, service, "GetExternalIPAddress", nil)
+	if err != nil {
+		return nil, err
+	}
+	report.ExternalIp = external["NewExternalIPAddress"]
+
+	// Gateways may refuse to list their mappings, which leaves them
+	// unknown rather than failing the rest
+	mappings, capped, err := countPortMappings(client, service)
+	if err == nil {
+		report.PortMappings = &mappings
+		report.PortMappingsCapped = capped
+	}
+	return report, nil
+}
+
+// discoverUpnp searches target for a gateway from a socket of listen,
+// then asks it over UPnP IGD.
+func discoverUpnp(listen func() (net.PacketConn, error), target string, timeout time.Duration) (*UpnpReport, error) {
+	addr, err := net.ResolveUDPAddr("udp4", target)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %v: %w", target, err)
+	}
+	conn, err := listen()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open UDP socket: %w", err)
+	}
+	location, err := ssdpSearch(conn, addr, timeout)
+	conn.Close()
+	if err != nil {
+		return nil, err
+	}
+	return queryIgd(&http.Client{Timeout: timeout}, location)
+}
+
+// upnpResult is the outcome of asking the gateway, which happens whilst
+// measuring.
+type upnpResult struct {
+	report *UpnpReport
+	err    error
+}
+
+// startUpnp asks the gateway over UPnP IGD from the address the
+// connections are dialed from, in the background.
+func (s *scheduler) startUpnp() <-chan upnpResult {
+	laddr := &net.UDPAddr{}
+	if s.traffic.dialer != nil {
+		if a, ok := s.traffic.dialer.LocalAddr.(*net.TCPAddr); ok {
+			laddr.IP = a.IP
+		}
+	}
+	listen := func() (net.PacketConn, error) {
+		return net.ListenUDP("udp4", laddr)
+	}
+	resultC := make(chan upnpResult, 1)
+	go func() {
+		report, err := discoverUpnp(listen, ssdpGroup, upnpTimeout)
+		resultC <- upnpResult{report: report, err: err}
+	}()
+	return resultC
+}
+
+// upnpWarning says when the gateway is itself behind another NAT, its
+// WAN address being private or shared.
+func upnpWarning(u *UpnpReport) string {
+	if u == nil {
+		return ""
+	}
+	ip, err := netip.ParseAddr(u.ExternalIp)
+	if err != nil || (!ip.IsPrivate() && !sharedRange.Contains(ip)) {
+		return ""
+	}
+	return fmt.Sprintf("the gateway reports the private WAN address %v over UPnP, another NAT is upstream of it", ip)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const igdDescription = `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+<device>
+<deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+<friendlyName>Home Router</friendlyName>
+<manufacturer>Example</manufacturer>
+<modelName>HR-1</modelName>
+<deviceList><device>
+<deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+<deviceList><device>
+<deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+<serviceList>
+<service><serviceType>urn:schemas-upnp-org:service:WANPPPConnection:1</serviceType><controlURL>/ppp</controlURL></service>
+<service><serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType><controlURL>/ctl/ip</controlURL></service>
+</serviceList>
+</device></deviceList>
+</device></deviceList>
+</device>
+</root>`
+
+// serveIgd serves a gateway with mappings port mappings, answering
+// SSDP searches on a socket of its own.
+func serveIgd(t *testing.T, mappings int) string {
+	index := regexp.MustCompile(`<NewPortMappingIndex>(\d+)</NewPortMappingIndex>`)
+	srv := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/desc.xml" {
+			io.WriteString(res, igdDescription)
+			return
+		}
+		if req.URL.Path != "/ctl/ip" {
+			http.NotFound(res, req)
+			return
+		}
+		body, _ := io.ReadAll(req.Body)
+		action := strings.Trim(req.Header.Get("SOAPAction"), `"`)
+		action = action[strings.Index(action, "#")+1:]
+		reply := ""
+		switch action {
+		case "GetStatusInfo":
+			reply = "<NewConnectionStatus>Connected</NewConnectionStatus><NewUptime>3600</NewUptime>"
+		case "GetExternalIPAddress":
+			reply = "<NewExternalIPAddress>100.64.1.2</NewExternalIPAddress>"
+		case "GetGenericPortMappingEntry":
+			m := index.FindSubmatch(body)
+			i, _ := strconv.Atoi(string(m[1]))
+			if i >= mappings {
+				res.WriteHeader(http.StatusInternalServerError)
+				io.WriteString(res, `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><s:Fault><detail><UPnPError><errorCode>713</errorCode><errorDescription>SpecifiedArrayIndexInvalid</errorDescription></UPnPError></detail></s:Fault></s:Body></s:Envelope>`)
+				return
+			}
+			reply = "<NewExternalPort>" + strconv.Itoa(10000+i) + "</NewExternalPort>"
+		}
+		fmt.Fprintf(res, `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><u:%vResponse xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:1">%v</u:%vResponse></s:Body></s:Envelope>`, action, reply, action)
+	}))
+	t.Cleanup(srv.Close)
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Failed to listen for SSDP: ", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if !strings.Contains(string(buf[:n]), "InternetGatewayDevice") {
+				continue
+			}
+			reply := "HTTP/1.1 200 OK\r\nCACHE-CONTROL: max-age=120\r\nST: urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\nLOCATION: " + srv.URL + "/desc.xml\r\n\r\n"
+			conn.WriteTo([]byte(reply), from)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func listenUpnp() (net.PacketConn, error) {
+	return net.ListenPacket("udp4", "127.0.0.1:0")
+}
+
+func TestDiscoverUpnp(t *testing.T) {
+	testcases := map[string]struct {
+		inMappings int
+		outCapped  bool
+	}{
+		"No mappings":   {inMappings: 0},
+		"Some mappings": {inMappings: 3},
+		"Too many":      {inMappings: maxUpnpPortMappings + 1, outCapped: true},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			target := serveIgd(t, tc.inMappings)
+			r, err := discoverUpnp(listenUpnp, target, time.Second)
+			if err != nil {
+				t.Fatal("Failed to discover gateway: ", err)
+			}
+			if r.Name != "Home Router" || r.Model != "HR-1" || r.Service != "WANIPConnection:1" {
+				t.Errorf("expected the WANIPConnection of Home Router HR-1, got %+v", r)
+			}
+			if r.ConnectionStatus != "Connected" || r.Uptime != time.Hour || r.ExternalIp != "100.64.1.2" {
+				t.Errorf("expected connected for an hour from 100.64.1.2, got %+v", r)
+			}
+			expect := min(tc.inMappings, maxUpnpPortMappings)
+			if r.PortMappings == nil || *r.PortMappings != expect || r.PortMappingsCapped != tc.outCapped {
+				t.Errorf("expected %d port mappings, capped %v, got %v, %v", expect, tc.outCapped, r.PortMappings, r.PortMappingsCapped)
+			}
+			if upnpWarning(r) == "" {
+				t.Error("expected a warning of the shared WAN address")
+			}
+		})
+	}
+}
+
+func TestDiscoverUpnpNoGateway(t *testing.T) {
+	silent, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Failed to listen: ", err)
+	}
+	defer silent.Close()
+
+	_, err = discoverUpnp(listenUpnp, silent.LocalAddr().String(), 100*time.Millisecond)
+	if !errors.Is(err, errNoIgd) {
+		t.Errorf("expected no gateway to answer, got %v", err)
+	}
+	if w := upnpWarning(&UpnpReport{ExternalIp: "203.0.113.1"}); w != "" {
+		t.Errorf("expected no warning of a public WAN address, got %q", w)
+	}
+}
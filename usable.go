@@ -0,0 +1,123 @@
+// Functions related to deciding when a connection is usable enough to
+// count towards the measured maximum.
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// Count connections once they are established
+	CountAfterConnect = "connect"
+	// Count connections once robots.txt got a response
+	CountAfterRobots = "robots"
+	// Count connections once a page other than robots.txt was fetched
+	// successfully
+	CountAfterContent = "content"
+	// Count connections once a second request succeeded over the same
+	// socket, proving the server keeps connections alive rather than
+	// accepting then closing them
+	CountAfterReuse = "reuse"
+)
+
+var countAfterStages = []string{CountAfterConnect, CountAfterRobots, CountAfterContent, CountAfterReuse}
+
+func checkCountAfter(stage string) error {
+	if stage != "" && !slices.Contains(countAfterStages, stage) {
+		return fmt.Errorf("unknown stage to count connections after %q, expected one of %v", stage, strings.Join(countAfterStages, ", "))
+	}
+	return nil
+}
+
+func countedAfterDescription(stage string) string {
+	switch stage {
+	case CountAfterRobots:
+		return "robots.txt was fetched"
+	case CountAfterContent:
+		return "a page was fetched"
+	case CountAfterReuse:
+		return "a second request succeeded over the same socket"
+	default:
+		return "connected"
+	}
+}
+
+// markUsable records how far a connection got, given a reply it kept
+// the connection for.
+func markUsable(c *connection, reply *roundtrip) {
+	if reply.err != nil || reply.ping || reply.keepAliver != nil {
+		return
+	}
+	if reply.url.Path == "/robots.txt" {
+		c.robotsFetched = true
+	} else if reply.status >= 200 && reply.status < 400 {
+		c.contentFetched = true
+	}
+}
+
+// markReused records whether a successful reply came over the socket of
+// the successful reply before it, rather than one the transport dialed
+// again after the server closed the last.
+func markReused(c *connection, reply *roundtrip) {
+	if reply.err != nil || reply.keepAliver != nil {
+		return
+	}
+	socket := c.conn.Load()
+	if !c.established.IsZero() && socket == c.lastSocket {
+		c.socketReused = true
+	}
+	c.lastSocket = socket
+}
+
+// isUsable is whether the connection reached the stage.
+func isUsable(c *connection, stage string) bool {
+	switch cmp.Or(stage, CountAfterConnect) {
+	case CountAfterRobots:
+		return c.robotsFetched
+	case CountAfterContent:
+		return c.contentFetched
+	case CountAfterReuse:
+		return c.socketReused
+	default:
+		return !c.lastReply.IsZero()
+	}
+}
+
+// usableConnections filters the connections that reached the stage.
+func usableConnections(conns []*connection, stage string) []*connection {
+	return slices.DeleteFunc(slices.Clone(conns), func(c *connection) bool {
+		return !isUsable(c, stage)
+	})
+}
+
+func countUsable(conns []*connection, stage string) int {
+	n := 0
+	for _, c := range conns {
+		if isUsable(c, stage) {
+			n++
+		}
+	}
+	return n
+}
+
+// verifiedWindow is how recently a connection must have replied to be
+// verified alive. Connections are kept alive once idle for their
+// keep-alive interval, or Crawl-delay if longer, so replies are
+// expected within that window and the time to answer the keep-alive,
+// allowed another window.
+func verifiedWindow(c *connection) time.Duration {
+	return 2 * max(cmp.Or(c.keepAliveInterval, reRequestInterval), c.crawlDelay)
+}
+
+// verifiedConnections filters the connections that replied within their
+// verifiedWindow of now, those still known to be alive rather than
+// believed established.
+func verifiedConnections(conns []*connection, now time.Time) []*connection {
+	return slices.DeleteFunc(slices.Clone(conns), func(c *connection) bool {
+		return now.Sub(c.lastReply) > verifiedWindow(c)
+	})
+}
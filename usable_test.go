@@ -0,0 +1,171 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestCountAfter(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping due to re-request timeouts.")
+	}
+
+	srv := &httpTestServer{name: "server"}
+	startHttpServer(t, srv)
+	root := makeServerRoot(t, tPath("wildcard_robots.txt"))
+	srv.server.Handler = HandlerChain{
+		func(res http.ResponseWriter, req *http.Request) bool {
+			if req.URL.Path == "/robots.txt" {
+				return true
+			}
+			res.WriteHeader(http.StatusInternalServerError)
+			return false
+		},
+		makeFileHandler(root),
+	}
+
+	testcases := map[string]struct {
+		countAfter string
+		outNConns  int
+	}{
+		"Default": {outNConns: 1},
+		"Connect": {countAfter: CountAfterConnect, outNConns: 1},
+		"Robots":  {countAfter: CountAfterRobots, outNConns: 1},
+		"Content": {countAfter: CountAfterContent, outNConns: 0},
+		"Reuse":   {countAfter: CountAfterReuse, outNConns: 1},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			m := Measurer{CountAfter: tc.countAfter}
+			r, err := m.Measure([]*url.URL{srv.tUrl(t, "")})
+			if err != nil {
+				t.Fatal("Failed to measure: ", err)
+			}
+			if r.MaxConnections != tc.outNConns {
+				t.Errorf("expected to measure %d connections, got %d", tc.outNConns, r.MaxConnections)
+			}
+			if r.PeakEstablished != tc.outNConns {
+				t.Errorf("expected %d connections established at the peak, got %d", tc.outNConns, r.PeakEstablished)
+			}
+			if r.CountedAfter != cmp.Or(tc.countAfter, CountAfterConnect) {
+				t.Errorf("expected to count after %v, got %v", cmp.Or(tc.countAfter, CountAfterConnect), r.CountedAfter)
+			}
+		})
+	}
+}
+
+func TestCountAfterReuse(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping due to re-request timeouts.")
+	}
+
+	srv := &httpTestServer{name: "server"}
+	startHttpServer(t, srv)
+	root := makeServerRoot(t, tPath("wildcard_robots.txt"))
+	// Accepts each request, then closes the connection. The redial is
+	// refused, but the connection was counted at the peak until then.
+	srv.server.Handler = HandlerChain{
+		func(res http.ResponseWriter, req *http.Request) bool {
+			res.Header().Set("Connection", "close")
+			return true
+		},
+		makeFileHandler(root),
+	}
+
+	testcases := map[string]struct {
+		countAfter string
+		outPeak    int
+	}{
+		"Connect": {countAfter: CountAfterConnect, outPeak: 1},
+		"Reuse":   {countAfter: CountAfterReuse, outPeak: 0},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			m := Measurer{CountAfter: tc.countAfter}
+			r, err := m.Measure([]*url.URL{srv.tUrl(t, "")})
+			if err != nil {
+				t.Fatal("Failed to measure: ", err)
+			}
+			if r.MaxConnections != 0 {
+				t.Errorf("expected to measure no connections, got %d", r.MaxConnections)
+			}
+			if r.PeakEstablished != tc.outPeak {
+				t.Errorf("expected %d connections established at the peak, got %d", tc.outPeak, r.PeakEstablished)
+			}
+		})
+	}
+}
+
+func TestMarkReused(t *testing.T) {
+	first, second := &countingConn{}, &countingConn{}
+	testcases := map[string]struct {
+		inSockets []*countingConn
+		inErr     error
+		expect    bool
+	}{
+		"One reply":      {inSockets: []*countingConn{first}},
+		"Same socket":    {inSockets: []*countingConn{first, first}, expect: true},
+		"Dialed again":   {inSockets: []*countingConn{first, second}},
+		"Then reused":    {inSockets: []*countingConn{first, second, second}, expect: true},
+		"Failed replies": {inSockets: []*countingConn{first, first}, inErr: errors.New("reset")},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			c := &connection{}
+			for _, socket := range tc.inSockets {
+				c.conn.Store(socket)
+				markReused(c, &roundtrip{err: tc.inErr})
+				c.established = time.Now()
+			}
+			if c.socketReused != tc.expect {
+				t.Errorf("expected the socket to be reused %v, got %v", tc.expect, c.socketReused)
+			}
+		})
+	}
+}
+
+func TestUnknownCountAfter(t *testing.T) {
+	m := Measurer{CountAfter: "handshake"}
+	_, err := m.Measure(nil)
+	if err == nil {
+		t.Error("expected an unknown stage to count connections after to fail")
+	}
+}
+
+func TestVerifiedConnections(t *testing.T) {
+	now := time.Now()
+	testcases := map[string]struct {
+		keepAliveInterval time.Duration
+		crawlDelay        time.Duration
+		idle              time.Duration
+		verified          bool
+	}{
+		"Just replied":       {idle: 0, verified: true},
+		"Keep-alive due":     {idle: reRequestInterval + time.Second, verified: true},
+		"Keep-alive missed":  {idle: 3 * reRequestInterval},
+		"Long interval":      {keepAliveInterval: time.Minute, idle: time.Minute, verified: true},
+		"Long crawl-delay":   {crawlDelay: 10 * time.Second, idle: 15 * time.Second, verified: true},
+		"Crawl-delay missed": {crawlDelay: 10 * time.Second, idle: time.Minute},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			c := &connection{
+				keepAliveInterval: tc.keepAliveInterval,
+				crawlDelay:        tc.crawlDelay,
+				lastReply:         now.Add(-tc.idle),
+			}
+			verified := len(verifiedConnections([]*connection{c}, now)) == 1
+			if verified != tc.verified {
+				t.Errorf("expected a connection idle for %v to be verified %v, got %v", tc.idle, tc.verified, verified)
+			}
+		})
+	}
+}
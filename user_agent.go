@@ -0,0 +1,77 @@
+// Functions related to rotating the User-Agent of connections, for users
+// testing whether middleboxes apply policies per User-Agent.
+package main
+
+import (
+	"math/rand/v2"
+	"net/http"
+)
+
+// userAgentPool are the User-Agents connections rotate through, those
+// of common browsers.
+var userAgentPool = []string{
+	"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36",
+	"Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:125.0) Gecko/20100101 Firefox/125.0",
+	"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36 Edg/124.0.0.0",
+	"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.4 Safari/605.1.15",
+	"Mozilla/5.0 (Macintosh; Intel Mac OS X 14.4; rv:125.0) Gecko/20100101 Firefox/125.0",
+	"Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36",
+	"Mozilla/5.0 (X11; Ubuntu; Linux x86_64; rv:125.0) Gecko/20100101 Firefox/125.0",
+	"Mozilla/5.0 (iPhone; CPU iPhone OS 17_4 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.4 Mobile/15E148 Safari/604.1",
+	"Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Mobile Safari/537.36",
+}
+
+// UserAgentConnection is the User-Agent a connection was made with.
+type UserAgentConnection struct {
+	Host      string `json:"host"`
+	UserAgent string `json:"user_agent"`
+}
+
+// userAgentTransport sends every request with the User-Agent.
+type userAgentTransport struct {
+	http.RoundTripper
+	userAgent string
+}
+
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", t.userAgent)
+	return t.RoundTripper.RoundTrip(req)
+}
+
+func (t *userAgentTransport) CloseIdleConnections() {
+	if c, ok := t.RoundTripper.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
+
+// newUserAgentRotation starts each run at a random User-Agent of the
+// pool, so runs do not always pair the same hosts and User-Agents.
+func newUserAgentRotation() int {
+	return rand.IntN(len(userAgentPool))
+}
+
+// setUserAgent gives c the next User-Agent of the rotation, the same for
+// every request on it. Connections only share a User-Agent once the pool
+// is exhausted.
+func (s *scheduler) setUserAgent(c *connection) {
+	if !s.m.RotateUserAgent {
+		return
+	}
+	c.userAgent = userAgentPool[(s.userAgentStart+int(c.id))%len(userAgentPool)]
+	c.client.Transport = &userAgentTransport{RoundTripper: c.client.Transport, userAgent: c.userAgent}
+}
+
+func userAgentConnections(conns []*connection) []UserAgentConnection {
+	userAgents := []UserAgentConnection{}
+	for _, c := range conns {
+		if c.userAgent == "" {
+			continue
+		}
+		userAgents = append(userAgents, UserAgentConnection{
+			Host:      c.host.hostPort,
+			UserAgent: c.userAgent,
+		})
+	}
+	return userAgents
+}
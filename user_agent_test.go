@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"testing"
+)
+
+func TestSetUserAgent(t *testing.T) {
+	var got string
+	srv := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		got = req.Header.Get("User-Agent")
+	}))
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal("Failed to parse server url: ", err)
+	}
+	addr := netip.MustParseAddrPort(u.Host)
+	ctx := context.WithValue(context.Background(), ctxAddrKey{}, addr)
+
+	s := scheduler{m: &Measurer{RotateUserAgent: true}, userAgentStart: 3}
+	seen := map[string]bool{}
+	for id := range len(userAgentPool) {
+		c := makeConnection(addr, u, &traffic{}, nil)
+		c.id = uint(id)
+		s.setUserAgent(c)
+		if seen[c.userAgent] {
+			t.Errorf("expected a distinct User-Agent for connection %d, got %q again", id, c.userAgent)
+		}
+		seen[c.userAgent] = true
+
+		resp, err := getUrl(ctx, c.client, http.MethodGet, u)
+		if err != nil {
+			t.Fatal("Failed to get: ", err)
+		}
+		resp.Body.Close()
+		c.client.CloseIdleConnections()
+		if got != c.userAgent {
+			t.Errorf("expected the request to be sent with %q, got %q", c.userAgent, got)
+		}
+	}
+}
+
+func TestRotateUserAgentResult(t *testing.T) {
+	testcases := map[string]struct {
+		inRotate      bool
+		expUserAgents int
+	}{
+		"Rotated":     {inRotate: true, expUserAgents: 4},
+		"Not rotated": {inRotate: false, expUserAgents: 0},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			n := &benchNetwork{hosts: 4, seeds: 4}
+			m := Measurer{network: n, RotateUserAgent: tc.inRotate}
+			r, err := m.Measure(n.seedUrls())
+			if err != nil {
+				t.Fatal("Failed to measure: ", err)
+			}
+			if len(r.UserAgents) != tc.expUserAgents {
+				t.Errorf("expected %d User-Agents, got %+v", tc.expUserAgents, r.UserAgents)
+			}
+		})
+	}
+}
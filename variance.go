@@ -0,0 +1,87 @@
+// Functions related to confirming measurements that differ greatly from
+// the last, so noise does not reach the alerting on repeated measurements.
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+)
+
+const (
+	// Confirmation runs of a measurement differing from the last by
+	// default
+	defaultConfirmationRuns = 2
+	// Time before each confirmation run by default, like --sweep-pause
+	defaultConfirmationPause = 2 * time.Minute
+)
+
+// varianceCheck re-measures when a measurement differs from the last by
+// more than threshold percent of the max connections.
+type varianceCheck struct {
+	// Zero never re-measures
+	threshold float64
+	runs      int
+	// Time before each confirmation run, so the NAT has released the
+	// mappings of the last run rather than counting against it
+	pause time.Duration
+}
+
+// percentChange is the change from last to r in percent of last.
+func percentChange(last, r int) float64 {
+	if last == r {
+		return 0
+	}
+	diff := float64(r - last)
+	if diff < 0 {
+		diff = -diff
+	}
+	return 100 * diff / float64(max(last, 1))
+}
+
+// check returns the result to publish for r, measured after last. When
+// they differ by more than the threshold, the runs are measured again
+// and the median of them all is published, flagged as unstable if any
+// run differs from it by more than the threshold. Once ctx is done, the
+// confirmation runs not yet finished are skipped, as are those failing.
+func (v varianceCheck) check(ctx context.Context, last, r *Result, measure func(ctx context.Context) (*Result, error)) *Result {
+	if v.threshold <= 0 || last == nil || percentChange(last.MaxConnections, r.MaxConnections) <= v.threshold {
+		return r
+	}
+
+	results := []*Result{r}
+	for range v.runs {
+		pause := time.NewTimer(v.pause)
+		select {
+		case <-pause.C:
+		case <-ctx.Done():
+			pause.Stop()
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		confirmed, err := measure(ctx)
+		if ctx.Err() != nil {
+			break
+		}
+		if err != nil {
+			slog.Error("Failed to confirm measurement", "err", err)
+			continue
+		}
+		results = append(results, confirmed)
+	}
+	slices.SortStableFunc(results, func(a, b *Result) int {
+		return a.MaxConnections - b.MaxConnections
+	})
+	median := results[len(results)/2]
+	median.ConfirmationRuns = len(results) - 1
+	lowest, highest := results[0].MaxConnections, results[len(results)-1].MaxConnections
+	median.Unstable = percentChange(median.MaxConnections, lowest) > v.threshold ||
+		percentChange(median.MaxConnections, highest) > v.threshold
+	if median.Unstable {
+		median.Warnings = append(median.Warnings, fmt.Sprintf("unstable, %d runs measured between %d and %d connections", len(results), lowest, highest))
+	}
+	return median
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestVarianceCheck(t *testing.T) {
+	testcases := map[string]struct {
+		inThreshold   float64
+		inLast        *Result
+		inMax         int
+		inRuns        []int
+		outMax        int
+		outRuns       int
+		outUnstable   bool
+		outStopBefore bool
+	}{
+		"disabled": {
+			inLast: &Result{MaxConnections: 100},
+			inMax:  10,
+			outMax: 10,
+		},
+		"first measurement": {
+			inThreshold: 20,
+			inMax:       10,
+			outMax:      10,
+		},
+		"within threshold": {
+			inThreshold: 20,
+			inLast:      &Result{MaxConnections: 100},
+			inMax:       85,
+			outMax:      85,
+		},
+		"confirmed": {
+			inThreshold: 20,
+			inLast:      &Result{MaxConnections: 100},
+			inMax:       10,
+			inRuns:      []int{100, 95},
+			outMax:      95,
+			outRuns:     2,
+			outUnstable: true,
+		},
+		"stable once confirmed": {
+			inThreshold: 20,
+			inLast:      &Result{MaxConnections: 100},
+			inMax:       50,
+			inRuns:      []int{52, 48},
+			outMax:      50,
+			outRuns:     2,
+		},
+		"failed confirmation": {
+			inThreshold: 20,
+			inLast:      &Result{MaxConnections: 100},
+			inMax:       50,
+			inRuns:      []int{-1, 52},
+			outMax:      52,
+			outRuns:     1,
+		},
+		"stopped": {
+			inThreshold:   20,
+			inLast:        &Result{MaxConnections: 100},
+			inMax:         50,
+			outMax:        50,
+			outStopBefore: true,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			runs := tc.inRuns
+			measure := func(ctx context.Context) (*Result, error) {
+				max := runs[0]
+				runs = runs[1:]
+				if max < 0 {
+					return nil, errors.New("no route to host")
+				}
+				return &Result{MaxConnections: max}, nil
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tc.outStopBefore {
+				cancel()
+			}
+			v := varianceCheck{threshold: tc.inThreshold, runs: len(tc.inRuns)}
+			if tc.outStopBefore {
+				v.runs = defaultConfirmationRuns
+			}
+			got := v.check(ctx, tc.inLast, &Result{MaxConnections: tc.inMax}, measure)
+			if got.MaxConnections != tc.outMax || got.ConfirmationRuns != tc.outRuns || got.Unstable != tc.outUnstable {
+				t.Errorf("expected %v connections, %v runs and unstable %v, got %v, %v and %v",
+					tc.outMax, tc.outRuns, tc.outUnstable, got.MaxConnections, got.ConfirmationRuns, got.Unstable)
+			}
+			if got.Unstable && len(got.Warnings) == 0 {
+				t.Error("expected an unstable result to warn")
+			}
+		})
+	}
+}
+
+func TestVarianceCheckPause(t *testing.T) {
+	testcases := map[string]struct {
+		inPause    time.Duration
+		inCancel   time.Duration
+		outRuns    int
+		outMinTime time.Duration
+	}{
+		"Paused before each run": {
+			inPause:    20 * time.Millisecond,
+			outRuns:    2,
+			outMinTime: 40 * time.Millisecond,
+		},
+		"Cancelled whilst paused": {
+			inPause:  time.Hour,
+			inCancel: 10 * time.Millisecond,
+			outRuns:  0,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tc.inCancel > 0 {
+				time.AfterFunc(tc.inCancel, cancel)
+			}
+			measure := func(ctx context.Context) (*Result, error) {
+				return &Result{MaxConnections: 100}, nil
+			}
+
+			start := time.Now()
+			v := varianceCheck{threshold: 20, runs: defaultConfirmationRuns, pause: tc.inPause}
+			got := v.check(ctx, &Result{MaxConnections: 100}, &Result{MaxConnections: 10}, measure)
+			elapsed := time.Since(start)
+			if got.ConfirmationRuns != tc.outRuns {
+				t.Errorf("expected %d confirmation runs, got %d", tc.outRuns, got.ConfirmationRuns)
+			}
+			if elapsed < tc.outMinTime || elapsed > tc.outMinTime+time.Second {
+				t.Errorf("expected the check to take %v, took %v", tc.outMinTime, elapsed)
+			}
+		})
+	}
+}
@@ -0,0 +1,148 @@
+// Functions related to reporting the version of natck, how it was built
+// and which optional features were compiled in, for bug reports and
+// scripts that depend on a feature.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"strings"
+)
+
+// Overrides the module version, set when building releases with
+// -ldflags "-X main.version=v1.2.3"
+var version = ""
+
+// VersionInfo is the version of natck and how it was built.
+type VersionInfo struct {
+	Version    string   `json:"version"`
+	Commit     string   `json:"commit,omitempty"`
+	CommitTime string   `json:"commit_time,omitempty"`
+	Modified   bool     `json:"modified"`
+	GoVersion  string   `json:"go_version"`
+	Platform   string   `json:"platform"`
+	BuildTags  []string `json:"build_tags"`
+	// Optional features and whether they were compiled in
+	Features map[string]bool `json:"features"`
+}
+
+// compiledFeatures are the optional features and whether they were
+// compiled in. pcap, netns and http3 are not yet part of natck.
+func compiledFeatures() map[string]bool {
+	return map[string]bool{
+		"pcap":     false,
+		"netns":    false,
+		"http3":    false,
+		"journald": journaldSupported,
+		"syslog":   syslogSupported,
+		// Needed by sqlite: result stores
+		"sqlite": sqliteSupported(),
+		// Needed by --tcp-user-timeout
+		"tcp-user-timeout": userTimeoutSupported,
+		// Needed to find half-open connections
+		"tcp-info": tcpInfoSupported,
+	}
+}
+
+func readVersionInfo(info *debug.BuildInfo) VersionInfo {
+	v := VersionInfo{
+		Version:   "unknown",
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+		BuildTags: []string{},
+		Features:  compiledFeatures(),
+	}
+	if info != nil {
+		v.Version = info.Main.Version
+		for _, s := range info.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				v.Commit = s.Value
+			case "vcs.time":
+				v.CommitTime = s.Value
+			case "vcs.modified":
+				v.Modified = s.Value == "true"
+			case "-tags":
+				v.BuildTags = strings.Split(s.Value, ",")
+			}
+		}
+	}
+	if version != "" {
+		v.Version = version
+	}
+	return v
+}
+
+func runningVersion() string {
+	info, _ := debug.ReadBuildInfo()
+	return readVersionInfo(info).Version
+}
+
+func printVersion(w io.Writer, v VersionInfo) {
+	fmt.Fprintln(w, "natck", v.Version)
+	if v.Commit != "" {
+		modified := ""
+		if v.Modified {
+			modified = ", modified"
+		}
+		fmt.Fprintf(w, "Commit %v (%v%v)\n", v.Commit, v.CommitTime, modified)
+	}
+	fmt.Fprintf(w, "Built with %v for %v\n", v.GoVersion, v.Platform)
+	if len(v.BuildTags) > 0 {
+		fmt.Fprintln(w, "Build tags:", strings.Join(v.BuildTags, ","))
+	}
+
+	names := []string{}
+	for name := range v.Features {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	features := []string{}
+	for _, name := range names {
+		sign := "-"
+		if v.Features[name] {
+			sign = "+"
+		}
+		features = append(features, sign+name)
+	}
+	fmt.Fprintln(w, "Features:", strings.Join(features, " "))
+}
+
+// versionOptions are the flags of the version command.
+type versionOptions struct {
+	fs   *flag.FlagSet
+	json bool
+}
+
+func newVersionFlags(name string) *versionOptions {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	o := &versionOptions{fs: fs}
+	fs.BoolVar(&o.json, "json", false, "print the version as json, for scripts")
+	return o
+}
+
+func versionCommand(name string, args []string) {
+	o := newVersionFlags(name)
+	parseCommandArgs(o.fs, args, "", 0, false)
+
+	info, _ := debug.ReadBuildInfo()
+	v := readVersionInfo(info)
+	if !o.json {
+		printVersion(os.Stdout, v)
+		return
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	err := enc.Encode(v)
+	if err != nil {
+		fmt.Printf("Failed to print version: %v\n", err)
+		os.Exit(1)
+	}
+}
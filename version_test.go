@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestReadVersionInfo(t *testing.T) {
+	info := &debug.BuildInfo{
+		Main: debug.Module{Version: "v1.2.3"},
+		Settings: []debug.BuildSetting{
+			{Key: "-tags", Value: "netgo,osusergo"},
+			{Key: "vcs.revision", Value: "0123abcd"},
+			{Key: "vcs.time", Value: "2024-01-02T03:04:05Z"},
+			{Key: "vcs.modified", Value: "true"},
+		},
+	}
+
+	v := readVersionInfo(info)
+	if v.Version != "v1.2.3" || v.Commit != "0123abcd" || !v.Modified {
+		t.Errorf("expected the version, commit and modified to be read, got %+v", v)
+	}
+	if !slices.Equal(v.BuildTags, []string{"netgo", "osusergo"}) {
+		t.Errorf("expected build tags netgo and osusergo, got %v", v.BuildTags)
+	}
+	for _, feature := range []string{"pcap", "netns", "http3"} {
+		if _, found := v.Features[feature]; !found {
+			t.Errorf("expected feature %v to be reported", feature)
+		}
+	}
+
+	var b bytes.Buffer
+	printVersion(&b, v)
+	for _, expected := range []string{"natck v1.2.3", "0123abcd", "modified", "Build tags: netgo,osusergo", "-pcap"} {
+		if !strings.Contains(b.String(), expected) {
+			t.Errorf("expected %q in %q", expected, b.String())
+		}
+	}
+}
+
+func TestReadVersionInfoOverride(t *testing.T) {
+	version = "v9.9.9"
+	defer func() { version = "" }()
+
+	v := readVersionInfo(nil)
+	if v.Version != "v9.9.9" {
+		t.Errorf("expected the version to be overridden, got %v", v.Version)
+	}
+}
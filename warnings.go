@@ -0,0 +1,99 @@
+// Functions related to the caveats that affect how a result should be
+// interpreted, so the max connections are never reported without them.
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// Fraction of seeds failing to be looked up worth warning of
+	seedLookupFailureWarning = 0.1
+	// Rise of the median uplink rtt over its minimum worth warning of
+	uplinkRttRiseWarning = 3
+	// Fraction of echoes lost worth warning of
+	uplinkLossWarning = 0.1
+)
+
+// warnings are the caveats of the result of the measurement.
+func (s *scheduler) warnings(r *Result) []string {
+	warnings := []string{}
+	if r.OverBudget {
+		warnings = append(warnings, fmt.Sprintf("stopped early after exceeding the data budget of %d bytes", s.m.MaxTotalBytes))
+	}
+	if s.timedOut {
+		warnings = append(warnings, fmt.Sprintf("stopped early after the timeout of %v, the NAT may allow more connections", s.m.Timeout))
+	}
+	if unverified := r.PeakEstablished - r.MaxConnections; unverified > 0 {
+		warnings = append(warnings, fmt.Sprintf("%d connections established at the peak were not verified alive at the end", unverified))
+	}
+	if s.seeds > 0 && float64(s.seedLookupFailures)/float64(s.seeds) >= seedLookupFailureWarning {
+		warnings = append(warnings, fmt.Sprintf("DNS failures for %d%% of seeds", 100*s.seedLookupFailures/s.seeds))
+	}
+	if r.Preloaded < s.m.Preload {
+		warnings = append(warnings, fmt.Sprintf("only %d of the %d preload connections were established, leaving no headroom to measure", r.Preloaded, s.m.Preload))
+	}
+	if w := throttledWarning(r.Statuses, r.MaxConnections); w != "" {
+		warnings = append(warnings, w)
+	}
+	if w := doubleNatWarning(r.DoubleNat); w != "" {
+		warnings = append(warnings, w)
+	}
+	if w := upnpWarning(r.Upnp); w != "" {
+		warnings = append(warnings, w)
+	}
+	if r.PolitenessExclusions > 0 {
+		warnings = append(warnings, fmt.Sprintf("%d hosts excluded by robots.txt", r.PolitenessExclusions))
+	}
+	if r.SensitivePortHosts > 0 {
+		warnings = append(warnings, fmt.Sprintf("%d hosts linked on the ports of sensitive services were not connected to", r.SensitivePortHosts))
+	}
+	if r.HalfOpenConnections > 0 {
+		warnings = append(warnings, fmt.Sprintf("%d half-open connections were no longer counted as active", r.HalfOpenConnections))
+	}
+	if w := aliasesWarning(r.Aliases); w != "" {
+		warnings = append(warnings, w)
+	}
+	if r.RefusedRedials > 0 {
+		warnings = append(warnings, fmt.Sprintf("refused %d attempts to open a second connection to a server", r.RefusedRedials))
+	}
+	if r.MemorySheds > 0 {
+		warnings = append(warnings, fmt.Sprintf("exceeded the memory budget %d times, shedding %d urls", r.MemorySheds, r.ShedUrls))
+	}
+	if r.DroppedLookups > 0 {
+		warnings = append(warnings, fmt.Sprintf("dropped %d urls of hosts waiting to be looked up, the frontier was full", r.DroppedLookups))
+	}
+	for _, c := range r.ExternalIpChanges {
+		warnings = append(warnings, fmt.Sprintf("external IP changed from %v to %v whilst measuring, %d of %d established connections were lost after", c.From, c.To, c.LostConnections, c.EstablishedConnections))
+	}
+	if n := len(r.ExternalIps); n > 1 {
+		warnings = append(warnings, fmt.Sprintf("connections to the reflector came from %d external IPs, the NAT spreads connections over a pool", n))
+	}
+	for _, p := range r.Proxies {
+		warnings = append(warnings, fmt.Sprintf("connected through the proxy %v, measuring its NAT rather than the local one", p))
+	}
+	for _, p := range r.Pacing {
+		if p.BelowCrawlDelay > 0 {
+			warnings = append(warnings, fmt.Sprintf("made %d requests to %v sooner than its Crawl-delay of %v", p.BelowCrawlDelay, p.Host, p.CrawlDelay))
+		}
+	}
+	return warnings
+}
+
+// uplinkWarnings are the caveats of the uplink latency whilst measuring,
+// a congested uplink may drop connections rather than the NAT.
+func uplinkWarnings(rtt *RttSummary) []string {
+	warnings := []string{}
+	if rtt == nil || rtt.Sent == 0 {
+		return warnings
+	}
+	if rtt.Min > 0 && rtt.Median >= uplinkRttRiseWarning*rtt.Min {
+		factor := float64(rtt.Median) / float64(rtt.Min)
+		warnings = append(warnings, fmt.Sprintf("uplink latency rose %.1fx whilst measuring, from %v to a median of %v", factor, rtt.Min.Round(time.Microsecond), rtt.Median.Round(time.Microsecond)))
+	}
+	if float64(rtt.Lost)/float64(rtt.Sent) >= uplinkLossWarning {
+		warnings = append(warnings, fmt.Sprintf("lost %d of %d uplink echoes whilst measuring", rtt.Lost, rtt.Sent))
+	}
+	return warnings
+}
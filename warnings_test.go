@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUplinkWarnings(t *testing.T) {
+	testcases := map[string]struct {
+		rtt      *RttSummary
+		warnings []string
+	}{
+		"Not monitored": {warnings: []string{}},
+		"Steady": {
+			rtt:      &RttSummary{Min: 10 * time.Millisecond, Median: 12 * time.Millisecond, Sent: 10},
+			warnings: []string{},
+		},
+		"Tripled": {
+			rtt:      &RttSummary{Min: 10 * time.Millisecond, Median: 30 * time.Millisecond, Sent: 10},
+			warnings: []string{"uplink latency rose 3.0x whilst measuring, from 10ms to a median of 30ms"},
+		},
+		"Lossy": {
+			rtt:      &RttSummary{Min: 10 * time.Millisecond, Median: 10 * time.Millisecond, Sent: 10, Lost: 2},
+			warnings: []string{"lost 2 of 10 uplink echoes whilst measuring"},
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			got := uplinkWarnings(tc.rtt)
+			if !slices.Equal(got, tc.warnings) {
+				t.Errorf("expected warnings %q, got %q", tc.warnings, got)
+			}
+		})
+	}
+}
+
+func TestSeedLookupWarning(t *testing.T) {
+	n := &benchNetwork{hosts: 4, seeds: 4}
+	// Hosts past the end of the network fail to be looked up
+	seeds := append(n.seedUrls(), &url.URL{Scheme: "http", Host: "h10.bench", Path: "/"})
+	m := Measurer{network: n}
+	r, err := m.Measure(seeds)
+	if err != nil {
+		t.Fatal("Failed to measure: ", err)
+	}
+
+	i := slices.IndexFunc(r.Warnings, func(w string) bool { return strings.HasPrefix(w, "DNS failures") })
+	if i == -1 || r.Warnings[i] != "DNS failures for 20% of seeds" {
+		t.Errorf("expected a warning of DNS failures for 20%% of seeds, got %q", r.Warnings)
+	}
+}